@@ -0,0 +1,52 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// FieldEntry is a single top-level field of a message.
+type FieldEntry struct {
+	FieldNum int32
+	Value    Value
+}
+
+// MessageEachBatchFn is a function that is called with each batch of fields decoded by
+// MessageEachBatch.
+type MessageEachBatchFn func(fields []FieldEntry) (bool, error)
+
+// MessageEachBatch is like MessageEach except that it decodes up to batchSize fields at a
+// time and calls fn once for each batch, which amortizes the cost of the callback and lets
+// consumers apply backpressure per batch. Every batch except the last one holds exactly
+// batchSize fields, and fn is never called with an empty batch. If decoding fails, the
+// fields of the incomplete batch are not passed to fn.
+//
+// The slice passed to fn is reused for every batch, so neither it nor its backing array
+// may be retained after fn returns. As with MessageEach, the Bytes of each Value alias the
+// buffer.
+func MessageEachBatch(buffer *codec.Buffer, batchSize int, fn MessageEachBatchFn, opts ...Option) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("MessageEachBatch: batch size must be positive, got: %d", batchSize)
+	}
+
+	var (
+		batch   = make([]FieldEntry, 0, batchSize)
+		stopped bool
+	)
+	err := retainingEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		batch = append(batch, FieldEntry{FieldNum: fieldNum, Value: value})
+		if len(batch) < batchSize {
+			return true, nil
+		}
+		shouldContinue, err := fn(batch)
+		batch = batch[:0]
+		stopped = !shouldContinue
+		return shouldContinue, err
+	}, opts...)
+	if err != nil || stopped || len(batch) == 0 {
+		return err
+	}
+	_, err = fn(batch)
+	return err
+}
@@ -0,0 +1,135 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Binding associates a field number with a typed destination that Bind stores the
+// field's value in. Bindings are created with the Bind* functions such as BindInt32.
+type Binding struct {
+	fieldNum int32
+	wireType codec.WireType
+	set      func(value *Value) error
+}
+
+// Bind decodes the message stored in buffer in a single pass, storing the value of each
+// field that has a binding in the binding's destination. Destinations of fields that are
+// not present are left untouched and if a field occurs more than once the last occurrence
+// wins. Fields without a binding are ignored.
+//
+// Bind returns an error if a bound field was encoded with a wire type that doesn't match
+// its binding.
+//
+// The buffer is consumed.
+func Bind(buffer *codec.Buffer, bindings ...Binding) error {
+	return MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		for i := range bindings {
+			b := &bindings[i]
+			if b.fieldNum != fieldNum {
+				continue
+			}
+			if value.WireType != b.wireType {
+				return false, fmt.Errorf(
+					"Bind: field %d: expected wiretype %d, got: %d", fieldNum, b.wireType, value.WireType)
+			}
+			if err := b.set(&value); err != nil {
+				return false, fmt.Errorf("Bind: field %d: %w", fieldNum, err)
+			}
+		}
+		return true, nil
+	})
+}
+
+func newBinding[T any](fieldNum int32, wireType codec.WireType, dst *T, as func(*Value) (T, error)) Binding {
+	return Binding{
+		fieldNum: fieldNum,
+		wireType: wireType,
+		set: func(value *Value) error {
+			v, err := as(value)
+			if err != nil {
+				return err
+			}
+			*dst = v
+			return nil
+		},
+	}
+}
+
+// BindDouble binds the double field fieldNum to dst.
+func BindDouble(fieldNum int32, dst *float64) Binding {
+	return newBinding(fieldNum, codec.WireFixed64, dst, (*Value).AsDouble)
+}
+
+// BindFloat binds the float field fieldNum to dst.
+func BindFloat(fieldNum int32, dst *float32) Binding {
+	return newBinding(fieldNum, codec.WireFixed32, dst, (*Value).AsFloat)
+}
+
+// BindInt32 binds the int32 field fieldNum to dst.
+func BindInt32(fieldNum int32, dst *int32) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsInt32)
+}
+
+// BindInt64 binds the int64 field fieldNum to dst.
+func BindInt64(fieldNum int32, dst *int64) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsInt64)
+}
+
+// BindUint32 binds the uint32 field fieldNum to dst.
+func BindUint32(fieldNum int32, dst *uint32) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsUint32)
+}
+
+// BindUint64 binds the uint64 field fieldNum to dst.
+func BindUint64(fieldNum int32, dst *uint64) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsUint64)
+}
+
+// BindSint32 binds the sint32 field fieldNum to dst.
+func BindSint32(fieldNum int32, dst *int32) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsSint32)
+}
+
+// BindSint64 binds the sint64 field fieldNum to dst.
+func BindSint64(fieldNum int32, dst *int64) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsSint64)
+}
+
+// BindFixed32 binds the fixed32 field fieldNum to dst.
+func BindFixed32(fieldNum int32, dst *uint32) Binding {
+	return newBinding(fieldNum, codec.WireFixed32, dst, (*Value).AsFixed32)
+}
+
+// BindFixed64 binds the fixed64 field fieldNum to dst.
+func BindFixed64(fieldNum int32, dst *uint64) Binding {
+	return newBinding(fieldNum, codec.WireFixed64, dst, (*Value).AsFixed64)
+}
+
+// BindSFixed32 binds the sfixed32 field fieldNum to dst.
+func BindSFixed32(fieldNum int32, dst *int32) Binding {
+	return newBinding(fieldNum, codec.WireFixed32, dst, (*Value).AsSFixed32)
+}
+
+// BindSFixed64 binds the sfixed64 field fieldNum to dst.
+func BindSFixed64(fieldNum int32, dst *int64) Binding {
+	return newBinding(fieldNum, codec.WireFixed64, dst, (*Value).AsSFixed64)
+}
+
+// BindBool binds the bool field fieldNum to dst.
+func BindBool(fieldNum int32, dst *bool) Binding {
+	return newBinding(fieldNum, codec.WireVarint, dst, (*Value).AsBool)
+}
+
+// BindString binds the string field fieldNum to dst. The string is a safe copy of the
+// buffer's data.
+func BindString(fieldNum int32, dst *string) Binding {
+	return newBinding(fieldNum, codec.WireBytes, dst, (*Value).AsStringSafe)
+}
+
+// BindBytes binds the bytes field fieldNum to dst. The slice is a safe copy of the
+// buffer's data.
+func BindBytes(fieldNum int32, dst *[]byte) Binding {
+	return newBinding(fieldNum, codec.WireBytes, dst, (*Value).AsBytesSafe)
+}
@@ -0,0 +1,210 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Column holds the values of a single field across every message added to a
+// ColumnAccumulator. Only the slice that matches the column's Type is populated:
+//
+//	int32, int64, sint32, sint64, sfixed32, sfixed64, enum    Int64s
+//	uint32, uint64, fixed32, fixed64                          Uint64s
+//	float, double                                             Float64s
+//	bool                                                      Bools
+//	string, bytes, message                                    Bytes
+//
+// Offsets maps messages, or rows, to values: the values of row i are at indexes
+// Offsets[i] through Offsets[i+1]-1 of the populated slice, so a row for which the
+// field is absent is empty and a repeated field can contribute many values to a single
+// row. len(Offsets) is always one more than the number of rows.
+type Column struct {
+	FieldNum int32
+	Type     codec.FieldType
+
+	Offsets  []int
+	Int64s   []int64
+	Uint64s  []uint64
+	Float64s []float64
+	Bools    []bool
+	// Bytes holds copies of the values, so they remain valid after the buffers that they
+	// were decoded from are reused.
+	Bytes [][]byte
+}
+
+// Len returns the total number of values in the column.
+func (c *Column) Len() int {
+	return c.Offsets[len(c.Offsets)-1]
+}
+
+// len returns the length of the populated slice.
+func (c *Column) len() int {
+	return len(c.Int64s) + len(c.Uint64s) + len(c.Float64s) + len(c.Bools) + len(c.Bytes)
+}
+
+// truncate discards every value from index n onwards.
+func (c *Column) truncate(n int) {
+	switch {
+	case c.Int64s != nil:
+		c.Int64s = c.Int64s[:n]
+	case c.Uint64s != nil:
+		c.Uint64s = c.Uint64s[:n]
+	case c.Float64s != nil:
+		c.Float64s = c.Float64s[:n]
+	case c.Bools != nil:
+		c.Bools = c.Bools[:n]
+	case c.Bytes != nil:
+		c.Bytes = c.Bytes[:n]
+	}
+}
+
+// append appends value, whose wire type has already been checked, to the column.
+func (c *Column) append(value Value) error {
+	switch c.Type {
+	case codec.FieldType_INT32, codec.FieldType_ENUM:
+		v, err := value.AsInt32()
+		if err != nil {
+			return err
+		}
+		c.Int64s = append(c.Int64s, int64(v))
+	case codec.FieldType_SINT32:
+		v, err := value.AsSint32()
+		if err != nil {
+			return err
+		}
+		c.Int64s = append(c.Int64s, int64(v))
+	case codec.FieldType_SFIXED32:
+		v, err := value.AsSFixed32()
+		if err != nil {
+			return err
+		}
+		c.Int64s = append(c.Int64s, int64(v))
+	case codec.FieldType_INT64, codec.FieldType_SFIXED64:
+		c.Int64s = append(c.Int64s, int64(value.Number))
+	case codec.FieldType_SINT64:
+		c.Int64s = append(c.Int64s, codec.DecodeZigZag64(value.Number))
+	case codec.FieldType_UINT32, codec.FieldType_FIXED32:
+		v, err := value.AsUint32()
+		if err != nil {
+			return err
+		}
+		c.Uint64s = append(c.Uint64s, uint64(v))
+	case codec.FieldType_UINT64, codec.FieldType_FIXED64:
+		c.Uint64s = append(c.Uint64s, value.Number)
+	case codec.FieldType_FLOAT:
+		v, err := value.AsFloat()
+		if err != nil {
+			return err
+		}
+		c.Float64s = append(c.Float64s, float64(v))
+	case codec.FieldType_DOUBLE:
+		v, _ := value.AsDouble()
+		c.Float64s = append(c.Float64s, v)
+	case codec.FieldType_BOOL:
+		v, _ := value.AsBool()
+		c.Bools = append(c.Bools, v)
+	default:
+		b, _ := value.AsBytesSafe()
+		c.Bytes = append(c.Bytes, b)
+	}
+	return nil
+}
+
+// ColumnAccumulator decodes a batch of messages into columns, one per configured field,
+// in a single streaming pass. This is the layout preferred by analytical systems, which
+// can then process every value of a field at once.
+//
+// A ColumnAccumulator is not safe for concurrent use.
+type ColumnAccumulator struct {
+	columns  map[int32]*Column
+	wireType map[int32]codec.WireType
+	rows     int
+}
+
+// NewColumnAccumulator returns a ColumnAccumulator that collects the fields in schema,
+// which maps the number of each field to its declared type. Fields of every type other
+// than groups are supported.
+func NewColumnAccumulator(schema map[int32]codec.FieldType) (*ColumnAccumulator, error) {
+	a := &ColumnAccumulator{
+		columns:  make(map[int32]*Column, len(schema)),
+		wireType: make(map[int32]codec.WireType, len(schema)),
+	}
+	for fieldNum, fieldType := range schema {
+		wireType, err := wireTypeForFieldType(fieldType)
+		if err != nil || fieldType == codec.FieldType_GROUP {
+			return nil, fmt.Errorf("NewColumnAccumulator: field %d: unsupported field type %v", fieldNum, fieldType)
+		}
+		a.columns[fieldNum] = &Column{FieldNum: fieldNum, Type: fieldType, Offsets: []int{0}}
+		a.wireType[fieldNum] = wireType
+	}
+	return a, nil
+}
+
+// Add decodes the message stored in buffer and appends a row holding its values to every
+// column. Scalar fields may be packed, unpacked or both, and fields that aren't in the
+// schema are ignored.
+//
+// If the message can't be decoded the error is returned and none of its values are
+// added, so the columns always stay aligned with each other. The buffer is consumed.
+func (a *ColumnAccumulator) Add(buffer *codec.Buffer, opts ...Option) error {
+	err := MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		column, ok := a.columns[fieldNum]
+		if !ok {
+			return true, nil
+		}
+		wireType := a.wireType[fieldNum]
+
+		if wireType != codec.WireBytes && value.WireType == codec.WireBytes {
+			err := PackedRepeatedEach(buffer.Nested(value.Bytes), column.Type, func(element Value) (bool, error) {
+				return true, column.append(element)
+			})
+			if err != nil {
+				return false, fmt.Errorf("ColumnAccumulator.Add: field %d: %w", fieldNum, err)
+			}
+			return true, nil
+		}
+		if value.WireType != wireType {
+			return false, fmt.Errorf(
+				"ColumnAccumulator.Add: field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+		if err := column.append(value); err != nil {
+			return false, fmt.Errorf("ColumnAccumulator.Add: field %d: %w", fieldNum, err)
+		}
+		return true, nil
+	}, opts...)
+
+	for _, column := range a.columns {
+		if err != nil {
+			column.truncate(column.Offsets[a.rows])
+			continue
+		}
+		column.Offsets = append(column.Offsets, column.len())
+	}
+	if err != nil {
+		return err
+	}
+	a.rows++
+	return nil
+}
+
+// Rows returns the number of messages that have been added.
+func (a *ColumnAccumulator) Rows() int {
+	return a.rows
+}
+
+// Column returns the column for fieldNum, or nil if fieldNum isn't in the schema. The
+// column is updated in place by subsequent calls to Add and Reset.
+func (a *ColumnAccumulator) Column(fieldNum int32) *Column {
+	return a.columns[fieldNum]
+}
+
+// Reset discards every row while keeping the capacity of the columns, so that the next
+// batch can be accumulated without reallocating them.
+func (a *ColumnAccumulator) Reset() {
+	for _, column := range a.columns {
+		column.Offsets = column.Offsets[:1]
+		column.truncate(0)
+	}
+	a.rows = 0
+}
@@ -0,0 +1,230 @@
+package molecule
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// DelimitedEach reads a stream of length-prefixed frames from r and calls fn with a
+// Buffer containing each frame. The framing scheme is supplied by frameLen, which must
+// read the length prefix of the next frame from r and return the length of the frame
+// that follows it. This makes DelimitedEach usable with any framing, such as varint
+// prefixes written by protobuf's delimited encoders or the fixed32 prefixes used by
+// many RPC and log formats.
+//
+// Iteration stops without error when frameLen returns io.EOF before the start of a
+// frame. A frame that is cut short returns io.ErrUnexpectedEOF.
+//
+// The Buffer and its backing slice are reused for every frame, so neither may be
+// retained after fn returns.
+func DelimitedEach(r io.Reader, frameLen func(io.Reader) (int, error), fn func(*codec.Buffer) (bool, error)) error {
+	var (
+		frame  []byte
+		buffer = codec.NewBuffer(nil)
+	)
+	for {
+		n, err := frameLen(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("DelimitedEach: error reading frame length: %w", err)
+		}
+		if n < 0 {
+			return fmt.Errorf("DelimitedEach: %w: %d", codec.ErrBadLength, n)
+		}
+
+		frame, err = readFrame(r, frame, n)
+		if err != nil {
+			return fmt.Errorf("DelimitedEach: error reading frame: %w", err)
+		}
+
+		buffer.Reset(frame)
+		if shouldContinue, err := fn(buffer); err != nil || !shouldContinue {
+			return err
+		}
+	}
+}
+
+// minFrameGrowth is the smallest step by which readFrame grows a frame that doesn't fit
+// in the slice it was given.
+const minFrameGrowth = 64 * 1024
+
+// readFrame reads a frame of n bytes from r into frame, growing it if needed, and returns
+// the frame. A frame that is cut short returns io.ErrUnexpectedEOF.
+//
+// The length of a frame comes from the stream, so it can't be trusted to allocate the
+// frame up front: a corrupt or hostile prefix of a few bytes could declare gigabytes.
+// Instead the frame grows geometrically as its data arrives, which bounds the memory
+// that a short stream can make readFrame allocate to a small multiple of its size.
+func readFrame(r io.Reader, frame []byte, n int) ([]byte, error) {
+	frame = frame[:0]
+	for len(frame) < n {
+		if len(frame) == cap(frame) {
+			size := 2 * cap(frame)
+			if size < minFrameGrowth {
+				size = minFrameGrowth
+			}
+			if size > n {
+				size = n
+			}
+			grown := make([]byte, len(frame), size)
+			copy(grown, frame)
+			frame = grown
+		}
+		end := cap(frame)
+		if end > n {
+			end = n
+		}
+		read, err := io.ReadFull(r, frame[len(frame):end])
+		frame = frame[:len(frame)+read]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return frame, err
+		}
+	}
+	return frame, nil
+}
+
+// EnvelopeDecoder reads a stream of protobuf messages that are each wrapped in an
+// envelope made of a fixed-size header followed by the message body, such as a magic
+// number and a length, or the 5-byte frames used by gRPC. The format of the header is
+// supplied by a parser that is given the raw header bytes and returns the length of the
+// body that follows. Successive calls to Next step through the bodies:
+//
+//	decoder := molecule.NewEnvelopeDecoder(r, 8, parseHeader)
+//	for decoder.Next() {
+//		buffer := decoder.Buffer()
+//		...
+//	}
+//	if err := decoder.Err(); err != nil {
+//		...
+//	}
+//
+// The Buffer and its backing slice are reused for every body, so neither may be retained
+// after the next call to Next.
+type EnvelopeDecoder struct {
+	r           io.Reader
+	header      []byte
+	parseHeader func(header []byte) (int, error)
+
+	body   []byte
+	buffer *codec.Buffer
+	err    error
+}
+
+// NewEnvelopeDecoder returns an EnvelopeDecoder that reads envelopes with headers of
+// headerSize bytes from r. parseHeader is called with the header of each envelope and
+// returns the length of its body, or an error if the header is invalid, for example
+// because it doesn't start with the expected magic number.
+func NewEnvelopeDecoder(r io.Reader, headerSize int, parseHeader func(header []byte) (int, error)) *EnvelopeDecoder {
+	return &EnvelopeDecoder{
+		r:           r,
+		header:      make([]byte, headerSize),
+		parseHeader: parseHeader,
+		buffer:      codec.NewBuffer(nil),
+	}
+}
+
+// Next reads the next envelope, whose body is then available through Buffer. It returns
+// false once the stream ends cleanly before the start of an envelope or an error occurs,
+// after which Err reports the error, if any. An envelope that is cut short is an error
+// wrapping io.ErrUnexpectedEOF.
+func (d *EnvelopeDecoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+	d.buffer.Reset(nil)
+
+	if _, err := io.ReadFull(d.r, d.header); err != nil {
+		if err != io.EOF {
+			d.err = fmt.Errorf("EnvelopeDecoder: error reading header: %w", err)
+		}
+		return false
+	}
+	n, err := d.parseHeader(d.header)
+	if err != nil {
+		d.err = fmt.Errorf("EnvelopeDecoder: error parsing header: %w", err)
+		return false
+	}
+	if n < 0 {
+		d.err = fmt.Errorf("EnvelopeDecoder: %w: %d", codec.ErrBadLength, n)
+		return false
+	}
+
+	d.body, err = readFrame(d.r, d.body, n)
+	if err != nil {
+		d.err = fmt.Errorf("EnvelopeDecoder: error reading body: %w", err)
+		return false
+	}
+	d.buffer.Reset(d.body)
+	return true
+}
+
+// Buffer returns a Buffer over the body of the envelope most recently read by Next.
+func (d *EnvelopeDecoder) Buffer() *codec.Buffer {
+	return d.buffer
+}
+
+// Err returns the first error that occurred while decoding, or nil if the end of the
+// stream was reached without error.
+func (d *EnvelopeDecoder) Err() error {
+	return d.err
+}
+
+// StreamReducePacked folds every element of a stream of packed chunks read from r into a
+// single result, for example to sum a numeric column stored as a standalone file. Each
+// chunk is the contents of a packed repeated field of type fieldType preceded by its
+// length as a varint, which is the framing written by protobuf's delimited encoders, and
+// every chunk must contain whole elements. fn is called with the accumulated result,
+// starting with init, and each element in turn and returns the new result.
+//
+// Only one chunk is held in memory at a time, so arbitrarily large streams can be reduced
+// in bounded memory. A chunk that is cut short returns an error wrapping
+// io.ErrUnexpectedEOF, along with the result accumulated up to that point.
+func StreamReducePacked[T any](r io.Reader, fieldType codec.FieldType, init T, fn func(acc T, value Value) (T, error)) (T, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	acc := init
+	err := DelimitedEach(br, varintFrameLen, func(buffer *codec.Buffer) (bool, error) {
+		err := PackedRepeatedEach(buffer, fieldType, func(value Value) (bool, error) {
+			var err error
+			acc, err = fn(acc, value)
+			return err == nil, err
+		})
+		return err == nil, err
+	})
+	if err != nil {
+		return acc, fmt.Errorf("StreamReducePacked: %w", err)
+	}
+	return acc, nil
+}
+
+// byteReader is an io.Reader that can also read a single byte at a time, which is needed
+// to read a varint without consuming the data that follows it.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// varintFrameLen reads a varint length prefix from r, which must be a byteReader.
+func varintFrameLen(r io.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r.(io.ByteReader))
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: %d", codec.ErrBadLength, n)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,39 @@
+package molecule
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// ErrUnknownEnumValue is returned by DecodeEnum when a value is rejected by the
+// validation function.
+var ErrUnknownEnumValue = errors.New("molecule: unknown enum value")
+
+// DecodeEnum interprets value as an enum and converts it to the Go enum type T.
+//
+// Enums in proto3 are open, meaning that values which aren't declared in the schema
+// must be preserved rather than rejected, so valid may be nil in which case every
+// value that fits in an int32 is accepted. Callers that want closed, proto2-style
+// semantics can provide a valid function that reports whether a number is a declared
+// member of the enum. Numbers that it rejects cause DecodeEnum to return an error
+// wrapping ErrUnknownEnumValue.
+//
+// Enums are encoded like int32s, so negative members are sign-extended to 10 byte
+// varints on the wire. DecodeEnum reinterprets the varint as a signed int32, so they
+// decode to their negative value rather than to a large positive number.
+func DecodeEnum[T ~int32](value Value, valid func(int32) bool) (T, error) {
+	if value.WireType != codec.WireVarint {
+		return 0, fmt.Errorf(
+			"DecodeEnum: %w: expected %s, got %s", codec.ErrBadWireType, codec.WireVarint, value.WireType)
+	}
+	n, err := value.AsInt32()
+	if err != nil {
+		return 0, fmt.Errorf("DecodeEnum: %w", err)
+	}
+	if valid != nil && !valid(n) {
+		return 0, fmt.Errorf("DecodeEnum: %w: %d", ErrUnknownEnumValue, n)
+	}
+	return T(n), nil
+}
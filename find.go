@@ -0,0 +1,313 @@
+package molecule
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// FindOneof scans the top-level fields of the message stored in buffer and returns
+// whichever member of a oneof is present. members should contain the field numbers
+// of every field in the oneof.
+//
+// If more than one member is present the last one encoded wins, matching the protobuf
+// semantics for oneofs. If none of the members are present found will be false.
+//
+// The buffer is not advanced and the returned Value is an unsafe view over the buffer's
+// bytes.
+func FindOneof(buffer *codec.Buffer, members []int32) (fieldNum int32, value Value, found bool, err error) {
+	err = lookupEach(buffer, func(num int32, v Value) (bool, error) {
+		for _, member := range members {
+			if num == member {
+				fieldNum, value, found = num, v, true
+				break
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, Value{}, false, err
+	}
+	return fieldNum, value, found, nil
+}
+
+// lookupEach is like MessageEach except that it scans a clone of buffer so that
+// the caller's read position is left untouched. The clone is stable so that the
+// values that callers keep from fn are not overwritten as the scan moves on when
+// buffer reads its source through a window.
+func lookupEach(buffer *codec.Buffer, fn MessageEachFn) error {
+	return MessageEach(buffer.CloneStable(), fn)
+}
+
+// retainingEach is like MessageEach for callers that keep the values passed to fn
+// after it returns. It scans a stable clone of buffer, see lookupEach, and then
+// consumes as much of buffer as the scan did.
+func retainingEach(buffer *codec.Buffer, fn MessageEachFn, opts ...Option) error {
+	clone := buffer.CloneStable()
+	err := MessageEach(clone, fn, opts...)
+	if skipErr := buffer.Skip(buffer.Len() - clone.Len()); err == nil {
+		err = skipErr
+	}
+	return err
+}
+
+// GetInt32 returns the value of the int32 field fieldNum in the message stored in buffer,
+// or def if the field is not present. If the field occurs more than once the last
+// occurrence wins. The buffer is not advanced.
+func GetInt32(buffer *codec.Buffer, fieldNum int32, def int32) (int32, error) {
+	value, found, err := findLast("GetInt32", buffer, fieldNum, codec.WireVarint)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return def, nil
+	}
+	return value.AsInt32()
+}
+
+// GetString returns a safe copy of the string field fieldNum in the message stored in
+// buffer, or def if the field is not present. If the field occurs more than once the last
+// occurrence wins. The buffer is not advanced.
+func GetString(buffer *codec.Buffer, fieldNum int32, def string) (string, error) {
+	value, found, err := findLast("GetString", buffer, fieldNum, codec.WireBytes)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return def, nil
+	}
+	return value.AsStringSafe()
+}
+
+// GetBool returns the value of the bool field fieldNum in the message stored in buffer,
+// or def if the field is not present. If the field occurs more than once the last
+// occurrence wins. The buffer is not advanced.
+func GetBool(buffer *codec.Buffer, fieldNum int32, def bool) (bool, error) {
+	value, found, err := findLast("GetBool", buffer, fieldNum, codec.WireVarint)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return def, nil
+	}
+	return value.AsBool()
+}
+
+// GetDouble returns the value of the double field fieldNum in the message stored in
+// buffer, or def if the field is not present. If the field occurs more than once the last
+// occurrence wins. The buffer is not advanced.
+func GetDouble(buffer *codec.Buffer, fieldNum int32, def float64) (float64, error) {
+	value, found, err := findLast("GetDouble", buffer, fieldNum, codec.WireFixed64)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return def, nil
+	}
+	return value.AsDouble()
+}
+
+// findLast returns the last occurrence of fieldNum in the message stored in buffer and
+// verifies that it was encoded with the expected wire type.
+func findLast(caller string, buffer *codec.Buffer, fieldNum int32, wireType codec.WireType) (value Value, found bool, err error) {
+	err = lookupEach(buffer, func(num int32, v Value) (bool, error) {
+		if num == fieldNum {
+			value, found = v, true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return Value{}, false, err
+	}
+	if found && value.WireType != wireType {
+		return Value{}, false, fmt.Errorf(
+			"%s: field %d: expected wiretype %d, got: %d", caller, fieldNum, wireType, value.WireType)
+	}
+	return value, found, nil
+}
+
+// CountField returns the number of times fieldNum occurs in the message stored in buffer.
+// A packed repeated field counts as a single occurrence, use CountRepeated to count the
+// elements inside of it instead. The buffer is not advanced.
+func CountField(buffer *codec.Buffer, fieldNum int32) (int, error) {
+	var count int
+	err := lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num == fieldNum {
+			count++
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountRepeated returns the number of elements in the repeated field fieldNum of type
+// fieldType in the message stored in buffer. Both packed and unpacked occurrences of the
+// field are counted, without allocating or decoding the packed elements themselves. The
+// buffer is not advanced.
+func CountRepeated(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType) (int, error) {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return 0, fmt.Errorf("CountRepeated: %w", err)
+	}
+
+	var count int
+	err = lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		if value.WireType == wireType {
+			count++
+			return true, nil
+		}
+		if value.WireType != codec.WireBytes {
+			return false, fmt.Errorf(
+				"CountRepeated: field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+
+		// A length-delimited occurrence of a scalar field is a packed run of elements.
+		n, err := countPacked(value.Bytes, wireType)
+		if err != nil {
+			return false, fmt.Errorf("CountRepeated: field %d: %w", fieldNum, err)
+		}
+		count += n
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// countPacked returns the number of elements of wireType in the packed field contents b.
+func countPacked(b []byte, wireType codec.WireType) (int, error) {
+	switch wireType {
+	case codec.WireVarint:
+		// Every varint ends with exactly one byte that has its continuation bit unset.
+		var count int
+		for _, c := range b {
+			if c < 0x80 {
+				count++
+			}
+		}
+		if len(b) > 0 && b[len(b)-1] >= 0x80 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return count, nil
+	case codec.WireFixed32:
+		if len(b)%4 != 0 {
+			return 0, fmt.Errorf("%w: packed fixed32 length %d", codec.ErrBadLength, len(b))
+		}
+		return len(b) / 4, nil
+	case codec.WireFixed64:
+		if len(b)%8 != 0 {
+			return 0, fmt.Errorf("%w: packed fixed64 length %d", codec.ErrBadLength, len(b))
+		}
+		return len(b) / 8, nil
+	default:
+		return 0, fmt.Errorf("wiretype %d can't be packed", wireType)
+	}
+}
+
+// SubMessageEach finds the first occurrence of the message field fieldNum in the message
+// stored in buffer and calls fn for each of the nested message's top-level fields, as if
+// by MessageEach. If the field is absent fn is never called and nil is returned. This
+// collapses the common pattern of finding a field, scoping a Buffer to it and iterating
+// over it into a single call.
+//
+// Errors returned by fn are returned as is. The buffer is not advanced.
+func SubMessageEach(buffer *codec.Buffer, fieldNum int32, fn MessageEachFn, opts ...Option) error {
+	var (
+		msg   Value
+		found bool
+	)
+	err := lookupEach(buffer, func(num int32, v Value) (bool, error) {
+		if num == fieldNum {
+			msg, found = v, true
+		}
+		return !found, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	if msg.WireType != codec.WireBytes {
+		return fmt.Errorf(
+			"SubMessageEach: field %d: expected wiretype %d, got: %d", fieldNum, codec.WireBytes, msg.WireType)
+	}
+
+	var fnErr error
+	err = MessageEach(buffer.Nested(msg.Bytes), func(num int32, v Value) (bool, error) {
+		var shouldContinue bool
+		// fn's errors go through MessageEach, rather than stopping it quietly, so that
+		// they are reported to the Metrics of WithMetrics.
+		shouldContinue, fnErr = fn(num, v)
+		return shouldContinue, fnErr
+	}, opts...)
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("SubMessageEach: field %d: %w", fieldNum, err)
+	}
+	return nil
+}
+
+// PeekFirstFieldNum returns the number of the first field in the message stored in buffer
+// without decoding the field's value, which allows messages to be routed on a leading
+// discriminator field before they are parsed. An empty buffer returns an error wrapping
+// ErrEmptyMessage.
+//
+// The buffer is not advanced.
+func PeekFirstFieldNum(buffer *codec.Buffer) (int32, error) {
+	if buffer.EOF() {
+		return 0, fmt.Errorf("PeekFirstFieldNum: %w", ErrEmptyMessage)
+	}
+	fieldNum, _, err := buffer.Clone().DecodeTagAndWireType()
+	if err != nil {
+		return 0, fmt.Errorf("PeekFirstFieldNum: error decoding tag: %w", err)
+	}
+	return fieldNum, nil
+}
+
+// SkipFields advances buffer past its next n top-level fields without decoding their
+// values, for example to jump to a field whose position in a message is known ahead of
+// time. Skipping is much cheaper than visiting the fields with MessageEach because no
+// Values are produced, but its cost still depends on how each field is laid out:
+//
+//   - Length-delimited fields, including nested messages, strings and packed repeated
+//     fields, are skipped in O(1) regardless of their size, as are fixed32 and fixed64
+//     fields.
+//   - Varints are skipped by scanning for their last byte, so their cost is bounded by
+//     their length of at most 10 bytes.
+//   - Every element of an unpacked repeated field is a field of its own, so skipping one
+//     is O(n) in its number of elements.
+//   - Groups have no length prefix and are skipped in O(n) in the size of their contents.
+//
+// If the message has fewer than n fields the buffer is left at its end and an error
+// wrapping io.ErrUnexpectedEOF is returned.
+//
+// The buffer is advanced.
+func SkipFields(buffer *codec.Buffer, n int) error {
+	if n < 0 {
+		return fmt.Errorf("SkipFields: negative count %d", n)
+	}
+	for i := 0; i < n; i++ {
+		if buffer.EOF() {
+			return fmt.Errorf("SkipFields: skipped %d of %d fields: %w", i, n, io.ErrUnexpectedEOF)
+		}
+		fieldNum, wireType, err := buffer.DecodeTagAndWireType()
+		if err != nil {
+			return fmt.Errorf("SkipFields: error decoding tag: %w", err)
+		}
+		if err := buffer.SkipField(wireType); err != nil {
+			return fmt.Errorf("SkipFields: error skipping field %d: %w", fieldNum, err)
+		}
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 module github.com/richardartoul/molecule
 
-go 1.13
+go 1.18
 
 require (
-	github.com/golang/protobuf v1.3.5
+	github.com/golang/protobuf v1.5.2
 	github.com/google/gofuzz v1.1.0
 	github.com/stretchr/testify v1.5.1
+	google.golang.org/protobuf v1.28.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,112 @@
+package molecule
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// hexDumpRowSize is the maximum number of bytes printed on a single line of an
+// annotated hex dump.
+const hexDumpRowSize = 16
+
+// AnnotatedHexDump writes a hex dump of the message stored in buffer to w in which the
+// bytes of each top-level field are grouped together and labeled with the field's number,
+// wire type and value:
+//
+//	00000000  0a 02 68 69  field=1 bytes len=2
+//	00000004  10 96 01  field=2 varint 150
+//
+// Fields longer than 16 bytes continue onto additional unlabeled lines. Group start and
+// end tags are printed on their own lines.
+//
+// AnnotatedHexDump is intended for debugging corrupt data so it does not fail when the
+// message can't be decoded. Instead, everything after the last field that could be
+// decoded is dumped as raw bytes labeled with the decoding error. Only errors returned by
+// w are returned.
+//
+// The buffer is consumed.
+func AnnotatedHexDump(buffer *codec.Buffer, w io.Writer) error {
+	var (
+		data = buffer.Bytes()
+		in   = codec.NewBuffer(data)
+	)
+	buffer.SkipToEnd()
+
+	for !in.EOF() {
+		start := len(data) - in.Len()
+		annotation, err := annotateField(in)
+		if err != nil {
+			return writeHexRows(w, start, data[start:], fmt.Sprintf("error: %v", err))
+		}
+		if err := writeHexRows(w, start, data[start:len(data)-in.Len()], annotation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotateField decodes the next field from buffer and describes it.
+func annotateField(buffer *codec.Buffer) (string, error) {
+	fieldNum, wireType, err := buffer.DecodeTagAndWireType()
+	if err != nil {
+		return "", err
+	}
+
+	switch wireType {
+	case codec.WireVarint:
+		v, err := buffer.DecodeVarint()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("field=%d %s %d", fieldNum, wireType, v), nil
+	case codec.WireFixed32:
+		v, err := buffer.DecodeFixed32()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("field=%d %s %d", fieldNum, wireType, v), nil
+	case codec.WireFixed64:
+		v, err := buffer.DecodeFixed64()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("field=%d %s %d", fieldNum, wireType, v), nil
+	case codec.WireBytes:
+		b, err := buffer.DecodeRawBytes(false)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("field=%d %s len=%d", fieldNum, wireType, len(b)), nil
+	case codec.WireStartGroup, codec.WireEndGroup:
+		return fmt.Sprintf("field=%d %s", fieldNum, wireType), nil
+	default:
+		return "", fmt.Errorf("%w: %d", codec.ErrBadWireType, wireType)
+	}
+}
+
+// writeHexRows writes b, which starts at offset in the dumped message, as rows of hex
+// bytes. The first row is followed by annotation.
+func writeHexRows(w io.Writer, offset int, b []byte, annotation string) error {
+	var sb strings.Builder
+	for i := 0; i < len(b); i += hexDumpRowSize {
+		end := i + hexDumpRowSize
+		if end > len(b) {
+			end = len(b)
+		}
+
+		fmt.Fprintf(&sb, "%08x ", offset+i)
+		for _, c := range b[i:end] {
+			fmt.Fprintf(&sb, " %02x", c)
+		}
+		if i == 0 {
+			sb.WriteString("  ")
+			sb.WriteString(annotation)
+		}
+		sb.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
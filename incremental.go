@@ -0,0 +1,107 @@
+package molecule
+
+import (
+	"errors"
+	"io"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// IncrementalDecoder decodes the top-level fields of a message that arrives in pieces,
+// such as a message read from the network, without waiting for all of it. Chunks of the
+// message are passed to Feed as they arrive and Fields yields every field that has been
+// received in full, in wire order. A field that is cut off by the end of a chunk is kept
+// until enough of the following chunks have been fed to complete it:
+//
+//	decoder := &molecule.IncrementalDecoder{}
+//	for chunk := range chunks {
+//		decoder.Feed(chunk)
+//		decoder.Fields()(func(fieldNum int32, value molecule.Value) bool {
+//			...
+//			return true
+//		})
+//		if err := decoder.Err(); err != nil {
+//			...
+//		}
+//	}
+//	if decoder.Buffered() > 0 {
+//		// The message ended in the middle of a field.
+//	}
+//
+// The zero value is ready to use. An IncrementalDecoder is not safe for concurrent use.
+type IncrementalDecoder struct {
+	buf []byte
+	// off is the offset in buf of the first field that hasn't been yielded yet.
+	off int
+	err error
+}
+
+// Feed appends chunk, the next piece of the message, to the decoder. The decoder keeps
+// its own copy of any bytes that it needs so chunk may be reused as soon as Feed returns.
+//
+// Feed invalidates the Values yielded by earlier calls to Fields.
+func (d *IncrementalDecoder) Feed(chunk []byte) {
+	if d.off > 0 {
+		// Drop the fields that have already been yielded.
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf, d.off = d.buf[:n], 0
+	}
+	d.buf = append(d.buf, chunk...)
+}
+
+// Fields returns an iterator over the fields that have been fed in full since they were
+// last iterated over. It has the same shape as an iter.Seq2[int32, Value], so callers
+// that use Go 1.23 or later can range over it. Iteration stops early if yield returns
+// false, in which case the remaining fields are yielded by the next call to Fields.
+//
+// The Bytes of each Value are an unsafe view over the decoder's buffer, and are only
+// valid until the next call to Feed. If a field can't be decoded for any reason other
+// than not having been received in full, iteration stops and the error is reported by
+// Err, after which no more fields are yielded.
+func (d *IncrementalDecoder) Fields() func(yield func(int32, Value) bool) {
+	return func(yield func(int32, Value) bool) {
+		if d.err != nil {
+			return
+		}
+		var (
+			buffer = codec.NewBuffer(d.buf[d.off:])
+			state  = newDecodeState(nil)
+		)
+		for {
+			// Without options nextField never passes over fields, so a field that is cut
+			// off always starts here.
+			fieldStart := buffer.Len()
+			fieldNum, value, _, err := nextField(buffer, &state)
+			if err == io.EOF {
+				d.off = len(d.buf)
+				return
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				// The field hasn't been received in full yet.
+				d.off = len(d.buf) - fieldStart
+				return
+			}
+			if err != nil {
+				d.err = err
+				return
+			}
+			d.off = len(d.buf) - buffer.Len()
+			if !yield(fieldNum, value) {
+				return
+			}
+		}
+	}
+}
+
+// Buffered returns the number of bytes that have been fed but not yet yielded as part of
+// a field. Once the whole message has been fed and its fields iterated over, a non-zero
+// value means that the message was truncated.
+func (d *IncrementalDecoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Err returns the error that stopped iteration, or nil if every field fed so far could
+// be decoded.
+func (d *IncrementalDecoder) Err() error {
+	return d.err
+}
@@ -0,0 +1,276 @@
+package molecule
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// WriteJSON writes a JSON representation of the message stored in buffer to w. Output is
+// streamed to w as the message is decoded so the full JSON document is never held in
+// memory. Wrapping w in a bufio.Writer is recommended since WriteJSON issues many small
+// writes.
+//
+// Since molecule has no schema, the output is a best-effort rendering:
+//
+//  1. Each message is rendered as a JSON object keyed by field number, with keys in the
+//     order in which each field first appears.
+//  2. Fields that occur more than once are rendered as a JSON array of their values.
+//  3. Varint and fixed-width values are rendered as unsigned integers.
+//  4. Length-delimited values are rendered as a nested object if they parse as a message,
+//     otherwise as a string if they are valid UTF-8 and as a base64 encoded string if not.
+//     Values nested deeper than the limit set with WithMaxDepth, DefaultMaxDepth by
+//     default, are always rendered as base64 encoded strings.
+//
+// Nested messages are parsed in full before any of their output is written so a field
+// that turns out not to be a message never leaves a partially written object behind.
+// Options apply to every message that is rendered as an object, nested ones included,
+// but a value that fails to parse as a message is rendered as a string rather than
+// reported as an error.
+//
+// The buffer is consumed.
+func WriteJSON(w io.Writer, buffer *codec.Buffer, opts ...Option) error {
+	state := newDecodeState(opts)
+	jw := jsonWriter{w: w, buffer: buffer, state: &state, maxDepth: state.opts.maxDepth}
+	if jw.maxDepth <= 0 {
+		jw.maxDepth = DefaultMaxDepth
+	}
+	// Messages are parsed with the limits of the options but without reporting to any
+	// hook or metrics, since a nested value that fails to parse isn't an error. The
+	// fields of the messages that are written are reported afterwards instead.
+	scanOpts := *state.opts
+	scanOpts.fieldHook, scanOpts.metrics = nil, nil
+	scanOpts.collectErrors = false
+	scanOpts.maxTotalBytes = 0
+	jw.scan = decodeState{opts: &scanOpts}
+
+	b := buffer.Bytes()
+	m, err := jw.parseMessage(b)
+	if err == nil {
+		err = jw.report(&m, len(b))
+	}
+	if err == nil {
+		err = jw.writeMessage(&m, 1)
+	} else if state.opts.metrics != nil {
+		state.opts.metrics.ObserveError(err)
+	}
+	if err != nil {
+		return fmt.Errorf("WriteJSON: %w", err)
+	}
+	buffer.SkipToEnd()
+	return nil
+}
+
+type jsonWriter struct {
+	w io.Writer
+	// buffer is the buffer passed to WriteJSON, whose settings every message is parsed
+	// with.
+	buffer *codec.Buffer
+	state  *decodeState
+	// scan is the state that messages are parsed with, see WriteJSON.
+	scan     decodeState
+	maxDepth int
+	scratch  [64]byte
+}
+
+// jsonMessage is a message whose fields have been grouped by number, which lets repeated
+// fields be written as arrays without buffering any output.
+type jsonMessage struct {
+	// fields holds every distinct field in the order of its first occurrence.
+	fields []jsonField
+	// occurrences holds every field in wire order.
+	occurrences []jsonOccurrence
+}
+
+type jsonField struct {
+	fieldNum int32
+	// first and last are the indexes in occurrences of the first and last occurrence of
+	// the field, which are linked through jsonOccurrence.next.
+	first, last int
+	count       int
+}
+
+type jsonOccurrence struct {
+	fieldNum int32
+	value    Value
+	// size is the size of the field's entire encoding, including its tag.
+	size int
+	// next is the index of the next occurrence of the same field, or -1.
+	next int
+}
+
+// parseMessage parses b as a message in a single pass. The values alias b so holding on
+// to them is free.
+func (jw *jsonWriter) parseMessage(b []byte) (jsonMessage, error) {
+	var (
+		m      jsonMessage
+		index  = map[int32]int{}
+		buffer = jw.buffer.Nested(b)
+	)
+	for {
+		fieldNum, value, fieldStart, err := nextField(buffer, &jw.scan)
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return jsonMessage{}, err
+		}
+
+		i := len(m.occurrences)
+		m.occurrences = append(m.occurrences, jsonOccurrence{
+			fieldNum: fieldNum,
+			value:    value,
+			size:     fieldStart - buffer.Len(),
+			next:     -1,
+		})
+		if f, ok := index[fieldNum]; ok {
+			m.occurrences[m.fields[f].last].next = i
+			m.fields[f].last = i
+			m.fields[f].count++
+		} else {
+			index[fieldNum] = len(m.fields)
+			m.fields = append(m.fields, jsonField{fieldNum: fieldNum, first: i, last: i, count: 1})
+		}
+	}
+}
+
+// report counts the size bytes of the message m towards WithMaxTotalBytes and reports its
+// fields to the hook and the metrics of the options, if any.
+func (jw *jsonWriter) report(m *jsonMessage, size int) error {
+	if err := jw.state.consume(size); err != nil {
+		return err
+	}
+	for _, o := range m.occurrences {
+		jw.state.observe(o.fieldNum, o.value.WireType, o.size)
+	}
+	if jw.state.opts.metrics != nil {
+		jw.state.opts.metrics.ObserveMessage(len(m.occurrences), size)
+	}
+	return nil
+}
+
+// writeMessage writes m, a message at the given depth, as a JSON object.
+func (jw *jsonWriter) writeMessage(m *jsonMessage, depth int) error {
+	if err := jw.writeString("{"); err != nil {
+		return err
+	}
+	for i, field := range m.fields {
+		if i > 0 {
+			if err := jw.writeString(","); err != nil {
+				return err
+			}
+		}
+		key := strconv.AppendInt(append(jw.scratch[:0], '"'), int64(field.fieldNum), 10)
+		if _, err := jw.w.Write(append(key, '"', ':')); err != nil {
+			return err
+		}
+		repeated := field.count > 1
+		if repeated {
+			if err := jw.writeString("["); err != nil {
+				return err
+			}
+		}
+		for o := field.first; o >= 0; o = m.occurrences[o].next {
+			if o != field.first {
+				if err := jw.writeString(","); err != nil {
+					return err
+				}
+			}
+			if err := jw.writeValue(m.occurrences[o].value, depth); err != nil {
+				return err
+			}
+		}
+		if repeated {
+			if err := jw.writeString("]"); err != nil {
+				return err
+			}
+		}
+	}
+	return jw.writeString("}")
+}
+
+// writeValue writes value, a field of a message at the given depth.
+func (jw *jsonWriter) writeValue(value Value, depth int) error {
+	switch value.WireType {
+	case codec.WireBytes:
+		if depth >= jw.maxDepth {
+			return jw.writeBase64(value.Bytes)
+		}
+		if len(value.Bytes) > 0 {
+			if m, err := jw.parseMessage(value.Bytes); err == nil {
+				if err := jw.report(&m, len(value.Bytes)); err != nil {
+					return err
+				}
+				return jw.writeMessage(&m, depth+1)
+			}
+		}
+		if utf8.Valid(value.Bytes) {
+			return jw.writeQuoted(value.Bytes)
+		}
+		return jw.writeBase64(value.Bytes)
+	default:
+		_, err := jw.w.Write(strconv.AppendUint(jw.scratch[:0], value.Number, 10))
+		return err
+	}
+}
+
+func (jw *jsonWriter) writeQuoted(b []byte) error {
+	const hex = "0123456789abcdef"
+
+	if err := jw.writeString(`"`); err != nil {
+		return err
+	}
+	start := 0
+	for i, c := range b {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+		if _, err := jw.w.Write(b[start:i]); err != nil {
+			return err
+		}
+		var escaped []byte
+		switch c {
+		case '"', '\\':
+			escaped = append(jw.scratch[:0], '\\', c)
+		case '\n':
+			escaped = append(jw.scratch[:0], '\\', 'n')
+		case '\r':
+			escaped = append(jw.scratch[:0], '\\', 'r')
+		case '\t':
+			escaped = append(jw.scratch[:0], '\\', 't')
+		default:
+			escaped = append(jw.scratch[:0], '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		}
+		if _, err := jw.w.Write(escaped); err != nil {
+			return err
+		}
+		start = i + 1
+	}
+	if _, err := jw.w.Write(b[start:]); err != nil {
+		return err
+	}
+	return jw.writeString(`"`)
+}
+
+func (jw *jsonWriter) writeBase64(b []byte) error {
+	if err := jw.writeString(`"`); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, jw.w)
+	if _, err := enc.Write(b); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return jw.writeString(`"`)
+}
+
+func (jw *jsonWriter) writeString(s string) error {
+	_, err := io.WriteString(jw.w, s)
+	return err
+}
@@ -0,0 +1,123 @@
+package molecule
+
+import (
+	"math"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Kind is a guess at what the contents of a length-delimited field represent.
+type Kind int
+
+const (
+	// KindBytes is opaque binary data.
+	KindBytes Kind = iota
+	// KindString is a UTF-8 string.
+	KindString
+	// KindMessage is a nested message.
+	KindMessage
+)
+
+// String returns the name of the kind, for example "message".
+func (k Kind) String() string {
+	switch k {
+	case KindBytes:
+		return "bytes"
+	case KindString:
+		return "string"
+	case KindMessage:
+		return "message"
+	default:
+		return "unknown"
+	}
+}
+
+// GuessKind guesses whether b, the contents of a length-delimited field, holds a nested
+// message, a string or opaque bytes. b is considered a message if it is non-empty and
+// parses completely as a sequence of fields, otherwise a string if it is valid UTF-8,
+// and otherwise bytes. Empty contents are considered a string.
+//
+// Without a schema the distinction can't be made reliably: short strings are often also
+// valid messages (for example "hi" parses as field 13 with the varint value 105) and
+// binary data may happen to be valid UTF-8. GuessKind is therefore only suitable for
+// display purposes, such as the output of WriteJSON, and should never be used to decide
+// how to interpret data.
+func GuessKind(b []byte) Kind {
+	switch {
+	case len(b) > 0 && isMessage(b):
+		return KindMessage
+	case utf8.Valid(b):
+		return KindString
+	default:
+		return KindBytes
+	}
+}
+
+// isMessage returns whether b can be fully consumed as a sequence of fields. Failure is
+// reported with a bool rather than an error, and lengths are checked before they are
+// skipped, so that rejecting data which isn't a message never allocates.
+//
+// Groups are rejected, just like MessageEach rejects them by default, rather than
+// skipped. Skipping a group means scanning every group nested inside of it, so accepting
+// them would let a short run of start group tags trigger arbitrarily deep recursion.
+func isMessage(b []byte) bool {
+	buffer := codec.NewBuffer(b)
+	for !buffer.EOF() {
+		tag, err := buffer.DecodeVarint()
+		if err != nil || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return false
+		}
+		switch wireType := codec.WireType(tag & 7); wireType {
+		case codec.WireVarint, codec.WireFixed32, codec.WireFixed64:
+			if err := buffer.SkipField(wireType); err != nil {
+				return false
+			}
+		case codec.WireBytes:
+			l, err := buffer.DecodeVarint()
+			if err != nil || l > uint64(buffer.Len()) {
+				return false
+			}
+			if err := buffer.Skip(int(l)); err != nil {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// AsStringOrBytes guesses whether the value, which must be length-delimited, holds a
+// string or opaque bytes. If its contents are valid UTF-8 made up only of printable
+// characters and whitespace, they are returned as a string, which is a copy that doesn't
+// alias the buffer, and isString is true. Otherwise, including for values that aren't
+// length-delimited, an empty string and false are returned so that the caller can fall
+// back to another representation such as hex.
+//
+// Like GuessKind this is a heuristic meant only for display purposes: short binary values
+// are often printable by chance, and it says nothing about whether the value is a nested
+// message. Never use it to decide how to interpret data.
+func (v *Value) AsStringOrBytes() (s string, isString bool) {
+	if v.WireType != codec.WireBytes || !isPrintable(v.Bytes) {
+		return "", false
+	}
+	return string(v.Bytes), true
+}
+
+// isPrintable returns whether b is valid UTF-8 that consists only of printable characters
+// and whitespace.
+func isPrintable(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			return false
+		}
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+		b = b[size:]
+	}
+	return true
+}
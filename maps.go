@@ -0,0 +1,128 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// MapEachFn is a function that is called for each entry of a map field.
+type MapEachFn func(key Value, value Value) (bool, error)
+
+// MapEach calls fn for each entry of the map field fieldNum in the message stored in
+// buffer, in wire order. keyType and valueType are the types of the map's keys and
+// values.
+//
+// On the wire a map is a repeated message field with the key in field 1 and the value in
+// field 2 of each entry. A key or value that is missing from an entry is passed to fn as
+// the zero value of its type, and if an entry contains a key or value more than once the
+// last occurrence wins. Entries with duplicate keys are passed to fn individually; by
+// protobuf semantics the last one wins.
+//
+// The Bytes of the keys and values are unsafe views over the buffer. The buffer is not
+// advanced.
+func MapEach(buffer *codec.Buffer, fieldNum int32, keyType, valueType codec.FieldType, fn MapEachFn) error {
+	keyWireType, err := wireTypeForFieldType(keyType)
+	if err != nil {
+		return fmt.Errorf("MapEach: key: %w", err)
+	}
+	valueWireType, err := wireTypeForFieldType(valueType)
+	if err != nil {
+		return fmt.Errorf("MapEach: value: %w", err)
+	}
+
+	return lookupEach(buffer, func(num int32, entry Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		if entry.WireType != codec.WireBytes {
+			return false, fmt.Errorf(
+				"MapEach: field %d: expected wiretype %d, got: %d", fieldNum, codec.WireBytes, entry.WireType)
+		}
+
+		var (
+			key   = Value{WireType: keyWireType}
+			value = Value{WireType: valueWireType}
+		)
+		err := MessageEach(buffer.Nested(entry.Bytes), func(num int32, v Value) (bool, error) {
+			switch num {
+			case 1:
+				if v.WireType != keyWireType {
+					return false, fmt.Errorf("key: expected wiretype %d, got: %d", keyWireType, v.WireType)
+				}
+				key = v
+			case 2:
+				if v.WireType != valueWireType {
+					return false, fmt.Errorf("value: expected wiretype %d, got: %d", valueWireType, v.WireType)
+				}
+				value = v
+			}
+			return true, nil
+		})
+		if err != nil {
+			return false, fmt.Errorf("MapEach: field %d: %w", fieldNum, err)
+		}
+		return fn(key, value)
+	})
+}
+
+// decodeMap collects the entries of a map field into a Go map using as to convert each
+// key and value.
+func decodeMap[K comparable, V any](
+	caller string,
+	buffer *codec.Buffer,
+	fieldNum int32,
+	keyType, valueType codec.FieldType,
+	asKey func(*Value) (K, error),
+	asValue func(*Value) (V, error),
+) (map[K]V, error) {
+	m := make(map[K]V)
+	err := MapEach(buffer, fieldNum, keyType, valueType, func(key Value, value Value) (bool, error) {
+		k, err := asKey(&key)
+		if err != nil {
+			return false, err
+		}
+		v, err := asValue(&value)
+		if err != nil {
+			return false, err
+		}
+		m[k] = v
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", caller, err)
+	}
+	return m, nil
+}
+
+// DecodeMapStringString returns the entries of the map<string, string> field fieldNum in
+// the message stored in buffer. If a key occurs more than once the last entry wins. Keys
+// and values are safe copies. The buffer is not advanced.
+func DecodeMapStringString(buffer *codec.Buffer, fieldNum int32) (map[string]string, error) {
+	return decodeMap("DecodeMapStringString", buffer, fieldNum,
+		codec.FieldType_STRING, codec.FieldType_STRING, (*Value).AsStringSafe, (*Value).AsStringSafe)
+}
+
+// DecodeMapStringInt64 returns the entries of the map<string, int64> field fieldNum in the
+// message stored in buffer. If a key occurs more than once the last entry wins. Keys are
+// safe copies. The buffer is not advanced.
+func DecodeMapStringInt64(buffer *codec.Buffer, fieldNum int32) (map[string]int64, error) {
+	return decodeMap("DecodeMapStringInt64", buffer, fieldNum,
+		codec.FieldType_STRING, codec.FieldType_INT64, (*Value).AsStringSafe, (*Value).AsInt64)
+}
+
+// DecodeMapInt32String returns the entries of the map<int32, string> field fieldNum in the
+// message stored in buffer. If a key occurs more than once the last entry wins. Values are
+// safe copies. The buffer is not advanced.
+func DecodeMapInt32String(buffer *codec.Buffer, fieldNum int32) (map[int32]string, error) {
+	return decodeMap("DecodeMapInt32String", buffer, fieldNum,
+		codec.FieldType_INT32, codec.FieldType_STRING, (*Value).AsInt32, (*Value).AsStringSafe)
+}
+
+// DecodeMapInt64String returns the entries of the map<int64, string> field fieldNum in the
+// message stored in buffer. If a key occurs more than once the last entry wins. Values are
+// safe copies. The buffer is not advanced.
+func DecodeMapInt64String(buffer *codec.Buffer, fieldNum int32) (map[int64]string, error) {
+	return decodeMap("DecodeMapInt64String", buffer, fieldNum,
+		codec.FieldType_INT64, codec.FieldType_STRING, (*Value).AsInt64, (*Value).AsStringSafe)
+}
@@ -2,35 +2,252 @@
 package molecule
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/richardartoul/molecule/src/codec"
 )
 
+// ErrTrailingData is returned by StrictMessageEach when bytes remain in the buffer after
+// the message has been read.
+var ErrTrailingData = errors.New("molecule: trailing data after message")
+
 // MessageEachFn is a function that will be called for each top-level field in a
 // message passed to MessageEach.
+//
+// The Bytes of value alias the buffer being iterated over. Use value.Retain() to
+// obtain a copy if value needs to outlive the buffer's contents.
 type MessageEachFn func(fieldNum int32, value Value) (bool, error)
 
 // MessageEach iterates over each top-level field in the message stored in buffer
 // and calls fn on each one.
-func MessageEach(buffer *codec.Buffer, fn MessageEachFn) error {
+func MessageEach(buffer *codec.Buffer, fn MessageEachFn, opts ...Option) error {
+	state := newDecodeState(opts)
+	return messageEach(buffer, fn, &state)
+}
+
+// Parse is shorthand for calling MessageEach on a new Buffer containing data. Like
+// MessageEach it doesn't allocate.
+func Parse(data []byte, fn MessageEachFn, opts ...Option) error {
+	return MessageEach(codec.NewBuffer(data), fn, opts...)
+}
+
+// MessageEachTypedFn is like MessageEachFn except that the field's wire type is also passed
+// as a separate argument.
+type MessageEachTypedFn func(fieldNum int32, wireType codec.WireType, value Value) (bool, error)
+
+// MessageEachTyped is like MessageEach except that fn receives each field's wire type as a
+// direct argument, which is convenient for callbacks that switch on it.
+func MessageEachTyped(buffer *codec.Buffer, fn MessageEachTypedFn, opts ...Option) error {
+	state := newDecodeState(opts)
+	return messageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		return fn(fieldNum, value.WireType, value)
+	}, &state)
+}
+
+// MessageEachOrdinalFn is like MessageEachFn except that it also receives the 0-based
+// ordinal of each occurrence of a field, that is the number of times that the same field
+// number occurred before it.
+type MessageEachOrdinalFn func(fieldNum int32, ordinal int, value Value) (bool, error)
+
+// MessageEachOrdinal is like MessageEach except that fn also receives the ordinal of each
+// field's occurrence, which allows unpacked repeated fields to be reconstructed into
+// indexed slices in a single pass. Ordinals are counted separately for every field number
+// and count occurrences rather than elements, so a packed occurrence counts once no matter
+// how many elements it holds.
+//
+// Occurrences of fields numbered below 64 are counted without allocating.
+func MessageEachOrdinal(buffer *codec.Buffer, fn MessageEachOrdinalFn, opts ...Option) error {
+	var (
+		small [64]int
+		large map[int32]int
+	)
+	state := newDecodeState(opts)
+	return messageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		var ordinal int
+		if int(fieldNum) < len(small) {
+			ordinal = small[fieldNum]
+			small[fieldNum]++
+		} else {
+			if large == nil {
+				large = map[int32]int{}
+			}
+			ordinal = large[fieldNum]
+			large[fieldNum]++
+		}
+		return fn(fieldNum, ordinal, value)
+	}, &state)
+}
+
+// MessageEachNestedFn is like MessageEachFn except that, for length-delimited fields, sub is
+// a Buffer over value.Bytes that can be used to decode the field as a nested message. sub is
+// nil for every other wire type.
+//
+// sub is reused for every field, so it must not be retained after fn returns.
+type MessageEachNestedFn func(fieldNum int32, value Value, sub *codec.Buffer) (bool, error)
+
+// nestedBufferPool holds the Buffers handed to MessageEachNestedFns.
+var nestedBufferPool = sync.Pool{
+	New: func() interface{} { return new(codec.Buffer) },
+}
+
+// MessageEachNested is like MessageEach except that fn also receives a Buffer scoped to
+// the contents of each length-delimited field. The Buffers are pooled, so recursively
+// walking a tree of nested messages by calling MessageEachNested on sub doesn't allocate
+// once the pool has warmed up.
+func MessageEachNested(buffer *codec.Buffer, fn MessageEachNestedFn, opts ...Option) error {
+	sub := nestedBufferPool.Get().(*codec.Buffer)
+	state := newDecodeState(opts)
+	err := messageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		if value.WireType != codec.WireBytes {
+			return fn(fieldNum, value, nil)
+		}
+		// Start from scratch in case fn configured the buffer during a previous call.
+		*sub = codec.Buffer{}
+		sub.Reset(value.Bytes)
+		return fn(fieldNum, value, sub)
+	}, &state)
+	// Don't keep the message alive through the pool.
+	*sub = codec.Buffer{}
+	nestedBufferPool.Put(sub)
+	return err
+}
+
+// StrictMessageEach is like MessageEach except that it requires the message to span the
+// entire buffer. If fn stops the iteration early by returning false, any bytes that remain
+// in the buffer are treated as trailing garbage and StrictMessageEach returns an error
+// wrapping ErrTrailingData that reports the offset at which they begin.
+func StrictMessageEach(buffer *codec.Buffer, fn MessageEachFn, opts ...Option) error {
+	start := buffer.Len()
+	state := newDecodeState(opts)
+	if err := messageEach(buffer, fn, &state); err != nil {
+		return err
+	}
+	if buffer.Len() > 0 {
+		return fmt.Errorf(
+			"StrictMessageEach: %w: %d bytes at offset %d", ErrTrailingData, buffer.Len(), start-buffer.Len())
+	}
+	return nil
+}
+
+func messageEach(buffer *codec.Buffer, fn MessageEachFn, state *decodeState) error {
+	if state.opts.metrics == nil {
+		_, err := eachField(buffer, fn, state)
+		return err
+	}
+	start := buffer.Len()
+	fields, err := eachField(buffer, fn, state)
+	if err != nil {
+		state.opts.metrics.ObserveError(err)
+	} else {
+		state.opts.metrics.ObserveMessage(fields, start-buffer.Len())
+	}
+	return err
+}
+
+// eachField implements messageEach and returns the number of fields passed to fn.
+func eachField(buffer *codec.Buffer, fn MessageEachFn, state *decodeState) (int, error) {
+	if state.opts.rejectEmpty && buffer.EOF() {
+		return 0, fmt.Errorf("MessageEach: %w", ErrEmptyMessage)
+	}
+	if state.opts.collectErrors {
+		// Errors are collected separately for every message, including nested ones that
+		// share the state.
+		origin, fieldErrs := state.origin, state.fieldErrs
+		state.origin, state.fieldErrs = buffer.Len(), nil
+		defer func() {
+			state.origin, state.fieldErrs = origin, fieldErrs
+		}()
+	}
+	for fields := 0; ; fields++ {
+		fieldNum, value, _, err := nextField(buffer, state)
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return fields, err
+		}
+
+		if shouldContinue, err := fn(fieldNum, value); err != nil || !shouldContinue {
+			return fields + 1, err
+		}
+	}
+}
+
+// nextField decodes the next field in buffer, passing over any fields that the options
+// say to skip. Along with the field it returns the value of buffer.Len() before the
+// field's tag. io.EOF is returned once the buffer is exhausted, unless errors were
+// collected because of WithCollectErrors in which case they are returned instead.
+func nextField(buffer *codec.Buffer, state *decodeState) (int32, Value, int, error) {
 	for !buffer.EOF() {
+		fieldStart := buffer.Len()
 		fieldNum, wireType, err := buffer.DecodeTagAndWireType()
 		if err == io.EOF {
-			return nil
+			break
 		}
-
-		value, err := readValueFromBuffer(wireType, buffer)
 		if err != nil {
-			return fmt.Errorf("MessageEach: error reading value from buffer: %v", err)
+			return 0, Value{}, 0, state.failField(0, fieldStart, fmt.Errorf("MessageEach: error decoding tag: %w", err))
+		}
+		if err := state.checkFieldNum(fieldNum); err != nil {
+			err = fmt.Errorf("MessageEach: %w", err)
+			if !state.skipBadField(fieldNum, fieldStart, err, func() error { return buffer.SkipField(wireType) }) {
+				return 0, Value{}, 0, state.failField(fieldNum, fieldStart, err)
+			}
+			if err := state.consume(fieldStart - buffer.Len()); err != nil {
+				return 0, Value{}, 0, state.failField(fieldNum, fieldStart, fmt.Errorf("MessageEach: %w", err))
+			}
+			continue
 		}
 
-		if shouldContinue, err := fn(fieldNum, value); err != nil || !shouldContinue {
-			return err
+		if wireType == codec.WireStartGroup && state.opts.skipUnknownWireTypes && !state.opts.delimitedMessages {
+			if err := buffer.SkipGroup(); err != nil {
+				return 0, Value{}, 0, state.failField(fieldNum, fieldStart,
+					fmt.Errorf("MessageEach: error skipping group for field %d: %w", fieldNum, err))
+			}
+			state.observe(fieldNum, wireType, fieldStart-buffer.Len())
+			if err := state.consume(fieldStart - buffer.Len()); err != nil {
+				return 0, Value{}, 0, state.failField(fieldNum, fieldStart, fmt.Errorf("MessageEach: %w", err))
+			}
+			continue
 		}
+
+		var value Value
+		if wireType == codec.WireStartGroup && state.opts.delimitedMessages {
+			value, err = readDelimitedMessage(fieldNum, buffer)
+		} else {
+			value, err = readValueFromBuffer(wireType, buffer)
+		}
+		if err != nil {
+			err = fmt.Errorf("MessageEach: error reading value from buffer: %w", err)
+			// Unsupported groups can still be skipped reliably.
+			if wireType != codec.WireStartGroup || !state.skipBadField(fieldNum, fieldStart, err, buffer.SkipGroup) {
+				return 0, Value{}, 0, state.failField(fieldNum, fieldStart, err)
+			}
+		}
+		state.observe(fieldNum, wireType, fieldStart-buffer.Len())
+		if err == nil {
+			if err = state.checkValue(value); err != nil {
+				err = fmt.Errorf("MessageEach: field %d: %w", fieldNum, err)
+				if !state.skipBadField(fieldNum, fieldStart, err, nil) {
+					return 0, Value{}, 0, state.failField(fieldNum, fieldStart, err)
+				}
+			}
+		}
+		if err := state.consume(fieldStart - buffer.Len()); err != nil {
+			return 0, Value{}, 0, state.failField(fieldNum, fieldStart, fmt.Errorf("MessageEach: %w", err))
+		}
+		if err != nil {
+			// The field was recovered from.
+			continue
+		}
+		return fieldNum, value, fieldStart, nil
 	}
-	return nil
+	if len(state.fieldErrs) > 0 {
+		return 0, Value{}, 0, state.fieldErrs
+	}
+	return 0, Value{}, 0, io.EOF
 }
 
 // PackedRepeatedEachFn is a function that is called for each value in a repeated field.
@@ -42,8 +259,70 @@ type PackedRepeatedEachFn func(value Value) (bool, error)
 // The fieldType argument should match the type of the value stored in the repeated field.
 //
 // PackedRepeatedEach only supports repeated fields encoded using packed encoding.
+//
+// Every byte in buffer belongs to some element, so an empty buffer never calls fn and
+// trailing zero bytes are decoded as elements with the value zero rather than ignored.
+// If fn returns false iteration stops and PackedRepeatedEach returns nil, exactly as if
+// every element had been visited. Errors returned by fn are returned as is, while
+// decoding errors name the index of the element that couldn't be read.
 func PackedRepeatedEach(buffer *codec.Buffer, fieldType codec.FieldType, fn PackedRepeatedEachFn) error {
-	var wireType codec.WireType
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return fmt.Errorf("PackedRepeatedEach: %w", err)
+	}
+	return packedRemaining("PackedRepeatedEach", buffer, wireType, fn)
+}
+
+// PackedRemaining is a lower-level PackedRepeatedEach for callers that already know the
+// wire type of the elements, or don't want to assert their exact type: it iterates over
+// the rest of buffer as packed elements of wireType, which must be codec.WireVarint,
+// codec.WireFixed32 or codec.WireFixed64, and calls fn on each one. Each element's Value
+// holds its raw wire representation, which can then be interpreted with any of the
+// Value methods that match the wire type.
+//
+// The buffer is consumed.
+func PackedRemaining(buffer *codec.Buffer, wireType codec.WireType, fn PackedRepeatedEachFn) error {
+	switch wireType {
+	case codec.WireVarint, codec.WireFixed32, codec.WireFixed64:
+	default:
+		return fmt.Errorf("PackedRemaining: wiretype %d can't be packed", wireType)
+	}
+	return packedRemaining("PackedRemaining", buffer, wireType, fn)
+}
+
+// PackedBytesEach is like PackedRepeatedEach except that the packed elements are read
+// from data, which holds just the contents of a packed repeated field without the
+// surrounding message or tag, such as a column stored in a file of its own. It saves the
+// caller from wrapping data in a Buffer.
+func PackedBytesEach(data []byte, fieldType codec.FieldType, fn PackedRepeatedEachFn) error {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return fmt.Errorf("PackedBytesEach: %w", err)
+	}
+	return packedRemaining("PackedBytesEach", codec.NewBuffer(data), wireType, fn)
+}
+
+// packedRemaining implements PackedRepeatedEach, PackedRemaining and PackedBytesEach.
+func packedRemaining(funcName string, buffer *codec.Buffer, wireType codec.WireType, fn PackedRepeatedEachFn) error {
+	for i := 0; !buffer.EOF(); i++ {
+		value, err := readValueFromBuffer(wireType, buffer)
+		if err != nil {
+			return fmt.Errorf("%s: element %d: error reading value from buffer: %w", funcName, i, err)
+		}
+		shouldContinue, err := fn(value)
+		if err != nil {
+			return err
+		}
+		if !shouldContinue {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// wireTypeForFieldType returns the wire type that values of fieldType are encoded with.
+func wireTypeForFieldType(fieldType codec.FieldType) (codec.WireType, error) {
 	switch fieldType {
 	case codec.FieldType_INT32,
 		codec.FieldType_INT64,
@@ -53,35 +332,45 @@ func PackedRepeatedEach(buffer *codec.Buffer, fieldType codec.FieldType, fn Pack
 		codec.FieldType_SINT64,
 		codec.FieldType_BOOL,
 		codec.FieldType_ENUM:
-		wireType = codec.WireVarint
+		return codec.WireVarint, nil
 	case codec.FieldType_FIXED64,
 		codec.FieldType_SFIXED64,
 		codec.FieldType_DOUBLE:
-		wireType = codec.WireFixed64
+		return codec.WireFixed64, nil
 	case codec.FieldType_FIXED32,
 		codec.FieldType_SFIXED32,
 		codec.FieldType_FLOAT:
-		wireType = codec.WireFixed32
+		return codec.WireFixed32, nil
 	case codec.FieldType_STRING,
 		codec.FieldType_MESSAGE,
 		codec.FieldType_BYTES:
-		wireType = codec.WireBytes
+		return codec.WireBytes, nil
 	default:
-		return fmt.Errorf(
-			"PackedRepeatedEach: unknown field type: %v", fieldType)
+		return 0, fmt.Errorf("unknown field type: %v", fieldType)
 	}
+}
 
-	for !buffer.EOF() {
-		value, err := readValueFromBuffer(wireType, buffer)
-		if err != nil {
-			return fmt.Errorf("PackedRepeatedEach: error reading value from buffer: %v", err)
-		}
-		if shouldContinue, err := fn(value); err != nil || !shouldContinue {
-			return nil
-		}
+// readDelimitedMessage reads the contents of the delimited message field fieldNum, whose
+// start group tag has already been consumed, and verifies that it is terminated by the end
+// group tag of the same field.
+func readDelimitedMessage(fieldNum int32, buffer *codec.Buffer) (Value, error) {
+	end := buffer.Clone()
+	b, err := buffer.ReadGroup(buffer.CopiesBytes())
+	if err != nil {
+		return Value{}, fmt.Errorf("MessageEach: error reading delimited message: %w", err)
 	}
-
-	return nil
+	if err := end.Skip(len(b)); err != nil {
+		return Value{}, err
+	}
+	endNum, _, err := end.DecodeTagAndWireType()
+	if err != nil {
+		return Value{}, err
+	}
+	if endNum != fieldNum {
+		return Value{}, fmt.Errorf(
+			"MessageEach: delimited message for field %d ended by end group tag for field %d", fieldNum, endNum)
+	}
+	return Value{WireType: codec.WireStartGroup, Bytes: b}, nil
 }
 
 func readValueFromBuffer(wireType codec.WireType, buffer *codec.Buffer) (Value, error) {
@@ -94,28 +383,28 @@ func readValueFromBuffer(wireType codec.WireType, buffer *codec.Buffer) (Value,
 		varint, err := buffer.DecodeVarint()
 		if err != nil {
 			return Value{}, fmt.Errorf(
-				"MessageEach: error decoding varint: %v", err)
+				"MessageEach: error decoding varint: %w", err)
 		}
 		value.Number = varint
 	case codec.WireFixed32:
 		fixed32, err := buffer.DecodeFixed32()
 		if err != nil {
 			return Value{}, fmt.Errorf(
-				"MessageEach: error decoding fixed32: %v", err)
+				"MessageEach: error decoding fixed32: %w", err)
 		}
 		value.Number = fixed32
 	case codec.WireFixed64:
 		fixed64, err := buffer.DecodeFixed64()
 		if err != nil {
 			return Value{}, fmt.Errorf(
-				"MessageEach: error decoding fixed64: %v", err)
+				"MessageEach: error decoding fixed64: %w", err)
 		}
 		value.Number = fixed64
 	case codec.WireBytes:
-		b, err := buffer.DecodeRawBytes(false)
+		b, err := buffer.DecodeRawBytes(buffer.CopiesBytes())
 		if err != nil {
 			return Value{}, fmt.Errorf(
-				"MessageEach: error decoding raw bytes: %v", err)
+				"MessageEach: error decoding raw bytes: %w", err)
 		}
 		value.Bytes = b
 	case codec.WireStartGroup, codec.WireEndGroup:
@@ -124,7 +413,7 @@ func readValueFromBuffer(wireType codec.WireType, buffer *codec.Buffer) (Value,
 			wireType)
 	default:
 		return Value{}, fmt.Errorf(
-			"MessageEach: unknown wireType: %d", wireType)
+			"MessageEach: %w: unknown wireType: %d", codec.ErrBadWireType, wireType)
 	}
 
 	return value, nil
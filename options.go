@@ -0,0 +1,353 @@
+package molecule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// ErrEmptyMessage is returned when a decode configured with WithRejectEmpty, or
+// PeekFirstFieldNum, is given an empty buffer.
+var ErrEmptyMessage = errors.New("molecule: empty message")
+
+// ErrMaxTotalBytes is returned when a decode consumes more bytes than allowed by
+// WithMaxTotalBytes.
+var ErrMaxTotalBytes = errors.New("molecule: total decoded bytes limit exceeded")
+
+// ErrFieldOutOfRange is returned when a decode configured with WithAllowedFieldRange
+// encounters a field number outside of the allowed range.
+var ErrFieldOutOfRange = errors.New("molecule: field number out of allowed range")
+
+// DefaultMaxDepth is the deepest nesting of messages that the functions which recurse
+// into nested messages on their own, such as MessageSize, descend into. It matches the
+// default recursion limit of the protobuf libraries and keeps hostile input that nests
+// messages millions of levels deep from exhausting the stack.
+const DefaultMaxDepth = 100
+
+// ErrMaxDepth is returned by the functions that recurse into nested messages on their own
+// and fail, rather than degrade, when messages are nested too deeply.
+var ErrMaxDepth = errors.New("molecule: maximum nesting depth exceeded")
+
+// Option configures the behavior of the functions that accept it.
+type Option func(*options)
+
+type options struct {
+	maxTotalBytes  int
+	maxMessageSize int
+
+	skipUnknownWireTypes bool
+	delimitedMessages    bool
+	collectErrors        bool
+	copy                 bool
+	rejectEmpty          bool
+
+	fieldHook FieldHook
+
+	limitFieldRange    bool
+	minField, maxField int32
+
+	metrics Metrics
+
+	maxDepth int
+}
+
+// defaultOptions is shared by every call that doesn't specify any options so that
+// the common case does not allocate. It must never be modified.
+var defaultOptions options
+
+func newOptions(opts []Option) *options {
+	if len(opts) == 0 {
+		return &defaultOptions
+	}
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithMaxDepth limits how many levels of nested messages WriteJSON recurses into to n,
+// instead of DefaultMaxDepth. The top-level message is at depth 1. A value of 0 or less
+// restores the default.
+func WithMaxDepth(n int) Option {
+	return func(o *options) {
+		o.maxDepth = n
+	}
+}
+
+// WithMaxTotalBytes limits the cumulative number of bytes that a single decode may
+// consume. Bytes are counted at every nesting level that the decode recurses into, so
+// a nested message's bytes count once for the field that contains it and once more for
+// each of its own fields. This bounds the total amount of work performed on a payload
+// even when every individual message in it is small.
+//
+// A value of zero or less disables the limit, which is the default.
+func WithMaxTotalBytes(n int) Option {
+	return func(o *options) {
+		o.maxTotalBytes = n
+	}
+}
+
+// WithMaxMessageSize limits the declared length of any single length-delimited field,
+// and therefore of any nested message, to n bytes. Fields that exceed the limit cause
+// the decode to fail with an error wrapping codec.ErrFieldTooLarge. To apply the same
+// limit when skipping fields directly with a codec.Buffer, use Buffer.SetMaxFieldLength.
+//
+// A value of zero or less disables the limit, which is the default.
+func WithMaxMessageSize(n int) Option {
+	return func(o *options) {
+		o.maxMessageSize = n
+	}
+}
+
+// WithSkipUnknownWireTypes controls what happens when a decode encounters a field
+// whose wire type it can't represent as a Value. By default the decode fails. When
+// skip is true, fields that can be skipped reliably, which are groups, are passed
+// over without calling the callback and the decode continues. This allows messages
+// from newer producers to be parsed as long as the fields of interest are readable.
+//
+// Stray end group tags and the reserved wire types 6 and 7 still fail the decode
+// even when skipping is enabled because there is no way to determine where such a
+// field ends.
+func WithSkipUnknownWireTypes(skip bool) Option {
+	return func(o *options) {
+		o.skipUnknownWireTypes = skip
+	}
+}
+
+// WithDelimitedMessages makes MessageEach and its variants decode fields that start with a
+// start group tag as delimited messages, the encoding that protobuf editions use for
+// message fields with the DELIMITED message encoding feature. On the wire these are
+// indistinguishable from proto2 groups: the message's fields are followed by an end group
+// tag for the same field number instead of being preceded by their length.
+//
+// Such fields are passed to the callback as a Value whose WireType is
+// codec.WireStartGroup and whose Bytes hold the contents of the message, excluding the
+// end group tag, so they can be decoded like any other nested message. The option takes
+// precedence over WithSkipUnknownWireTypes. It is off by default because proto2 groups
+// are otherwise rejected or skipped rather than surfaced.
+func WithDelimitedMessages() Option {
+	return func(o *options) {
+		o.delimitedMessages = true
+	}
+}
+
+// WithStopOnError controls whether MessageEach and its variants stop at the first field
+// that they can't decode, which is the default. When stop is false they behave as if
+// configured with WithCollectErrors instead.
+func WithStopOnError(stop bool) Option {
+	return func(o *options) {
+		o.collectErrors = !stop
+	}
+}
+
+// WithCollectErrors makes MessageEach and its variants continue past fields that they
+// can't decode but can determine the end of, and report every such field at the end of
+// the message instead of failing on the first one. This allows a validator to report all
+// of the problems with a message in a single pass. The fields are skipped without calling
+// the callback.
+//
+// The recoverable errors are field numbers rejected by WithAllowedFieldRange, fields that
+// exceed WithMaxMessageSize and unsupported groups. Any other error, such as a truncated
+// field, still stops the decode since there is no way to tell where the next field starts.
+// Either way, every error encountered is returned together as FieldErrors. Errors
+// returned by the callback are returned as is.
+func WithCollectErrors() Option {
+	return WithStopOnError(false)
+}
+
+// FieldError describes a field that couldn't be decoded by a decode configured with
+// WithCollectErrors.
+type FieldError struct {
+	// FieldNum is the number of the field, or 0 if its tag couldn't be decoded.
+	FieldNum int32
+	// Offset is the offset of the field's tag relative to the buffer's position when the
+	// decode started.
+	Offset int
+	Err    error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// FieldErrors is the error returned by decodes configured with WithCollectErrors. It lists
+// every field that couldn't be decoded in the order in which they occur, and matches any
+// target that one of them matches with errors.Is.
+type FieldErrors []*FieldError
+
+func (e FieldErrors) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "MessageEach: %d invalid fields", len(e))
+	for _, fieldErr := range e {
+		sb.WriteString("; ")
+		sb.WriteString(fieldErr.Error())
+	}
+	return sb.String()
+}
+
+func (e FieldErrors) Is(target error) bool {
+	for _, fieldErr := range e {
+		if errors.Is(fieldErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithRejectEmpty makes MessageEach and its variants fail with ErrEmptyMessage when the
+// buffer is empty. An empty buffer is a valid encoding of a message whose fields are all
+// unset, so it is accepted by default, but when a message is always expected to have
+// content an empty buffer usually means that the caller forgot to read the message body.
+func WithRejectEmpty() Option {
+	return func(o *options) {
+		o.rejectEmpty = true
+	}
+}
+
+// WithCopy makes functions that would otherwise return views over the buffer being
+// decoded, such as CollectMessages, return copies of the data instead. Copies remain
+// valid after the buffer is modified or reused at the cost of an allocation for each
+// one.
+func WithCopy() Option {
+	return func(o *options) {
+		o.copy = true
+	}
+}
+
+// WithAllowedFieldRange makes MessageEach and its variants fail with an error wrapping
+// ErrFieldOutOfRange when a field number is less than min or greater than max, or falls
+// in the range 19000 to 19999 that protobuf reserves for its own implementation. This is
+// a lightweight, schema-free way to reject input that uses field numbers set aside for
+// internal use. The check happens as soon as a field's tag has been read, before its
+// value is decoded.
+func WithAllowedFieldRange(min, max int32) Option {
+	return func(o *options) {
+		o.limitFieldRange = true
+		o.minField, o.maxField = min, max
+	}
+}
+
+// FieldHook is called by decodes configured with WithFieldHook for every field that they
+// read. bytes is the size of the field's entire encoding, including its tag.
+type FieldHook func(fieldNum int32, wireType codec.WireType, bytes int)
+
+// WithFieldHook makes MessageEach and its variants call hook for each field read from the
+// buffer, including groups passed over because of WithSkipUnknownWireTypes, before the
+// field is handed to the callback. This is intended for instrumentation, such as building
+// histograms of field sizes and frequencies across a corpus, and can't influence the
+// decode. There is no overhead when no hook is configured.
+func WithFieldHook(hook FieldHook) Option {
+	return func(o *options) {
+		o.fieldHook = hook
+	}
+}
+
+// Metrics receives aggregate statistics about the messages decoded by MessageEach and its
+// variants when configured with WithMetrics. Implementations typically forward them to a
+// metrics system such as Prometheus, for example as a histogram of message sizes and a
+// counter of errors, and must be safe for concurrent use if the option is shared.
+type Metrics interface {
+	// ObserveMessage is called when a decode finishes without error. fields is the number
+	// of fields that were passed to the callback and bytes is the number of bytes that
+	// were consumed, which is less than the size of the message if the callback stopped
+	// the iteration early.
+	ObserveMessage(fields int, bytes int)
+	// ObserveError is called with the error that a decode failed with, including errors
+	// returned by the callback.
+	ObserveError(err error)
+}
+
+// WithMetrics makes MessageEach and its variants report every decode to m. Nested
+// messages are only reported if they are decoded with the option too. There is no
+// overhead when no Metrics are configured.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// decodeState tracks the limits that span every nesting level of a single decode.
+type decodeState struct {
+	opts       *options
+	totalBytes int
+
+	// origin is the value of buffer.Len() when the current message started, which the
+	// offsets of fieldErrs are relative to.
+	origin    int
+	fieldErrs FieldErrors
+}
+
+func newDecodeState(opts []Option) decodeState {
+	return decodeState{opts: newOptions(opts)}
+}
+
+// checkFieldNum verifies that fieldNum is allowed by WithAllowedFieldRange.
+func (s *decodeState) checkFieldNum(fieldNum int32) error {
+	if !s.opts.limitFieldRange {
+		return nil
+	}
+	if fieldNum >= 19000 && fieldNum <= 19999 {
+		return fmt.Errorf("%w: %d is reserved", ErrFieldOutOfRange, fieldNum)
+	}
+	if fieldNum < s.opts.minField || fieldNum > s.opts.maxField {
+		return fmt.Errorf(
+			"%w: %d is not in [%d, %d]", ErrFieldOutOfRange, fieldNum, s.opts.minField, s.opts.maxField)
+	}
+	return nil
+}
+
+// checkValue verifies that value doesn't exceed any of the configured per-field limits.
+func (s *decodeState) checkValue(value Value) error {
+	if s.opts.maxMessageSize > 0 && len(value.Bytes) > s.opts.maxMessageSize {
+		return fmt.Errorf(
+			"%w: %d > %d", codec.ErrFieldTooLarge, len(value.Bytes), s.opts.maxMessageSize)
+	}
+	return nil
+}
+
+// observe reports a field that occupied n bytes to the configured FieldHook, if any.
+func (s *decodeState) observe(fieldNum int32, wireType codec.WireType, n int) {
+	if s.opts.fieldHook != nil {
+		s.opts.fieldHook(fieldNum, wireType, n)
+	}
+}
+
+// consume records that n more bytes have been decoded.
+func (s *decodeState) consume(n int) error {
+	s.totalBytes += n
+	if s.opts.maxTotalBytes > 0 && s.totalBytes > s.opts.maxTotalBytes {
+		return fmt.Errorf(
+			"%w: consumed %d bytes, limit is %d", ErrMaxTotalBytes, s.totalBytes, s.opts.maxTotalBytes)
+	}
+	return nil
+}
+
+// skipBadField records err for the field at fieldStart and skips the rest of the field with
+// skip, if not nil, when errors are being collected. It reports whether the decode can
+// continue with the next field.
+func (s *decodeState) skipBadField(fieldNum int32, fieldStart int, err error, skip func() error) bool {
+	if !s.opts.collectErrors {
+		return false
+	}
+	if skip != nil && skip() != nil {
+		return false
+	}
+	s.fieldErrs = append(s.fieldErrs, &FieldError{FieldNum: fieldNum, Offset: s.origin - fieldStart, Err: err})
+	return true
+}
+
+// failField returns the error that a decode which can't continue past err should fail with.
+func (s *decodeState) failField(fieldNum int32, fieldStart int, err error) error {
+	if !s.opts.collectErrors {
+		return err
+	}
+	s.fieldErrs = append(s.fieldErrs, &FieldError{FieldNum: fieldNum, Offset: s.origin - fieldStart, Err: err})
+	return s.fieldErrs
+}
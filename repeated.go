@@ -0,0 +1,521 @@
+package molecule
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Repack returns a copy of the message stored in buffer in which every occurrence of the
+// repeated scalar field fieldNum has been combined into a single packed field. The packed
+// field is emitted at the position of the field's first occurrence and all other fields
+// are copied byte for byte, which makes Repack useful for normalizing messages before
+// hashing or comparing them.
+//
+// Occurrences that are already packed are merged with unpacked ones in wire order. If
+// fieldNum is not present the message is returned unchanged. fieldType must be a scalar
+// type since length-delimited types can't be packed.
+//
+// The buffer is consumed.
+func Repack(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType) ([]byte, error) {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return nil, fmt.Errorf("Repack: %w", err)
+	}
+	if wireType == codec.WireBytes {
+		return nil, fmt.Errorf("Repack: field type %v can't be packed", fieldType)
+	}
+
+	msg := buffer.Bytes()
+	buffer.SkipToEnd()
+
+	// Collect every element of the field first since occurrences can be spread
+	// throughout the message.
+	var numbers []uint64
+	err = MessageEach(buffer.Nested(msg), func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		switch value.WireType {
+		case wireType:
+			numbers = append(numbers, value.Number)
+		case codec.WireBytes:
+			return true, PackedRepeatedEach(buffer.Nested(value.Bytes), fieldType, func(v Value) (bool, error) {
+				numbers = append(numbers, v.Number)
+				return true, nil
+			})
+		default:
+			return false, fmt.Errorf(
+				"field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Repack: %w", err)
+	}
+	if len(numbers) == 0 {
+		return append([]byte(nil), msg...), nil
+	}
+
+	packed := codec.NewBuffer(nil)
+	for _, n := range numbers {
+		switch wireType {
+		case codec.WireVarint:
+			packed.EncodeVarint(n)
+		case codec.WireFixed32:
+			packed.EncodeFixed32(n)
+		case codec.WireFixed64:
+			packed.EncodeFixed64(n)
+		}
+	}
+
+	var (
+		in      = codec.NewBuffer(msg)
+		out     = codec.NewBuffer(make([]byte, 0, len(msg)))
+		written bool
+	)
+	for !in.EOF() {
+		fieldStart := len(msg) - in.Len()
+		num, wt, err := in.DecodeTagAndWireType()
+		if err != nil {
+			return nil, fmt.Errorf("Repack: %w", err)
+		}
+		if err := in.SkipField(wt); err != nil {
+			return nil, fmt.Errorf("Repack: %w", err)
+		}
+		if num != fieldNum {
+			out.Write(msg[fieldStart : len(msg)-in.Len()])
+			continue
+		}
+		if !written {
+			out.EncodeTagAndWireType(fieldNum, codec.WireBytes)
+			out.EncodeRawBytes(packed.Bytes())
+			written = true
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// RepeatedEach calls fn for each element of the repeated field fieldNum of type
+// fieldType in the message stored in buffer, in wire order.
+//
+// Scalar fields may be encoded packed, unpacked, or even a mix of both (parsers are
+// required to accept either) and RepeatedEach handles all of them. Fields of a
+// length-delimited type (string, bytes and messages) are never packed, so each of their
+// occurrences is a single element.
+//
+// The buffer is not advanced.
+func RepeatedEach(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType, fn PackedRepeatedEachFn) error {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return fmt.Errorf("RepeatedEach: %w", err)
+	}
+
+	return lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		switch value.WireType {
+		case wireType:
+			return fn(value)
+		case codec.WireBytes:
+			return packedEach("RepeatedEach", buffer, fieldNum, value, wireType, fn)
+		default:
+			return false, fmt.Errorf(
+				"RepeatedEach: field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+	})
+}
+
+// PackedField calls fn for each element of the packed repeated field fieldNum of type
+// fieldType in the message stored in buffer, in wire order. Unlike PackedRepeatedEach,
+// buffer holds the entire message rather than just the contents of the field: PackedField
+// locates the field and reads its length prefix itself. If the field occurs more than
+// once the elements of every occurrence are visited, as if they had been concatenated.
+//
+// Every occurrence of the field must be packed. Use RepeatedEach to also accept unpacked
+// elements.
+//
+// The buffer is not advanced.
+func PackedField(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType, fn PackedRepeatedEachFn) error {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return fmt.Errorf("PackedField: %w", err)
+	}
+	if wireType == codec.WireBytes {
+		return fmt.Errorf("PackedField: field type %v can't be packed", fieldType)
+	}
+
+	return lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		if value.WireType != codec.WireBytes {
+			return false, fmt.Errorf(
+				"PackedField: field %d: expected wiretype %d, got: %d", fieldNum, codec.WireBytes, value.WireType)
+		}
+		return packedEach("PackedField", buffer, fieldNum, value, wireType, fn)
+	})
+}
+
+// IsPacked reports whether the first occurrence of the repeated scalar field fieldNum of
+// type fieldType in the message stored in buffer is packed. It returns false if the
+// field is absent.
+//
+// Parsers must accept packed and unpacked elements for any repeated scalar field, and
+// both encodings may legitimately appear in the same message, so the first occurrence
+// doesn't determine how later occurrences are encoded. Use RepeatedEach to handle every
+// combination.
+//
+// The buffer is not advanced.
+func IsPacked(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType) (bool, error) {
+	wireType, err := wireTypeForFieldType(fieldType)
+	if err != nil {
+		return false, fmt.Errorf("IsPacked: %w", err)
+	}
+	if wireType == codec.WireBytes {
+		return false, fmt.Errorf("IsPacked: field type %v can't be packed", fieldType)
+	}
+
+	var (
+		first Value
+		found bool
+	)
+	err = lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num == fieldNum {
+			first, found = value, true
+		}
+		return !found, nil
+	})
+	if err != nil || !found {
+		return false, err
+	}
+	switch first.WireType {
+	case codec.WireBytes:
+		return true, nil
+	case wireType:
+		return false, nil
+	default:
+		return false, fmt.Errorf(
+			"IsPacked: field %d: expected wiretype %d, got: %d", fieldNum, wireType, first.WireType)
+	}
+}
+
+// packedEach calls fn for each element of the packed occurrence value of fieldNum,
+// whose elements are encoded with wireType, decoding them with the settings of parent,
+// the buffer that value was read from. It returns false if fn stopped the iteration, and
+// returns fn's errors as is.
+func packedEach(
+	funcName string, parent *codec.Buffer, fieldNum int32, value Value, wireType codec.WireType,
+	fn PackedRepeatedEachFn,
+) (bool, error) {
+	elements := parent.Nested(value.Bytes)
+	for i := 0; !elements.EOF(); i++ {
+		element, err := readValueFromBuffer(wireType, elements)
+		if err != nil {
+			return false, fmt.Errorf("%s: field %d: element %d: %w", funcName, fieldNum, i, err)
+		}
+		if shouldContinue, err := fn(element); err != nil || !shouldContinue {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RepeatedEachIndexedFn is a function that is called for each element of a repeated field
+// along with the element's 0-based index.
+type RepeatedEachIndexedFn func(index int, value Value) (bool, error)
+
+// RepeatedEachIndexed is like RepeatedEach except that fn also receives the index of
+// each element. Indexes are contiguous across every occurrence of the field, regardless
+// of whether each occurrence was packed or unpacked.
+//
+// The buffer is not advanced.
+func RepeatedEachIndexed(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType, fn RepeatedEachIndexedFn) error {
+	var index int
+	return RepeatedEach(buffer, fieldNum, fieldType, func(value Value) (bool, error) {
+		shouldContinue, err := fn(index, value)
+		index++
+		return shouldContinue, err
+	})
+}
+
+// CollectRepeated returns every element of the repeated field fieldNum of type fieldType
+// in the message stored in buffer. See RepeatedEach for how packed and unpacked encodings
+// are handled: whether a length-delimited occurrence is treated as a packed run of
+// elements depends on fieldType, so each occurrence of a string, bytes or message field
+// is returned as a single element even if its contents happen to parse as packed
+// scalars.
+//
+// The Bytes of each returned Value are an unsafe view over the buffer. The buffer is not
+// advanced.
+func CollectRepeated(buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType) ([]Value, error) {
+	var values []Value
+	err := RepeatedEach(buffer, fieldNum, fieldType, func(v Value) (bool, error) {
+		values = append(values, v)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// CollectMessages returns a Buffer for each occurrence of the repeated message field
+// fieldNum in the message stored in buffer, in wire order.
+//
+// By default every returned Buffer is a view over buffer's backing slice, so collecting
+// the elements allocates the same small, fixed amount of memory no matter how many there
+// are, but the Buffers are only valid for as long as the backing slice is neither
+// modified nor reused. Pass WithCopy to give each Buffer its own copy of its message
+// instead.
+//
+// The buffer is not advanced.
+func CollectMessages(buffer *codec.Buffer, fieldNum int32, opts ...Option) ([]*codec.Buffer, error) {
+	o := newOptions(opts)
+	count, err := CountField(buffer, fieldNum)
+	if err != nil {
+		return nil, fmt.Errorf("CollectMessages: %w", err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	// Sizing the Buffers up front and storing them contiguously keeps the number of
+	// allocations constant.
+	buffers := make([]codec.Buffer, 0, count)
+	err = lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		if value.WireType != codec.WireBytes {
+			return false, fmt.Errorf(
+				"CollectMessages: field %d: expected wiretype %d, got: %d", fieldNum, codec.WireBytes, value.WireType)
+		}
+		b := value.Bytes
+		if o.copy {
+			b = append([]byte(nil), b...)
+		}
+		// Cap each view so that encoding to one Buffer can't overwrite the next message.
+		buffers = append(buffers, *codec.NewBuffer(b[:len(b):len(b)]))
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*codec.Buffer, len(buffers))
+	for i := range buffers {
+		result[i] = &buffers[i]
+	}
+	return result, nil
+}
+
+// CollectInt32s returns the elements of the repeated int32 field fieldNum in the message
+// stored in buffer. Negative values are encoded as sign-extended varints which are
+// truncated back to 32 bits. The buffer is not advanced.
+func CollectInt32s(buffer *codec.Buffer, fieldNum int32) ([]int32, error) {
+	var result []int32
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_INT32, func(v Value) (bool, error) {
+		i, err := v.AsInt32()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectInt64s returns the elements of the repeated int64 field fieldNum in the message
+// stored in buffer. The buffer is not advanced.
+func CollectInt64s(buffer *codec.Buffer, fieldNum int32) ([]int64, error) {
+	var result []int64
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_INT64, func(v Value) (bool, error) {
+		i, err := v.AsInt64()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectSint32s returns the elements of the repeated zig-zag encoded sint32 field
+// fieldNum in the message stored in buffer. The buffer is not advanced.
+func CollectSint32s(buffer *codec.Buffer, fieldNum int32) ([]int32, error) {
+	var result []int32
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_SINT32, func(v Value) (bool, error) {
+		i, err := v.AsSint32()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectSint64s returns the elements of the repeated zig-zag encoded sint64 field
+// fieldNum in the message stored in buffer. The buffer is not advanced.
+func CollectSint64s(buffer *codec.Buffer, fieldNum int32) ([]int64, error) {
+	var result []int64
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_SINT64, func(v Value) (bool, error) {
+		i, err := v.AsSint64()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectSfixed32s returns the elements of the repeated sfixed32 field fieldNum in the
+// message stored in buffer. The buffer is not advanced.
+func CollectSfixed32s(buffer *codec.Buffer, fieldNum int32) ([]int32, error) {
+	var result []int32
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_SFIXED32, func(v Value) (bool, error) {
+		i, err := v.AsSFixed32()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectSfixed64s returns the elements of the repeated sfixed64 field fieldNum in the
+// message stored in buffer. The buffer is not advanced.
+func CollectSfixed64s(buffer *codec.Buffer, fieldNum int32) ([]int64, error) {
+	var result []int64
+	err := RepeatedEach(buffer, fieldNum, codec.FieldType_SFIXED64, func(v Value) (bool, error) {
+		i, err := v.AsSFixed64()
+		result = append(result, i)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CollectFixed64s returns the elements of the repeated fixed64 field fieldNum in the
+// message stored in buffer, in wire order. Occurrences may be packed or unpacked. Packed
+// occurrences are a plain little-endian array of elements, so rather than being decoded
+// one element at a time they are copied into the result in bulk, which is considerably
+// faster for large arrays. Packed occurrences whose length isn't a multiple of 8 are
+// rejected with an error wrapping codec.ErrBadLength.
+//
+// The bits of double and sfixed64 fields can be collected in the same way and converted
+// with math.Float64frombits or int64. The buffer is not advanced.
+func CollectFixed64s(buffer *codec.Buffer, fieldNum int32) ([]uint64, error) {
+	return collectFixed[uint64]("CollectFixed64s", buffer, fieldNum, codec.FieldType_FIXED64, 8)
+}
+
+// CollectFixed32s is the fixed32 counterpart to CollectFixed64s. Packed occurrences whose
+// length isn't a multiple of 4 are rejected with an error wrapping codec.ErrBadLength.
+//
+// The bits of float and sfixed32 fields can be collected in the same way and converted
+// with math.Float32frombits or int32. The buffer is not advanced.
+func CollectFixed32s(buffer *codec.Buffer, fieldNum int32) ([]uint32, error) {
+	return collectFixed[uint32]("CollectFixed32s", buffer, fieldNum, codec.FieldType_FIXED32, 4)
+}
+
+// collectFixed implements CollectFixed64s and CollectFixed32s for elements of size bytes.
+func collectFixed[T uint32 | uint64](
+	funcName string, buffer *codec.Buffer, fieldNum int32, fieldType codec.FieldType, size int,
+) ([]T, error) {
+	// Counting first validates the lengths of the packed occurrences and allows the result
+	// to be allocated once.
+	count, err := CountRepeated(buffer, fieldNum, fieldType)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", funcName, err)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	result := make([]T, 0, count)
+	err = lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		if value.WireType != codec.WireBytes {
+			// CountRepeated has already verified the wire type.
+			result = append(result, T(value.Number))
+			return true, nil
+		}
+		n := len(value.Bytes) / size
+		if n == 0 {
+			return true, nil
+		}
+		elements := result[len(result) : len(result)+n]
+		if nativeLittleEndian {
+			copy(unsafe.Slice((*byte)(unsafe.Pointer(&elements[0])), len(value.Bytes)), value.Bytes)
+		} else {
+			for i := range elements {
+				b := value.Bytes[i*size:]
+				if size == 8 {
+					elements[i] = T(binary.LittleEndian.Uint64(b))
+				} else {
+					elements[i] = T(binary.LittleEndian.Uint32(b))
+				}
+			}
+		}
+		result = result[:len(result)+n]
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// nativeLittleEndian is whether the host stores integers in little-endian byte order, in
+// which case packed fixed-width elements can be copied straight into memory.
+var nativeLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// CollectBools returns the elements of the repeated bool field fieldNum in the message
+// stored in buffer, in wire order. Occurrences may be packed or unpacked. The buffer is
+// not advanced.
+func CollectBools(buffer *codec.Buffer, fieldNum int32) ([]bool, error) {
+	var result []bool
+	appendBool := func(v Value) (bool, error) {
+		b, err := v.AsBool()
+		result = append(result, b)
+		return err == nil, err
+	}
+	err := lookupEach(buffer, func(num int32, value Value) (bool, error) {
+		if num != fieldNum {
+			return true, nil
+		}
+		switch value.WireType {
+		case codec.WireVarint:
+			return appendBool(value)
+		case codec.WireBytes:
+			// Every element occupies at least one byte and a canonical bool exactly one,
+			// so the length of the packed occurrence bounds the number of elements.
+			if n := len(result) + len(value.Bytes); n > cap(result) {
+				grown := make([]bool, len(result), n)
+				copy(grown, result)
+				result = grown
+			}
+			return packedEach("CollectBools", buffer, fieldNum, value, codec.WireVarint, appendBool)
+		default:
+			return false, fmt.Errorf(
+				"CollectBools: field %d: expected wiretype %d, got: %d", fieldNum, codec.WireVarint, value.WireType)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// ReplaceField returns a copy of the message stored in buffer in which the first
+// occurrence of fieldNum is replaced by newTagAndValue, or with newTagAndValue appended if
+// the field doesn't occur. Every other field, including later occurrences of fieldNum, is
+// copied byte for byte.
+//
+// newTagAndValue must be the complete encoding of a single occurrence of fieldNum,
+// including its tag. The buffer is consumed.
+func ReplaceField(buffer *codec.Buffer, fieldNum int32, newTagAndValue []byte) ([]byte, error) {
+	if err := checkSingleField(newTagAndValue, fieldNum); err != nil {
+		return nil, fmt.Errorf("ReplaceField: %w", err)
+	}
+
+	msg := buffer.Bytes()
+	buffer.SkipToEnd()
+
+	scanner := NewScanner(codec.NewBuffer(msg))
+	start, end := len(msg), len(msg)
+	for scanner.Scan() {
+		if scanner.FieldNum() == fieldNum {
+			start, end = scanner.FieldSpan()
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReplaceField: %w", err)
+	}
+
+	out := make([]byte, 0, len(msg)-(end-start)+len(newTagAndValue))
+	out = append(out, msg[:start]...)
+	out = append(out, newTagAndValue...)
+	return append(out, msg[end:]...), nil
+}
+
+// checkSingleField returns an error unless b holds exactly one occurrence of fieldNum.
+func checkSingleField(b []byte, fieldNum int32) error {
+	scanner := NewScanner(codec.NewBuffer(b))
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("expected an encoded field %d, got no fields", fieldNum)
+	}
+	if scanner.FieldNum() != fieldNum {
+		return fmt.Errorf("expected an encoded field %d, got field %d", fieldNum, scanner.FieldNum())
+	}
+	if _, end := scanner.FieldSpan(); end != len(b) {
+		return fmt.Errorf("expected a single encoded field %d, got %d trailing bytes", fieldNum, len(b)-end)
+	}
+	return nil
+}
+
+// TransformFn is a function that is called by Transform for each field of the input
+// message and encodes any number of fields into out in its place.
+type TransformFn func(fieldNum int32, value Value, out *codec.Encoder) error
+
+// Transform is a streaming map and filter over the top-level fields of the message stored
+// in in: fn is called with each field in turn and encodes whatever should replace it into
+// out. A field can be kept with value.EncodeTo(out, fieldNum), renamed by encoding it
+// under another field number, duplicated by encoding it more than once, or dropped by not
+// encoding anything. Fields are appended to out, so out must not share its backing array
+// with in.
+//
+// Errors returned by fn stop the transform and are returned as is. The Bytes of each
+// Value are an unsafe view over in. The input buffer is consumed.
+func Transform(in *codec.Buffer, out *codec.Encoder, fn TransformFn, opts ...Option) error {
+	var fnErr error
+	err := MessageEach(in, func(fieldNum int32, value Value) (bool, error) {
+		fnErr = fn(fieldNum, value, out)
+		return fnErr == nil, fnErr
+	}, opts...)
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("Transform: %w", err)
+	}
+	return nil
+}
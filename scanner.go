@@ -0,0 +1,163 @@
+package molecule
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Scanner provides a pull-based alternative to MessageEach for iterating over the
+// top-level fields of a message. Successive calls to Scan step through the fields, and
+// FieldNum and Value return the field that was just read:
+//
+//	scanner := molecule.NewScanner(buffer)
+//	for scanner.Scan() {
+//		switch scanner.FieldNum() {
+//		...
+//		}
+//	}
+//	if err := scanner.Err(); err != nil {
+//		...
+//	}
+//
+// The Scanner consumes the buffer as it goes.
+type Scanner struct {
+	buffer *codec.Buffer
+	state  decodeState
+	// origin is the value of buffer.Len() when the Scanner was created, which spans are
+	// relative to.
+	origin int
+
+	fieldNum   int32
+	value      Value
+	start, end int
+	err        error
+}
+
+// NewScanner returns a Scanner that reads the fields of the message stored in buffer.
+func NewScanner(buffer *codec.Buffer, opts ...Option) *Scanner {
+	s := &Scanner{
+		buffer: buffer,
+		state:  newDecodeState(opts),
+		origin: buffer.Len(),
+	}
+	s.state.origin = s.origin
+	return s
+}
+
+// Scan advances to the next field, which is then available through FieldNum, Value and
+// FieldSpan. It returns false once there are no more fields or an error occurs, after
+// which Err reports the error, if any.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	fieldNum, value, fieldStart, err := nextField(s.buffer, &s.state)
+	if err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		s.fieldNum, s.value = 0, Value{}
+		return false
+	}
+	s.fieldNum, s.value = fieldNum, value
+	s.start, s.end = s.origin-fieldStart, s.origin-s.buffer.Len()
+	return true
+}
+
+// FieldNum returns the number of the field most recently read by Scan.
+func (s *Scanner) FieldNum() int32 {
+	return s.fieldNum
+}
+
+// Value returns the value of the field most recently read by Scan. Its Bytes are an
+// unsafe view over the buffer.
+func (s *Scanner) Value() Value {
+	return s.value
+}
+
+// FieldSpan returns the byte range, including its tag, that the field most recently read
+// by Scan occupies in the buffer. Offsets are relative to the buffer's position when the
+// Scanner was created, so the field's encoding is data[start:end] where data is the result
+// of calling buffer.Bytes() before creating the Scanner. This allows tools that rewrite
+// messages to collect the spans of the fields they want to keep or replace.
+func (s *Scanner) FieldSpan() (start, end int) {
+	return s.start, s.end
+}
+
+// Offset returns the offset just past the field most recently read by Scan, relative to
+// the buffer's position when the Scanner was created, or 0 before the first call to Scan.
+// Once Scan returns false Offset still refers to the end of the last field that was read
+// successfully, so it never points into the middle of a field.
+//
+// This allows long running consumers to checkpoint their progress through a large
+// message: after handling a field they can record Offset, and later resume by creating a
+// Scanner over the same data with the first Offset bytes skipped, for example with
+// buffer.Skip(offset). Each resumed offset is again relative to the skipped position.
+func (s *Scanner) Offset() int {
+	return s.end
+}
+
+// Err returns the first error that occurred while scanning, or nil if the end of the
+// message was reached without error.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// FieldSpanAtPath returns the byte range that the field at path occupies in the message
+// stored in buffer, including the field's tag and, for length-delimited fields, its
+// length prefix. path lists the field numbers to follow from the top-level message down
+// to the field, so every element but the last must name a nested message field. Offsets
+// are relative to the buffer's position, so the field's encoding is data[start:end]
+// where data is the result of calling buffer.Bytes(). Since that encoding is a message
+// with a single field, it can be parsed on its own, which makes it suitable for hashing
+// or signing a subtree of a message.
+//
+// If a field on the path occurs more than once the last occurrence is followed, matching
+// the protobuf semantics for singular fields. found is false if any field on the path is
+// absent.
+//
+// The buffer is not advanced.
+func FieldSpanAtPath(buffer *codec.Buffer, path []int32) (start, end int, found bool, err error) {
+	if len(path) == 0 {
+		return 0, 0, false, errors.New("FieldSpanAtPath: empty path")
+	}
+
+	// base is the offset of the message being scanned relative to buffer.
+	var base int
+	message := buffer.CloneStable()
+	for depth, fieldNum := range path {
+		var (
+			scanner = NewScanner(message)
+			value   Value
+		)
+		found = false
+		for scanner.Scan() {
+			if scanner.FieldNum() == fieldNum {
+				start, end = scanner.FieldSpan()
+				value, found = scanner.Value(), true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, 0, false, fmt.Errorf("FieldSpanAtPath: path %v: %w", path[:depth], err)
+		}
+		if !found {
+			return 0, 0, false, nil
+		}
+		start, end = base+start, base+end
+		if depth == len(path)-1 {
+			break
+		}
+
+		if value.WireType != codec.WireBytes {
+			return 0, 0, false, fmt.Errorf(
+				"FieldSpanAtPath: path %v: expected wiretype %d, got: %d", path[:depth+1], codec.WireBytes, value.WireType)
+		}
+		// The nested message is at the end of the field, after its tag and length.
+		base = end - len(value.Bytes)
+		message = message.Nested(value.Bytes)
+	}
+	return start, end, true, nil
+}
@@ -0,0 +1,115 @@
+package molecule
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Schema describes the shape of a message without a protobuf descriptor by mapping the
+// number of each field of interest to its FieldSpec. It is written as a plain Go literal:
+//
+//	schema := molecule.Schema{
+//		1: {Type: codec.FieldType_STRING},
+//		2: {Type: codec.FieldType_MESSAGE, Repeated: true, Nested: molecule.Schema{
+//			1: {Type: codec.FieldType_INT64},
+//		}},
+//	}
+//
+// A Schema may refer to itself to describe recursive messages.
+type Schema map[int32]FieldSpec
+
+// FieldSpec describes a single field of a Schema.
+type FieldSpec struct {
+	// Type is the declared type of the field. Groups aren't supported.
+	Type codec.FieldType
+	// Repeated is set for repeated fields.
+	Repeated bool
+	// Nested is the schema of the field's message for fields of type
+	// codec.FieldType_MESSAGE. If it is nil the message is returned as its encoded bytes.
+	Nested Schema
+}
+
+// DecodeSchema decodes the message stored in buffer using schema. It sits between
+// DecodeTyped, which takes the declared type of each field but leaves nested messages
+// encoded, and a full protobuf descriptor: each field is returned as the same Go type as
+// DecodeTyped returns for it, except that message fields with a Nested schema are
+// decoded recursively into a map[int32]interface{} of their own.
+//
+// Repeated fields are always returned as a []interface{} of elements in wire order,
+// whether they are packed, unpacked or both, while only the last occurrence of a
+// singular field is returned. Fields that are absent from the message, and fields that
+// aren't in the schema, are left out of the result. Every returned value is a copy that
+// doesn't alias the buffer. Since a Schema may be recursive, an error wrapping
+// ErrMaxDepth is returned for messages nested more than DefaultMaxDepth levels deep.
+//
+// The buffer is consumed.
+func DecodeSchema(buffer *codec.Buffer, schema Schema) (map[int32]interface{}, error) {
+	result, err := decodeSchema(buffer, schema, 1)
+	if err != nil {
+		return nil, fmt.Errorf("DecodeSchema: %w", err)
+	}
+	return result, nil
+}
+
+// decodeSchema implements DecodeSchema for the message at the given depth. Errors are
+// prefixed with the path of field numbers that leads to the field that couldn't be decoded.
+func decodeSchema(buffer *codec.Buffer, schema Schema, depth int) (map[int32]interface{}, error) {
+	result := make(map[int32]interface{}, len(schema))
+	add := func(fieldNum int32, spec FieldSpec, v interface{}) {
+		if !spec.Repeated {
+			result[fieldNum] = v
+			return
+		}
+		elements, _ := result[fieldNum].([]interface{})
+		result[fieldNum] = append(elements, v)
+	}
+
+	err := MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		spec, ok := schema[fieldNum]
+		if !ok {
+			return true, nil
+		}
+		wireType, err := wireTypeForFieldType(spec.Type)
+		if err != nil || spec.Type == codec.FieldType_GROUP {
+			return false, fmt.Errorf("field %d: unsupported field type %v", fieldNum, spec.Type)
+		}
+
+		if wireType != codec.WireBytes && value.WireType == codec.WireBytes {
+			err := PackedRepeatedEach(buffer.Nested(value.Bytes), spec.Type, func(element Value) (bool, error) {
+				v, err := decodeTypedValue(spec.Type, element)
+				if err != nil {
+					return false, err
+				}
+				add(fieldNum, spec, v)
+				return true, nil
+			})
+			if err != nil {
+				return false, fmt.Errorf("field %d: %w", fieldNum, err)
+			}
+			return true, nil
+		}
+		if value.WireType != wireType {
+			return false, fmt.Errorf("field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+
+		var v interface{}
+		switch {
+		case spec.Type == codec.FieldType_MESSAGE && spec.Nested != nil && depth >= DefaultMaxDepth:
+			err = fmt.Errorf("%w: messages nested more than %d deep", ErrMaxDepth, DefaultMaxDepth)
+		case spec.Type == codec.FieldType_MESSAGE && spec.Nested != nil:
+			v, err = decodeSchema(buffer.Nested(value.Bytes), spec.Nested, depth+1)
+		default:
+			v, err = decodeTypedValue(spec.Type, value)
+		}
+		if err != nil {
+			return false, fmt.Errorf("field %d: %w", fieldNum, err)
+		}
+		add(fieldNum, spec, v)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
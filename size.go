@@ -0,0 +1,77 @@
+package molecule
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// MessageSize walks the message stored in buffer and returns the total number of fields
+// in it, including the fields of every nested message, along with the number of bytes
+// that the message occupies. This is useful for cheap metrics and for sizing
+// preallocations before decoding or re-encoding a message.
+//
+// Since molecule has no schema, a length-delimited field is treated as a nested message
+// whenever its contents parse as one. Strings and bytes fields that happen to be valid
+// messages are therefore counted as messages too. Messages nested more than
+// DefaultMaxDepth levels deep are counted as opaque bytes rather than recursed into.
+// MessageSize does not allocate for each field.
+//
+// The buffer is consumed.
+func MessageSize(buffer *codec.Buffer) (fields int, bytes int, err error) {
+	bytes = buffer.Len()
+	err = MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		fields++
+		if value.WireType == codec.WireBytes {
+			if nested, ok := countFields(buffer, value.Bytes, 2); ok {
+				fields += nested
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("MessageSize: %w", err)
+	}
+	return fields, bytes, nil
+}
+
+// countFields returns the number of fields in b, the message at the given depth,
+// including the fields of every nested message down to DefaultMaxDepth, and whether b
+// parsed as a message at all. b is read with the settings of parent. Failure is reported
+// with a bool rather than an error so that speculatively parsing bytes that turn out not
+// to be a message doesn't allocate.
+func countFields(parent *codec.Buffer, b []byte, depth int) (int, bool) {
+	var (
+		buffer = parent.Nested(b)
+		fields int
+	)
+	for !buffer.EOF() {
+		tag, err := buffer.DecodeVarint()
+		if err != nil || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return 0, false
+		}
+		fields++
+
+		switch wireType := codec.WireType(tag & 7); wireType {
+		case codec.WireBytes:
+			nested, err := buffer.DecodeRawBytes(false)
+			if err != nil {
+				return 0, false
+			}
+			if depth >= DefaultMaxDepth {
+				break
+			}
+			if n, ok := countFields(buffer, nested, depth+1); ok {
+				fields += n
+			}
+		case codec.WireVarint, codec.WireFixed32, codec.WireFixed64:
+			if err := buffer.SkipField(wireType); err != nil {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+	}
+	return fields, true
+}
@@ -0,0 +1,104 @@
+package molecule
+
+import (
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// Snapshot is an immutable, eagerly decoded view of the top-level fields of a message.
+//
+// Unlike the Values passed to a MessageEachFn, the Values held by a Snapshot do not alias
+// the buffer they were decoded from so the buffer may be reset or reused as soon as the
+// Snapshot has been created. A Snapshot is safe for concurrent use by multiple goroutines
+// as long as callers do not modify the Values (or their Bytes) that it returns.
+//
+// Creating a Snapshot allocates, so it should only be used when the convenience of
+// sharing the decoded fields outweighs the cost.
+type Snapshot struct {
+	fields map[int32][]Value
+	order  []int32
+}
+
+// NewSnapshot decodes every top-level field in the message stored in buffer into a new
+// Snapshot. The buffer is consumed.
+func NewSnapshot(buffer *codec.Buffer, opts ...Option) (*Snapshot, error) {
+	// Copy the remaining bytes once so that every value can alias the copy instead of
+	// allocating for each individual field.
+	owned := codec.NewBuffer(append([]byte(nil), buffer.Bytes()...))
+	buffer.SkipToEnd()
+
+	s := &Snapshot{fields: map[int32][]Value{}}
+	err := MessageEach(owned, func(fieldNum int32, value Value) (bool, error) {
+		values, ok := s.fields[fieldNum]
+		if !ok {
+			s.order = append(s.order, fieldNum)
+		}
+		s.fields[fieldNum] = append(values, value)
+		return true, nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseOwned decodes every top-level field in the message stored in data into a new
+// Snapshot whose Values own their bytes, so data may be modified or reused as soon as
+// ParseOwned returns. It is the safe entry point for callers who want to parse a message
+// once and then hold on to its values, and who are willing to trade an allocation for
+// not having to reason about the lifetime of data.
+//
+// Unlike NewSnapshot, which copies the whole message, only the contents of
+// length-delimited fields are copied, into a single allocation that is shared by every
+// Value. Tags and scalar values are decoded in place.
+func ParseOwned(data []byte, opts ...Option) (*Snapshot, error) {
+	s := &Snapshot{fields: map[int32][]Value{}}
+	var size int
+	err := MessageEach(codec.NewBuffer(data), func(fieldNum int32, value Value) (bool, error) {
+		values, ok := s.fields[fieldNum]
+		if !ok {
+			s.order = append(s.order, fieldNum)
+		}
+		s.fields[fieldNum] = append(values, value)
+		size += len(value.Bytes)
+		return true, nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	owned := make([]byte, 0, size)
+	for _, values := range s.fields {
+		for i := range values {
+			if values[i].Bytes == nil {
+				continue
+			}
+			start := len(owned)
+			owned = append(owned, values[i].Bytes...)
+			// Cap each value so that appending to it can't clobber the next one.
+			values[i].Bytes = owned[start:len(owned):len(owned)]
+		}
+	}
+	return s, nil
+}
+
+// Get returns the value of fieldNum. If the field occurred more than once the last
+// occurrence is returned, matching the protobuf semantics for singular fields.
+func (s *Snapshot) Get(fieldNum int32) (Value, bool) {
+	values := s.fields[fieldNum]
+	if len(values) == 0 {
+		return Value{}, false
+	}
+	return values[len(values)-1], true
+}
+
+// All returns every occurrence of fieldNum in the order they were encoded.
+func (s *Snapshot) All(fieldNum int32) []Value {
+	values := s.fields[fieldNum]
+	// Cap the slice so that appending to it can't clobber the Snapshot's state.
+	return values[:len(values):len(values)]
+}
+
+// Fields returns the distinct field numbers present in the Snapshot in the order that
+// they first occurred.
+func (s *Snapshot) Fields() []int32 {
+	return append([]int32(nil), s.order...)
+}
@@ -3,6 +3,7 @@
 package codec
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -13,9 +14,122 @@ import (
 // Its operation is similar to that of a bytes.Buffer: writing pushes
 // data to the end of the buffer while reading pops data from the head
 // of the buffer. So the same buffer can be used to both read and write.
+//
+// The buffer therefore has two independent cursors. Reads start at the
+// read position, which only moves forward as data is decoded or skipped,
+// while every Encode method and Write appends after the last byte in the
+// buffer, growing it on demand, so encoding never disturbs data that
+// hasn't been read yet. To encode a new message from scratch call
+// Reset(nil), or Reset(b[:0]) to reuse the capacity of b, which moves
+// both cursors to the start of the buffer. Callers that only encode can
+// use an Encoder instead, which also writes groups and packed fields.
+//
+// Buffers created by NewBufferFromReaderAt are read-only and encoding to
+// them fails with ErrReadOnly. Take care when encoding to a buffer whose
+// initial contents are a sub-slice of a larger array: appending overwrites
+// whatever follows the sub-slice in the array unless its capacity has
+// been limited, as it is for the buffers returned by Sub and
+// ReadGroupBuffer.
 type Buffer struct {
 	buf   []byte
 	index int
+
+	maxFieldLength int
+	allocBytes     func(n int) []byte
+	// byteOrder is nil for the standard little-endian encoding.
+	byteOrder binary.ByteOrder
+	copyBytes bool
+
+	// The following fields are only used by buffers created with
+	// NewBufferFromReaderAt, in which case buf is a window over the bytes
+	// of src starting at offset base.
+	src     io.ReaderAt
+	srcSize int
+	base    int
+	// srcErr is returned by every read when src can't be decoded at all.
+	srcErr error
+	// While pinned, bytes at or after the offset pin in src are never
+	// discarded from the window.
+	pinned bool
+	pin    int
+	// sharedWindow is set when the window may be in use by another buffer
+	// so it must not be overwritten.
+	sharedWindow bool
+	// stableWindows is set for buffers returned by CloneStable, which never
+	// overwrite a window that they have read from.
+	stableWindows bool
+}
+
+// BufferOption configures a Buffer created with NewBufferWithOptions or
+// NewBufferFromReaderAt.
+type BufferOption func(*Buffer)
+
+// WithByteAllocator makes the buffer call alloc, instead of make, to obtain
+// the slices that DecodeRawBytes and ReadGroup copy data into when their
+// alloc argument is true. alloc must return a slice with a length of at
+// least n, only the first n bytes of which are used. This allows the copies
+// to be pooled or carved out of an arena. The allocator is retained across
+// calls to Reset.
+func WithByteAllocator(alloc func(n int) []byte) BufferOption {
+	return func(cb *Buffer) {
+		cb.allocBytes = alloc
+	}
+}
+
+// WithByteOrder makes DecodeFixed32 and DecodeFixed64 read fixed-width
+// values in the given byte order.
+//
+// WARNING: the protobuf encoding is always little-endian, so this option
+// exists only to parse non-conformant data from encoders that emit
+// fixed32, fixed64, sfixed32, sfixed64, float and double values in a
+// different byte order. Never use it for data produced by a protobuf
+// library. It only affects decoding: encoding is always little-endian.
+// Buffers over the bytes of nested messages or packed fields need the
+// option too, so create them with Nested, which inherits it. The byte
+// order is retained across calls to Reset.
+func WithByteOrder(order binary.ByteOrder) BufferOption {
+	return func(cb *Buffer) {
+		if order == binary.LittleEndian {
+			// Keep the default fast path.
+			order = nil
+		}
+		cb.byteOrder = order
+	}
+}
+
+// WithDefaultCopyBytes sets whether the higher-level helpers that decode
+// length-delimited values on the caller's behalf, such as MessageEach and
+// the collectors in package molecule, copy the values out of the buffer. By
+// default they don't, so the values are views that are only valid for as
+// long as the buffer's data is neither modified nor reused, which is what
+// allocation-sensitive callers want. Callers that prefer safety can make
+// them copy instead, at the cost of an allocation per value, which is
+// obtained from the allocator set with WithByteAllocator if there is one.
+//
+// The explicit alloc argument of DecodeRawBytes and ReadGroup is unaffected.
+// Like WithByteOrder, the option is retained across calls to Reset and
+// inherited by Clone, Sub, Nested and ReadGroupBuffer, but not by buffers
+// that callers create over the bytes of nested messages with NewBuffer.
+func WithDefaultCopyBytes(copy bool) BufferOption {
+	return func(cb *Buffer) {
+		cb.copyBytes = copy
+	}
+}
+
+// CopiesBytes returns whether the buffer was configured to copy decoded
+// values by default with WithDefaultCopyBytes.
+func (cb *Buffer) CopiesBytes() bool {
+	return cb.copyBytes
+}
+
+// ByteOrder returns the byte order that the buffer reads fixed-width
+// values in, which is little-endian unless it was configured otherwise
+// with WithByteOrder.
+func (cb *Buffer) ByteOrder() binary.ByteOrder {
+	if cb.byteOrder == nil {
+		return binary.LittleEndian
+	}
+	return cb.byteOrder
 }
 
 // NewBuffer creates a new buffer with the given slice of bytes as the
@@ -24,11 +138,119 @@ func NewBuffer(buf []byte) *Buffer {
 	return &Buffer{buf: buf}
 }
 
-// Reset resets this buffer back to empty. Any subsequent writes/encodes
-// to the buffer will allocate a new backing slice of bytes.
+// NewBufferWithOptions is like NewBuffer except that the buffer is also
+// configured with opts. It is separate from NewBuffer because applying
+// options prevents the compiler from allocating the buffer on the stack.
+func NewBufferWithOptions(buf []byte, opts ...BufferOption) *Buffer {
+	cb := &Buffer{buf: buf}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	return cb
+}
+
+// alloc returns a slice of n bytes to copy data into.
+func (cb *Buffer) alloc(n int) []byte {
+	return makeBytes(cb.allocBytes, n)
+}
+
+// makeBytes returns a slice of n bytes obtained from allocBytes, or from
+// make if allocBytes is nil.
+func makeBytes(allocBytes func(n int) []byte, n int) []byte {
+	if allocBytes == nil {
+		return make([]byte, n)
+	}
+	return allocBytes(n)[:n]
+}
+
+// Reset replaces the contents of the buffer with buf and moves the read
+// position to its start. Subsequent writes/encodes append after the end of
+// buf, so Reset(nil) prepares the buffer for encoding a new message into a
+// newly allocated slice and Reset(b[:0]) reuses the capacity of b.
 func (cb *Buffer) Reset(buf []byte) {
 	cb.buf = buf
 	cb.index = 0
+	cb.src = nil
+	cb.srcSize = 0
+	cb.srcErr = nil
+	cb.base = 0
+	cb.pinned = false
+	cb.sharedWindow = false
+	cb.stableWindows = false
+}
+
+// Clone returns a new buffer that reads the same data as this one from the
+// same position. Reading from either buffer does not affect the other.
+func (cb *Buffer) Clone() *Buffer {
+	if cb.src != nil {
+		// Both buffers must switch to a window of their own before refilling.
+		cb.sharedWindow = true
+	}
+	clone := *cb
+	return &clone
+}
+
+// CloneStable is like Clone except that, for buffers created with
+// NewBufferFromReaderAt, the returned buffer never refills its window in
+// place. Every refill moves to a newly allocated window instead, so the
+// slices that the clone returns stay valid for as long as they are
+// referenced rather than only until its next read, at the cost of an
+// allocation per refill. This suits callers that hold on to decoded values
+// while they keep reading. For any other buffer it is the same as Clone.
+func (cb *Buffer) CloneStable() *Buffer {
+	clone := cb.Clone()
+	clone.stableWindows = clone.src != nil
+	return clone
+}
+
+// Sub returns a new buffer over the unread bytes of this buffer from
+// offset start up to, but not including, offset end. Offsets are relative
+// to the current read position, so they match the offsets of the slice
+// returned by Bytes. The returned buffer aliases this buffer's data rather
+// than copying it, is capped so that encoding to it can't overwrite the
+// bytes that follow end, and inherits this buffer's maximum field length,
+// byte allocator, byte order and default for copying bytes. Reading from
+// either buffer does not affect the other.
+//
+// An error wrapping ErrBadLength is returned if the range is out of bounds.
+func (cb *Buffer) Sub(start, end int) (*Buffer, error) {
+	if start < 0 || end < start || end > cb.Len() {
+		return nil, fmt.Errorf("%w: range [%d:%d] of %d bytes", ErrBadLength, start, end, cb.Len())
+	}
+	if err := cb.ensure(end); err != nil {
+		return nil, err
+	}
+	if cb.src != nil {
+		// The returned buffer is a view over the window.
+		cb.sharedWindow = true
+	}
+	start, end = cb.index+start, cb.index+end
+	return cb.Nested(cb.buf[start:end:end]), nil
+}
+
+// Nested returns a new buffer over b that inherits this buffer's maximum
+// field length, byte allocator, byte order and default for copying bytes.
+// It is meant for decoding data that was read from this buffer, such as
+// the contents of a nested message or a packed field, with the same
+// settings. Unlike with Sub, b doesn't have to be part of this buffer's
+// unread bytes. The returned buffer aliases b.
+func (cb *Buffer) Nested(b []byte) *Buffer {
+	return &Buffer{
+		buf:            b,
+		maxFieldLength: cb.maxFieldLength,
+		allocBytes:     cb.allocBytes,
+		byteOrder:      cb.byteOrder,
+		copyBytes:      cb.copyBytes,
+	}
+}
+
+// SetMaxFieldLength limits the declared length of any length-delimited field
+// that is decoded or skipped by the buffer. Fields that claim to be longer
+// than n bytes are rejected with ErrFieldTooLarge before any of their data
+// is read. A value of zero or less disables the limit, which is the default.
+// The limit is retained across calls to Reset.
+func (cb *Buffer) SetMaxFieldLength(n int) {
+	cb.maxFieldLength = n
 }
 
 // Bytes returns the slice of bytes remaining in the buffer. Note that
@@ -36,33 +258,57 @@ func (cb *Buffer) Reset(buf []byte) {
 // are modified, the modifications will be visible to subsequent reads
 // via the buffer.
 func (cb *Buffer) Bytes() []byte {
+	// The error can't be returned. Whatever could be read is returned instead.
+	_ = cb.ensure(cb.Len())
 	return cb.buf[cb.index:]
 }
 
 // EOF returns true if there are no more bytes remaining to read.
 func (cb *Buffer) EOF() bool {
-	return cb.index >= len(cb.buf)
+	return cb.index >= len(cb.buf) && cb.unread() <= 0
 }
 
 // Skip attempts to skip the given number of bytes in the input. If
-// the input has fewer bytes than the given count, false is returned
-// and the buffer is unchanged. Otherwise, the given number of bytes
-// are skipped and true is returned.
+// the input has fewer bytes than the given count, io.ErrUnexpectedEOF
+// is returned and the buffer is unchanged. A negative count, which
+// usually means that a length varint overflowed when it was converted
+// to an int, is rejected with ErrBadLength.
 func (cb *Buffer) Skip(count int) error {
 	if count < 0 {
-		return fmt.Errorf("proto: bad byte length %d", count)
+		return fmt.Errorf("%w: %d", ErrBadLength, count)
 	}
-	newIndex := cb.index + count
-	if newIndex < cb.index || newIndex > len(cb.buf) {
+	if count > cb.Len() {
 		return io.ErrUnexpectedEOF
 	}
-	cb.index = newIndex
+	if count > len(cb.buf)-cb.index && !cb.pinned {
+		// Jump straight past the skipped bytes without reading them.
+		cb.base += cb.index + count
+		cb.buf = cb.buf[:0]
+		cb.index = 0
+		return nil
+	}
+	if err := cb.ensure(count); err != nil {
+		return err
+	}
+	cb.index += count
 	return nil
 }
 
+// SkipToEnd advances the buffer past all of its remaining bytes, after
+// which EOF returns true.
+func (cb *Buffer) SkipToEnd() {
+	if cb.src != nil {
+		cb.base = cb.srcSize
+		cb.buf = cb.buf[:0]
+		cb.index = 0
+		return
+	}
+	cb.index = len(cb.buf)
+}
+
 // Len returns the remaining number of bytes in the buffer.
 func (cb *Buffer) Len() int {
-	return len(cb.buf) - cb.index
+	return len(cb.buf) - cb.index + cb.unread()
 }
 
 // Read implements the io.Reader interface. If there are no bytes
@@ -71,6 +317,9 @@ func (cb *Buffer) Len() int {
 // them into dest. It returns the number of bytes copied and a nil
 // error in this case.
 func (cb *Buffer) Read(dest []byte) (int, error) {
+	if err := cb.ensure(len(dest)); err != nil {
+		return 0, err
+	}
 	if cb.index == len(cb.buf) {
 		return 0, io.EOF
 	}
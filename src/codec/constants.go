@@ -4,6 +4,12 @@
 // all the encoding and field type specific constants required for using the molecule library.
 package codec
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // WireType represents a protobuf encoding wire type.
 type WireType int8
 
@@ -17,9 +23,38 @@ const (
 	WireFixed32    WireType = 5
 )
 
+var wireTypeNames = [...]string{
+	WireVarint:     "varint",
+	WireFixed64:    "fixed64",
+	WireBytes:      "bytes",
+	WireStartGroup: "start_group",
+	WireEndGroup:   "end_group",
+	WireFixed32:    "fixed32",
+}
+
+// String returns a short lowercase name for the wire type, for example "varint".
+func (w WireType) String() string {
+	if w >= 0 && int(w) < len(wireTypeNames) {
+		return wireTypeNames[w]
+	}
+	return "WireType(" + strconv.Itoa(int(w)) + ")"
+}
+
+// ParseWireType returns the wire type whose String is s, ignoring case.
+func ParseWireType(s string) (WireType, error) {
+	for w, name := range wireTypeNames {
+		if strings.EqualFold(s, name) {
+			return WireType(w), nil
+		}
+	}
+	return 0, fmt.Errorf("codec: unknown wire type %q", s)
+}
+
 // FieldType represents a protobuf field type.
 type FieldType int32
 
+// Constants that identify the declared type of a field. Their values match the field
+// types in descriptor.proto.
 const (
 	FieldType_DOUBLE   FieldType = 1
 	FieldType_FLOAT    FieldType = 2
@@ -40,3 +75,43 @@ const (
 	FieldType_SINT32   FieldType = 17
 	FieldType_SINT64   FieldType = 18
 )
+
+var fieldTypeNames = [...]string{
+	FieldType_DOUBLE:   "double",
+	FieldType_FLOAT:    "float",
+	FieldType_INT64:    "int64",
+	FieldType_UINT64:   "uint64",
+	FieldType_INT32:    "int32",
+	FieldType_FIXED64:  "fixed64",
+	FieldType_FIXED32:  "fixed32",
+	FieldType_BOOL:     "bool",
+	FieldType_STRING:   "string",
+	FieldType_GROUP:    "group",
+	FieldType_MESSAGE:  "message",
+	FieldType_BYTES:    "bytes",
+	FieldType_UINT32:   "uint32",
+	FieldType_ENUM:     "enum",
+	FieldType_SFIXED32: "sfixed32",
+	FieldType_SFIXED64: "sfixed64",
+	FieldType_SINT32:   "sint32",
+	FieldType_SINT64:   "sint64",
+}
+
+// String returns the name of the field type as it is written in a .proto file, for
+// example "sint64".
+func (t FieldType) String() string {
+	if t > 0 && int(t) < len(fieldTypeNames) {
+		return fieldTypeNames[t]
+	}
+	return "FieldType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// ParseFieldType returns the field type whose String is s, ignoring case.
+func ParseFieldType(s string) (FieldType, error) {
+	for t, name := range fieldTypeNames {
+		if t > 0 && strings.EqualFold(s, name) {
+			return FieldType(t), nil
+		}
+	}
+	return 0, fmt.Errorf("codec: unknown field type %q", s)
+}
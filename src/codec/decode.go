@@ -16,6 +16,19 @@ var ErrOverflow = errors.New("proto: integer overflow")
 // is not valid.
 var ErrBadWireType = errors.New("proto: bad wiretype")
 
+// ErrTagOutOfRange is returned when a decoded field number is zero or does
+// not fit in an int32.
+var ErrTagOutOfRange = errors.New("proto: tag number out of range")
+
+// ErrBadLength is returned when a byte length is negative or otherwise
+// invalid. Lengths that are too large to be represented as an int on the
+// current platform match both ErrBadLength and ErrOverflow.
+var ErrBadLength = errors.New("proto: bad byte length")
+
+// ErrFieldTooLarge is returned when a length-delimited field is longer than
+// the limit configured with SetMaxFieldLength.
+var ErrFieldTooLarge = errors.New("proto: field length exceeds limit")
+
 var varintTypes = map[FieldType]bool{}
 var fixed32Types = map[FieldType]bool{}
 var fixed64Types = map[FieldType]bool{}
@@ -66,7 +79,14 @@ func (cb *Buffer) decodeVarintSlow() (x uint64, err error) {
 // This is the format for the
 // int32, int64, uint32, uint64, bool, and enum
 // protocol buffer types.
+//
+// Varints that don't fit in a uint64, either because they are longer than
+// 10 bytes or because their 10th byte is greater than 1, are rejected with
+// ErrOverflow.
 func (cb *Buffer) DecodeVarint() (uint64, error) {
+	if err := cb.ensure(maxVarintLen); err != nil {
+		return 0, err
+	}
 	i := cb.index
 	buf := cb.buf
 
@@ -148,24 +168,37 @@ func (cb *Buffer) DecodeVarint() (uint64, error) {
 	}
 	x -= 0x80 << 56
 
+	// The 10th byte only has room for the 64th bit, so anything other than
+	// 0 or 1 means the value doesn't fit in a uint64.
 	b = uint64(buf[i])
 	i++
-	x += b << 63
-	if b&0x80 == 0 {
-		goto done
+	if b > 1 {
+		return 0, ErrOverflow
 	}
-	// x -= 0x80 << 63 // Always zero.
-
-	return 0, ErrOverflow
+	x += b << 63
+	goto done
 
 done:
 	cb.index = i
 	return x, nil
 }
 
+// DecodeVarintN is like DecodeVarint except that it also returns the number
+// of bytes that the varint occupied in the buffer. This is useful for length
+// prefix arithmetic where the size of the prefix itself matters.
+func (cb *Buffer) DecodeVarintN() (value uint64, n int, err error) {
+	start := cb.Len()
+	value, err = cb.DecodeVarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return value, start - cb.Len(), nil
+}
+
 // DecodeTagAndWireType decodes a field tag and wire type from input.
 // This reads a varint and then extracts the two fields from the varint
-// value read.
+// value read. Tags with a field number of zero, which protobuf doesn't
+// allow, are rejected with an error wrapping ErrTagOutOfRange.
 func (cb *Buffer) DecodeTagAndWireType() (tag int32, wireType WireType, err error) {
 	var v uint64
 	v, err = cb.DecodeVarint()
@@ -176,19 +209,142 @@ func (cb *Buffer) DecodeTagAndWireType() (tag int32, wireType WireType, err erro
 	wireType = WireType(v & 7)
 	// rest is int32 tag number
 	v = v >> 3
+	if v == 0 {
+		// Zero is never a valid field number, so this is usually a sign of
+		// corrupt data or of reading past the end of the message.
+		err = fmt.Errorf("%w: field number 0", ErrTagOutOfRange)
+		return
+	}
 	if v > math.MaxInt32 {
-		err = fmt.Errorf("tag number out of range: %d", v)
+		err = fmt.Errorf("%w: %d", ErrTagOutOfRange, v)
 		return
 	}
 	tag = int32(v)
 	return
 }
 
+// NextIs reports whether the next field in the buffer has the field number
+// fieldNum, without consuming its tag, which makes loops of the form "while
+// the next field is N, consume it" straightforward to write for repeated
+// fields. It returns false at the end of the buffer and an error if the
+// next tag can't be decoded. The read position is left unchanged in every
+// case.
+func (cb *Buffer) NextIs(fieldNum int32) (bool, error) {
+	if cb.EOF() {
+		return false, nil
+	}
+	// The offset is tracked relative to the start of the source, rather than
+	// the window, since decoding the tag may refill the window.
+	start := cb.base + cb.index
+	tag, _, err := cb.DecodeTagAndWireType()
+	cb.index = start - cb.base
+	if err != nil {
+		return false, err
+	}
+	return tag == fieldNum, nil
+}
+
+// FieldCursor is a field that has been started with BeginField but not yet
+// committed or aborted.
+type FieldCursor struct {
+	FieldNum int32
+	WireType WireType
+
+	cb *Buffer
+	// Offsets are relative to the start of the source, rather than the
+	// window, since the window may be refilled while the field is open.
+	start, dataStart int
+	wasPinned        bool
+	pin              int
+}
+
+// BeginField decodes the tag of the next field and returns a cursor for it,
+// leaving the buffer positioned at the start of the field's data. The data
+// can then be decoded speculatively, in part or in full, before deciding
+// whether to consume the field with Commit or to rewind to its tag with
+// Abort, which makes the field the unit of transactional parsing. io.EOF is
+// returned at the end of the buffer, and the buffer is left unchanged if the
+// tag can't be decoded.
+//
+// Exactly one of Commit or Abort must be called on the cursor before the
+// next call to BeginField. Until then, the bytes of the field are kept in
+// memory by buffers created with NewBufferFromReaderAt.
+func (cb *Buffer) BeginField() (FieldCursor, error) {
+	if cb.EOF() {
+		return FieldCursor{}, io.EOF
+	}
+	c := FieldCursor{
+		cb:        cb,
+		start:     cb.base + cb.index,
+		wasPinned: cb.pinned,
+		pin:       cb.pin,
+	}
+	if !cb.pinned {
+		cb.pinned, cb.pin = true, c.start
+	}
+	var err error
+	c.FieldNum, c.WireType, err = cb.DecodeTagAndWireType()
+	if err != nil {
+		c.Abort()
+		return FieldCursor{}, err
+	}
+	c.dataStart = cb.base + cb.index
+	return c, nil
+}
+
+// Commit advances the buffer past the field, however much of its data has
+// been decoded since BeginField. If the field's data is truncated an error
+// is returned and the buffer is rewound to the field's tag, as by Abort.
+func (c *FieldCursor) Commit() error {
+	cb := c.cb
+	cb.index = c.dataStart - cb.base
+	if c.WireType != WireBytes {
+		err := cb.SkipField(c.WireType)
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		cb.pinned, cb.pin = c.wasPinned, c.pin
+		return nil
+	}
+
+	l, err := cb.DecodeVarint()
+	if err != nil {
+		c.Abort()
+		return err
+	}
+	n, err := cb.checkFieldLength(l)
+	if err != nil {
+		c.Abort()
+		return err
+	}
+	// Unpinning first lets Skip jump past a large payload without reading it.
+	// Skip leaves the buffer unchanged if it fails, so the tag is still in the
+	// window to rewind to.
+	cb.pinned, cb.pin = c.wasPinned, c.pin
+	if err := cb.Skip(n); err != nil {
+		c.Abort()
+		return err
+	}
+	return nil
+}
+
+// Abort rewinds the buffer to the field's tag, as if BeginField had never
+// been called.
+func (c *FieldCursor) Abort() {
+	cb := c.cb
+	cb.index = c.start - cb.base
+	cb.pinned, cb.pin = c.wasPinned, c.pin
+}
+
 // DecodeFixed64 reads a 64-bit integer from the Buffer.
 // This is the format for the
 // fixed64, sfixed64, and double protocol buffer types.
 func (cb *Buffer) DecodeFixed64() (x uint64, err error) {
 	// x, err already 0
+	if err = cb.ensure(8); err != nil {
+		return
+	}
 	i := cb.index + 8
 	if i < 0 || i > len(cb.buf) {
 		err = io.ErrUnexpectedEOF
@@ -196,6 +352,9 @@ func (cb *Buffer) DecodeFixed64() (x uint64, err error) {
 	}
 	cb.index = i
 
+	if cb.byteOrder != nil {
+		return cb.byteOrder.Uint64(cb.buf[i-8 : i]), nil
+	}
 	x = uint64(cb.buf[i-8])
 	x |= uint64(cb.buf[i-7]) << 8
 	x |= uint64(cb.buf[i-6]) << 16
@@ -212,6 +371,9 @@ func (cb *Buffer) DecodeFixed64() (x uint64, err error) {
 // fixed32, sfixed32, and float protocol buffer types.
 func (cb *Buffer) DecodeFixed32() (x uint64, err error) {
 	// x, err already 0
+	if err = cb.ensure(4); err != nil {
+		return
+	}
 	i := cb.index + 4
 	if i < 0 || i > len(cb.buf) {
 		err = io.ErrUnexpectedEOF
@@ -219,6 +381,9 @@ func (cb *Buffer) DecodeFixed32() (x uint64, err error) {
 	}
 	cb.index = i
 
+	if cb.byteOrder != nil {
+		return uint64(cb.byteOrder.Uint32(cb.buf[i-4 : i])), nil
+	}
 	x = uint64(cb.buf[i-4])
 	x |= uint64(cb.buf[i-3]) << 8
 	x |= uint64(cb.buf[i-2]) << 16
@@ -228,6 +393,11 @@ func (cb *Buffer) DecodeFixed32() (x uint64, err error) {
 
 // DecodeZigZag32 decodes a signed 32-bit integer from the given
 // zig-zag encoded value.
+//
+// Only the low 32 bits of v are used and any higher bits are ignored,
+// which matches how protobuf decodes sint32 fields whose varint encoding
+// is wider than 32 bits. For example, DecodeZigZag32(math.MaxUint64)
+// returns math.MinInt32.
 func DecodeZigZag32(v uint64) int32 {
 	return int32((uint32(v) >> 1) ^ uint32((int32(v&1)<<31)>>31))
 }
@@ -238,6 +408,22 @@ func DecodeZigZag64(v uint64) int64 {
 	return int64((v >> 1) ^ uint64((int64(v&1)<<63)>>63))
 }
 
+// DecodeZigZag decodes a signed integer that is bits wide from the given
+// zig-zag encoded value. Like DecodeZigZag32, bits of v above the width
+// are ignored, so DecodeZigZag(v, 32) == int64(DecodeZigZag32(v)) and
+// DecodeZigZag(v, 64) == DecodeZigZag64(v).
+//
+// An error is returned if bits is not between 1 and 64.
+func DecodeZigZag(v uint64, bits int) (int64, error) {
+	if bits < 1 || bits > 64 {
+		return 0, fmt.Errorf("DecodeZigZag: invalid width %d", bits)
+	}
+	if bits < 64 {
+		v &= 1<<uint(bits) - 1
+	}
+	return int64(v>>1) ^ -int64(v&1), nil
+}
+
 // DecodeRawBytes reads a count-delimited byte buffer from the Buffer.
 // This is the format used for the bytes protocol buffer
 // type and for embedded messages.
@@ -247,9 +433,12 @@ func (cb *Buffer) DecodeRawBytes(alloc bool) (buf []byte, err error) {
 		return nil, err
 	}
 
-	nb := int(n)
-	if nb < 0 {
-		return nil, fmt.Errorf("proto: bad byte length %d", nb)
+	nb, err := cb.checkFieldLength(n)
+	if err != nil {
+		return nil, err
+	}
+	if err := cb.ensure(nb); err != nil {
+		return nil, err
 	}
 	end := cb.index + nb
 	if end < cb.index || end > len(cb.buf) {
@@ -262,12 +451,75 @@ func (cb *Buffer) DecodeRawBytes(alloc bool) (buf []byte, err error) {
 		return
 	}
 
-	buf = make([]byte, nb)
+	buf = cb.alloc(nb)
 	copy(buf, cb.buf[cb.index:])
 	cb.index = end
 	return
 }
 
+// ConsumeLengthPrefixed reads a varint length from the start of b followed by
+// that many bytes, and returns those bytes as body along with whatever
+// follows them as rest. It is the slice based counterpart to DecodeRawBytes
+// for callers that run their own framing loop over a []byte rather than a
+// Buffer. body aliases b, but is capped so that appending to it can't
+// overwrite rest.
+//
+// io.EOF is returned if b is empty, so that a loop can consume frames until
+// rest runs out, while a length or body that is cut short returns
+// io.ErrUnexpectedEOF.
+func ConsumeLengthPrefixed(b []byte) (body []byte, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, io.EOF
+	}
+	cb := Buffer{buf: b}
+	body, err = cb.DecodeRawBytes(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body[:len(body):len(body)], b[cb.index:], nil
+}
+
+// CowBytes is a length-delimited value decoded by DecodeBytesCow. It holds
+// a view over the buffer that the value was decoded from, and defers the
+// decision of whether to copy it to whoever consumes the value.
+type CowBytes struct {
+	view       []byte
+	allocBytes func(n int) []byte
+}
+
+// View returns the value without copying it. The returned slice aliases
+// the buffer it was decoded from, so it is only valid for as long as that
+// buffer's contents are neither modified nor reused.
+func (c CowBytes) View() []byte {
+	return c.view
+}
+
+// Copy returns a copy of the value that remains valid after the buffer it
+// was decoded from is modified or reused. The copy is obtained from the
+// buffer's byte allocator, if one was configured with WithByteAllocator.
+// Copy must be called while the view is still valid.
+func (c CowBytes) Copy() []byte {
+	b := makeBytes(c.allocBytes, len(c.view))
+	copy(b, c.view)
+	return b
+}
+
+// Len returns the length of the value.
+func (c CowBytes) Len() int {
+	return len(c.view)
+}
+
+// DecodeBytesCow is like DecodeRawBytes except that, rather than requiring
+// the caller to choose up front whether the value is copied, it returns a
+// CowBytes whose consumer can call either View or Copy.
+func (cb *Buffer) DecodeBytesCow() (CowBytes, error) {
+	view, err := cb.DecodeRawBytes(false)
+	if err != nil {
+		return CowBytes{}, err
+	}
+	return CowBytes{view: view, allocBytes: cb.allocBytes}, nil
+}
+
 // ReadGroup reads the input until a "group end" tag is found
 // and returns the data up to that point. Subsequent reads from
 // the buffer will read data after the group end tag. If alloc
@@ -288,13 +540,30 @@ func (cb *Buffer) ReadGroup(alloc bool) ([]byte, error) {
 	if !alloc {
 		results = cb.buf[cb.index:dataEnd]
 	} else {
-		results = make([]byte, dataEnd-cb.index)
-		copy(results, cb.buf[cb.index:])
+		results = cb.alloc(dataEnd - cb.index)
+		copy(results, cb.buf[cb.index:dataEnd])
 	}
 	cb.index = groupEnd
 	return results, nil
 }
 
+// ReadGroupBuffer is like ReadGroup, except that the group's data is
+// returned wrapped in a new Buffer so that the fields within the group
+// can be decoded directly. The returned Buffer is a view into this
+// buffer's underlying byte slice and inherits its maximum field length,
+// byte allocator, byte order and default for copying bytes. Its capacity
+// is limited to the group's data so that encoding to it can never
+// overwrite the data that follows the group.
+func (cb *Buffer) ReadGroupBuffer() (*Buffer, error) {
+	groupEnd, dataEnd, err := cb.findGroupEnd()
+	if err != nil {
+		return nil, err
+	}
+	group := cb.Nested(cb.buf[cb.index:dataEnd:dataEnd])
+	cb.index = groupEnd
+	return group, nil
+}
+
 // SkipGroup is like ReadGroup, except that it discards the
 // data and just advances the buffer to point to the input
 // right *after* the "group end" tag.
@@ -308,64 +577,109 @@ func (cb *Buffer) SkipGroup() error {
 }
 
 func (cb *Buffer) findGroupEnd() (groupEnd int, dataEnd int, err error) {
-	bs := cb.buf
-	start := cb.index
+	// Offsets are tracked relative to the start of the source, rather than
+	// the window, since the window may be refilled while scanning. Pinning
+	// the start of the group keeps all of it in the window.
+	start := cb.base + cb.index
+	wasPinned := cb.pinned
+	if !wasPinned {
+		cb.pinned, cb.pin = true, start
+	}
 	defer func() {
-		cb.index = start
+		cb.index = start - cb.base
+		cb.pinned = wasPinned
 	}()
 	for {
-		fieldStart := cb.index
+		fieldStart := cb.base + cb.index
 		// read a field tag
 		_, wireType, err := cb.DecodeTagAndWireType()
 		if err != nil {
 			return 0, 0, err
 		}
+		if wireType == WireEndGroup {
+			return cb.index, fieldStart - cb.base, nil
+		}
 		// skip past the field's data
-		switch wireType {
-		case WireFixed32:
-			if err := cb.Skip(4); err != nil {
-				return 0, 0, err
-			}
-		case WireFixed64:
-			if err := cb.Skip(8); err != nil {
-				return 0, 0, err
-			}
-		case WireVarint:
-			// skip varint by finding last byte (has high bit unset)
-			i := cb.index
-			limit := i + 10 // varint cannot be >10 bytes
-			for {
-				if i >= limit {
-					return 0, 0, ErrOverflow
-				}
-				if i >= len(bs) {
-					return 0, 0, io.ErrUnexpectedEOF
-				}
-				if bs[i]&0x80 == 0 {
-					break
-				}
-				i++
-			}
-			// TODO: This would only overflow if buffer length was MaxInt and we
-			// read the last byte. This is not a real/feasible concern on 64-bit
-			// systems. Something to worry about for 32-bit systems? Do we care?
-			cb.index = i + 1
-		case WireBytes:
-			l, err := cb.DecodeVarint()
-			if err != nil {
-				return 0, 0, err
+		if err := cb.SkipField(wireType); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// SkipField skips over the data of a field encoded with wireType. The
+// field's tag must already have been consumed. Fields with a start group
+// wire type are skipped up to and including their matching end group tag.
+func (cb *Buffer) SkipField(wireType WireType) error {
+	switch wireType {
+	case WireFixed32:
+		return cb.Skip(4)
+	case WireFixed64:
+		return cb.Skip(8)
+	case WireVarint:
+		if err := cb.ensure(maxVarintLen); err != nil {
+			return err
+		}
+		// skip varint by finding last byte (has high bit unset)
+		i := cb.index
+		limit := i + 10 // varint cannot be >10 bytes
+		for {
+			if i >= limit {
+				return ErrOverflow
 			}
-			if err := cb.Skip(int(l)); err != nil {
-				return 0, 0, err
+			if i >= len(cb.buf) {
+				return io.ErrUnexpectedEOF
 			}
-		case WireStartGroup:
-			if err := cb.SkipGroup(); err != nil {
-				return 0, 0, err
+			if cb.buf[i]&0x80 == 0 {
+				break
 			}
-		case WireEndGroup:
-			return cb.index, fieldStart, nil
-		default:
-			return 0, 0, ErrBadWireType
+			i++
+		}
+		// TODO: This would only overflow if buffer length was MaxInt and we
+		// read the last byte. This is not a real/feasible concern on 64-bit
+		// systems. Something to worry about for 32-bit systems? Do we care?
+		cb.index = i + 1
+		return nil
+	case WireBytes:
+		l, err := cb.DecodeVarint()
+		if err != nil {
+			return err
 		}
+		n, err := cb.checkFieldLength(l)
+		if err != nil {
+			return err
+		}
+		return cb.Skip(n)
+	case WireStartGroup:
+		return cb.SkipGroup()
+	default:
+		return ErrBadWireType
+	}
+}
+
+// checkFieldLength validates the declared length of a length-delimited
+// field and converts it to an int. The length is compared to the largest
+// int before it is converted, since on 32-bit platforms the conversion
+// would otherwise silently truncate lengths of 4GiB or more.
+func (cb *Buffer) checkFieldLength(l uint64) (int, error) {
+	if l > math.MaxInt {
+		return 0, lengthOverflowError(l)
+	}
+	n := int(l)
+	if cb.maxFieldLength > 0 && n > cb.maxFieldLength {
+		return 0, fmt.Errorf("%w: %d > %d", ErrFieldTooLarge, n, cb.maxFieldLength)
 	}
+	return n, nil
+}
+
+// lengthOverflowError is returned for lengths that don't fit in an int.
+// Such lengths are both bad lengths and integer overflows, so the error
+// matches both ErrBadLength and ErrOverflow.
+type lengthOverflowError uint64
+
+func (e lengthOverflowError) Error() string {
+	return fmt.Sprintf("%v: %v: %d", ErrBadLength, ErrOverflow, uint64(e))
+}
+
+func (e lengthOverflowError) Is(target error) bool {
+	return target == ErrBadLength || target == ErrOverflow
 }
@@ -0,0 +1,190 @@
+// This file contains modifications from the original source code found in: https://github.com/jhump/protoreflect
+
+package codec
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// ErrReadOnly is returned when encoding to a buffer that can only be read,
+// such as one created by NewBufferFromReaderAt.
+var ErrReadOnly = errors.New("proto: buffer is read-only")
+
+// writable returns ErrReadOnly if the buffer can't be encoded to.
+func (cb *Buffer) writable() error {
+	if cb.src != nil {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Available returns the number of bytes that can be encoded to the buffer
+// without another allocation.
+func (cb *Buffer) Available() int {
+	return cap(cb.buf) - len(cb.buf)
+}
+
+// Grow grows the buffer's capacity, if necessary, to guarantee space for
+// another n bytes. After Grow(n), at least n bytes can be encoded to the
+// buffer without another allocation. This is useful when the size of the
+// message being encoded is known ahead of time. If n is negative, Grow
+// will panic. Grow has no effect on read-only buffers.
+func (cb *Buffer) Grow(n int) {
+	if n < 0 {
+		panic("codec.Buffer.Grow: negative count")
+	}
+	if cb.src != nil {
+		return
+	}
+	if cap(cb.buf)-len(cb.buf) >= n {
+		return
+	}
+	buf := make([]byte, len(cb.buf), 2*cap(cb.buf)+n)
+	copy(buf, cb.buf)
+	cb.buf = buf
+}
+
+// EncodeVarint writes a varint-encoded integer to the Buffer.
+// This is the format for the
+// int32, int64, uint32, uint64, bool, and enum
+// protocol buffer types.
+func (cb *Buffer) EncodeVarint(x uint64) error {
+	if err := cb.writable(); err != nil {
+		return err
+	}
+	cb.buf = appendVarint(cb.buf, x)
+	return nil
+}
+
+// appendVarint appends the varint encoding of x to b.
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 1<<7 {
+		b = append(b, uint8(x&0x7f|0x80))
+		x >>= 7
+	}
+	return append(b, uint8(x))
+}
+
+// ComputeVarintSize returns the number of bytes that EncodeVarint will
+// use to encode x. Every byte of a varint holds 7 bits of the value and
+// even zero requires a single byte.
+func ComputeVarintSize(x uint64) int {
+	return (bits.Len64(x|1) + 6) / 7
+}
+
+// EncodeTagAndWireType encodes the given field tag and wire type to the
+// buffer. This combines the two values and then writes them as a varint.
+func (cb *Buffer) EncodeTagAndWireType(tag int32, wireType WireType) error {
+	return cb.EncodeVarint(tagAndWireType(tag, wireType))
+}
+
+// tagAndWireType returns the varint that the tag of field tag with the
+// given wire type is encoded as.
+func tagAndWireType(tag int32, wireType WireType) uint64 {
+	return uint64((int64(tag) << 3) | int64(wireType))
+}
+
+// EncodeFixed64 writes a 64-bit integer to the Buffer.
+// This is the format for the
+// fixed64, sfixed64, and double protocol buffer types.
+func (cb *Buffer) EncodeFixed64(x uint64) error {
+	if err := cb.writable(); err != nil {
+		return err
+	}
+	cb.buf = appendFixed64(cb.buf, x)
+	return nil
+}
+
+// appendFixed64 appends the little-endian encoding of x to b.
+func appendFixed64(b []byte, x uint64) []byte {
+	return append(b,
+		uint8(x),
+		uint8(x>>8),
+		uint8(x>>16),
+		uint8(x>>24),
+		uint8(x>>32),
+		uint8(x>>40),
+		uint8(x>>48),
+		uint8(x>>56))
+}
+
+// EncodeFixed32 writes a 32-bit integer to the Buffer.
+// This is the format for the
+// fixed32, sfixed32, and float protocol buffer types.
+func (cb *Buffer) EncodeFixed32(x uint64) error {
+	if err := cb.writable(); err != nil {
+		return err
+	}
+	cb.buf = appendFixed32(cb.buf, x)
+	return nil
+}
+
+// appendFixed32 appends the little-endian encoding of the low 32 bits of x
+// to b.
+func appendFixed32(b []byte, x uint64) []byte {
+	return append(b,
+		uint8(x),
+		uint8(x>>8),
+		uint8(x>>16),
+		uint8(x>>24))
+}
+
+// EncodeZigZag64 does zig-zag encoding to convert the given
+// signed 64-bit integer into a form that can be expressed
+// efficiently as a varint, even for negative values.
+func EncodeZigZag64(v int64) uint64 {
+	return (uint64(v) << 1) ^ uint64(v>>63)
+}
+
+// EncodeZigZag32 does zig-zag encoding to convert the given
+// signed 32-bit integer into a form that can be expressed
+// efficiently as a varint, even for negative values.
+func EncodeZigZag32(v int32) uint64 {
+	return uint64((uint32(v) << 1) ^ uint32((v >> 31)))
+}
+
+// EncodeRawBytes writes a count-delimited byte buffer to the Buffer.
+// This is the format used for the bytes protocol buffer
+// type and for embedded messages.
+func (cb *Buffer) EncodeRawBytes(b []byte) error {
+	if err := cb.EncodeVarint(uint64(len(b))); err != nil {
+		return err
+	}
+	cb.buf = append(cb.buf, b...)
+	return nil
+}
+
+// WriteDelimitedMessage writes msg, an encoded message, as the field
+// fieldNum using the delimited message encoding of protobuf editions. The
+// message is wrapped in a start and an end group tag rather than being
+// preceded by its length, exactly like a group written by
+// Encoder.WriteGroup.
+func (cb *Buffer) WriteDelimitedMessage(fieldNum int32, msg []byte) error {
+	if err := cb.writable(); err != nil {
+		return err
+	}
+	cb.buf = appendDelimitedMessage(cb.buf, fieldNum, msg)
+	return nil
+}
+
+// appendDelimitedMessage appends msg to b as the delimited message field
+// fieldNum.
+func appendDelimitedMessage(b []byte, fieldNum int32, msg []byte) []byte {
+	b = appendVarint(b, tagAndWireType(fieldNum, WireStartGroup))
+	b = append(b, msg...)
+	return appendVarint(b, tagAndWireType(fieldNum, WireEndGroup))
+}
+
+// Write implements the io.Writer interface. It appends p to the end of the
+// buffer and returns len(p), nil unless the buffer is read-only.
+func (cb *Buffer) Write(p []byte) (int, error) {
+	if err := cb.writable(); err != nil {
+		return 0, err
+	}
+	cb.buf = append(cb.buf, p...)
+	return len(p), nil
+}
+
+var _ io.Writer = (*Buffer)(nil)
@@ -0,0 +1,247 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Encoder encodes the protobuf binary format by appending to a slice of
+// bytes. Unlike a Buffer it can only be written to, so it has no read
+// position to keep track of and can never be read-only. Besides the
+// primitive Encode methods that it shares with Buffer it provides the
+// helpers that write entire fields, such as groups, delimited messages and
+// packed repeated fields.
+//
+// The Encode methods return an error so that their signatures match those
+// of Buffer, but an Encoder never fails to encode a value.
+type Encoder struct {
+	buf []byte
+}
+
+// NewEncoder creates an Encoder that appends to buf, which may be nil.
+// Pass b[:0] to reuse the capacity of b.
+func NewEncoder(buf []byte) *Encoder {
+	return &Encoder{buf: buf}
+}
+
+// Bytes returns the encoded bytes. The slice aliases the Encoder's
+// storage, so it is only valid until the next call that encodes to or
+// resets the Encoder.
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+// Len returns the number of encoded bytes.
+func (e *Encoder) Len() int {
+	return len(e.buf)
+}
+
+// Reset discards the encoded bytes while keeping the capacity of the
+// Encoder's storage for reuse.
+func (e *Encoder) Reset() {
+	e.buf = e.buf[:0]
+}
+
+// Available returns the number of bytes that can be encoded without
+// another allocation.
+func (e *Encoder) Available() int {
+	return cap(e.buf) - len(e.buf)
+}
+
+// Grow grows the Encoder's capacity, if necessary, to guarantee space for
+// another n bytes, like Buffer.Grow. If n is negative, Grow will panic.
+func (e *Encoder) Grow(n int) {
+	if n < 0 {
+		panic("codec.Encoder.Grow: negative count")
+	}
+	if cap(e.buf)-len(e.buf) >= n {
+		return
+	}
+	buf := make([]byte, len(e.buf), 2*cap(e.buf)+n)
+	copy(buf, e.buf)
+	e.buf = buf
+}
+
+// Write implements the io.Writer interface. It appends p to the encoded
+// bytes and always returns len(p), nil.
+func (e *Encoder) Write(p []byte) (int, error) {
+	e.buf = append(e.buf, p...)
+	return len(p), nil
+}
+
+var _ io.Writer = (*Encoder)(nil)
+
+// EncodeVarint writes a varint-encoded integer, like Buffer.EncodeVarint.
+func (e *Encoder) EncodeVarint(x uint64) error {
+	e.buf = appendVarint(e.buf, x)
+	return nil
+}
+
+// EncodeTagAndWireType writes the tag of a field, like
+// Buffer.EncodeTagAndWireType.
+func (e *Encoder) EncodeTagAndWireType(tag int32, wireType WireType) error {
+	e.buf = appendVarint(e.buf, tagAndWireType(tag, wireType))
+	return nil
+}
+
+// EncodeFixed64 writes a 64-bit integer, like Buffer.EncodeFixed64.
+func (e *Encoder) EncodeFixed64(x uint64) error {
+	e.buf = appendFixed64(e.buf, x)
+	return nil
+}
+
+// EncodeFixed32 writes a 32-bit integer, like Buffer.EncodeFixed32.
+func (e *Encoder) EncodeFixed32(x uint64) error {
+	e.buf = appendFixed32(e.buf, x)
+	return nil
+}
+
+// EncodeRawBytes writes a count-delimited byte slice, like
+// Buffer.EncodeRawBytes.
+func (e *Encoder) EncodeRawBytes(b []byte) error {
+	e.buf = appendVarint(e.buf, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+	return nil
+}
+
+// WriteGroup writes the deprecated proto2 group fieldNum. It writes a start
+// group tag, calls fn to encode the group's fields to the same Encoder and
+// then writes the matching end group tag, so groups can be nested by
+// calling WriteGroup from within fn. This is the counterpart to ReadGroup.
+//
+// If fn returns an error it is returned as is, without writing the end group
+// tag, and the Encoder is left holding a partial group.
+func (e *Encoder) WriteGroup(fieldNum int32, fn func(*Encoder) error) error {
+	e.buf = appendVarint(e.buf, tagAndWireType(fieldNum, WireStartGroup))
+	if err := fn(e); err != nil {
+		return err
+	}
+	e.buf = appendVarint(e.buf, tagAndWireType(fieldNum, WireEndGroup))
+	return nil
+}
+
+// WriteDelimitedMessage writes msg, an encoded message, as the field
+// fieldNum using the delimited message encoding of protobuf editions, like
+// Buffer.WriteDelimitedMessage.
+func (e *Encoder) WriteDelimitedMessage(fieldNum int32, msg []byte) error {
+	e.buf = appendDelimitedMessage(e.buf, fieldNum, msg)
+	return nil
+}
+
+// WritePackedRepeated writes values as the packed repeated field fieldNum of
+// type fieldType, which must be a numeric, bool or enum type. The tag and the
+// length of the packed body are written first, followed by every element.
+//
+// Each element of values holds the field's value in the same form as
+// Value.Number: signed types are sign-extended to 64 bits, floats and doubles
+// are stored as their IEEE 754 bits and sint32 and sint64 values are not yet
+// zig-zag encoded, that is applied here. Nothing is written if values is
+// empty, since protobuf omits empty repeated fields.
+func (e *Encoder) WritePackedRepeated(fieldNum int32, fieldType FieldType, values []uint64) error {
+	var size int
+	switch {
+	case varintTypes[fieldType]:
+		for _, v := range values {
+			size += ComputeVarintSize(packedVarint(fieldType, v))
+		}
+	case fixed32Types[fieldType]:
+		size = 4 * len(values)
+	case fixed64Types[fieldType]:
+		size = 8 * len(values)
+	default:
+		return fmt.Errorf("WritePackedRepeated: field type %s can't be packed", fieldType)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	e.encodePackedHeader(fieldNum, size)
+
+	for _, v := range values {
+		switch {
+		case varintTypes[fieldType]:
+			e.buf = appendVarint(e.buf, packedVarint(fieldType, v))
+		case fixed32Types[fieldType]:
+			e.buf = appendFixed32(e.buf, v)
+		default:
+			e.buf = appendFixed64(e.buf, v)
+		}
+	}
+	return nil
+}
+
+// packedVarint returns the varint that v is encoded as for fieldType.
+func packedVarint(fieldType FieldType, v uint64) uint64 {
+	switch fieldType {
+	case FieldType_SINT32:
+		return EncodeZigZag32(int32(v))
+	case FieldType_SINT64:
+		return EncodeZigZag64(int64(v))
+	default:
+		return v
+	}
+}
+
+// WritePackedInt32 writes values as the packed repeated int32 field fieldNum.
+func (e *Encoder) WritePackedInt32(fieldNum int32, values []int32) error {
+	if len(values) == 0 {
+		return nil
+	}
+	var size int
+	for _, v := range values {
+		size += ComputeVarintSize(uint64(int64(v)))
+	}
+	e.encodePackedHeader(fieldNum, size)
+	for _, v := range values {
+		e.buf = appendVarint(e.buf, uint64(int64(v)))
+	}
+	return nil
+}
+
+// WritePackedInt64 writes values as the packed repeated int64 field fieldNum.
+func (e *Encoder) WritePackedInt64(fieldNum int32, values []int64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	var size int
+	for _, v := range values {
+		size += ComputeVarintSize(uint64(v))
+	}
+	e.encodePackedHeader(fieldNum, size)
+	for _, v := range values {
+		e.buf = appendVarint(e.buf, uint64(v))
+	}
+	return nil
+}
+
+// WritePackedFloat writes values as the packed repeated float field fieldNum.
+func (e *Encoder) WritePackedFloat(fieldNum int32, values []float32) error {
+	if len(values) == 0 {
+		return nil
+	}
+	e.encodePackedHeader(fieldNum, 4*len(values))
+	for _, v := range values {
+		e.buf = appendFixed32(e.buf, uint64(math.Float32bits(v)))
+	}
+	return nil
+}
+
+// WritePackedDouble writes values as the packed repeated double field fieldNum.
+func (e *Encoder) WritePackedDouble(fieldNum int32, values []float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	e.encodePackedHeader(fieldNum, 8*len(values))
+	for _, v := range values {
+		e.buf = appendFixed64(e.buf, math.Float64bits(v))
+	}
+	return nil
+}
+
+// encodePackedHeader writes the tag and length of a packed field with a body
+// of size bytes and grows the Encoder to fit the body.
+func (e *Encoder) encodePackedHeader(fieldNum int32, size int) {
+	e.buf = appendVarint(e.buf, tagAndWireType(fieldNum, WireBytes))
+	e.buf = appendVarint(e.buf, uint64(size))
+	e.Grow(size)
+}
@@ -0,0 +1,118 @@
+package codec
+
+import (
+	"io"
+	"sort"
+)
+
+// multiScratchSize is the minimum size of the scratch windows that buffers
+// created with NewMultiBuffer copy values that straddle chunks into, which
+// leaves some slack so that the reads that follow a straddling value don't
+// immediately need another copy.
+const multiScratchSize = 64
+
+// NewMultiBuffer creates a new buffer that decodes the concatenation of
+// chunks as a single message, for example a message that arrived in
+// several network reads, without first copying the chunks into one
+// contiguous slice.
+//
+// The buffer keeps track of the chunk that it is reading and its offset
+// within that chunk, and decodes straight from the chunks: values that lie
+// within a single chunk, including the slices returned for
+// length-delimited fields, alias the chunk rather than being copied. Only
+// the bytes of a value that straddles the boundary between two chunks,
+// such as a varint or a fixed-width value split at any byte, are copied,
+// into a small scratch slice, so the value can be decoded as if the chunks
+// were contiguous. Length-delimited values that span chunks are copied in
+// full, and so is the remainder of the message when Bytes is called,
+// unless it lies within a single chunk.
+//
+// Scratch slices are never reused, so unlike those of a buffer created by
+// NewBufferFromReaderAt the slices returned by the buffer stay valid for
+// as long as the chunks do. The buffer is read-only, and the chunks must
+// not be modified while it is in use.
+func NewMultiBuffer(chunks ...[]byte) *Buffer {
+	r := &multiReaderAt{chunks: chunks, offsets: make([]int, len(chunks))}
+	for i, chunk := range chunks {
+		r.offsets[i] = r.size
+		r.size += len(chunk)
+	}
+	return NewBufferFromReaderAt(r, int64(r.size))
+}
+
+// fillChunks is fill for buffers created by NewMultiBuffer. If the bytes
+// from the first byte that must be kept up to the end of the n bytes
+// needed lie within a single chunk the window becomes that chunk, from the
+// first byte to keep to its end. Otherwise the bytes are copied into a
+// newly allocated scratch window.
+func (cb *Buffer) fillChunks(r *multiReaderAt, n int) error {
+	keep := cb.index
+	if cb.pinned && cb.pin-cb.base < keep {
+		keep = cb.pin - cb.base
+	}
+	// start and end are offsets in the concatenation of the chunks.
+	start, end := cb.base+keep, cb.base+cb.index+n
+	if end > r.size {
+		end = r.size
+	}
+
+	var window []byte
+	if i := r.chunkAt(start); i >= 0 && end <= r.offsets[i]+len(r.chunks[i]) {
+		chunk := r.chunks[i]
+		window = chunk[start-r.offsets[i] : len(chunk) : len(chunk)]
+	} else if start < r.size {
+		if end < cb.base+cb.index+multiScratchSize {
+			end = cb.base + cb.index + multiScratchSize
+			if end > r.size {
+				end = r.size
+			}
+		}
+		window = make([]byte, end-start)
+		// Every byte is available, so the read can't fail.
+		_, _ = r.ReadAt(window, int64(start))
+	}
+
+	cb.buf = window
+	cb.base = start
+	cb.index -= keep
+	return nil
+}
+
+// multiReaderAt is an io.ReaderAt over the concatenation of chunks.
+type multiReaderAt struct {
+	chunks [][]byte
+	// offsets holds the offset at which each chunk starts.
+	offsets []int
+	size    int
+}
+
+// chunkAt returns the index of the chunk that holds the byte at offset off,
+// or -1 if off is at or past the end of the chunks.
+func (r *multiReaderAt) chunkAt(off int) int {
+	if off >= r.size {
+		return -1
+	}
+	// The last chunk that starts at or before off, which skips over any
+	// empty chunks that start at the same offset.
+	return sort.Search(len(r.offsets), func(i int) bool {
+		return r.offsets[i] > off
+	}) - 1
+}
+
+func (r *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(r.size) {
+		return 0, io.EOF
+	}
+	i := r.chunkAt(int(off))
+
+	var n int
+	pos := int(off) - r.offsets[i]
+	for ; n < len(p) && i < len(r.chunks); i++ {
+		n += copy(p[n:], r.chunks[i][pos:])
+		pos = 0
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
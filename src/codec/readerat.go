@@ -0,0 +1,122 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// readerAtWindowSize is the initial size of the window that buffers created
+// with NewBufferFromReaderAt read their source through.
+const readerAtWindowSize = 32 * 1024
+
+// maxVarintLen is the maximum number of bytes that a varint can occupy.
+const maxVarintLen = 10
+
+// NewBufferFromReaderAt creates a new buffer that decodes the first size
+// bytes of r without loading them into memory all at once. Instead the
+// buffer reads r through a small window that is refilled, and reused, as
+// decoding advances. Fields that are skipped are never read at all.
+//
+// Because the window is reused, slices returned by the buffer are only
+// valid until the next call that reads from it. This applies to the
+// results of DecodeRawBytes(false), ReadGroup(false), ReadGroupBuffer and
+// Bytes, and therefore also to the Bytes of any Value decoded from the
+// buffer, which typically means that they may only be used until the
+// callback that received them returns. Buffers returned by CloneStable
+// don't have this restriction. Decoding a field that is larger
+// than the window grows the window to fit it, and calling Bytes loads the
+// entire remainder of the source into memory.
+//
+// Buffers created with NewBufferFromReaderAt are read-only and encoding to
+// them fails with ErrReadOnly. Errors returned by r are returned by the decode that caused
+// the read, except for Bytes which instead returns the data read so far. If size doesn't
+// fit in an int, which can only happen on 32-bit platforms, every decode fails with an
+// error wrapping ErrOverflow.
+func NewBufferFromReaderAt(r io.ReaderAt, size int64, opts ...BufferOption) *Buffer {
+	cb := &Buffer{src: r, srcSize: int(size)}
+	if size > math.MaxInt {
+		cb.srcSize = math.MaxInt
+		cb.srcErr = fmt.Errorf("%w: source size %d exceeds the maximum of %d", ErrOverflow, size, math.MaxInt)
+	}
+	for _, opt := range opts {
+		opt(cb)
+	}
+	return cb
+}
+
+// ensure makes sure that at least n bytes are available in the window, or
+// as many as remain in the source if that's fewer. It only returns an
+// error if reading from the source fails.
+func (cb *Buffer) ensure(n int) error {
+	if cb.src == nil || len(cb.buf)-cb.index >= n {
+		return nil
+	}
+	return cb.fill(n)
+}
+
+// fill refills the window so that it holds at least n unread bytes, or as
+// many as remain in the source. Bytes before the read position are
+// discarded unless they are pinned.
+func (cb *Buffer) fill(n int) error {
+	if cb.srcErr != nil {
+		return cb.srcErr
+	}
+	if r, ok := cb.src.(*multiReaderAt); ok {
+		return cb.fillChunks(r, n)
+	}
+	keep := cb.index
+	if cb.pinned && cb.pin-cb.base < keep {
+		keep = cb.pin - cb.base
+	}
+	var (
+		retained = len(cb.buf) - keep
+		need     = cb.index - keep + n
+		avail    = cb.srcSize - cb.base - keep
+	)
+
+	window := cb.buf[:cap(cb.buf)]
+	if cb.sharedWindow || cb.stableWindows || cap(window) < need {
+		size := cap(window)
+		if size < need {
+			size = 2 * size
+		}
+		if size < need {
+			size = need
+		}
+		if size < readerAtWindowSize {
+			size = readerAtWindowSize
+		}
+		window = make([]byte, size)
+		cb.sharedWindow = false
+	}
+	copy(window, cb.buf[keep:])
+
+	target := len(window)
+	if target > avail {
+		target = avail
+	}
+	if target > retained {
+		read, err := cb.src.ReadAt(window[retained:target], int64(cb.base+keep+retained))
+		if read < target-retained {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	cb.buf = window[:target]
+	cb.base += keep
+	cb.index -= keep
+	return nil
+}
+
+// unread returns the number of bytes in the source that have not been
+// loaded into the window yet.
+func (cb *Buffer) unread() int {
+	if cb.src == nil {
+		return 0
+	}
+	return cb.srcSize - cb.base - len(cb.buf)
+}
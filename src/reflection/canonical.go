@@ -0,0 +1,400 @@
+package reflection
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Canonicalize re-encodes the message stored in buffer, which is described by md, in a
+// deterministic form so that equal messages produce identical bytes no matter how they
+// were originally encoded. This makes the output suitable for signing, hashing and use
+// as a cache key:
+//
+//  1. Fields are written in ascending field number order. Unknown fields are included
+//     in that order with their occurrences copied as is.
+//  2. Repeated scalar fields are always packed.
+//  3. Map entries are sorted by key, duplicate keys are resolved in favor of the last
+//     entry, and every entry is written with both its key and its value.
+//  4. Singular fields that occur more than once are reduced to their last occurrence,
+//     or merged in the case of messages, and fields without presence that hold their
+//     default value are omitted.
+//  5. Varints are re-encoded minimally, with int32 and enum values sign-extended and
+//     bools normalized to 0 or 1.
+//  6. Nested messages, including map values, are canonicalized recursively.
+//
+// Groups are not supported, and an error wrapping molecule.ErrMaxDepth is returned for
+// messages nested more than molecule.DefaultMaxDepth levels deep. The buffer is consumed.
+func Canonicalize(buffer *codec.Buffer, md protoreflect.MessageDescriptor) ([]byte, error) {
+	out := codec.NewBuffer(nil)
+	if err := canonicalize(out, buffer.Bytes(), md, 1); err != nil {
+		return nil, fmt.Errorf("Canonicalize: %w", err)
+	}
+	buffer.SkipToEnd()
+	return out.Bytes(), nil
+}
+
+// canonicalize writes the canonical form of the message b, which is at the given depth,
+// to out.
+func canonicalize(out *codec.Buffer, b []byte, md protoreflect.MessageDescriptor, depth int) error {
+	// Group the occurrences of each field in a single pass. The values alias b, so nested
+	// messages are never copied on the way down.
+	var (
+		fieldNums []int32
+		byField   = make(map[int32][]molecule.Value)
+	)
+	err := molecule.MessageEach(codec.NewBuffer(b), func(fieldNum int32, value molecule.Value) (bool, error) {
+		if _, ok := byField[fieldNum]; !ok {
+			fieldNums = append(fieldNums, fieldNum)
+		}
+		byField[fieldNum] = append(byField[fieldNum], value)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(fieldNums, func(i, j int) bool { return fieldNums[i] < fieldNums[j] })
+
+	for _, fieldNum := range fieldNums {
+		var (
+			values = byField[fieldNum]
+			fd     = md.Fields().ByNumber(protoreflect.FieldNumber(fieldNum))
+			err    error
+		)
+		switch {
+		case fd == nil:
+			err = writeUnknown(out, fieldNum, values)
+		case fd.Kind() == protoreflect.GroupKind:
+			err = fmt.Errorf("field %s: groups are not supported", fd.FullName())
+		case fd.IsMap():
+			err = writeMap(out, fd, values, depth)
+		case fd.IsList():
+			err = writeList(out, fd, values, depth)
+		default:
+			err = writeSingular(out, fd, values, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUnknown(out *codec.Buffer, fieldNum int32, values []molecule.Value) error {
+	for _, v := range values {
+		if err := out.EncodeTagAndWireType(fieldNum, v.WireType); err != nil {
+			return err
+		}
+		var err error
+		switch v.WireType {
+		case codec.WireVarint:
+			err = out.EncodeVarint(v.Number)
+		case codec.WireFixed32:
+			err = out.EncodeFixed32(v.Number)
+		case codec.WireFixed64:
+			err = out.EncodeFixed64(v.Number)
+		default:
+			err = out.EncodeRawBytes(v.Bytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSingular(
+	out *codec.Buffer, fd protoreflect.FieldDescriptor, values []molecule.Value, depth int,
+) error {
+	if fd.Kind() == protoreflect.MessageKind {
+		// Occurrences of a singular message field are merged, which is equivalent to
+		// concatenating their encodings. A single occurrence is used as is.
+		for _, v := range values {
+			if err := checkWireType(fd, v, codec.WireBytes); err != nil {
+				return err
+			}
+		}
+		merged := values[0].Bytes
+		if len(values) > 1 {
+			merged = nil
+			for _, v := range values {
+				merged = append(merged, v.Bytes...)
+			}
+		}
+		return writeMessage(out, int32(fd.Number()), merged, fd.Message(), depth+1)
+	}
+
+	v := values[len(values)-1]
+	if err := checkWireType(fd, v, wireTypeForKind(fd.Kind())); err != nil {
+		return err
+	}
+	if !fd.HasPresence() && isDefault(fd.Kind(), v) {
+		return nil
+	}
+	return writeField(out, int32(fd.Number()), fd.Kind(), v)
+}
+
+func writeList(out *codec.Buffer, fd protoreflect.FieldDescriptor, values []molecule.Value, depth int) error {
+	var (
+		fieldNum = int32(fd.Number())
+		kind     = fd.Kind()
+		wireType = wireTypeForKind(kind)
+	)
+	if wireType == codec.WireBytes {
+		// Strings, bytes and messages can't be packed.
+		for _, v := range values {
+			if err := checkWireType(fd, v, codec.WireBytes); err != nil {
+				return err
+			}
+			var err error
+			if kind == protoreflect.MessageKind {
+				err = writeMessage(out, fieldNum, v.Bytes, fd.Message(), depth+1)
+			} else {
+				err = writeField(out, fieldNum, kind, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	packed := codec.NewBuffer(nil)
+	for _, v := range values {
+		if v.WireType == wireType {
+			if err := writeScalar(packed, kind, v); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkWireType(fd, v, codec.WireBytes); err != nil {
+			return err
+		}
+		elements := codec.NewBuffer(v.Bytes)
+		for !elements.EOF() {
+			element := molecule.Value{WireType: wireType}
+			var err error
+			switch wireType {
+			case codec.WireVarint:
+				element.Number, err = elements.DecodeVarint()
+			case codec.WireFixed32:
+				element.Number, err = elements.DecodeFixed32()
+			case codec.WireFixed64:
+				element.Number, err = elements.DecodeFixed64()
+			}
+			if err != nil {
+				return fmt.Errorf("field %s: error decoding packed element: %w", fd.FullName(), err)
+			}
+			if err := writeScalar(packed, kind, element); err != nil {
+				return err
+			}
+		}
+	}
+	if packed.Len() == 0 {
+		return nil
+	}
+	if err := out.EncodeTagAndWireType(fieldNum, codec.WireBytes); err != nil {
+		return err
+	}
+	return out.EncodeRawBytes(packed.Bytes())
+}
+
+// mapEntry is a decoded map entry along with the key that entries are sorted by.
+type mapEntry struct {
+	key, value molecule.Value
+	// Exactly one of the following is used depending on the kind of the key.
+	str    []byte
+	signed int64
+	number uint64
+}
+
+func writeMap(out *codec.Buffer, fd protoreflect.FieldDescriptor, values []molecule.Value, depth int) error {
+	var (
+		keyFd   = fd.MapKey()
+		valueFd = fd.MapValue()
+		entries []mapEntry
+		// Indexes into entries by the key's encoding so that later duplicates replace
+		// earlier ones.
+		byKey = make(map[string]int)
+	)
+	for _, v := range values {
+		if err := checkWireType(fd, v, codec.WireBytes); err != nil {
+			return err
+		}
+		entry := mapEntry{
+			key:   molecule.Value{WireType: wireTypeForKind(keyFd.Kind())},
+			value: molecule.Value{WireType: wireTypeForKind(valueFd.Kind())},
+		}
+		err := molecule.MessageEach(codec.NewBuffer(v.Bytes), func(fieldNum int32, v molecule.Value) (bool, error) {
+			switch fieldNum {
+			case 1:
+				entry.key = v
+				return true, checkWireType(keyFd, v, wireTypeForKind(keyFd.Kind()))
+			case 2:
+				entry.value = v
+				return true, checkWireType(valueFd, v, wireTypeForKind(valueFd.Kind()))
+			}
+			return true, nil
+		})
+		if err != nil {
+			return fmt.Errorf("field %s: error decoding map entry: %w", fd.FullName(), err)
+		}
+
+		key := codec.NewBuffer(nil)
+		if err := writeScalarOrBytes(key, keyFd.Kind(), entry.key); err != nil {
+			return err
+		}
+		setSortKey(&entry, keyFd.Kind())
+		if i, ok := byKey[string(key.Bytes())]; ok {
+			entries[i] = entry
+			continue
+		}
+		byKey[string(key.Bytes())] = len(entries)
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		switch keyFd.Kind() {
+		case protoreflect.StringKind:
+			return bytes.Compare(a.str, b.str) < 0
+		case protoreflect.Int32Kind, protoreflect.Int64Kind,
+			protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+			protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind:
+			return a.signed < b.signed
+		default:
+			return a.number < b.number
+		}
+	})
+
+	for _, entry := range entries {
+		encoded := codec.NewBuffer(nil)
+		if err := writeField(encoded, 1, keyFd.Kind(), entry.key); err != nil {
+			return err
+		}
+		var err error
+		if valueFd.Kind() == protoreflect.MessageKind {
+			// The map value is nested in the entry, which is nested in the message.
+			err = writeMessage(encoded, 2, entry.value.Bytes, valueFd.Message(), depth+2)
+		} else {
+			err = writeField(encoded, 2, valueFd.Kind(), entry.value)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := out.EncodeTagAndWireType(int32(fd.Number()), codec.WireBytes); err != nil {
+			return err
+		}
+		if err := out.EncodeRawBytes(encoded.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSortKey populates the field of entry that entries with keys of the given kind are
+// sorted by.
+func setSortKey(entry *mapEntry, kind protoreflect.Kind) {
+	n := entry.key.Number
+	switch kind {
+	case protoreflect.StringKind:
+		entry.str = entry.key.Bytes
+	case protoreflect.Int32Kind, protoreflect.Sfixed32Kind:
+		entry.signed = int64(int32(n))
+	case protoreflect.Int64Kind, protoreflect.Sfixed64Kind:
+		entry.signed = int64(n)
+	case protoreflect.Sint32Kind:
+		entry.signed = int64(codec.DecodeZigZag32(n))
+	case protoreflect.Sint64Kind:
+		entry.signed = codec.DecodeZigZag64(n)
+	default:
+		entry.number = normalizeVarint(kind, n)
+	}
+}
+
+// writeMessage writes a message field containing the canonical form of the message b,
+// which is at the given depth.
+func writeMessage(
+	out *codec.Buffer, fieldNum int32, b []byte, md protoreflect.MessageDescriptor, depth int,
+) error {
+	if depth > molecule.DefaultMaxDepth {
+		return fmt.Errorf("message %s: %w: messages nested more than %d deep",
+			md.FullName(), molecule.ErrMaxDepth, molecule.DefaultMaxDepth)
+	}
+	nested := codec.NewBuffer(nil)
+	if err := canonicalize(nested, b, md, depth); err != nil {
+		return err
+	}
+	if err := out.EncodeTagAndWireType(fieldNum, codec.WireBytes); err != nil {
+		return err
+	}
+	return out.EncodeRawBytes(nested.Bytes())
+}
+
+// writeField writes a field containing a single scalar, string or bytes value.
+func writeField(out *codec.Buffer, fieldNum int32, kind protoreflect.Kind, v molecule.Value) error {
+	if err := out.EncodeTagAndWireType(fieldNum, wireTypeForKind(kind)); err != nil {
+		return err
+	}
+	return writeScalarOrBytes(out, kind, v)
+}
+
+func writeScalarOrBytes(out *codec.Buffer, kind protoreflect.Kind, v molecule.Value) error {
+	if wireTypeForKind(kind) == codec.WireBytes {
+		return out.EncodeRawBytes(v.Bytes)
+	}
+	return writeScalar(out, kind, v)
+}
+
+// writeScalar writes the value of a scalar without a tag.
+func writeScalar(out *codec.Buffer, kind protoreflect.Kind, v molecule.Value) error {
+	switch wireTypeForKind(kind) {
+	case codec.WireFixed32:
+		return out.EncodeFixed32(v.Number)
+	case codec.WireFixed64:
+		return out.EncodeFixed64(v.Number)
+	default:
+		return out.EncodeVarint(normalizeVarint(kind, v.Number))
+	}
+}
+
+// normalizeVarint returns the canonical varint encoding of n, a value of the given kind
+// that may have been encoded by a lenient encoder.
+func normalizeVarint(kind protoreflect.Kind, n uint64) uint64 {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.EnumKind:
+		return uint64(int64(int32(n)))
+	case protoreflect.Uint32Kind, protoreflect.Sint32Kind:
+		return uint64(uint32(n))
+	case protoreflect.BoolKind:
+		if n != 0 {
+			return 1
+		}
+		return 0
+	default:
+		return n
+	}
+}
+
+// isDefault returns whether v holds the default value for its kind. Negative zero is not
+// considered a default, matching the official implementations.
+func isDefault(kind protoreflect.Kind, v molecule.Value) bool {
+	if v.WireType == codec.WireBytes {
+		return len(v.Bytes) == 0
+	}
+	return normalizeVarint(kind, v.Number) == 0
+}
+
+func checkWireType(fd protoreflect.FieldDescriptor, v molecule.Value, expected codec.WireType) error {
+	if v.WireType != expected {
+		return fmt.Errorf(
+			"field %s of kind %s expects wiretype %d, got: %d", fd.FullName(), fd.Kind(), expected, v.WireType)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package reflection
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/richardartoul/molecule"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DecodeEnumName interprets value as a member of the enum described by ed and returns
+// the member's name, for example to print readable enum values in dumps. Enums are
+// treated as open, so a number that ed doesn't declare is returned in its decimal form,
+// such as "-7", rather than as an error. If several names share a number, the first one
+// declared is returned.
+func DecodeEnumName(value molecule.Value, ed protoreflect.EnumDescriptor) (string, error) {
+	n, err := molecule.DecodeEnum[int32](value, nil)
+	if err != nil {
+		return "", fmt.Errorf("DecodeEnumName: %w", err)
+	}
+	if ev := ed.Values().ByNumber(protoreflect.EnumNumber(n)); ev != nil {
+		return string(ev.Name()), nil
+	}
+	return strconv.Itoa(int(n)), nil
+}
@@ -0,0 +1,40 @@
+package reflection
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DecodePresence reports which of the fields declared by md are present in the message
+// stored in buffer. The result contains an entry for every declared field, keyed by field
+// number, which is true if the field occurred at least once. Fields in the message that
+// md doesn't declare are ignored.
+//
+// For fields with explicit presence, such as proto2 optional and required fields, this
+// distinguishes a field that was set to its default value from one that was never set.
+// Fields without presence are omitted from the encoding when they hold their default
+// value, so for them false only means that the field has its default value.
+//
+// The buffer is consumed.
+func DecodePresence(buffer *codec.Buffer, md protoreflect.MessageDescriptor) (map[int32]bool, error) {
+	fields := md.Fields()
+	presence := make(map[int32]bool, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		presence[int32(fields.Get(i).Number())] = false
+	}
+
+	err := molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+		if _, ok := presence[fieldNum]; ok {
+			presence[fieldNum] = true
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DecodePresence: %w", err)
+	}
+	return presence, nil
+}
@@ -0,0 +1,111 @@
+// Package reflection bridges molecule with the official protobuf reflection APIs
+// (google.golang.org/protobuf/reflect/protoreflect). It lives in its own package so
+// that the core molecule library remains free of external dependencies.
+package reflection
+
+import (
+	"fmt"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ToProtoreflect converts v into the protoreflect.Value described by fd. The field
+// descriptor provides the type context that the raw wire value lacks, for example
+// whether a varint should be interpreted as an int32, a sint32 or an enum.
+//
+// For repeated fields v must be a single element. Packed repeated fields should be
+// iterated with molecule.PackedRepeatedEach and each element converted individually.
+//
+// String and bytes values are copied so the result does not alias the buffer that v
+// was read from. Message values are unmarshaled into a dynamicpb message built from
+// fd's message descriptor.
+func ToProtoreflect(v molecule.Value, fd protoreflect.FieldDescriptor) (protoreflect.Value, error) {
+	if expected := wireTypeForKind(fd.Kind()); v.WireType != expected {
+		return protoreflect.Value{}, fmt.Errorf(
+			"ToProtoreflect: field %s of kind %s expects wiretype %d, got: %d",
+			fd.FullName(), fd.Kind(), expected, v.WireType)
+	}
+
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		b, err := v.AsBool()
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.EnumKind:
+		e, err := v.AsInt32()
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(e)), err
+	case protoreflect.Int32Kind:
+		i, err := v.AsInt32()
+		return protoreflect.ValueOfInt32(i), err
+	case protoreflect.Sint32Kind:
+		i, err := v.AsSint32()
+		return protoreflect.ValueOfInt32(i), err
+	case protoreflect.Sfixed32Kind:
+		i, err := v.AsSFixed32()
+		return protoreflect.ValueOfInt32(i), err
+	case protoreflect.Int64Kind:
+		i, err := v.AsInt64()
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Sint64Kind:
+		i, err := v.AsSint64()
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Sfixed64Kind:
+		i, err := v.AsSFixed64()
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Uint32Kind:
+		u, err := v.AsUint32()
+		return protoreflect.ValueOfUint32(u), err
+	case protoreflect.Fixed32Kind:
+		u, err := v.AsFixed32()
+		return protoreflect.ValueOfUint32(u), err
+	case protoreflect.Uint64Kind:
+		u, err := v.AsUint64()
+		return protoreflect.ValueOfUint64(u), err
+	case protoreflect.Fixed64Kind:
+		u, err := v.AsFixed64()
+		return protoreflect.ValueOfUint64(u), err
+	case protoreflect.FloatKind:
+		f, err := v.AsFloat()
+		return protoreflect.ValueOfFloat32(f), err
+	case protoreflect.DoubleKind:
+		f, err := v.AsDouble()
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.StringKind:
+		s, err := v.AsStringSafe()
+		return protoreflect.ValueOfString(s), err
+	case protoreflect.BytesKind:
+		b, err := v.AsBytesSafe()
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.MessageKind:
+		m := dynamicpb.NewMessage(fd.Message())
+		if err := proto.Unmarshal(v.Bytes, m); err != nil {
+			return protoreflect.Value{}, fmt.Errorf(
+				"ToProtoreflect: error unmarshaling message field %s: %v", fd.FullName(), err)
+		}
+		return protoreflect.ValueOfMessage(m), nil
+	default:
+		return protoreflect.Value{}, fmt.Errorf(
+			"ToProtoreflect: unsupported kind %s for field %s", fd.Kind(), fd.FullName())
+	}
+}
+
+// wireTypeForKind returns the wire type that a single (non-packed) value of the given
+// kind is encoded with.
+func wireTypeForKind(kind protoreflect.Kind) codec.WireType {
+	switch kind {
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind, protoreflect.FloatKind:
+		return codec.WireFixed32
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind, protoreflect.DoubleKind:
+		return codec.WireFixed64
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.MessageKind:
+		return codec.WireBytes
+	case protoreflect.GroupKind:
+		return codec.WireStartGroup
+	default:
+		return codec.WireVarint
+	}
+}
@@ -0,0 +1,116 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// AssertNoAllocs fails t if fn allocates any memory, averaged over a number of runs, and
+// reports whether it succeeded.
+func AssertNoAllocs(t testing.TB, fn func()) bool {
+	t.Helper()
+	if allocs := testing.AllocsPerRun(100, fn); allocs > 0 {
+		t.Errorf("expected no allocations, got %v per run", allocs)
+		return false
+	}
+	return true
+}
+
+// recordingTB captures failures instead of failing the test so that AssertNoAllocs itself
+// can be tested.
+type recordingTB struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.failed = true
+}
+
+var allocSink []byte
+
+func TestAssertNoAllocs(t *testing.T) {
+	recorder := &recordingTB{TB: t}
+	require.False(t, AssertNoAllocs(recorder, func() {
+		allocSink = make([]byte, 64)
+	}))
+	require.True(t, recorder.failed)
+
+	recorder = &recordingTB{TB: t}
+	require.True(t, AssertNoAllocs(recorder, func() {}))
+	require.False(t, recorder.failed)
+}
+
+func TestZeroAllocs(t *testing.T) {
+	m := &simple.Simple{Int64: 10, String_: "hello", Bytes: []byte("world"), Double: 1.5}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	t.Run("MessageEach", func(t *testing.T) {
+		buffer := codec.NewBuffer(nil)
+		AssertNoAllocs(t, func() {
+			buffer.Reset(marshaled)
+			if err := molecule.MessageEach(buffer, nopMessageEachFn); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+
+	t.Run("AsMessage recursion", func(t *testing.T) {
+		data := encodeTree(t, 6)
+		w := &asMessageWalker{}
+		require.NoError(t, w.walk(codec.NewBuffer(data)))
+		// A full binary tree of depth 6 has 2^7-1 nodes.
+		require.Equal(t, 127, w.nodes)
+
+		AssertNoAllocs(t, func() {
+			if err := w.walk(codec.NewBuffer(data)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+
+	t.Run("PackedRepeatedEach", func(t *testing.T) {
+		packed := []byte{0x01, 0x96, 0x01, 0xff, 0xff, 0x03}
+		buffer := codec.NewBuffer(nil)
+		AssertNoAllocs(t, func() {
+			buffer.Reset(packed)
+			err := molecule.PackedRepeatedEach(buffer, codec.FieldType_INT64, func(value molecule.Value) (bool, error) {
+				return true, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+// asMessageWalker counts the nodes of a tree built by encodeTree by recursing into the
+// nested messages with Value.AsMessage.
+type asMessageWalker struct {
+	nodes int
+}
+
+func (w *asMessageWalker) walk(buffer *codec.Buffer) error {
+	w.nodes++
+	return molecule.MessageEach(buffer, w.visit)
+}
+
+func (w *asMessageWalker) visit(fieldNum int32, value molecule.Value) (bool, error) {
+	if fieldNum != 1 {
+		return true, nil
+	}
+	sub, err := value.AsMessage()
+	if err != nil {
+		return false, err
+	}
+	return true, w.walk(sub)
+}
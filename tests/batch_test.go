@@ -0,0 +1,99 @@
+package moleculetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEachBatch(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	for i := 1; i <= 7; i++ {
+		encodeVarintField(t, encoder, int32(i), uint64(i*10))
+	}
+	data := encoder.Bytes()
+
+	for _, batchSize := range []int{1, 2, 3, 7, 8, 100} {
+		var (
+			sizes  []int
+			fields []int32
+			values []uint64
+			first  *molecule.FieldEntry
+		)
+		err := molecule.MessageEachBatch(codec.NewBuffer(data), batchSize, func(batch []molecule.FieldEntry) (bool, error) {
+			// The backing array is reused for every batch.
+			if first == nil {
+				first = &batch[0]
+			}
+			require.True(t, first == &batch[0])
+
+			sizes = append(sizes, len(batch))
+			for _, f := range batch {
+				fields = append(fields, f.FieldNum)
+				values = append(values, f.Value.Number)
+			}
+			return true, nil
+		})
+		require.NoError(t, err, "batch size %d", batchSize)
+		require.Equal(t, []int32{1, 2, 3, 4, 5, 6, 7}, fields, "batch size %d", batchSize)
+		require.Equal(t, []uint64{10, 20, 30, 40, 50, 60, 70}, values, "batch size %d", batchSize)
+
+		var expectedSizes []int
+		for remaining := 7; remaining > 0; remaining -= batchSize {
+			if remaining < batchSize {
+				expectedSizes = append(expectedSizes, remaining)
+			} else {
+				expectedSizes = append(expectedSizes, batchSize)
+			}
+		}
+		require.Equal(t, expectedSizes, sizes, "batch size %d", batchSize)
+	}
+
+	// Stopping early skips the remaining fields, including a partial final batch.
+	var calls int
+	err := molecule.MessageEachBatch(codec.NewBuffer(data), 3, func(batch []molecule.FieldEntry) (bool, error) {
+		calls++
+		return false, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = molecule.MessageEachBatch(codec.NewBuffer(data), 3, func(batch []molecule.FieldEntry) (bool, error) {
+		calls++
+		return calls < 2, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// Errors from fn are returned as is, including for the final batch.
+	errStop := errors.New("stop")
+	err = molecule.MessageEachBatch(codec.NewBuffer(data), 4, func(batch []molecule.FieldEntry) (bool, error) {
+		if len(batch) < 4 {
+			return false, errStop
+		}
+		return true, nil
+	})
+	require.Equal(t, errStop, err)
+
+	// Empty messages never call fn.
+	err = molecule.MessageEachBatch(codec.NewBuffer(nil), 3, func(batch []molecule.FieldEntry) (bool, error) {
+		t.Fatal("unexpected batch")
+		return false, nil
+	})
+	require.NoError(t, err)
+
+	// Fields decoded before a corrupt one aren't delivered as a partial batch.
+	err = molecule.MessageEachBatch(codec.NewBuffer(append(data, 0x0a, 0x05)), 100, func(batch []molecule.FieldEntry) (bool, error) {
+		t.Fatal("unexpected batch")
+		return false, nil
+	})
+	require.Error(t, err)
+
+	require.Error(t, molecule.MessageEachBatch(codec.NewBuffer(data), 0, nil))
+}
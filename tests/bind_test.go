@@ -0,0 +1,66 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBind(t *testing.T) {
+	m := &simple.Simple{
+		Double:   1.5,
+		Float:    -2.5,
+		Int32:    -3,
+		Int64:    1 << 40,
+		Uint32:   5,
+		Uint64:   1 << 50,
+		Sint32:   -7,
+		Sint64:   -8,
+		Fixed32:  9,
+		Fixed64:  10,
+		Sfixed32: -11,
+		Sfixed64: -12,
+		Bool:     true,
+		String_:  "hello",
+		Bytes:    []byte("world"),
+	}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	var (
+		got       simple.Simple
+		untouched = int32(42)
+	)
+	err = molecule.Bind(codec.NewBuffer(marshaled),
+		molecule.BindDouble(1, &got.Double),
+		molecule.BindFloat(2, &got.Float),
+		molecule.BindInt32(3, &got.Int32),
+		molecule.BindInt64(4, &got.Int64),
+		molecule.BindUint32(5, &got.Uint32),
+		molecule.BindUint64(6, &got.Uint64),
+		molecule.BindSint32(7, &got.Sint32),
+		molecule.BindSint64(8, &got.Sint64),
+		molecule.BindFixed32(9, &got.Fixed32),
+		molecule.BindFixed64(10, &got.Fixed64),
+		molecule.BindSFixed32(11, &got.Sfixed32),
+		molecule.BindSFixed64(12, &got.Sfixed64),
+		molecule.BindBool(13, &got.Bool),
+		molecule.BindString(14, &got.String_),
+		molecule.BindBytes(15, &got.Bytes),
+		molecule.BindInt32(100, &untouched),
+	)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(m, &got))
+	require.Equal(t, int32(42), untouched)
+
+	t.Run("wire type mismatch", func(t *testing.T) {
+		var s string
+		err := molecule.Bind(codec.NewBuffer(marshaled), molecule.BindString(3, &s))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,1315 @@
+package moleculetest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecSentinelErrors(t *testing.T) {
+	t.Run("overflow", func(t *testing.T) {
+		buffer := codec.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+		_, err := buffer.DecodeVarint()
+		require.True(t, errors.Is(err, codec.ErrOverflow))
+	})
+
+	t.Run("bad wire type", func(t *testing.T) {
+		// Field 1 with the reserved wire type 6.
+		buffer := codec.NewBuffer([]byte{1<<3 | 6})
+		err := buffer.SkipGroup()
+		require.True(t, errors.Is(err, codec.ErrBadWireType))
+	})
+
+	t.Run("tag out of range", func(t *testing.T) {
+		// A tag varint whose field number doesn't fit in an int32.
+		buffer := codec.NewBuffer([]byte{0xf8, 0xff, 0xff, 0xff, 0x7f})
+		_, _, err := buffer.DecodeTagAndWireType()
+		require.True(t, errors.Is(err, codec.ErrTagOutOfRange))
+
+		err = molecule.MessageEach(codec.NewBuffer([]byte{0xf8, 0xff, 0xff, 0xff, 0x7f}), nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrTagOutOfRange))
+	})
+
+	t.Run("field number zero", func(t *testing.T) {
+		// Every wire type, as well as a redundantly encoded zero.
+		for _, tag := range [][]byte{{0x00}, {0x02}, {0x05}, {0x80, 0x00}} {
+			buffer := codec.NewBuffer(append(tag, 0x01))
+			_, _, err := buffer.DecodeTagAndWireType()
+			require.True(t, errors.Is(err, codec.ErrTagOutOfRange), "tag %x", tag)
+			require.Contains(t, err.Error(), "field number 0")
+		}
+
+		// Typically zero padding after the end of a message.
+		err := molecule.MessageEach(codec.NewBuffer([]byte{0x08, 0x01, 0x00, 0x00}), nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrTagOutOfRange))
+
+		// The smallest valid field number is accepted.
+		fieldNum, _, err := codec.NewBuffer([]byte{0x08}).DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.Equal(t, int32(1), fieldNum)
+	})
+
+	t.Run("bad length", func(t *testing.T) {
+		require.True(t, errors.Is(codec.NewBuffer(nil).Skip(-1), codec.ErrBadLength))
+
+		// A length of 1<<63 doesn't fit in an int.
+		length := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}
+		_, err := codec.NewBuffer(length).DecodeRawBytes(false)
+		require.True(t, errors.Is(err, codec.ErrBadLength))
+
+		err = molecule.MessageEach(codec.NewBuffer(append([]byte{1<<3 | 2}, length...)), nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrBadLength))
+	})
+}
+
+func nopMessageEachFn(fieldNum int32, value molecule.Value) (bool, error) {
+	return true, nil
+}
+
+func TestSkipFieldMaxFieldLength(t *testing.T) {
+	// A field declaring a 100 byte length that is entirely present in the buffer.
+	data := append([]byte{100}, make([]byte, 100)...)
+
+	buffer := codec.NewBuffer(data)
+	require.NoError(t, buffer.SkipField(codec.WireBytes))
+	require.True(t, buffer.EOF())
+
+	buffer = codec.NewBuffer(data)
+	buffer.SetMaxFieldLength(99)
+	err := buffer.SkipField(codec.WireBytes)
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+
+	buffer.Reset(data)
+	_, err = buffer.DecodeRawBytes(false)
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+
+	// The limit also applies to fields skipped as part of a group.
+	group := append(append([]byte{1<<3 | byte(codec.WireBytes)}, data...), 1<<3|byte(codec.WireEndGroup))
+	buffer.Reset(group)
+	err = buffer.SkipGroup()
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+}
+
+func TestWithMaxMessageSize(t *testing.T) {
+	data := append([]byte{1<<3 | byte(codec.WireBytes), 100}, make([]byte, 100)...)
+
+	err := molecule.MessageEach(codec.NewBuffer(data), nopMessageEachFn, molecule.WithMaxMessageSize(100))
+	require.NoError(t, err)
+
+	err = molecule.MessageEach(codec.NewBuffer(data), nopMessageEachFn, molecule.WithMaxMessageSize(99))
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+}
+
+func TestDecodeVarintN(t *testing.T) {
+	for n := 1; n <= 10; n++ {
+		// The smallest value that requires n bytes.
+		var value uint64
+		if n > 1 {
+			value = 1 << (7 * uint(n-1))
+		}
+		buffer := codec.NewBuffer(nil)
+		require.NoError(t, buffer.EncodeVarint(value))
+		// Trailing data must not be counted.
+		buffer.Write([]byte{0x01})
+
+		decoded, consumed, err := buffer.DecodeVarintN()
+		require.NoError(t, err)
+		require.Equal(t, value, decoded)
+		require.Equal(t, n, consumed)
+		require.Equal(t, 1, buffer.Len())
+	}
+
+	_, _, err := codec.NewBuffer([]byte{0x80}).DecodeVarintN()
+	require.Error(t, err)
+}
+
+func TestNegativeLengthRejected(t *testing.T) {
+	// 0xffffffffffffffff doesn't fit in an int, it would convert to -1.
+	negative := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	buffer := codec.NewBuffer(append(append([]byte(nil), negative...), 0x00))
+	err := buffer.SkipField(codec.WireBytes)
+	require.True(t, errors.Is(err, codec.ErrBadLength))
+
+	buffer = codec.NewBuffer(negative)
+	_, err = buffer.DecodeRawBytes(true)
+	require.True(t, errors.Is(err, codec.ErrBadLength))
+
+	// A negative length inside of a group.
+	group := append([]byte{1<<3 | byte(codec.WireBytes)}, negative...)
+	err = codec.NewBuffer(group).SkipGroup()
+	require.True(t, errors.Is(err, codec.ErrBadLength))
+
+	buffer = codec.NewBuffer([]byte{0x01, 0x02})
+	require.True(t, errors.Is(buffer.Skip(-1), codec.ErrBadLength))
+	require.Equal(t, 2, buffer.Len())
+}
+
+func TestLengthOverflow(t *testing.T) {
+	encodeLength := func(l uint64) []byte {
+		buffer := codec.NewBuffer(nil)
+		require.NoError(t, buffer.EncodeVarint(l))
+		return buffer.Bytes()
+	}
+
+	// The largest length that fits in an int is merely longer than the data.
+	_, err := codec.NewBuffer(encodeLength(math.MaxInt)).DecodeRawBytes(false)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Anything larger overflows, whatever the size of an int on this platform. On 32-bit
+	// platforms this includes lengths that used to be truncated, such as 1<<32 | 1.
+	overflowing := []uint64{math.MaxInt + 1, math.MaxUint64}
+	if math.MaxInt == math.MaxInt32 {
+		overflowing = append(overflowing, 1<<32|1)
+	}
+	for _, l := range overflowing {
+		data := append(encodeLength(l), 0x00)
+		_, err := codec.NewBuffer(data).DecodeRawBytes(false)
+		require.True(t, errors.Is(err, codec.ErrOverflow), "length %d", l)
+		require.True(t, errors.Is(err, codec.ErrBadLength), "length %d", l)
+
+		err = codec.NewBuffer(data).SkipField(codec.WireBytes)
+		require.True(t, errors.Is(err, codec.ErrOverflow), "length %d", l)
+
+		err = molecule.MessageEach(codec.NewBuffer(append([]byte{1<<3 | 2}, data...)), nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrOverflow), "length %d", l)
+	}
+}
+
+func TestBufferGrow(t *testing.T) {
+	buffer := codec.NewBuffer([]byte{1})
+	buffer.Grow(64)
+	require.Equal(t, []byte{1}, buffer.Bytes())
+
+	// Encoding up to the requested number of bytes must not reallocate.
+	start := &buffer.Bytes()[0]
+	for i := 0; i < 16; i++ {
+		require.NoError(t, buffer.EncodeFixed32(uint64(i)))
+	}
+	require.Equal(t, 65, buffer.Len())
+	require.True(t, start == &buffer.Bytes()[0])
+
+	require.Panics(t, func() { buffer.Grow(-1) })
+}
+
+func TestReadGroupBuffer(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireStartGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(150))
+	require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hi")))
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireEndGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(4, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(7))
+
+	buffer := codec.NewBuffer(encoder.Bytes())
+	fieldNum, wireType, err := buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fieldNum)
+	require.Equal(t, codec.WireStartGroup, wireType)
+
+	group, err := buffer.ReadGroupBuffer()
+	require.NoError(t, err)
+
+	var (
+		num int64
+		str string
+	)
+	err = molecule.MessageEach(group, func(fieldNum int32, value molecule.Value) (bool, error) {
+		var err error
+		switch fieldNum {
+		case 2:
+			num, err = value.AsInt64()
+		case 3:
+			str, err = value.AsStringSafe()
+		default:
+			t.Fatalf("unexpected field %d in group", fieldNum)
+		}
+		return true, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(150), num)
+	require.Equal(t, "hi", str)
+
+	// The outer buffer continues after the group's end tag.
+	fieldNum, _, err = buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	require.Equal(t, int32(4), fieldNum)
+	v, err := buffer.DecodeVarint()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), v)
+	require.True(t, buffer.EOF())
+}
+
+func TestComputeVarintSize(t *testing.T) {
+	values := []uint64{0, 1, 127, 128, 16383, 16384, math.MaxUint32, math.MaxInt64, math.MaxUint64}
+	for shift := 0; shift < 64; shift++ {
+		values = append(values, 1<<shift, 1<<shift-1, 1<<shift+1)
+	}
+
+	buffer := codec.NewBuffer(nil)
+	for _, v := range values {
+		buffer.Reset(nil)
+		require.NoError(t, buffer.EncodeVarint(v))
+		require.Equal(t, buffer.Len(), codec.ComputeVarintSize(v), "value %d", v)
+	}
+}
+
+func TestWithByteAllocator(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hello")))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hi")))
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(1))
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireEndGroup))
+
+	var (
+		requests []int
+		arena    = make([]byte, 0, 64)
+	)
+	buffer := codec.NewBufferWithOptions(encoder.Bytes(), codec.WithByteAllocator(func(n int) []byte {
+		requests = append(requests, n)
+		arena = arena[len(arena):]
+		return arena[:n]
+	}))
+
+	b, err := buffer.DecodeRawBytes(true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), b)
+
+	// Views into the buffer don't need to be allocated.
+	b, err = buffer.DecodeRawBytes(false)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), b)
+
+	b, err = buffer.ReadGroup(true)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1 << 3, 1}, b)
+
+	require.Equal(t, []int{5, 2}, requests)
+}
+
+func TestDecodeBytesCow(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hello")))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("world")))
+	data := encoder.Bytes()
+
+	var requests []int
+	buffer := codec.NewBufferWithOptions(data, codec.WithByteAllocator(func(n int) []byte {
+		requests = append(requests, n)
+		return make([]byte, n)
+	}))
+
+	hello, err := buffer.DecodeBytesCow()
+	require.NoError(t, err)
+	require.Equal(t, 5, hello.Len())
+	world, err := buffer.DecodeBytesCow()
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+
+	// Decoding doesn't copy, the view aliases the buffer's backing slice.
+	view := hello.View()
+	require.Equal(t, []byte("hello"), view)
+	require.Equal(t, &data[1], &view[0])
+	require.Empty(t, requests)
+
+	// Copies are obtained from the allocator and survive the backing slice
+	// being overwritten.
+	copied := world.Copy()
+	require.Equal(t, []int{5}, requests)
+	for i := range data {
+		data[i] = 0
+	}
+	require.Equal(t, []byte("world"), copied)
+	require.Equal(t, make([]byte, 5), world.View())
+
+	_, err = codec.NewBuffer([]byte{5, 'a'}).DecodeBytesCow()
+	require.Error(t, err)
+}
+
+func TestWithDefaultCopyBytes(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte("hello"))
+	encodeVarintField(t, encoder, 2, 7)
+	encodeBytesField(t, encoder, 1, []byte("world"))
+
+	collect := func(t *testing.T, buffer *codec.Buffer) [][]byte {
+		var values [][]byte
+		require.NoError(t, molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+			if fieldNum == 1 {
+				values = append(values, value.Bytes)
+			}
+			return true, nil
+		}))
+		return values
+	}
+
+	// By default the values are views over the buffer.
+	data := append([]byte(nil), encoder.Bytes()...)
+	values := collect(t, codec.NewBufferWithOptions(data, codec.WithDefaultCopyBytes(false)))
+	require.Equal(t, &data[2], &values[0][0])
+
+	// With copying enabled they outlive changes to it, and are obtained from the allocator.
+	var requests []int
+	buffer := codec.NewBufferWithOptions(data, codec.WithDefaultCopyBytes(true), codec.WithByteAllocator(func(n int) []byte {
+		requests = append(requests, n)
+		return make([]byte, n)
+	}))
+	require.True(t, buffer.CopiesBytes())
+	values = collect(t, buffer)
+	require.Equal(t, []int{5, 5}, requests)
+	for i := range data {
+		data[i] = 0
+	}
+	require.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, values)
+
+	// The option is retained across Reset and flows through to the collectors.
+	data = append(data[:0], encoder.Bytes()...)
+	buffer.Reset(data)
+	messages, err := molecule.CollectMessages(buffer, 1)
+	require.NoError(t, err)
+	for i := range data {
+		data[i] = 0
+	}
+	require.Equal(t, []byte("hello"), messages[0].Bytes())
+	require.Equal(t, []byte("world"), messages[1].Bytes())
+
+	// Sub and ReadGroupBuffer inherit it, while the explicit alloc argument of DecodeRawBytes is unaffected.
+	data = append(data[:0], encoder.Bytes()...)
+	buffer.Reset(data)
+	sub, err := buffer.Sub(0, 7)
+	require.NoError(t, err)
+	require.True(t, sub.CopiesBytes())
+	group := codec.NewBufferWithOptions([]byte{0x0b, 0x0c}, codec.WithDefaultCopyBytes(true))
+	_, _, err = group.DecodeTagAndWireType()
+	require.NoError(t, err)
+	groupBuffer, err := group.ReadGroupBuffer()
+	require.NoError(t, err)
+	require.True(t, groupBuffer.CopiesBytes())
+	_, _, err = buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	b, err := buffer.DecodeRawBytes(false)
+	require.NoError(t, err)
+	require.Equal(t, &data[2], &b[0])
+
+	require.False(t, codec.NewBuffer(nil).CopiesBytes())
+}
+
+func TestBufferNextIs(t *testing.T) {
+	check := func(t *testing.T, buffer *codec.Buffer) {
+		// Consume every leading occurrence of field 1.
+		var values []uint64
+		for {
+			next, err := buffer.NextIs(1)
+			require.NoError(t, err)
+			if !next {
+				break
+			}
+			_, _, err = buffer.DecodeTagAndWireType()
+			require.NoError(t, err)
+			v, err := buffer.DecodeVarint()
+			require.NoError(t, err)
+			values = append(values, v)
+		}
+		require.Equal(t, []uint64{1, 2, 3}, values)
+
+		// A different field doesn't match and isn't consumed either.
+		remaining := buffer.Len()
+		next, err := buffer.NextIs(1)
+		require.NoError(t, err)
+		require.False(t, next)
+		require.Equal(t, remaining, buffer.Len())
+
+		next, err = buffer.NextIs(1000)
+		require.NoError(t, err)
+		require.True(t, next)
+		require.Equal(t, remaining, buffer.Len())
+		tag, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.Equal(t, int32(1000), tag)
+		_, err = buffer.DecodeRawBytes(false)
+		require.NoError(t, err)
+
+		// The end of the buffer never matches.
+		require.True(t, buffer.EOF())
+		next, err = buffer.NextIs(1)
+		require.NoError(t, err)
+		require.False(t, next)
+	}
+
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 1)
+	encodeVarintField(t, encoder, 1, 2)
+	encodeVarintField(t, encoder, 1, 3)
+	encodeBytesField(t, encoder, 1000, []byte("hello"))
+	data := encoder.Bytes()
+
+	t.Run("slice", func(t *testing.T) {
+		check(t, codec.NewBuffer(data))
+	})
+	t.Run("reader at", func(t *testing.T) {
+		check(t, codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	})
+
+	// A malformed tag is reported without advancing the buffer.
+	buffer := codec.NewBuffer([]byte{0x80})
+	_, err := buffer.NextIs(1)
+	require.Error(t, err)
+	require.Equal(t, 1, buffer.Len())
+}
+
+func TestBufferBeginField(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(300))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes(make([]byte, 1<<17)))
+	require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireFixed32))
+	require.NoError(t, encoder.EncodeFixed32(7))
+	data := encoder.Bytes()
+	firstLen, secondLen := 3, 1+3+1<<17
+
+	check := func(t *testing.T, buffer *codec.Buffer) {
+		// Inspecting a field and aborting leaves the buffer where it was.
+		field, err := buffer.BeginField()
+		require.NoError(t, err)
+		require.Equal(t, int32(1), field.FieldNum)
+		require.Equal(t, codec.WireVarint, field.WireType)
+		v, err := buffer.DecodeVarint()
+		require.NoError(t, err)
+		require.Equal(t, uint64(300), v)
+		field.Abort()
+		require.Equal(t, len(data), buffer.Len())
+
+		// Committing consumes the whole field whether or not its data was decoded.
+		field, err = buffer.BeginField()
+		require.NoError(t, err)
+		require.Equal(t, int32(1), field.FieldNum)
+		require.NoError(t, field.Commit())
+		require.Equal(t, len(data)-firstLen, buffer.Len())
+
+		// A field larger than the window of a reader-at buffer can be decoded in full and
+		// still be aborted.
+		field, err = buffer.BeginField()
+		require.NoError(t, err)
+		require.Equal(t, int32(2), field.FieldNum)
+		b, err := buffer.DecodeRawBytes(false)
+		require.NoError(t, err)
+		require.Len(t, b, 1<<17)
+		field.Abort()
+		require.Equal(t, len(data)-firstLen, buffer.Len())
+
+		// Or committed after decoding only part of it.
+		field, err = buffer.BeginField()
+		require.NoError(t, err)
+		_, err = buffer.DecodeVarint()
+		require.NoError(t, err)
+		require.NoError(t, field.Commit())
+		require.Equal(t, len(data)-firstLen-secondLen, buffer.Len())
+
+		field, err = buffer.BeginField()
+		require.NoError(t, err)
+		require.Equal(t, int32(3), field.FieldNum)
+		require.NoError(t, field.Commit())
+		require.True(t, buffer.EOF())
+
+		_, err = buffer.BeginField()
+		require.Equal(t, io.EOF, err)
+	}
+
+	t.Run("slice", func(t *testing.T) {
+		check(t, codec.NewBuffer(data))
+	})
+	t.Run("reader at", func(t *testing.T) {
+		check(t, codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data))))
+	})
+
+	t.Run("committed fields are not read", func(t *testing.T) {
+		r := &countingReaderAt{r: bytes.NewReader(data)}
+		buffer := codec.NewBufferFromReaderAt(r, int64(len(data)))
+		require.NoError(t, buffer.Skip(firstLen))
+		field, err := buffer.BeginField()
+		require.NoError(t, err)
+		require.NoError(t, field.Commit())
+		field, err = buffer.BeginField()
+		require.NoError(t, err)
+		require.Equal(t, int32(3), field.FieldNum)
+		require.Less(t, r.read, 1<<16)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		// A malformed tag leaves the buffer unchanged.
+		buffer := codec.NewBuffer([]byte{0x80})
+		_, err := buffer.BeginField()
+		require.Error(t, err)
+		require.Equal(t, 1, buffer.Len())
+
+		// So does committing a truncated field.
+		truncated := data[:firstLen+10]
+		for _, buffer := range []*codec.Buffer{
+			codec.NewBuffer(truncated),
+			codec.NewBufferFromReaderAt(bytes.NewReader(truncated), int64(len(truncated))),
+		} {
+			require.NoError(t, buffer.Skip(firstLen))
+			field, err := buffer.BeginField()
+			require.NoError(t, err)
+			require.True(t, errors.Is(field.Commit(), io.ErrUnexpectedEOF))
+			require.Equal(t, 10, buffer.Len())
+		}
+	})
+}
+
+func TestBufferSkip(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+
+	t.Run("over skip", func(t *testing.T) {
+		buffer := codec.NewBuffer(data)
+		require.NoError(t, buffer.Skip(1))
+		// Skipping more than remains fails without moving the buffer, rather than
+		// clamping to the end.
+		require.Equal(t, io.ErrUnexpectedEOF, buffer.Skip(4))
+		require.Equal(t, 3, buffer.Len())
+		require.Equal(t, []byte{2, 3, 4}, buffer.Bytes())
+	})
+
+	t.Run("exact skip", func(t *testing.T) {
+		buffer := codec.NewBuffer(data)
+		require.NoError(t, buffer.Skip(1))
+		require.NoError(t, buffer.Skip(3))
+		require.True(t, buffer.EOF())
+		require.NoError(t, buffer.Skip(0))
+		require.Equal(t, io.ErrUnexpectedEOF, buffer.Skip(1))
+	})
+
+	t.Run("skip to end", func(t *testing.T) {
+		buffer := codec.NewBuffer(data)
+		require.NoError(t, buffer.Skip(1))
+		buffer.SkipToEnd()
+		require.True(t, buffer.EOF())
+		require.Equal(t, 0, buffer.Len())
+
+		readerAt := codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		readerAt.SkipToEnd()
+		require.True(t, readerAt.EOF())
+		require.Equal(t, 0, readerAt.Len())
+	})
+}
+
+func TestDecodeZigZag(t *testing.T) {
+	testCases32 := []struct {
+		v        uint64
+		expected int32
+	}{
+		{v: 0, expected: 0},
+		{v: 1, expected: -1},
+		{v: 2, expected: 1},
+		{v: math.MaxUint32 - 1, expected: math.MaxInt32},
+		{v: math.MaxUint32, expected: math.MinInt32},
+		// Bits above the low 32 are ignored rather than rejected.
+		{v: math.MaxUint64, expected: math.MinInt32},
+		{v: 1 << 32, expected: 0},
+		{v: 1<<32 | 2, expected: 1},
+		{v: 0xFFFFFFFF00000003, expected: -2},
+	}
+	for _, tc := range testCases32 {
+		require.Equal(t, tc.expected, codec.DecodeZigZag32(tc.v), "value %#x", tc.v)
+		n, err := codec.DecodeZigZag(tc.v, 32)
+		require.NoError(t, err)
+		require.Equal(t, int64(tc.expected), n, "value %#x", tc.v)
+	}
+
+	testCases64 := []struct {
+		v        uint64
+		expected int64
+	}{
+		{v: 0, expected: 0},
+		{v: 1, expected: -1},
+		{v: 2, expected: 1},
+		{v: math.MaxUint32, expected: math.MinInt32},
+		{v: math.MaxUint32 + 1, expected: math.MaxInt32 + 1},
+		{v: math.MaxUint64 - 1, expected: math.MaxInt64},
+		{v: math.MaxUint64, expected: math.MinInt64},
+	}
+	for _, tc := range testCases64 {
+		require.Equal(t, tc.expected, codec.DecodeZigZag64(tc.v), "value %#x", tc.v)
+		n, err := codec.DecodeZigZag(tc.v, 64)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, n, "value %#x", tc.v)
+	}
+
+	// Other widths round trip every value that fits.
+	for bits := 1; bits < 64; bits++ {
+		max, min := int64(1)<<(bits-1)-1, -int64(1)<<(bits-1)
+		for _, n := range []int64{min, min + 1, -1, 0, max - 1, max} {
+			if n < min || n > max {
+				continue
+			}
+			encoded := uint64(n<<1) ^ uint64(n>>63)
+			decoded, err := codec.DecodeZigZag(encoded, bits)
+			require.NoError(t, err)
+			require.Equal(t, n, decoded, "bits %d value %d", bits, n)
+			decoded, err = codec.DecodeZigZag(encoded|^(uint64(1)<<bits-1), bits)
+			require.NoError(t, err)
+			require.Equal(t, n, decoded, "bits %d value %d", bits, n)
+		}
+	}
+
+	// Invalid widths are an error rather than a panic.
+	for _, bits := range []int{-1, 0, 65} {
+		_, err := codec.DecodeZigZag(0, bits)
+		require.Error(t, err, "bits %d", bits)
+	}
+}
+
+func TestWithByteOrder(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4}
+
+	little := codec.NewBuffer(data)
+	big := codec.NewBufferWithOptions(data, codec.WithByteOrder(binary.BigEndian))
+	explicitLittle := codec.NewBufferWithOptions(data, codec.WithByteOrder(binary.LittleEndian))
+
+	for _, buffer := range []*codec.Buffer{little, explicitLittle} {
+		v, err := buffer.DecodeFixed64()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0x0807060504030201), v)
+		v, err = buffer.DecodeFixed32()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0x04030201), v)
+		require.True(t, buffer.EOF())
+	}
+
+	v, err := big.DecodeFixed64()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x0102030405060708), v)
+	v, err = big.DecodeFixed32()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0x01020304), v)
+	require.True(t, big.EOF())
+
+	// Short reads are still rejected.
+	big.Reset(data[:3])
+	_, err = big.DecodeFixed32()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// The byte order applies to fields decoded by MessageEach.
+	msg := []byte{0x0d, 0x00, 0x00, 0x00, 0x2a}
+	var fixed uint32
+	err = molecule.MessageEach(codec.NewBufferWithOptions(msg, codec.WithByteOrder(binary.BigEndian)), func(fieldNum int32, value molecule.Value) (bool, error) {
+		fixed, err = value.AsFixed32()
+		return true, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(42), fixed)
+
+	// And to nested messages and packed fields, which are decoded with the settings of
+	// the buffer they were read from.
+	msg = append([]byte{0x0a, byte(len(msg))}, msg...)
+	msg = append(msg, 0x12, 8, 0, 0, 0, 7, 0, 0, 0, 9)
+	newBig := func() *codec.Buffer {
+		return codec.NewBufferWithOptions(msg, codec.WithByteOrder(binary.BigEndian))
+	}
+
+	fixed = 0
+	err = molecule.SubMessageEach(newBig(), 1, func(fieldNum int32, value molecule.Value) (bool, error) {
+		fixed, err = value.AsFixed32()
+		return true, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(42), fixed)
+
+	var elements []uint64
+	err = molecule.RepeatedEach(newBig(), 2, codec.FieldType_FIXED32, func(value molecule.Value) (bool, error) {
+		elements = append(elements, value.Number)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{7, 9}, elements)
+
+	decoded, err := molecule.DecodeTyped(newBig(), map[int32]codec.FieldType{2: codec.FieldType_FIXED32})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{uint32(7), uint32(9)}, decoded[2])
+
+	var (
+		typed  interface{}
+		schema = map[int32]codec.FieldType{2: codec.FieldType_FIXED32}
+	)
+	err = molecule.MessageEachWithSchema(newBig(), schema, func(num int32, value molecule.Value) (bool, error) {
+		if num == 2 {
+			typed, err = value.Typed()
+		}
+		return true, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{uint32(7), uint32(9)}, typed)
+}
+
+func TestBufferNested(t *testing.T) {
+	alloc := func(n int) []byte { return make([]byte, n) }
+	parent := codec.NewBufferWithOptions(nil,
+		codec.WithByteOrder(binary.BigEndian), codec.WithDefaultCopyBytes(true), codec.WithByteAllocator(alloc))
+	parent.SetMaxFieldLength(2)
+	require.Equal(t, binary.ByteOrder(binary.LittleEndian), codec.NewBuffer(nil).ByteOrder())
+	require.Equal(t, binary.ByteOrder(binary.BigEndian), parent.ByteOrder())
+
+	nested := parent.Nested([]byte{0, 0, 0, 42, 3, 1, 2, 3})
+	require.Equal(t, binary.ByteOrder(binary.BigEndian), nested.ByteOrder())
+	require.True(t, nested.CopiesBytes())
+	v, err := nested.DecodeFixed32()
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), v)
+	_, err = nested.DecodeRawBytes(false)
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+}
+
+func TestDecodeVarintTenthByte(t *testing.T) {
+	maxUint64 := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+
+	buffer := codec.NewBuffer(maxUint64)
+	v, err := buffer.DecodeVarint()
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), v)
+	require.True(t, buffer.EOF())
+
+	// 1<<63 is the largest power of two that a varint can encode.
+	buffer = codec.NewBuffer([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01})
+	v, err = buffer.DecodeVarint()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1)<<63, v)
+
+	// A 10th byte of 2 or more sets bits beyond the 64th.
+	for _, last := range []byte{0x02, 0x03, 0x7f} {
+		invalid := append(append([]byte(nil), maxUint64[:9]...), last)
+		buffer = codec.NewBuffer(invalid)
+		_, err = buffer.DecodeVarint()
+		require.True(t, errors.Is(err, codec.ErrOverflow), "10th byte %#x", last)
+		// The buffer isn't advanced past the invalid varint.
+		require.Equal(t, len(invalid), buffer.Len())
+
+		err = molecule.MessageEach(codec.NewBuffer(append([]byte{0x08}, invalid...)), nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrOverflow), "10th byte %#x", last)
+	}
+}
+
+func TestReadGroup(t *testing.T) {
+	// The group's data, including a nested group whose end tag belongs to the data.
+	data := codec.NewBuffer(nil)
+	require.NoError(t, data.EncodeTagAndWireType(2, codec.WireVarint))
+	require.NoError(t, data.EncodeVarint(150))
+	require.NoError(t, data.EncodeTagAndWireType(3, codec.WireStartGroup))
+	require.NoError(t, data.EncodeTagAndWireType(4, codec.WireFixed32))
+	require.NoError(t, data.EncodeFixed32(9))
+	require.NoError(t, data.EncodeTagAndWireType(3, codec.WireEndGroup))
+	groupData := data.Bytes()
+
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireStartGroup))
+	encoder.Write(groupData)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireEndGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(7))
+	msg := encoder.Bytes()
+
+	for _, alloc := range []bool{false, true} {
+		backing := append([]byte(nil), msg...)
+		buffer := codec.NewBuffer(backing)
+		_, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+
+		group, err := buffer.ReadGroup(alloc)
+		require.NoError(t, err, "alloc %v", alloc)
+		// The group's own end tag is excluded.
+		require.Equal(t, groupData, group, "alloc %v", alloc)
+		// The buffer resumes after the end tag.
+		require.Equal(t, []byte{5 << 3, 7}, buffer.Bytes(), "alloc %v", alloc)
+
+		// Only the result of alloc=true is independent of the backing slice.
+		backing[1] = 0xff
+		if alloc {
+			require.Equal(t, groupData, group)
+		} else {
+			require.Equal(t, byte(0xff), group[0])
+		}
+	}
+
+	// A group without an end tag is rejected.
+	buffer := codec.NewBuffer(msg[:len(msg)-3])
+	_, _, err := buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	_, err = buffer.ReadGroup(true)
+	require.Error(t, err)
+}
+
+func TestWriteGroup(t *testing.T) {
+	encoder := codec.NewEncoder(nil)
+	err := encoder.WriteGroup(1, func(group *codec.Encoder) error {
+		require.NoError(t, group.EncodeTagAndWireType(2, codec.WireVarint))
+		require.NoError(t, group.EncodeVarint(150))
+		return group.WriteGroup(3, func(nested *codec.Encoder) error {
+			require.NoError(t, nested.EncodeTagAndWireType(4, codec.WireFixed32))
+			return nested.EncodeFixed32(9)
+		})
+	})
+	require.NoError(t, err)
+	require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(7))
+
+	// Groups end with an end tag for the same field number, innermost first.
+	require.Equal(t, []byte{
+		1<<3 | 3,
+		2 << 3, 0x96, 0x01,
+		3<<3 | 3,
+		4<<3 | 5, 9, 0, 0, 0,
+		3<<3 | 4,
+		1<<3 | 4,
+		5 << 3, 7,
+	}, encoder.Bytes())
+
+	// Round trip through ReadGroup.
+	buffer := codec.NewBuffer(encoder.Bytes())
+	fieldNum, wireType, err := buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fieldNum)
+	require.Equal(t, codec.WireStartGroup, wireType)
+	group, err := buffer.ReadGroup(false)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5 << 3, 7}, buffer.Bytes())
+
+	var fields []int32
+	groupBuffer := codec.NewBuffer(group)
+	for !groupBuffer.EOF() {
+		fieldNum, wireType, err := groupBuffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		fields = append(fields, fieldNum)
+		if wireType == codec.WireStartGroup {
+			nested, err := groupBuffer.ReadGroupBuffer()
+			require.NoError(t, err)
+			nestedNum, _, err := nested.DecodeTagAndWireType()
+			require.NoError(t, err)
+			require.Equal(t, int32(4), nestedNum)
+			v, err := nested.DecodeFixed32()
+			require.NoError(t, err)
+			require.Equal(t, uint64(9), v)
+			require.True(t, nested.EOF())
+			continue
+		}
+		require.NoError(t, groupBuffer.SkipField(wireType))
+	}
+	require.Equal(t, []int32{2, 3}, fields)
+
+	// Errors from fn are returned as is and the end tag isn't written.
+	errBody := errors.New("body")
+	encoder.Reset()
+	err = encoder.WriteGroup(1, func(*codec.Encoder) error { return errBody })
+	require.Equal(t, errBody, err)
+	require.Equal(t, []byte{1<<3 | 3}, encoder.Bytes())
+}
+
+func TestEncoder(t *testing.T) {
+	// An Encoder produces the same bytes as a Buffer.
+	var (
+		encoder = codec.NewEncoder(make([]byte, 0, 4))
+		buffer  = codec.NewBuffer(nil)
+	)
+	require.Equal(t, 4, encoder.Available())
+	encoder.Grow(64)
+	require.GreaterOrEqual(t, encoder.Available(), 64)
+	for _, enc := range []interface {
+		EncodeVarint(uint64) error
+		EncodeTagAndWireType(int32, codec.WireType) error
+		EncodeFixed32(uint64) error
+		EncodeFixed64(uint64) error
+		EncodeRawBytes([]byte) error
+		WriteDelimitedMessage(int32, []byte) error
+		Write([]byte) (int, error)
+	}{encoder, buffer} {
+		require.NoError(t, enc.EncodeTagAndWireType(1, codec.WireVarint))
+		require.NoError(t, enc.EncodeVarint(300))
+		require.NoError(t, enc.EncodeTagAndWireType(2, codec.WireFixed32))
+		require.NoError(t, enc.EncodeFixed32(7))
+		require.NoError(t, enc.EncodeTagAndWireType(3, codec.WireFixed64))
+		require.NoError(t, enc.EncodeFixed64(math.MaxUint64))
+		require.NoError(t, enc.EncodeTagAndWireType(4, codec.WireBytes))
+		require.NoError(t, enc.EncodeRawBytes([]byte("hi")))
+		require.NoError(t, enc.WriteDelimitedMessage(5, []byte{1 << 3, 1}))
+		n, err := enc.Write([]byte{6 << 3, 1})
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+	}
+	require.Equal(t, buffer.Bytes(), encoder.Bytes())
+	require.Equal(t, buffer.Len(), encoder.Len())
+
+	encoder.Reset()
+	require.Equal(t, 0, encoder.Len())
+	require.Panics(t, func() { encoder.Grow(-1) })
+}
+
+func TestBufferSub(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Nested{NestedMessage: &simple.Test{StringField: "inner", Int64Field: 3}})
+	require.NoError(t, err)
+
+	check := func(t *testing.T, buffer *codec.Buffer) {
+		// Find the span of the nested message's value, which follows its tag and length.
+		scanner := molecule.NewScanner(buffer.Clone())
+		require.True(t, scanner.Scan())
+		value := scanner.Value()
+		_, end := scanner.FieldSpan()
+		start := end - len(value.Bytes)
+
+		sub, err := buffer.Sub(start, end)
+		require.NoError(t, err)
+		require.Equal(t, len(value.Bytes), sub.Len())
+		s, err := molecule.GetString(sub, 1, "")
+		require.NoError(t, err)
+		require.Equal(t, "inner", s)
+		i, err := molecule.GetInt32(sub, 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, int32(3), i)
+
+		// The parent buffer is unaffected.
+		require.Equal(t, len(marshaled), buffer.Len())
+
+		empty, err := buffer.Sub(end, end)
+		require.NoError(t, err)
+		require.True(t, empty.EOF())
+
+		for _, r := range [][2]int{{-1, 2}, {3, 2}, {0, len(marshaled) + 1}} {
+			_, err = buffer.Sub(r[0], r[1])
+			require.True(t, errors.Is(err, codec.ErrBadLength), "range %v", r)
+		}
+	}
+
+	t.Run("slice", func(t *testing.T) {
+		buffer := codec.NewBuffer(marshaled)
+		check(t, buffer)
+
+		// Offsets are relative to the read position and the view is capped.
+		require.NoError(t, buffer.Skip(2))
+		sub, err := buffer.Sub(0, 2)
+		require.NoError(t, err)
+		require.Equal(t, marshaled[2:4], sub.Bytes())
+		require.Equal(t, 2, cap(sub.Bytes()))
+	})
+
+	t.Run("reader at", func(t *testing.T) {
+		check(t, codec.NewBufferFromReaderAt(bytes.NewReader(marshaled), int64(len(marshaled))))
+	})
+}
+
+func TestParseWireType(t *testing.T) {
+	wireTypes := []codec.WireType{
+		codec.WireVarint, codec.WireFixed64, codec.WireBytes,
+		codec.WireStartGroup, codec.WireEndGroup, codec.WireFixed32,
+	}
+	for _, w := range wireTypes {
+		parsed, err := codec.ParseWireType(w.String())
+		require.NoError(t, err)
+		require.Equal(t, w, parsed)
+	}
+	require.Equal(t, "start_group", codec.WireStartGroup.String())
+	require.Equal(t, "WireType(6)", codec.WireType(6).String())
+	require.Equal(t, "WireType(-1)", codec.WireType(-1).String())
+
+	parsed, err := codec.ParseWireType("FIXED32")
+	require.NoError(t, err)
+	require.Equal(t, codec.WireFixed32, parsed)
+
+	for _, s := range []string{"", "WireType(6)", "int64"} {
+		_, err = codec.ParseWireType(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseFieldType(t *testing.T) {
+	names := map[codec.FieldType]string{
+		codec.FieldType_DOUBLE: "double", codec.FieldType_FLOAT: "float",
+		codec.FieldType_INT64: "int64", codec.FieldType_UINT64: "uint64",
+		codec.FieldType_INT32: "int32", codec.FieldType_FIXED64: "fixed64",
+		codec.FieldType_FIXED32: "fixed32", codec.FieldType_BOOL: "bool",
+		codec.FieldType_STRING: "string", codec.FieldType_GROUP: "group",
+		codec.FieldType_MESSAGE: "message", codec.FieldType_BYTES: "bytes",
+		codec.FieldType_UINT32: "uint32", codec.FieldType_ENUM: "enum",
+		codec.FieldType_SFIXED32: "sfixed32", codec.FieldType_SFIXED64: "sfixed64",
+		codec.FieldType_SINT32: "sint32", codec.FieldType_SINT64: "sint64",
+	}
+	for fieldType, name := range names {
+		require.Equal(t, name, fieldType.String())
+		parsed, err := codec.ParseFieldType(name)
+		require.NoError(t, err)
+		require.Equal(t, fieldType, parsed)
+	}
+	require.Equal(t, "FieldType(0)", codec.FieldType(0).String())
+	require.Equal(t, "FieldType(19)", codec.FieldType(19).String())
+
+	parsed, err := codec.ParseFieldType("SInt64")
+	require.NoError(t, err)
+	require.Equal(t, codec.FieldType_SINT64, parsed)
+
+	for _, s := range []string{"", "FieldType(0)", "varint", "int"} {
+		_, err = codec.ParseFieldType(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestBufferReadWrite(t *testing.T) {
+	buffer := codec.NewBuffer(nil)
+	require.Equal(t, 0, buffer.Available())
+	buffer.Grow(64)
+	require.True(t, buffer.Available() >= 64)
+
+	// Write a message and read it back.
+	require.NoError(t, buffer.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, buffer.EncodeVarint(300))
+	require.NoError(t, buffer.EncodeTagAndWireType(2, codec.WireBytes))
+	require.NoError(t, buffer.EncodeRawBytes([]byte("hi")))
+	require.True(t, buffer.Available() >= 64-8)
+
+	var fieldNums []int32
+	err := molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+		fieldNums = append(fieldNums, fieldNum)
+		return false, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int32{1}, fieldNums)
+
+	// Encoding appends after the unread data without disturbing the read position.
+	require.NoError(t, buffer.EncodeTagAndWireType(3, codec.WireFixed32))
+	require.NoError(t, buffer.EncodeFixed32(7))
+	err = molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+		fieldNums = append(fieldNums, fieldNum)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 2, 3}, fieldNums)
+	require.True(t, buffer.EOF())
+
+	// Resetting to an empty slice reuses its capacity for the next message.
+	backing := make([]byte, 0, 16)
+	buffer.Reset(backing)
+	require.Equal(t, 16, buffer.Available())
+	require.NoError(t, buffer.EncodeFixed64(1))
+	require.Equal(t, 8, buffer.Available())
+	require.True(t, &backing[:1][0] == &buffer.Bytes()[0])
+	v, err := buffer.DecodeFixed64()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), v)
+
+	// Capped views can't overwrite the data that follows them.
+	data := []byte{0x08, 0x01, 0x10, 0x02}
+	sub, err := codec.NewBuffer(data).Sub(0, 2)
+	require.NoError(t, err)
+	require.Equal(t, 0, sub.Available())
+	require.NoError(t, sub.EncodeVarint(5))
+	require.Equal(t, []byte{0x08, 0x01, 0x10, 0x02}, data)
+
+	// Buffers backed by an io.ReaderAt are read-only.
+	readOnly := codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data)))
+	require.True(t, errors.Is(readOnly.EncodeVarint(1), codec.ErrReadOnly))
+	require.True(t, errors.Is(readOnly.EncodeFixed32(1), codec.ErrReadOnly))
+	require.True(t, errors.Is(readOnly.EncodeFixed64(1), codec.ErrReadOnly))
+	require.True(t, errors.Is(readOnly.EncodeRawBytes(nil), codec.ErrReadOnly))
+	n, err := readOnly.Write([]byte{1})
+	require.True(t, errors.Is(err, codec.ErrReadOnly))
+	require.Equal(t, 0, n)
+	readOnly.Grow(10)
+	require.Equal(t, data, readOnly.Bytes())
+
+	// Until it's reset.
+	readOnly.Reset(nil)
+	require.NoError(t, readOnly.EncodeVarint(1))
+	require.Equal(t, []byte{1}, readOnly.Bytes())
+}
+
+func TestWritePackedRepeated(t *testing.T) {
+	decode := func(t *testing.T, b []byte, fieldNum int32, fieldType codec.FieldType) []molecule.Value {
+		var values []molecule.Value
+		err := molecule.MessageEach(codec.NewBuffer(b), func(num int32, value molecule.Value) (bool, error) {
+			require.Equal(t, fieldNum, num)
+			require.Equal(t, codec.WireBytes, value.WireType)
+			return true, molecule.PackedRepeatedEach(codec.NewBuffer(value.Bytes), fieldType, func(v molecule.Value) (bool, error) {
+				values = append(values, v)
+				return true, nil
+			})
+		})
+		require.NoError(t, err)
+		return values
+	}
+
+	t.Run("sint64", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		in := []int64{0, -1, 1, math.MinInt64, math.MaxInt64}
+		values := make([]uint64, len(in))
+		for i, v := range in {
+			values[i] = uint64(v)
+		}
+		require.NoError(t, encoder.WritePackedRepeated(1, codec.FieldType_SINT64, values))
+
+		var out []int64
+		for _, v := range decode(t, encoder.Bytes(), 1, codec.FieldType_SINT64) {
+			n, err := v.AsSint64()
+			require.NoError(t, err)
+			out = append(out, n)
+		}
+		require.Equal(t, in, out)
+	})
+
+	t.Run("sint32", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		in := []int32{-1, 2, math.MinInt32}
+		require.NoError(t, encoder.WritePackedRepeated(2, codec.FieldType_SINT32, []uint64{
+			uint64(int64(in[0])), uint64(int64(in[1])), uint64(int64(in[2])),
+		}))
+		// Zig-zag encoding keeps small negative numbers small.
+		require.Equal(t, []byte{2<<3 | 2, 7, 1, 4, 0xff, 0xff, 0xff, 0xff, 0x0f}, encoder.Bytes())
+
+		var out []int32
+		for _, v := range decode(t, encoder.Bytes(), 2, codec.FieldType_SINT32) {
+			n, err := v.AsSint32()
+			require.NoError(t, err)
+			out = append(out, n)
+		}
+		require.Equal(t, in, out)
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, encoder.WritePackedRepeated(3, codec.FieldType_SFIXED32, []uint64{uint64(uint32(0xffffffff)), 7}))
+		require.NoError(t, encoder.WritePackedRepeated(4, codec.FieldType_FIXED64, []uint64{math.MaxUint64, 7}))
+
+		var decoded []uint64
+		err := molecule.MessageEach(codec.NewBuffer(encoder.Bytes()), func(num int32, value molecule.Value) (bool, error) {
+			fieldType := codec.FieldType_SFIXED32
+			if num == 4 {
+				fieldType = codec.FieldType_FIXED64
+			}
+			return true, molecule.PackedRepeatedEach(codec.NewBuffer(value.Bytes), fieldType, func(v molecule.Value) (bool, error) {
+				decoded = append(decoded, v.Number)
+				return true, nil
+			})
+		})
+		require.NoError(t, err)
+		require.Equal(t, []uint64{0xffffffff, 7, math.MaxUint64, 7}, decoded)
+		require.Equal(t, 2+8+2+16, len(encoder.Bytes()))
+	})
+
+	t.Run("typed", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, encoder.WritePackedInt64(16, []int64{-1, math.MaxInt64}))
+
+		// The output matches what the protobuf library produces for the same field.
+		var m simple.Simple
+		require.NoError(t, proto.Unmarshal(encoder.Bytes(), &m))
+		require.Equal(t, []int64{-1, math.MaxInt64}, m.RepeatedInt64Packed)
+		expected, err := proto.Marshal(&m)
+		require.NoError(t, err)
+		require.Equal(t, expected, encoder.Bytes())
+
+		encoder.Reset()
+		require.NoError(t, encoder.WritePackedInt32(1, []int32{-1, 1, math.MaxInt32}))
+		var int32s []int32
+		for _, v := range decode(t, encoder.Bytes(), 1, codec.FieldType_INT32) {
+			n, err := v.AsInt32()
+			require.NoError(t, err)
+			int32s = append(int32s, n)
+		}
+		require.Equal(t, []int32{-1, 1, math.MaxInt32}, int32s)
+
+		encoder.Reset()
+		require.NoError(t, encoder.WritePackedFloat(2, []float32{1.5, -2}))
+		var floats []float32
+		for _, v := range decode(t, encoder.Bytes(), 2, codec.FieldType_FLOAT) {
+			f, err := v.AsFloat()
+			require.NoError(t, err)
+			floats = append(floats, f)
+		}
+		require.Equal(t, []float32{1.5, -2}, floats)
+
+		encoder.Reset()
+		require.NoError(t, encoder.WritePackedDouble(3, []float64{math.Pi, math.Inf(-1)}))
+		var doubles []float64
+		for _, v := range decode(t, encoder.Bytes(), 3, codec.FieldType_DOUBLE) {
+			d, err := v.AsDouble()
+			require.NoError(t, err)
+			doubles = append(doubles, d)
+		}
+		require.Equal(t, []float64{math.Pi, math.Inf(-1)}, doubles)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, encoder.WritePackedRepeated(1, codec.FieldType_INT64, nil))
+		require.NoError(t, encoder.WritePackedInt32(1, nil))
+		require.NoError(t, encoder.WritePackedDouble(1, nil))
+		require.Empty(t, encoder.Bytes())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		encoder := codec.NewEncoder(nil)
+		require.Error(t, encoder.WritePackedRepeated(1, codec.FieldType_STRING, []uint64{1}))
+		require.Error(t, encoder.WritePackedRepeated(1, codec.FieldType_MESSAGE, nil))
+		require.Empty(t, encoder.Bytes())
+	})
+}
+
+func TestConsumeLengthPrefixed(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hello")))
+	require.NoError(t, encoder.EncodeRawBytes(nil))
+	require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte{'x'}, 300)))
+	data := encoder.Bytes()
+
+	t.Run("single frame", func(t *testing.T) {
+		body, rest, err := codec.ConsumeLengthPrefixed([]byte{2, 'h', 'i'})
+		require.NoError(t, err)
+		require.Equal(t, []byte("hi"), body)
+		require.Empty(t, rest)
+	})
+
+	t.Run("multiple frames", func(t *testing.T) {
+		var (
+			frames [][]byte
+			rest   = data
+		)
+		for {
+			body, next, err := codec.ConsumeLengthPrefixed(rest)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			frames = append(frames, body)
+			rest = next
+		}
+		require.Equal(t, [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{'x'}, 300)}, frames)
+
+		// Bodies alias the input but appending to them doesn't overwrite the next frame.
+		body, rest, err := codec.ConsumeLengthPrefixed(data)
+		require.NoError(t, err)
+		require.True(t, &data[1] == &body[0])
+		_ = append(body, '!')
+		require.Equal(t, data[6:], rest)
+		require.Equal(t, byte(0), rest[0])
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		// The length itself is cut short.
+		_, _, err := codec.ConsumeLengthPrefixed([]byte{0x80})
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+		// The body is cut short.
+		_, _, err = codec.ConsumeLengthPrefixed(data[:3])
+		require.Equal(t, io.ErrUnexpectedEOF, err)
+		// Lengths that don't fit in an int are rejected.
+		_, _, err = codec.ConsumeLengthPrefixed([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+		require.True(t, errors.Is(err, codec.ErrBadLength))
+	})
+}
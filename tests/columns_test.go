@@ -0,0 +1,91 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnAccumulator(t *testing.T) {
+	messages := []*simple.Simple{
+		{Int64: 1, Sint32: -1, Double: 1.5, String_: "a", Bool: true, RepeatedInt64Packed: []int64{1, 2}},
+		{Int64: 2, Fixed32: 7},
+		{Int64: 3, Sint32: 5, String_: "c", RepeatedInt64Packed: []int64{3}},
+	}
+
+	accumulator, err := molecule.NewColumnAccumulator(map[int32]codec.FieldType{
+		1:  codec.FieldType_DOUBLE,
+		4:  codec.FieldType_INT64,
+		7:  codec.FieldType_SINT32,
+		9:  codec.FieldType_FIXED32,
+		13: codec.FieldType_BOOL,
+		14: codec.FieldType_STRING,
+		16: codec.FieldType_INT64,
+	})
+	require.NoError(t, err)
+
+	buffer := codec.NewBuffer(nil)
+	for _, m := range messages {
+		marshaled, err := proto.Marshal(m)
+		require.NoError(t, err)
+		buffer.Reset(marshaled)
+		require.NoError(t, accumulator.Add(buffer))
+		require.True(t, buffer.EOF())
+	}
+	require.Equal(t, 3, accumulator.Rows())
+
+	int64s := accumulator.Column(4)
+	require.Equal(t, []int64{1, 2, 3}, int64s.Int64s)
+	require.Equal(t, []int{0, 1, 2, 3}, int64s.Offsets)
+	require.Equal(t, 3, int64s.Len())
+
+	// proto3 doesn't encode zero values, so those rows are empty.
+	sint32s := accumulator.Column(7)
+	require.Equal(t, []int64{-1, 5}, sint32s.Int64s)
+	require.Equal(t, []int{0, 1, 1, 2}, sint32s.Offsets)
+
+	require.Equal(t, []float64{1.5}, accumulator.Column(1).Float64s)
+	require.Equal(t, []uint64{7}, accumulator.Column(9).Uint64s)
+	require.Equal(t, []int{0, 0, 1, 1}, accumulator.Column(9).Offsets)
+	require.Equal(t, []bool{true}, accumulator.Column(13).Bools)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("c")}, accumulator.Column(14).Bytes)
+
+	// Repeated fields contribute every element to their row.
+	repeated := accumulator.Column(16)
+	require.Equal(t, []int64{1, 2, 3}, repeated.Int64s)
+	require.Equal(t, []int{0, 2, 2, 3}, repeated.Offsets)
+
+	require.Nil(t, accumulator.Column(2))
+
+	// A message that fails to decode leaves every column as it was.
+	marshaled, err := proto.Marshal(&simple.Simple{Int64: 4, String_: "d"})
+	require.NoError(t, err)
+	require.Error(t, accumulator.Add(codec.NewBuffer(marshaled[:len(marshaled)-1])))
+	require.Equal(t, 3, accumulator.Rows())
+	require.Equal(t, []int64{1, 2, 3}, int64s.Int64s)
+	require.Equal(t, []int{0, 1, 2, 3}, int64s.Offsets)
+
+	// Mismatched wire types are rejected too.
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 4, 5)
+	encodeVarintField(t, encoder, 14, 1)
+	require.Error(t, accumulator.Add(codec.NewBuffer(encoder.Bytes())))
+	require.Equal(t, []int64{1, 2, 3}, int64s.Int64s)
+
+	// Reset discards the rows.
+	accumulator.Reset()
+	require.Equal(t, 0, accumulator.Rows())
+	require.Equal(t, 0, int64s.Len())
+	require.Empty(t, int64s.Int64s)
+	require.NoError(t, accumulator.Add(codec.NewBuffer(marshaled)))
+	require.Equal(t, []int64{4}, int64s.Int64s)
+	require.Equal(t, [][]byte{[]byte("d")}, accumulator.Column(14).Bytes)
+
+	_, err = molecule.NewColumnAccumulator(map[int32]codec.FieldType{1: codec.FieldType_GROUP})
+	require.Error(t, err)
+}
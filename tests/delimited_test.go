@@ -0,0 +1,226 @@
+package moleculetest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelimitedEach(t *testing.T) {
+	var frames [][]byte
+	for i, s := range []string{"a", "bb", "", "dddd"} {
+		m := &simple.Test{StringField: s, Int64Field: int64(i)}
+		marshaled, err := proto.Marshal(m)
+		require.NoError(t, err)
+		frames = append(frames, marshaled)
+	}
+
+	collect := func(t *testing.T, r io.Reader, frameLen func(io.Reader) (int, error)) []int64 {
+		var got []int64
+		err := molecule.DelimitedEach(r, frameLen, func(buffer *codec.Buffer) (bool, error) {
+			i, err := molecule.GetInt32(buffer, 2, 0)
+			got = append(got, int64(i))
+			return true, err
+		})
+		require.NoError(t, err)
+		return got
+	}
+
+	t.Run("varint", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		for _, frame := range frames {
+			require.NoError(t, encoder.EncodeRawBytes(frame))
+		}
+		varintLen := func(r io.Reader) (int, error) {
+			n, err := binary.ReadUvarint(r.(io.ByteReader))
+			return int(n), err
+		}
+
+		got := collect(t, bytes.NewReader(encoder.Bytes()), varintLen)
+		require.Equal(t, []int64{0, 1, 2, 3}, got)
+	})
+
+	t.Run("fixed32", func(t *testing.T) {
+		var stream []byte
+		for _, frame := range frames {
+			var prefix [4]byte
+			binary.BigEndian.PutUint32(prefix[:], uint32(len(frame)))
+			stream = append(append(stream, prefix[:]...), frame...)
+		}
+		fixed32Len := func(r io.Reader) (int, error) {
+			var prefix [4]byte
+			if _, err := io.ReadFull(r, prefix[:]); err != nil {
+				return 0, err
+			}
+			return int(binary.BigEndian.Uint32(prefix[:])), nil
+		}
+
+		got := collect(t, bytes.NewReader(stream), fixed32Len)
+		require.Equal(t, []int64{0, 1, 2, 3}, got)
+
+		// A frame that is cut short is an error rather than a clean end of stream.
+		err := molecule.DelimitedEach(bytes.NewReader(stream[:len(stream)-1]), fixed32Len, func(*codec.Buffer) (bool, error) {
+			return true, nil
+		})
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	})
+
+	t.Run("frames larger than the read size", func(t *testing.T) {
+		frame := bytes.Repeat([]byte{0x08, 0x01}, 100000)
+		encoder := proto.NewBuffer(nil)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, encoder.EncodeRawBytes(frame))
+		}
+		stream := encoder.Bytes()
+		varintLen := func(r io.Reader) (int, error) {
+			n, err := binary.ReadUvarint(r.(io.ByteReader))
+			return int(n), err
+		}
+
+		var frames int
+		err := molecule.DelimitedEach(bufio.NewReader(iotest.HalfReader(bytes.NewReader(stream))), varintLen, func(buffer *codec.Buffer) (bool, error) {
+			require.Equal(t, frame, buffer.Bytes())
+			frames++
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, frames)
+	})
+
+	t.Run("huge declared length", func(t *testing.T) {
+		// A 5-byte prefix declaring a frame of almost 2GiB, followed by only a few bytes.
+		encoder := proto.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeVarint(math.MaxInt32))
+		stream := append(encoder.Bytes(), 0x08, 0x01)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := molecule.StreamReducePacked(bytes.NewReader(stream), codec.FieldType_INT64, 0,
+			func(acc int, value molecule.Value) (int, error) {
+				return acc + 1, nil
+			})
+		runtime.ReadMemStats(&after)
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF), err)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+	})
+}
+
+func TestStreamReducePacked(t *testing.T) {
+	// Three chunks of packed sint64s, the last one empty.
+	var (
+		stream   = proto.NewBuffer(nil)
+		expected int64
+	)
+	for _, chunk := range [][]int64{{1, -2, 300}, {-4000, 50000, 7, 8}, {}} {
+		packed := proto.NewBuffer(nil)
+		for _, v := range chunk {
+			require.NoError(t, packed.EncodeZigzag64(uint64(v)))
+			expected += v
+		}
+		require.NoError(t, stream.EncodeRawBytes(packed.Bytes()))
+	}
+
+	sum := func(acc int64, value molecule.Value) (int64, error) {
+		v, err := value.AsSint64()
+		return acc + v, err
+	}
+
+	// bytes.Buffer is an io.ByteReader, iotest.OneByteReader isn't.
+	total, err := molecule.StreamReducePacked(bytes.NewBuffer(stream.Bytes()), codec.FieldType_SINT64, int64(0), sum)
+	require.NoError(t, err)
+	require.Equal(t, expected, total)
+	total, err = molecule.StreamReducePacked(iotest.OneByteReader(bytes.NewReader(stream.Bytes())), codec.FieldType_SINT64, int64(0), sum)
+	require.NoError(t, err)
+	require.Equal(t, expected, total)
+
+	// The result can be of any type.
+	count, err := molecule.StreamReducePacked(bytes.NewReader(stream.Bytes()), codec.FieldType_SINT64, 0, func(acc int, value molecule.Value) (int, error) {
+		return acc + 1, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 7, count)
+
+	// A truncated chunk fails after the chunks before it were reduced.
+	truncated := stream.Bytes()[:len(stream.Bytes())-3]
+	total, err = molecule.StreamReducePacked(bytes.NewReader(truncated), codec.FieldType_SINT64, int64(0), sum)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	require.Equal(t, int64(299), total)
+
+	// Errors from fn stop the reduction.
+	errStop := errors.New("stop")
+	_, err = molecule.StreamReducePacked(bytes.NewReader(stream.Bytes()), codec.FieldType_SINT64, int64(0), func(acc int64, value molecule.Value) (int64, error) {
+		return acc, errStop
+	})
+	require.True(t, errors.Is(err, errStop))
+
+	// Chunks must hold whole elements.
+	fixed := proto.NewBuffer(nil)
+	require.NoError(t, fixed.EncodeRawBytes([]byte{1, 0, 0, 0, 2, 0}))
+	_, err = molecule.StreamReducePacked(bytes.NewReader(fixed.Bytes()), codec.FieldType_FIXED32, uint32(0), func(acc uint32, value molecule.Value) (uint32, error) {
+		return acc + uint32(value.Number), nil
+	})
+	require.Error(t, err)
+}
+
+func TestEnvelopeDecoder(t *testing.T) {
+	magic := []byte("MOLE")
+	envelope := func(magic []byte, m *simple.Test) []byte {
+		body, err := proto.Marshal(m)
+		require.NoError(t, err)
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(body)))
+		return append(append(append([]byte(nil), magic...), length[:]...), body...)
+	}
+	errBadMagic := errors.New("bad magic")
+	parseHeader := func(header []byte) (int, error) {
+		if !bytes.Equal(header[:4], magic) {
+			return 0, errBadMagic
+		}
+		return int(binary.BigEndian.Uint32(header[4:])), nil
+	}
+
+	stream := append(
+		envelope(magic, &simple.Test{StringField: "first", Int64Field: 1}),
+		envelope(magic, &simple.Test{StringField: "second", Int64Field: 2})...)
+
+	decoder := molecule.NewEnvelopeDecoder(iotest.HalfReader(bytes.NewReader(stream)), 8, parseHeader)
+	var got []string
+	for decoder.Next() {
+		var m simple.Test
+		require.NoError(t, proto.Unmarshal(decoder.Buffer().Bytes(), &m))
+		got = append(got, m.StringField)
+	}
+	require.NoError(t, decoder.Err())
+	require.Equal(t, []string{"first", "second"}, got)
+	require.False(t, decoder.Next())
+
+	// A bad magic number stops decoding with the parser's error.
+	stream = append(
+		envelope(magic, &simple.Test{StringField: "first"}),
+		envelope([]byte("BAD!"), &simple.Test{StringField: "second"})...)
+	decoder = molecule.NewEnvelopeDecoder(bytes.NewReader(stream), 8, parseHeader)
+	require.True(t, decoder.Next())
+	require.False(t, decoder.Next())
+	require.True(t, errors.Is(decoder.Err(), errBadMagic))
+	require.False(t, decoder.Next())
+
+	// So does an envelope that is cut short, in its header or in its body.
+	for _, n := range []int{3, 10} {
+		decoder = molecule.NewEnvelopeDecoder(bytes.NewReader(stream[:n]), 8, parseHeader)
+		require.False(t, decoder.Next())
+		require.True(t, errors.Is(decoder.Err(), io.ErrUnexpectedEOF), "length %d", n)
+	}
+}
@@ -0,0 +1,73 @@
+package moleculetest
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestDecodeEnum(t *testing.T) {
+	isFieldType := func(n int32) bool {
+		_, ok := descriptorpb.FieldDescriptorProto_Type_name[n]
+		return ok
+	}
+
+	t.Run("known", func(t *testing.T) {
+		value := molecule.Int32Value(int32(descriptorpb.FieldDescriptorProto_TYPE_STRING))
+		for _, valid := range []func(int32) bool{nil, isFieldType} {
+			typ, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](value, valid)
+			require.NoError(t, err)
+			require.Equal(t, descriptorpb.FieldDescriptorProto_TYPE_STRING, typ)
+		}
+	})
+
+	t.Run("unknown lenient", func(t *testing.T) {
+		typ, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](molecule.Int32Value(99), nil)
+		require.NoError(t, err)
+		require.Equal(t, descriptorpb.FieldDescriptorProto_Type(99), typ)
+	})
+
+	t.Run("unknown strict", func(t *testing.T) {
+		_, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](molecule.Int32Value(99), isFieldType)
+		require.True(t, errors.Is(err, molecule.ErrUnknownEnumValue))
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		typ, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](molecule.Int32Value(-1), nil)
+		require.NoError(t, err)
+		require.Equal(t, descriptorpb.FieldDescriptorProto_Type(-1), typ)
+	})
+
+	t.Run("negative from the wire", func(t *testing.T) {
+		for _, n := range []int32{-1, math.MinInt32} {
+			// Negative enums are sign-extended to 10 byte varints, just like int32s.
+			encoder := codec.NewBuffer(nil)
+			require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+			require.NoError(t, encoder.EncodeVarint(uint64(int64(n))))
+			require.Equal(t, 11, len(encoder.Bytes()))
+
+			decoded, err := molecule.DecodeTyped(encoder.Clone(), map[int32]codec.FieldType{1: codec.FieldType_ENUM})
+			require.NoError(t, err)
+			require.Equal(t, map[int32]interface{}{1: n}, decoded)
+
+			err = molecule.MessageEach(encoder, func(fieldNum int32, value molecule.Value) (bool, error) {
+				typ, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](value, nil)
+				require.NoError(t, err)
+				require.Equal(t, descriptorpb.FieldDescriptorProto_Type(n), typ)
+				return true, nil
+			})
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("wrong wire type", func(t *testing.T) {
+		_, err := molecule.DecodeEnum[descriptorpb.FieldDescriptorProto_Type](molecule.Fixed32Value(1), nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,330 @@
+package moleculetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindOneof(t *testing.T) {
+	// oneof choice {
+	//   string name = 4;
+	//   int64 id = 5;
+	// }
+	members := []int32{4, 5}
+
+	t.Run("none present", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeVarintField(t, encoder, 1, 10)
+
+		buffer := codec.NewBuffer(encoder.Bytes())
+		_, _, found, err := molecule.FindOneof(buffer, members)
+		require.NoError(t, err)
+		require.False(t, found)
+		require.Equal(t, len(encoder.Bytes()), buffer.Len())
+	})
+
+	t.Run("one present", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeVarintField(t, encoder, 1, 10)
+		encodeBytesField(t, encoder, 4, []byte("hello"))
+
+		fieldNum, value, found, err := molecule.FindOneof(codec.NewBuffer(encoder.Bytes()), members)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, int32(4), fieldNum)
+		str, err := value.AsStringSafe()
+		require.NoError(t, err)
+		require.Equal(t, "hello", str)
+	})
+
+	t.Run("last wins", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeBytesField(t, encoder, 4, []byte("hello"))
+		encodeVarintField(t, encoder, 1, 10)
+		encodeVarintField(t, encoder, 5, 42)
+
+		fieldNum, value, found, err := molecule.FindOneof(codec.NewBuffer(encoder.Bytes()), members)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, int32(5), fieldNum)
+		id, err := value.AsInt64()
+		require.NoError(t, err)
+		require.Equal(t, int64(42), id)
+	})
+}
+
+func encodeVarintField(t *testing.T, encoder *proto.Buffer, fieldNum int32, v uint64) {
+	require.NoError(t, encoder.EncodeVarint(uint64(fieldNum)<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeVarint(v))
+}
+
+func encodeBytesField(t *testing.T, encoder *proto.Buffer, fieldNum int32, b []byte) {
+	require.NoError(t, encoder.EncodeVarint(uint64(fieldNum)<<3|uint64(codec.WireBytes)))
+	require.NoError(t, encoder.EncodeRawBytes(b))
+}
+
+func TestGetWithDefault(t *testing.T) {
+	m := &simple.Simple{Int32: -5, String_: "hello", Bool: true, Double: 1.5}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+	buffer := codec.NewBuffer(marshaled)
+
+	t.Run("present", func(t *testing.T) {
+		i, err := molecule.GetInt32(buffer, 3, 7)
+		require.NoError(t, err)
+		require.Equal(t, int32(-5), i)
+
+		s, err := molecule.GetString(buffer, 14, "default")
+		require.NoError(t, err)
+		require.Equal(t, "hello", s)
+
+		b, err := molecule.GetBool(buffer, 13, false)
+		require.NoError(t, err)
+		require.True(t, b)
+
+		d, err := molecule.GetDouble(buffer, 1, 2.5)
+		require.NoError(t, err)
+		require.Equal(t, 1.5, d)
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		empty := codec.NewBuffer(nil)
+
+		i, err := molecule.GetInt32(empty, 3, 7)
+		require.NoError(t, err)
+		require.Equal(t, int32(7), i)
+
+		s, err := molecule.GetString(empty, 14, "default")
+		require.NoError(t, err)
+		require.Equal(t, "default", s)
+
+		b, err := molecule.GetBool(empty, 13, true)
+		require.NoError(t, err)
+		require.True(t, b)
+
+		d, err := molecule.GetDouble(empty, 1, 2.5)
+		require.NoError(t, err)
+		require.Equal(t, 2.5, d)
+	})
+
+	t.Run("type mismatch", func(t *testing.T) {
+		_, err := molecule.GetInt32(buffer, 14, 7)
+		require.Error(t, err)
+
+		_, err = molecule.GetString(buffer, 3, "default")
+		require.Error(t, err)
+
+		_, err = molecule.GetBool(buffer, 1, false)
+		require.Error(t, err)
+
+		_, err = molecule.GetDouble(buffer, 13, 2.5)
+		require.Error(t, err)
+	})
+
+	// None of the lookups should have advanced the buffer.
+	require.Equal(t, len(marshaled), buffer.Len())
+}
+
+func TestCountField(t *testing.T) {
+	t.Run("unpacked repeated", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeVarintField(t, encoder, 1, 1)
+		encodeBytesField(t, encoder, 2, []byte("a"))
+		encodeVarintField(t, encoder, 1, 300)
+		encodeVarintField(t, encoder, 1, 3)
+
+		buffer := codec.NewBuffer(encoder.Bytes())
+		count, err := molecule.CountField(buffer, 1)
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+
+		count, err = molecule.CountRepeated(buffer, 1, codec.FieldType_INT64)
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+	})
+
+	t.Run("packed repeated", func(t *testing.T) {
+		m := &simple.Test{RepeatedInt64Field: []int64{1, 300, -1, 1 << 40, 5}}
+		marshaled, err := proto.Marshal(m)
+		require.NoError(t, err)
+
+		buffer := codec.NewBuffer(marshaled)
+		count, err := molecule.CountField(buffer, 3)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+
+		count, err = molecule.CountRepeated(buffer, 3, codec.FieldType_INT64)
+		require.NoError(t, err)
+		require.Equal(t, len(m.RepeatedInt64Field), count)
+	})
+
+	t.Run("packed fixed", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeBytesField(t, encoder, 1, make([]byte, 24))
+
+		count, err := molecule.CountRepeated(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_DOUBLE)
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+
+		count, err = molecule.CountRepeated(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_FIXED32)
+		require.NoError(t, err)
+		require.Equal(t, 6, count)
+	})
+
+	t.Run("singular", func(t *testing.T) {
+		m := &simple.Test{StringField: "hello", Int64Field: 10}
+		marshaled, err := proto.Marshal(m)
+		require.NoError(t, err)
+
+		buffer := codec.NewBuffer(marshaled)
+		for _, fieldNum := range []int32{1, 2} {
+			count, err := molecule.CountField(buffer, fieldNum)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+		}
+
+		count, err := molecule.CountField(buffer, 3)
+		require.NoError(t, err)
+		require.Equal(t, 0, count)
+
+		// Strings are never packed so their bytes must not be counted as elements.
+		count, err = molecule.CountRepeated(buffer, 1, codec.FieldType_STRING)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
+}
+
+func TestSubMessageEach(t *testing.T) {
+	first, err := proto.Marshal(&simple.Test{StringField: "first", Int64Field: 1})
+	require.NoError(t, err)
+	second, err := proto.Marshal(&simple.Test{StringField: "second"})
+	require.NoError(t, err)
+
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 2, 5)
+	encodeBytesField(t, encoder, 1, first)
+	encodeBytesField(t, encoder, 1, second)
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	var fieldNums []int32
+	var str string
+	err = molecule.SubMessageEach(buffer, 1, func(fieldNum int32, value molecule.Value) (bool, error) {
+		fieldNums = append(fieldNums, fieldNum)
+		if fieldNum == 1 {
+			str, err = value.AsStringSafe()
+			return true, err
+		}
+		return true, nil
+	})
+	require.NoError(t, err)
+	// Only the first occurrence is visited.
+	require.Equal(t, []int32{1, 2}, fieldNums)
+	require.Equal(t, "first", str)
+	require.Equal(t, len(encoder.Bytes()), buffer.Len())
+
+	// Absent fields never call fn.
+	err = molecule.SubMessageEach(buffer, 3, func(fieldNum int32, value molecule.Value) (bool, error) {
+		t.Fatal("unexpected field")
+		return false, nil
+	})
+	require.NoError(t, err)
+
+	// Errors from fn are returned as is.
+	errStop := errors.New("stop")
+	err = molecule.SubMessageEach(buffer, 1, func(fieldNum int32, value molecule.Value) (bool, error) {
+		return true, errStop
+	})
+	require.Equal(t, errStop, err)
+
+	// Fields that aren't length-delimited, or don't hold a valid message, are rejected.
+	require.Error(t, molecule.SubMessageEach(buffer, 2, nopMessageEachFn))
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte{0x0a, 0x05})
+	err = molecule.SubMessageEach(codec.NewBuffer(encoder.Bytes()), 1, nopMessageEachFn)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "SubMessageEach: field 1:")
+}
+
+func TestPeekFirstFieldNum(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Test{StringField: "hello", Int64Field: 2})
+	require.NoError(t, err)
+	buffer := codec.NewBuffer(marshaled)
+
+	fieldNum, err := molecule.PeekFirstFieldNum(buffer)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fieldNum)
+	require.Equal(t, len(marshaled), buffer.Len())
+
+	// Peeking after part of the message has been read returns the next field.
+	require.NoError(t, buffer.Skip(7))
+	fieldNum, err = molecule.PeekFirstFieldNum(buffer)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), fieldNum)
+	require.Equal(t, len(marshaled)-7, buffer.Len())
+
+	// Multi-byte tags.
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 123456, 1)
+	fieldNum, err = molecule.PeekFirstFieldNum(codec.NewBuffer(encoder.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int32(123456), fieldNum)
+
+	_, err = molecule.PeekFirstFieldNum(codec.NewBuffer(nil))
+	require.True(t, errors.Is(err, molecule.ErrEmptyMessage))
+
+	_, err = molecule.PeekFirstFieldNum(codec.NewBuffer([]byte{0x80}))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, molecule.ErrEmptyMessage))
+}
+
+func TestSkipFields(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 300)
+	encodeBytesField(t, encoder, 2, make([]byte, 1000))
+	require.NoError(t, encoder.EncodeVarint(3<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(7))
+	require.NoError(t, encoder.EncodeVarint(4<<3|uint64(codec.WireStartGroup)))
+	encodeVarintField(t, encoder, 1, 1)
+	require.NoError(t, encoder.EncodeVarint(4<<3|uint64(codec.WireEndGroup)))
+	require.NoError(t, encoder.EncodeVarint(5<<3|uint64(codec.WireFixed64)))
+	require.NoError(t, encoder.EncodeFixed64(8))
+	encodeVarintField(t, encoder, 6, 6)
+	encodeVarintField(t, encoder, 6, 7)
+	data := encoder.Bytes()
+
+	// Skipping lands exactly on the start of each field in turn.
+	expected := []int32{1, 2, 3, 4, 5, 6, 6}
+	for n, fieldNum := range expected {
+		buffer := codec.NewBuffer(data)
+		require.NoError(t, molecule.SkipFields(buffer, n))
+		num, err := molecule.PeekFirstFieldNum(buffer)
+		require.NoError(t, err)
+		require.Equal(t, fieldNum, num)
+	}
+
+	buffer := codec.NewBuffer(data)
+	require.NoError(t, molecule.SkipFields(buffer, 6))
+	last, err := molecule.GetInt32(buffer, 6, 0)
+	require.NoError(t, err)
+	require.Equal(t, int32(7), last)
+	require.NoError(t, molecule.SkipFields(buffer, 1))
+	require.True(t, buffer.EOF())
+	require.NoError(t, molecule.SkipFields(buffer, 0))
+
+	// Asking for more fields than there are consumes the whole message.
+	buffer = codec.NewBuffer(data)
+	err = molecule.SkipFields(buffer, len(expected)+1)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	require.True(t, buffer.EOF())
+
+	require.Error(t, molecule.SkipFields(codec.NewBuffer(data), -1))
+	require.Error(t, molecule.SkipFields(codec.NewBuffer(data[:10]), 2))
+}
@@ -0,0 +1,50 @@
+package moleculetest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotatedHexDump(t *testing.T) {
+	m := &simple.Test{StringField: "hi", Int64Field: 150}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	t.Run("well formed", func(t *testing.T) {
+		encoder := proto.NewBuffer(append([]byte(nil), marshaled...))
+		encodeBytesField(t, encoder, 4, []byte("0123456789abcdef"))
+
+		var out bytes.Buffer
+		buffer := codec.NewBuffer(encoder.Bytes())
+		require.NoError(t, molecule.AnnotatedHexDump(buffer, &out))
+		require.Equal(t, 0, buffer.Len())
+
+		expected := `00000000  0a 02 68 69  field=1 bytes len=2
+00000004  10 96 01  field=2 varint 150
+00000007  22 10 30 31 32 33 34 35 36 37 38 39 61 62 63 64  field=4 bytes len=16
+00000017  65 66
+`
+		require.Equal(t, expected, out.String())
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		// A bytes field that claims to be longer than the remaining data.
+		corrupt := append(append([]byte(nil), marshaled...), 0x1a, 0x05, 0x01, 0x02)
+
+		var out bytes.Buffer
+		require.NoError(t, molecule.AnnotatedHexDump(codec.NewBuffer(corrupt), &out))
+
+		expected := `00000000  0a 02 68 69  field=1 bytes len=2
+00000004  10 96 01  field=2 varint 150
+00000007  1a 05 01 02  error: unexpected EOF
+`
+		require.Equal(t, expected, out.String())
+	})
+}
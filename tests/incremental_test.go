@@ -0,0 +1,93 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrementalDecoder(t *testing.T) {
+	type field struct {
+		fieldNum int32
+		value    molecule.Value
+	}
+	m := &simple.Simple{
+		Int64:               -1,
+		Fixed32:             7,
+		Double:              1.5,
+		String_:             "hello, world",
+		Bytes:               make([]byte, 300),
+		RepeatedInt64Packed: []int64{1, 200, 30000},
+	}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	var expected []field
+	require.NoError(t, molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+		expected = append(expected, field{fieldNum, value.Retain()})
+		return true, nil
+	}))
+
+	for _, chunkSize := range []int{1, 2, 7, len(marshaled)} {
+		var (
+			decoder molecule.IncrementalDecoder
+			got     []field
+		)
+		for start := 0; start < len(marshaled); start += chunkSize {
+			end := start + chunkSize
+			if end > len(marshaled) {
+				end = len(marshaled)
+			}
+			decoder.Feed(marshaled[start:end])
+			decoder.Fields()(func(fieldNum int32, value molecule.Value) bool {
+				got = append(got, field{fieldNum, value.Retain()})
+				return true
+			})
+			require.NoError(t, decoder.Err())
+		}
+		require.Equal(t, expected, got, "chunk size %d", chunkSize)
+		require.Equal(t, 0, decoder.Buffered())
+	}
+
+	// Stopping early leaves the remaining fields for the next iteration.
+	var decoder molecule.IncrementalDecoder
+	decoder.Feed(marshaled)
+	var fieldNums []int32
+	decoder.Fields()(func(fieldNum int32, _ molecule.Value) bool {
+		fieldNums = append(fieldNums, fieldNum)
+		return false
+	})
+	decoder.Fields()(func(fieldNum int32, _ molecule.Value) bool {
+		fieldNums = append(fieldNums, fieldNum)
+		return true
+	})
+	require.Equal(t, []int32{1, 4, 9, 14, 15, 16}, fieldNums)
+
+	// A truncated message leaves its last field buffered.
+	decoder = molecule.IncrementalDecoder{}
+	decoder.Feed(marshaled[:len(marshaled)-1])
+	decoder.Fields()(func(int32, molecule.Value) bool { return true })
+	require.NoError(t, decoder.Err())
+	require.Equal(t, 8, decoder.Buffered())
+
+	// Errors other than truncation stop iteration for good.
+	decoder = molecule.IncrementalDecoder{}
+	decoder.Feed([]byte{0x08, 0x01, 0x0f})
+	fieldNums = nil
+	decoder.Fields()(func(fieldNum int32, _ molecule.Value) bool {
+		fieldNums = append(fieldNums, fieldNum)
+		return true
+	})
+	require.Equal(t, []int32{1}, fieldNums)
+	require.Error(t, decoder.Err())
+	decoder.Feed([]byte{0x08, 0x01})
+	decoder.Fields()(func(int32, molecule.Value) bool {
+		t.Fatal("unexpected field")
+		return true
+	})
+}
@@ -0,0 +1,101 @@
+package moleculetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSON(t *testing.T) {
+	nested := &simple.Nested{NestedMessage: &simple.Test{
+		StringField:        "hello \"world\"\n",
+		Int64Field:         10,
+		RepeatedInt64Field: []int64{1, 2, 3},
+	}}
+	marshaled, err := proto.Marshal(nested)
+	require.NoError(t, err)
+
+	// Append a repeated, non-contiguous field that isn't a valid message or UTF-8.
+	encoder := proto.NewBuffer(marshaled)
+	encodeBytesField(t, encoder, 2, []byte{0xff, 0xfe})
+	encodeVarintField(t, encoder, 3, 7)
+	encodeBytesField(t, encoder, 2, []byte{0xfd})
+	// Starts like a message (field 1, varint) but is truncated part way through.
+	encodeBytesField(t, encoder, 4, []byte{0x08, 0x96})
+
+	var out bytes.Buffer
+	buffer := codec.NewBuffer(encoder.Bytes())
+	require.NoError(t, molecule.WriteJSON(&out, buffer))
+	require.True(t, buffer.EOF())
+
+	expected := `{"1":{"1":"hello \"world\"\n","2":10,"3":"\u0001\u0002\u0003"},"2":["//4=","/Q=="],"3":7,"4":"CJY="}`
+	require.Equal(t, expected, out.String())
+	require.True(t, json.Valid(out.Bytes()))
+}
+
+func TestWriteJSONMaxTotalBytes(t *testing.T) {
+	nested := &simple.Nested{NestedMessage: &simple.Test{StringField: "hello world", Int64Field: 10}}
+	marshaled, err := proto.Marshal(nested)
+	require.NoError(t, err)
+
+	// The top-level message fits within the budget but recursing into the nested
+	// message exceeds it.
+	var out bytes.Buffer
+	err = molecule.WriteJSON(&out, codec.NewBuffer(marshaled), molecule.WithMaxTotalBytes(len(marshaled)+1))
+	require.True(t, errors.Is(err, molecule.ErrMaxTotalBytes))
+
+	out.Reset()
+	err = molecule.WriteJSON(&out, codec.NewBuffer(marshaled), molecule.WithMaxTotalBytes(1024))
+	require.NoError(t, err)
+}
+
+func TestWriteJSONScansEachFieldOnce(t *testing.T) {
+	nested := &simple.Nested{NestedMessage: &simple.Test{StringField: "hello world", Int64Field: 10}}
+	marshaled, err := proto.Marshal(nested)
+	require.NoError(t, err)
+
+	// Interleave many occurrences of a few fields, which used to be rescanned once
+	// per distinct field.
+	encoder := proto.NewBuffer(marshaled)
+	for i := 0; i < 1000; i++ {
+		encodeVarintField(t, encoder, int32(2+i%3), uint64(i))
+	}
+
+	// The hook is passed on to the scan of every message, nested ones included, and
+	// sees each field exactly once: the 1001 top-level fields plus the 2 nested ones.
+	var fields int
+	hook := func(fieldNum int32, wireType codec.WireType, bytes int) {
+		fields++
+	}
+	var out bytes.Buffer
+	err = molecule.WriteJSON(&out, codec.NewBuffer(encoder.Bytes()), molecule.WithFieldHook(hook))
+	require.NoError(t, err)
+	require.Equal(t, 1003, fields)
+	require.True(t, json.Valid(out.Bytes()))
+}
+
+func TestWriteJSONMaxDepth(t *testing.T) {
+	// Values nested deeper than the limit are written as base64 without being parsed.
+	var out bytes.Buffer
+	data := nestedChain(3)
+	require.NoError(t, molecule.WriteJSON(&out, codec.NewBuffer(data), molecule.WithMaxDepth(2)))
+	require.Equal(t, `{"1":{"1":"CgA="}}`, out.String())
+
+	out.Reset()
+	require.NoError(t, molecule.WriteJSON(&out, codec.NewBuffer(data)))
+	require.Equal(t, `{"1":{"1":{"1":""}}}`, out.String())
+
+	// Hostile input nested far deeper than the default limit doesn't exhaust the stack.
+	out.Reset()
+	require.NoError(t, molecule.WriteJSON(&out, codec.NewBuffer(nestedChain(1<<20))))
+	require.True(t, json.Valid(out.Bytes()))
+	require.Equal(t, molecule.DefaultMaxDepth, bytes.Count(out.Bytes(), []byte("{")))
+}
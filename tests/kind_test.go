@@ -0,0 +1,84 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuessKind(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Test{StringField: "hello", Int64Field: 10})
+	require.NoError(t, err)
+
+	t.Run("clear cut", func(t *testing.T) {
+		require.Equal(t, molecule.KindMessage, molecule.GuessKind(marshaled))
+		require.Equal(t, molecule.KindString, molecule.GuessKind([]byte("hello, world")))
+		require.Equal(t, molecule.KindString, molecule.GuessKind([]byte("héllo")))
+		require.Equal(t, molecule.KindBytes, molecule.GuessKind([]byte{0xff, 0xfe, 0xfd}))
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		// Empty contents could be any of the three.
+		require.Equal(t, molecule.KindString, molecule.GuessKind(nil))
+		// "hi" is a valid message consisting of field 13 with the varint value 105.
+		require.Equal(t, molecule.KindMessage, molecule.GuessKind([]byte("hi")))
+		// Packed varints are valid UTF-8 when every element is less than 128.
+		require.Equal(t, molecule.KindString, molecule.GuessKind([]byte{0x01, 0x02, 0x03}))
+	})
+
+	require.Equal(t, "message", molecule.KindMessage.String())
+}
+
+func TestValueAsStringOrBytes(t *testing.T) {
+	asStringOrBytes := func(b []byte) (string, bool) {
+		v := molecule.Value{WireType: codec.WireBytes, Bytes: b}
+		return v.AsStringOrBytes()
+	}
+
+	t.Run("clear cut", func(t *testing.T) {
+		s, ok := asStringOrBytes([]byte("hello,\tworld\n"))
+		require.True(t, ok)
+		require.Equal(t, "hello,\tworld\n", s)
+		s, ok = asStringOrBytes([]byte("héllo wörld"))
+		require.True(t, ok)
+		require.Equal(t, "héllo wörld", s)
+
+		s, ok = asStringOrBytes([]byte{0xff, 0xfe, 0xfd})
+		require.False(t, ok)
+		require.Empty(t, s)
+		// Valid UTF-8 that contains control characters isn't readable either.
+		_, ok = asStringOrBytes([]byte("ab\x00cd"))
+		require.False(t, ok)
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		// Empty contents are an empty string.
+		s, ok := asStringOrBytes(nil)
+		require.True(t, ok)
+		require.Empty(t, s)
+		// "hi" is also a valid message, but it's shown as a string.
+		s, ok = asStringOrBytes([]byte("hi"))
+		require.True(t, ok)
+		require.Equal(t, "hi", s)
+		// Packed varints less than 128 are valid UTF-8 but not printable.
+		_, ok = asStringOrBytes([]byte{0x01, 0x02, 0x03})
+		require.False(t, ok)
+	})
+
+	// The string is a copy.
+	b := []byte("hello")
+	s, ok := asStringOrBytes(b)
+	require.True(t, ok)
+	b[0] = 'j'
+	require.Equal(t, "hello", s)
+
+	// Only length-delimited values can hold strings.
+	v := molecule.Value{WireType: codec.WireVarint, Number: 'a'}
+	_, ok = v.AsStringOrBytes()
+	require.False(t, ok)
+}
@@ -0,0 +1,75 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMap(t *testing.T) {
+	t.Run("string to int64", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		for _, entry := range []struct {
+			key   string
+			value int64
+		}{{"a", 1}, {"b", -2}, {"a", 3}} {
+			e := proto.NewBuffer(nil)
+			encodeBytesField(t, e, 1, []byte(entry.key))
+			encodeVarintField(t, e, 2, uint64(entry.value))
+			encodeBytesField(t, encoder, 5, e.Bytes())
+		}
+		// An entry with neither a key nor a value maps the zero key to the zero value.
+		encodeBytesField(t, encoder, 5, nil)
+		encodeVarintField(t, encoder, 1, 99)
+
+		buffer := codec.NewBuffer(encoder.Bytes())
+		m, err := molecule.DecodeMapStringInt64(buffer, 5)
+		require.NoError(t, err)
+		require.Equal(t, map[string]int64{"a": 3, "b": -2, "": 0}, m)
+		require.Equal(t, len(encoder.Bytes()), buffer.Len())
+
+		_, err = molecule.DecodeMapInt32String(buffer, 5)
+		require.Error(t, err)
+	})
+
+	t.Run("int32 to string", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		for _, entry := range []struct {
+			key   int32
+			value string
+		}{{1, "one"}, {-1, "minus one"}, {1, "uno"}} {
+			e := proto.NewBuffer(nil)
+			encodeVarintField(t, e, 1, uint64(entry.key))
+			encodeBytesField(t, e, 2, []byte(entry.value))
+			encodeBytesField(t, encoder, 2, e.Bytes())
+		}
+
+		m, err := molecule.DecodeMapInt32String(codec.NewBuffer(encoder.Bytes()), 2)
+		require.NoError(t, err)
+		require.Equal(t, map[int32]string{1: "uno", -1: "minus one"}, m)
+	})
+
+	t.Run("map each", func(t *testing.T) {
+		e := proto.NewBuffer(nil)
+		encodeVarintField(t, e, 2, 7)
+		encoder := proto.NewBuffer(nil)
+		encodeBytesField(t, encoder, 1, e.Bytes())
+
+		var keys []string
+		err := molecule.MapEach(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_STRING, codec.FieldType_UINT64,
+			func(key molecule.Value, value molecule.Value) (bool, error) {
+				// The missing key is the zero value of its type.
+				require.Equal(t, codec.WireBytes, key.WireType)
+				require.Equal(t, uint64(7), value.Number)
+				k, err := key.AsStringSafe()
+				keys = append(keys, k)
+				return true, err
+			})
+		require.NoError(t, err)
+		require.Equal(t, []string{""}, keys)
+	})
+}
@@ -96,3 +96,195 @@ func noErr(err error) {
 		panic(err)
 	}
 }
+
+func BenchmarkEncodeGrow(b *testing.B) {
+	str := []byte("hello world")
+	encode := func(buffer *codec.Buffer) {
+		for i := 0; i < 100; i++ {
+			noErr(buffer.EncodeTagAndWireType(1, codec.WireVarint))
+			noErr(buffer.EncodeVarint(uint64(i) << 20))
+			noErr(buffer.EncodeTagAndWireType(2, codec.WireBytes))
+			noErr(buffer.EncodeRawBytes(str))
+		}
+	}
+
+	sizer := codec.NewBuffer(nil)
+	encode(sizer)
+	size := len(sizer.Bytes())
+
+	b.Run("without grow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encode(codec.NewBuffer(nil))
+		}
+	})
+
+	b.Run("with grow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buffer := codec.NewBuffer(nil)
+			buffer.Grow(size)
+			encode(buffer)
+		}
+	})
+}
+
+func BenchmarkComputeVarintSize(b *testing.B) {
+	naive := func(x uint64) int {
+		n := 1
+		for x >= 1<<7 {
+			x >>= 7
+			n++
+		}
+		return n
+	}
+
+	values := make([]uint64, 256)
+	for i := range values {
+		values[i] = 1<<uint(i%64) + uint64(i)
+	}
+
+	var sink int
+	b.Run("bits", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += codec.ComputeVarintSize(values[i%len(values)])
+		}
+	})
+
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			sink += naive(values[i%len(values)])
+		}
+	})
+	_ = sink
+}
+
+func BenchmarkCollectMessages(b *testing.B) {
+	encoder := proto.NewBuffer(nil)
+	for i := 0; i < 1000; i++ {
+		marshaled, err := proto.Marshal(&simple.Test{StringField: "hello", Int64Field: int64(i)})
+		noErr(err)
+		noErr(encoder.EncodeVarint(uint64(1)<<3 | uint64(codec.WireBytes)))
+		noErr(encoder.EncodeRawBytes(marshaled))
+	}
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	// The aliasing path performs a fixed number of allocations for the result, none of
+	// which are per element.
+	b.Run("alias", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := molecule.CollectMessages(buffer, 1)
+			noErr(err)
+		}
+	})
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := molecule.CollectMessages(buffer, 1, molecule.WithCopy())
+			noErr(err)
+		}
+	})
+}
+
+func BenchmarkMessageEachNested(b *testing.B) {
+	data := encodeTree(b, 8)
+	w := &treeWalker{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		noErr(w.walk(codec.NewBuffer(data)))
+	}
+}
+
+func BenchmarkAsMessage(b *testing.B) {
+	data := encodeTree(b, 8)
+	w := &asMessageWalker{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		noErr(w.walk(codec.NewBuffer(data)))
+	}
+}
+
+func BenchmarkSkipFields(b *testing.B) {
+	// A wide message whose last field is the one we're after, preceded by a mix of
+	// nested messages and scalars.
+	const width = 1000
+	nested, err := proto.Marshal(&simple.Test{StringField: "hello", RepeatedInt64Field: []int64{1, 2, 3}})
+	noErr(err)
+	encoder := proto.NewBuffer(nil)
+	for i := 0; i < width-1; i++ {
+		if i%2 == 0 {
+			noErr(encoder.EncodeVarint(uint64(1)<<3 | uint64(codec.WireBytes)))
+			noErr(encoder.EncodeRawBytes(nested))
+		} else {
+			noErr(encoder.EncodeVarint(uint64(2)<<3 | uint64(codec.WireVarint)))
+			noErr(encoder.EncodeVarint(uint64(i)))
+		}
+	}
+	noErr(encoder.EncodeVarint(uint64(3)<<3 | uint64(codec.WireVarint)))
+	noErr(encoder.EncodeVarint(42))
+	data := encoder.Bytes()
+
+	b.Run("SkipFields", func(b *testing.B) {
+		b.ReportAllocs()
+		buffer := codec.NewBuffer(nil)
+		for i := 0; i < b.N; i++ {
+			buffer.Reset(data)
+			noErr(molecule.SkipFields(buffer, width-1))
+			_, err := molecule.PeekFirstFieldNum(buffer)
+			noErr(err)
+		}
+	})
+
+	b.Run("MessageEach", func(b *testing.B) {
+		b.ReportAllocs()
+		buffer := codec.NewBuffer(nil)
+		for i := 0; i < b.N; i++ {
+			buffer.Reset(data)
+			var n int
+			noErr(molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+				n++
+				return n < width, nil
+			}))
+		}
+	})
+}
+
+func BenchmarkCollectFixed64s(b *testing.B) {
+	values := make([]uint64, 4096)
+	for i := range values {
+		values[i] = uint64(i) * 0x9E3779B97F4A7C15
+	}
+	marshaled, err := proto.Marshal(&simple.Test{})
+	noErr(err)
+	encoder := proto.NewBuffer(marshaled)
+	noErr(encoder.EncodeVarint(uint64(10)<<3 | uint64(codec.WireBytes)))
+	noErr(encoder.EncodeVarint(uint64(len(values) * 8)))
+	for _, v := range values {
+		noErr(encoder.EncodeFixed64(v))
+	}
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	b.Run("bulk", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := molecule.CollectFixed64s(buffer, 10)
+			noErr(err)
+		}
+	})
+
+	b.Run("element-wise", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var result []uint64
+			err := molecule.RepeatedEach(buffer.Clone(), 10, codec.FieldType_FIXED64, func(v molecule.Value) (bool, error) {
+				result = append(result, v.Number)
+				return true, nil
+			})
+			noErr(err)
+		}
+	})
+}
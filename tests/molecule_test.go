@@ -1,6 +1,10 @@
 package moleculetest
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"testing"
 	"time"
 
@@ -126,3 +130,318 @@ func TestMoleculeSimple(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestStrictMessageEach(t *testing.T) {
+	m := &simple.Test{StringField: "hello", Int64Field: 10}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	// Treat field 2 as the last field of the message.
+	stopAtInt64Field := func(fieldNum int32, value molecule.Value) (bool, error) {
+		return fieldNum != 2, nil
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		buffer := codec.NewBuffer(marshaled)
+		require.NoError(t, molecule.StrictMessageEach(buffer, stopAtInt64Field))
+		require.Equal(t, 0, buffer.Len())
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		trailing := append(append([]byte(nil), marshaled...), 0x08, 0x01)
+		err := molecule.StrictMessageEach(codec.NewBuffer(trailing), stopAtInt64Field)
+		require.True(t, errors.Is(err, molecule.ErrTrailingData))
+		require.Contains(t, err.Error(), fmt.Sprintf("offset %d", len(marshaled)))
+
+		// MessageEach has no notion of trailing data.
+		require.NoError(t, molecule.MessageEach(codec.NewBuffer(trailing), stopAtInt64Field))
+	})
+}
+
+func TestMessageEachTyped(t *testing.T) {
+	m := &simple.Simple{Double: 1.5, Float: 2.5, Int64: 3, String_: "hello"}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	seen := map[codec.WireType]int32{}
+	err = molecule.MessageEachTyped(codec.NewBuffer(marshaled), func(fieldNum int32, wireType codec.WireType, value molecule.Value) (bool, error) {
+		require.Equal(t, value.WireType, wireType)
+		seen[wireType] = fieldNum
+
+		switch wireType {
+		case codec.WireFixed64:
+			v, err := value.AsDouble()
+			require.NoError(t, err)
+			require.Equal(t, m.Double, v)
+		case codec.WireFixed32:
+			v, err := value.AsFloat()
+			require.NoError(t, err)
+			require.Equal(t, m.Float, v)
+		case codec.WireVarint:
+			v, err := value.AsInt64()
+			require.NoError(t, err)
+			require.Equal(t, m.Int64, v)
+		case codec.WireBytes:
+			v, err := value.AsStringSafe()
+			require.NoError(t, err)
+			require.Equal(t, m.String_, v)
+		}
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[codec.WireType]int32{
+		codec.WireFixed64: 1,
+		codec.WireFixed32: 2,
+		codec.WireVarint:  4,
+		codec.WireBytes:   14,
+	}, seen)
+}
+
+func TestMessageEachOrdinal(t *testing.T) {
+	type occurrence struct {
+		fieldNum int32
+		ordinal  int
+		value    uint64
+	}
+
+	// Interleaved repeated fields, including field numbers beyond the fixed size array.
+	var (
+		encoder  = proto.NewBuffer(nil)
+		expected []occurrence
+		counts   = map[int32]int{}
+	)
+	for i, fieldNum := range []int32{1, 2, 1, 1000, 63, 2, 64, 1, 1000, 64, 63} {
+		encodeVarintField(t, encoder, fieldNum, uint64(i))
+		expected = append(expected, occurrence{fieldNum, counts[fieldNum], uint64(i)})
+		counts[fieldNum]++
+	}
+
+	var actual []occurrence
+	err := molecule.MessageEachOrdinal(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, ordinal int, value molecule.Value) (bool, error) {
+		actual = append(actual, occurrence{fieldNum, ordinal, value.Number})
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// Reconstructing a repeated field into an indexed slice in a single pass.
+	var field1 []uint64
+	err = molecule.MessageEachOrdinal(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, ordinal int, value molecule.Value) (bool, error) {
+		if fieldNum == 1 {
+			require.Equal(t, len(field1), ordinal)
+			field1 = append(field1, value.Number)
+		}
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2, 7}, field1)
+
+	// Ordinals start over for every call.
+	err = molecule.MessageEachOrdinal(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, ordinal int, value molecule.Value) (bool, error) {
+		require.Equal(t, 0, ordinal)
+		return false, nil
+	})
+	require.NoError(t, err)
+
+	AssertNoAllocs(t, func() {
+		noErr(molecule.MessageEachOrdinal(codec.NewBuffer(encoder.Bytes()[:6]), func(int32, int, molecule.Value) (bool, error) {
+			return true, nil
+		}))
+	})
+}
+
+func TestPackedRepeatedEach(t *testing.T) {
+	collect := func(t *testing.T, data []byte, limit int) []int64 {
+		var got []int64
+		err := molecule.PackedRepeatedEach(codec.NewBuffer(data), codec.FieldType_INT64, func(value molecule.Value) (bool, error) {
+			v, err := value.AsInt64()
+			got = append(got, v)
+			return len(got) < limit, err
+		})
+		require.NoError(t, err)
+		return got
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		require.Empty(t, collect(t, nil, 10))
+		require.Empty(t, collect(t, []byte{}, 10))
+	})
+
+	t.Run("single element", func(t *testing.T) {
+		require.Equal(t, []int64{150}, collect(t, []byte{0x96, 0x01}, 10))
+	})
+
+	t.Run("early stop", func(t *testing.T) {
+		require.Equal(t, []int64{1, 2}, collect(t, []byte{0x01, 0x02, 0x03}, 2))
+	})
+
+	t.Run("trailing zeros", func(t *testing.T) {
+		require.Equal(t, []int64{1, 0, 0}, collect(t, []byte{0x01, 0x00, 0x00}, 10))
+	})
+
+	t.Run("callback error", func(t *testing.T) {
+		errStop := errors.New("stop")
+		err := molecule.PackedRepeatedEach(codec.NewBuffer([]byte{0x01, 0x02}), codec.FieldType_INT64, func(value molecule.Value) (bool, error) {
+			return true, errStop
+		})
+		require.Equal(t, errStop, err)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		// Three complete fixed32 elements followed by half of a fourth.
+		data := []byte{1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0}
+		var visited int
+		err := molecule.PackedRepeatedEach(codec.NewBuffer(data), codec.FieldType_FIXED32, func(value molecule.Value) (bool, error) {
+			visited++
+			return true, nil
+		})
+		require.Error(t, err)
+		require.Equal(t, 3, visited)
+		require.Contains(t, err.Error(), "PackedRepeatedEach: element 3:")
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+		// A varint that never terminates.
+		err = molecule.PackedRepeatedEach(codec.NewBuffer([]byte{0x01, 0x80}), codec.FieldType_INT64, nopPackedFn)
+		require.Contains(t, err.Error(), "element 1:")
+	})
+}
+
+func TestPackedBytesEach(t *testing.T) {
+	t.Run("int64", func(t *testing.T) {
+		expected := []int64{1, -1, 300, math.MaxInt64}
+		encoder := codec.NewBuffer(nil)
+		for _, v := range expected {
+			require.NoError(t, encoder.EncodeVarint(uint64(v)))
+		}
+
+		var got []int64
+		err := molecule.PackedBytesEach(encoder.Bytes(), codec.FieldType_INT64, func(v molecule.Value) (bool, error) {
+			i, err := v.AsInt64()
+			got = append(got, i)
+			return true, err
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	})
+
+	t.Run("double", func(t *testing.T) {
+		expected := []float64{1.5, -2.25, math.Inf(1), 0}
+		encoder := codec.NewBuffer(nil)
+		for _, v := range expected {
+			require.NoError(t, encoder.EncodeFixed64(math.Float64bits(v)))
+		}
+
+		var got []float64
+		err := molecule.PackedBytesEach(encoder.Bytes(), codec.FieldType_DOUBLE, func(v molecule.Value) (bool, error) {
+			d, err := v.AsDouble()
+			got = append(got, d)
+			return true, err
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+
+		// A blob that doesn't hold whole elements is rejected.
+		err = molecule.PackedBytesEach(encoder.Bytes()[:12], codec.FieldType_DOUBLE, func(molecule.Value) (bool, error) {
+			return true, nil
+		})
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		require.Contains(t, err.Error(), "PackedBytesEach: element 1")
+	})
+}
+
+func TestPackedRemaining(t *testing.T) {
+	collect := func(t *testing.T, b []byte, wireType codec.WireType) []molecule.Value {
+		var values []molecule.Value
+		buffer := codec.NewBuffer(b)
+		require.NoError(t, molecule.PackedRemaining(buffer, wireType, func(v molecule.Value) (bool, error) {
+			values = append(values, v)
+			return true, nil
+		}))
+		require.True(t, buffer.EOF())
+		return values
+	}
+
+	t.Run("varint", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeVarint(1))
+		require.NoError(t, encoder.EncodeVarint(300))
+		require.NoError(t, encoder.EncodeVarint(codec.EncodeZigZag64(-5)))
+		values := collect(t, encoder.Bytes(), codec.WireVarint)
+		require.Len(t, values, 3)
+		require.Equal(t, uint64(1), values[0].Number)
+		require.Equal(t, uint64(300), values[1].Number)
+		v, err := values[2].AsSint64()
+		require.NoError(t, err)
+		require.Equal(t, int64(-5), v)
+	})
+
+	t.Run("fixed32", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeFixed32(7))
+		require.NoError(t, encoder.EncodeFixed32(uint64(math.Float32bits(1.5))))
+		values := collect(t, encoder.Bytes(), codec.WireFixed32)
+		require.Len(t, values, 2)
+		require.Equal(t, codec.WireFixed32, values[0].WireType)
+		require.Equal(t, uint64(7), values[0].Number)
+		f, err := values[1].AsFloat()
+		require.NoError(t, err)
+		require.Equal(t, float32(1.5), f)
+	})
+
+	t.Run("fixed64", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeFixed64(1<<40))
+		require.NoError(t, encoder.EncodeFixed64(math.Float64bits(-2.25)))
+		values := collect(t, encoder.Bytes(), codec.WireFixed64)
+		require.Len(t, values, 2)
+		require.Equal(t, codec.WireFixed64, values[0].WireType)
+		require.Equal(t, uint64(1<<40), values[0].Number)
+		d, err := values[1].AsDouble()
+		require.NoError(t, err)
+		require.Equal(t, -2.25, d)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		nopPackedEachFn := func(molecule.Value) (bool, error) { return true, nil }
+		err := molecule.PackedRemaining(codec.NewBuffer([]byte{1, 2}), codec.WireBytes, nopPackedEachFn)
+		require.EqualError(t, err, "PackedRemaining: wiretype 2 can't be packed")
+
+		err = molecule.PackedRemaining(codec.NewBuffer([]byte{1, 2, 3, 4, 5}), codec.WireFixed32, nopPackedEachFn)
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+		require.Contains(t, err.Error(), "PackedRemaining: element 1")
+	})
+}
+
+func nopPackedFn(value molecule.Value) (bool, error) {
+	return true, nil
+}
+
+func TestParse(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Test{StringField: "hello", Int64Field: 2, RepeatedInt64Field: []int64{3}})
+	require.NoError(t, err)
+
+	var fromParse, fromMessageEach []readerAtField
+	err = molecule.Parse(marshaled, func(fieldNum int32, value molecule.Value) (bool, error) {
+		fromParse = append(fromParse, readerAtField{fieldNum: fieldNum, value: value})
+		return true, nil
+	})
+	require.NoError(t, err)
+	err = molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+		fromMessageEach = append(fromMessageEach, readerAtField{fieldNum: fieldNum, value: value})
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, fromParse, 3)
+	require.Equal(t, fromMessageEach, fromParse)
+
+	// Options are passed through.
+	err = molecule.Parse(nil, nopMessageEachFn, molecule.WithRejectEmpty())
+	require.True(t, errors.Is(err, molecule.ErrEmptyMessage))
+	require.Error(t, molecule.Parse([]byte{0x0a, 0x05}, nopMessageEachFn))
+
+	AssertNoAllocs(t, func() {
+		if err := molecule.Parse(marshaled, nopMessageEachFn); err != nil {
+			panic(err)
+		}
+	})
+}
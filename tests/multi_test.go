@@ -0,0 +1,146 @@
+package moleculetest
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMultiBuffer(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(math.MaxUint64))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireFixed32))
+	require.NoError(t, encoder.EncodeFixed32(0x01020304))
+	require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireFixed64))
+	require.NoError(t, encoder.EncodeFixed64(0x0102030405060708))
+	require.NoError(t, encoder.EncodeTagAndWireType(4, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hello world")))
+	require.NoError(t, encoder.EncodeTagAndWireType(123456, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(300))
+	require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireStartGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(1))
+	require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireEndGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(6, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(7))
+	data := encoder.Bytes()
+
+	collect := func(t *testing.T, buffer *codec.Buffer) []readerAtField {
+		var fields []readerAtField
+		err := molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+			fields = append(fields, readerAtField{fieldNum: fieldNum, value: value.Retain()})
+			return true, nil
+		}, molecule.WithSkipUnknownWireTypes(true))
+		require.NoError(t, err)
+		return fields
+	}
+	expected := collect(t, codec.NewBuffer(data))
+	require.Len(t, expected, 6)
+
+	// Two chunks split at every byte position, including an empty first or last chunk.
+	for split := 0; split <= len(data); split++ {
+		buffer := codec.NewMultiBuffer(data[:split], data[split:])
+		require.Equal(t, len(data), buffer.Len(), "split at %d", split)
+		require.Equal(t, expected, collect(t, buffer), "split at %d", split)
+	}
+
+	// Three chunks with an empty chunk in between.
+	for split := 0; split <= len(data); split++ {
+		buffer := codec.NewMultiBuffer(data[:split], nil, data[split:])
+		require.Equal(t, expected, collect(t, buffer), "split at %d", split)
+	}
+
+	// One chunk per byte.
+	chunks := make([][]byte, len(data))
+	for i := range data {
+		chunks[i] = data[i : i+1]
+	}
+	require.Equal(t, expected, collect(t, codec.NewMultiBuffer(chunks...)))
+
+	// The decode methods work directly too.
+	buffer := codec.NewMultiBuffer(data[:3], data[3:])
+	require.Equal(t, data, buffer.Bytes())
+	_, _, err := buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	v, err := buffer.DecodeVarint()
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), v)
+
+	// Truncated messages fail as they would if the chunks were contiguous.
+	err = molecule.MessageEach(codec.NewMultiBuffer(data[:5], data[5:20]), nopMessageEachFn)
+	require.Error(t, err)
+
+	empty := codec.NewMultiBuffer()
+	require.True(t, empty.EOF())
+	require.NoError(t, molecule.MessageEach(empty, nopMessageEachFn))
+}
+
+func TestNewMultiBufferLookups(t *testing.T) {
+	// The wanted field is in the first chunk, and the chunks are each larger than the
+	// window, so the lookups refill it after the field has been found.
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("hello-world")))
+	for i := 0; i < 200; i++ {
+		require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("x"), 1000)))
+	}
+	data := encoder.Bytes()
+	chunks := [][]byte{data[:100], data[100 : 100+40*1024], data[100+40*1024:]}
+
+	s, err := molecule.GetString(codec.NewMultiBuffer(chunks...), 1, "")
+	require.NoError(t, err)
+	require.Equal(t, "hello-world", s)
+
+	values, err := molecule.CollectRepeated(codec.NewMultiBuffer(chunks...), 2, codec.FieldType_BYTES)
+	require.NoError(t, err)
+	require.Len(t, values, 200)
+	for _, value := range values {
+		require.Equal(t, bytes.Repeat([]byte("x"), 1000), value.Bytes)
+	}
+
+	count, err := molecule.CountField(codec.NewMultiBuffer(chunks...), 2)
+	require.NoError(t, err)
+	require.Equal(t, 200, count)
+}
+
+func TestNewMultiBufferAliasesChunks(t *testing.T) {
+	encoder := codec.NewEncoder(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("a"), 100)))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("b"), 100)))
+	data := encoder.Bytes()
+
+	// The first value lies within the first chunk while the second straddles both.
+	chunks := [][]byte{data[:150], data[150:]}
+	buffer := codec.NewMultiBuffer(chunks...)
+
+	_, _, err := buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	first, err := buffer.DecodeRawBytes(false)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("a"), 100), first)
+	// The value is a view over the chunk rather than a copy.
+	require.Same(t, &chunks[0][2], &first[0])
+
+	_, _, err = buffer.DecodeTagAndWireType()
+	require.NoError(t, err)
+	second, err := buffer.DecodeRawBytes(false)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte("b"), 100), second)
+	require.True(t, buffer.EOF())
+
+	// Bytes only copies when the remainder spans chunks.
+	buffer = codec.NewMultiBuffer(chunks...)
+	require.NoError(t, buffer.Skip(160))
+	require.Same(t, &chunks[1][10], &buffer.Bytes()[0])
+	buffer = codec.NewMultiBuffer(chunks...)
+	require.Equal(t, data, buffer.Bytes())
+}
@@ -0,0 +1,90 @@
+package moleculetest
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTree returns a message in which field 1 holds two child messages, field 2 holds
+// the depth of the message and field 3 holds a string, down to the given depth.
+func encodeTree(t testing.TB, depth int) []byte {
+	encoder := proto.NewBuffer(nil)
+	if depth > 0 {
+		child := encodeTree(t, depth-1)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireBytes)))
+			require.NoError(t, encoder.EncodeRawBytes(child))
+		}
+	}
+	require.NoError(t, encoder.EncodeVarint(2<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeVarint(uint64(depth)))
+	require.NoError(t, encoder.EncodeVarint(3<<3|uint64(codec.WireBytes)))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("node")))
+	return encoder.Bytes()
+}
+
+// treeWalker sums the depths and counts the strings of a tree built by encodeTree.
+type treeWalker struct {
+	depthSum, strings int
+}
+
+func (w *treeWalker) walk(buffer *codec.Buffer) error {
+	return molecule.MessageEachNested(buffer, w.visit)
+}
+
+func (w *treeWalker) visit(fieldNum int32, value molecule.Value, sub *codec.Buffer) (bool, error) {
+	switch fieldNum {
+	case 1:
+		return true, w.walk(sub)
+	case 2:
+		if sub != nil {
+			panic("unexpected buffer for varint field")
+		}
+		w.depthSum += int(value.Number)
+	case 3:
+		if sub == nil || sub.Len() != len(value.Bytes) {
+			panic("expected buffer over the string")
+		}
+		w.strings++
+	}
+	return true, nil
+}
+
+func TestMessageEachNested(t *testing.T) {
+	data := encodeTree(t, 4)
+
+	// 1 node at depth 4, 2 at depth 3, 4 at depth 2, 8 at depth 1 and 16 at depth 0.
+	w := &treeWalker{}
+	require.NoError(t, w.walk(codec.NewBuffer(data)))
+	require.Equal(t, 4+2*3+4*2+8*1, w.depthSum)
+	require.Equal(t, 31, w.strings)
+
+	// Errors from nested walks are propagated.
+	err := molecule.MessageEachNested(codec.NewBuffer(data), func(fieldNum int32, value molecule.Value, sub *codec.Buffer) (bool, error) {
+		if fieldNum == 3 {
+			return true, molecule.MessageEach(sub, nopMessageEachFn)
+		}
+		return true, nil
+	})
+	require.Error(t, err)
+
+	// The nested buffers come from a sync.Pool, which drops its items at random under
+	// the race detector and on every garbage collection.
+	if raceEnabled {
+		t.Skip("sync.Pool doesn't reliably reuse items under the race detector")
+	}
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	AssertNoAllocs(t, func() {
+		w.depthSum, w.strings = 0, 0
+		if err := w.walk(codec.NewBuffer(data)); err != nil {
+			panic(err)
+		}
+	})
+	require.Equal(t, 31, w.strings)
+}
@@ -0,0 +1,433 @@
+package moleculetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMaxTotalBytes(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	for i := 0; i < 10; i++ {
+		// Each field is 1 byte of tag, 1 byte of length and 8 bytes of data.
+		encodeBytesField(t, encoder, 1, []byte("01234567"))
+	}
+	marshaled := encoder.Bytes()
+
+	err := molecule.MessageEach(codec.NewBuffer(marshaled), nopMessageEachFn, molecule.WithMaxTotalBytes(len(marshaled)))
+	require.NoError(t, err)
+
+	var seen int
+	err = molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+		seen++
+		return true, nil
+	}, molecule.WithMaxTotalBytes(45))
+	require.True(t, errors.Is(err, molecule.ErrMaxTotalBytes))
+	require.Equal(t, 4, seen)
+
+	_, err = molecule.NewSnapshot(codec.NewBuffer(marshaled), molecule.WithMaxTotalBytes(45))
+	require.True(t, errors.Is(err, molecule.ErrMaxTotalBytes))
+}
+
+func TestWithSkipUnknownWireTypes(t *testing.T) {
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(10))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireStartGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(20))
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireEndGroup))
+	require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(30))
+	withGroup := encoder.Bytes()
+
+	t.Run("group", func(t *testing.T) {
+		err := molecule.MessageEach(codec.NewBuffer(withGroup), nopMessageEachFn)
+		require.Error(t, err)
+
+		var seen []uint64
+		err = molecule.MessageEach(codec.NewBuffer(withGroup), func(fieldNum int32, value molecule.Value) (bool, error) {
+			seen = append(seen, value.Number)
+			return true, nil
+		}, molecule.WithSkipUnknownWireTypes(true))
+		require.NoError(t, err)
+		require.Equal(t, []uint64{10, 30}, seen)
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+		require.NoError(t, encoder.EncodeVarint(10))
+		require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireType(6)))
+		require.NoError(t, encoder.EncodeVarint(20))
+
+		for _, skip := range []bool{false, true} {
+			err := molecule.MessageEach(
+				codec.NewBuffer(encoder.Bytes()), nopMessageEachFn, molecule.WithSkipUnknownWireTypes(skip))
+			require.True(t, errors.Is(err, codec.ErrBadWireType))
+		}
+	})
+}
+
+func TestWithDelimitedMessages(t *testing.T) {
+	nested, err := proto.Marshal(&simple.Test{StringField: "inner", Int64Field: 2})
+	require.NoError(t, err)
+
+	encoder := codec.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(10))
+	require.NoError(t, encoder.WriteDelimitedMessage(2, nested))
+	require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(30))
+	data := encoder.Bytes()
+
+	// The encoding is a start group tag, the message and an end group tag.
+	require.Equal(t, byte(2<<3|codec.WireStartGroup), data[2])
+	require.Equal(t, byte(2<<3|codec.WireEndGroup), data[3+len(nested)])
+
+	// Without the option the field is a group, which isn't supported.
+	require.Error(t, molecule.MessageEach(codec.NewBuffer(data), nopMessageEachFn))
+
+	var (
+		fieldNums []int32
+		inner     simple.Test
+	)
+	err = molecule.MessageEach(codec.NewBuffer(data), func(fieldNum int32, value molecule.Value) (bool, error) {
+		fieldNums = append(fieldNums, fieldNum)
+		if fieldNum == 2 {
+			require.Equal(t, codec.WireStartGroup, value.WireType)
+			require.Equal(t, nested, value.Bytes)
+			require.NoError(t, proto.Unmarshal(value.Bytes, &inner))
+		}
+		return true, nil
+	}, molecule.WithDelimitedMessages(), molecule.WithSkipUnknownWireTypes(true))
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 2, 3}, fieldNums)
+	require.Equal(t, "inner", inner.StringField)
+	require.Equal(t, int64(2), inner.Int64Field)
+
+	// Delimited messages can themselves contain delimited messages.
+	outer := codec.NewBuffer(nil)
+	require.NoError(t, outer.WriteDelimitedMessage(1, data))
+	var depth int
+	var walk func(b []byte) error
+	walk = func(b []byte) error {
+		depth++
+		return molecule.MessageEach(codec.NewBuffer(b), func(fieldNum int32, value molecule.Value) (bool, error) {
+			if value.WireType == codec.WireStartGroup {
+				return true, walk(value.Bytes)
+			}
+			return true, nil
+		}, molecule.WithDelimitedMessages())
+	}
+	require.NoError(t, walk(outer.Bytes()))
+	require.Equal(t, 3, depth)
+
+	// The message must be ended by the end group tag of the same field.
+	mismatched := codec.NewBuffer(nil)
+	require.NoError(t, mismatched.EncodeTagAndWireType(2, codec.WireStartGroup))
+	_, err = mismatched.Write(nested)
+	require.NoError(t, err)
+	require.NoError(t, mismatched.EncodeTagAndWireType(4, codec.WireEndGroup))
+	require.Error(t, molecule.MessageEach(codec.NewBuffer(mismatched.Bytes()), nopMessageEachFn, molecule.WithDelimitedMessages()))
+
+	// And must be terminated.
+	require.Error(t, molecule.MessageEach(codec.NewBuffer(data[:3+len(nested)]), nopMessageEachFn, molecule.WithDelimitedMessages()))
+
+	// Size limits apply to delimited messages like they do to length-delimited ones.
+	err = molecule.MessageEach(codec.NewBuffer(data), nopMessageEachFn,
+		molecule.WithDelimitedMessages(), molecule.WithMaxMessageSize(len(nested)-1))
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+}
+
+func TestWithRejectEmpty(t *testing.T) {
+	var called bool
+	fn := func(fieldNum int32, value molecule.Value) (bool, error) {
+		called = true
+		return true, nil
+	}
+
+	require.NoError(t, molecule.MessageEach(codec.NewBuffer(nil), fn))
+
+	err := molecule.MessageEach(codec.NewBuffer(nil), fn, molecule.WithRejectEmpty())
+	require.True(t, errors.Is(err, molecule.ErrEmptyMessage))
+	err = molecule.MessageEach(codec.NewBuffer([]byte{}), fn, molecule.WithRejectEmpty())
+	require.True(t, errors.Is(err, molecule.ErrEmptyMessage))
+	require.False(t, called)
+
+	require.NoError(t, molecule.MessageEach(codec.NewBuffer([]byte{0x08, 0x01}), fn, molecule.WithRejectEmpty()))
+	require.True(t, called)
+}
+
+func TestWithFieldHook(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 300)
+	require.NoError(t, encoder.EncodeVarint(2<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(7))
+	require.NoError(t, encoder.EncodeVarint(3<<3|uint64(codec.WireFixed64)))
+	require.NoError(t, encoder.EncodeFixed64(7))
+	encodeBytesField(t, encoder, 4, []byte("hello"))
+	require.NoError(t, encoder.EncodeVarint(5<<3|uint64(codec.WireStartGroup)))
+	encodeVarintField(t, encoder, 1, 1)
+	require.NoError(t, encoder.EncodeVarint(5<<3|uint64(codec.WireEndGroup)))
+	// Field 16 needs a 2 byte tag.
+	encodeVarintField(t, encoder, 16, 1)
+
+	type observation struct {
+		fieldNum int32
+		wireType codec.WireType
+		bytes    int
+	}
+	var observed []observation
+	hook := molecule.WithFieldHook(func(fieldNum int32, wireType codec.WireType, bytes int) {
+		observed = append(observed, observation{fieldNum, wireType, bytes})
+	})
+
+	var visited []int32
+	err := molecule.MessageEach(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, value molecule.Value) (bool, error) {
+		visited = append(visited, fieldNum)
+		return true, nil
+	}, hook, molecule.WithSkipUnknownWireTypes(true))
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 2, 3, 4, 16}, visited)
+	require.Equal(t, []observation{
+		{1, codec.WireVarint, 3},
+		{2, codec.WireFixed32, 5},
+		{3, codec.WireFixed64, 9},
+		{4, codec.WireBytes, 7},
+		{5, codec.WireStartGroup, 4},
+		{16, codec.WireVarint, 3},
+	}, observed)
+
+	total := 0
+	for _, o := range observed {
+		total += o.bytes
+	}
+	require.Equal(t, len(encoder.Bytes()), total)
+
+	// Fields are observed before the callback sees them, even if it stops early.
+	observed = observed[:0]
+	err = molecule.MessageEach(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, value molecule.Value) (bool, error) {
+		return false, nil
+	}, hook)
+	require.NoError(t, err)
+	require.Equal(t, []observation{{1, codec.WireVarint, 3}}, observed)
+}
+
+func TestWithAllowedFieldRange(t *testing.T) {
+	encode := func(fieldNums ...int32) []byte {
+		encoder := proto.NewBuffer(nil)
+		for _, fieldNum := range fieldNums {
+			encodeVarintField(t, encoder, fieldNum, 1)
+		}
+		return encoder.Bytes()
+	}
+	decode := func(data []byte, opts ...molecule.Option) ([]int32, error) {
+		var fieldNums []int32
+		err := molecule.MessageEach(codec.NewBuffer(data), func(fieldNum int32, value molecule.Value) (bool, error) {
+			fieldNums = append(fieldNums, fieldNum)
+			return true, nil
+		}, opts...)
+		return fieldNums, err
+	}
+	allowed := molecule.WithAllowedFieldRange(1, 100)
+
+	fieldNums, err := decode(encode(1, 50, 100), allowed)
+	require.NoError(t, err)
+	require.Equal(t, []int32{1, 50, 100}, fieldNums)
+
+	// Fields after the first one out of range are never decoded.
+	fieldNums, err = decode(encode(1, 101, 2), allowed)
+	require.True(t, errors.Is(err, molecule.ErrFieldOutOfRange))
+	require.Equal(t, []int32{1}, fieldNums)
+
+	_, err = decode(encode(5, 4), molecule.WithAllowedFieldRange(5, 536870911))
+	require.True(t, errors.Is(err, molecule.ErrFieldOutOfRange))
+
+	// The reserved range is rejected even when it lies within the allowed range.
+	for _, fieldNum := range []int32{19000, 19500, 19999} {
+		_, err = decode(encode(fieldNum), molecule.WithAllowedFieldRange(1, 536870911))
+		require.True(t, errors.Is(err, molecule.ErrFieldOutOfRange), "field %d", fieldNum)
+		require.Contains(t, err.Error(), "reserved")
+
+		// Without the option every field number is accepted.
+		_, err = decode(encode(fieldNum))
+		require.NoError(t, err)
+	}
+	fieldNums, err = decode(encode(18999, 20000), molecule.WithAllowedFieldRange(1, 536870911))
+	require.NoError(t, err)
+	require.Equal(t, []int32{18999, 20000}, fieldNums)
+}
+
+type fakeMetrics struct {
+	messages [][2]int
+	errs     []error
+}
+
+func (m *fakeMetrics) ObserveMessage(fields int, bytes int) {
+	m.messages = append(m.messages, [2]int{fields, bytes})
+}
+
+func (m *fakeMetrics) ObserveError(err error) {
+	m.errs = append(m.errs, err)
+}
+
+func TestWithMetrics(t *testing.T) {
+	nested, err := proto.Marshal(&simple.Test{StringField: "hi", Int64Field: 1})
+	require.NoError(t, err)
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 300)
+	encodeBytesField(t, encoder, 2, nested)
+	encodeVarintField(t, encoder, 3, 1)
+	data := encoder.Bytes()
+
+	metrics := &fakeMetrics{}
+	opt := molecule.WithMetrics(metrics)
+
+	// The nested message is reported separately when it's decoded with the option.
+	err = molecule.MessageEach(codec.NewBuffer(data), func(fieldNum int32, value molecule.Value) (bool, error) {
+		if fieldNum == 2 {
+			return true, molecule.MessageEach(codec.NewBuffer(value.Bytes), nopMessageEachFn, opt)
+		}
+		return true, nil
+	}, opt)
+	require.NoError(t, err)
+	require.Equal(t, [][2]int{{2, len(nested)}, {3, len(data)}}, metrics.messages)
+	require.Empty(t, metrics.errs)
+
+	// Stopping early reports what was consumed.
+	metrics.messages = nil
+	err = molecule.MessageEach(codec.NewBuffer(data), func(fieldNum int32, value molecule.Value) (bool, error) {
+		return false, nil
+	}, opt)
+	require.NoError(t, err)
+	require.Equal(t, [][2]int{{1, 3}}, metrics.messages)
+
+	// Decoding errors and errors from the callback are both reported.
+	metrics.messages = nil
+	err = molecule.MessageEach(codec.NewBuffer(append(data, 0x0a, 0x05)), nopMessageEachFn, opt)
+	require.Error(t, err)
+	errStop := errors.New("stop")
+	err = molecule.MessageEachTyped(codec.NewBuffer(data), func(fieldNum int32, wireType codec.WireType, value molecule.Value) (bool, error) {
+		return false, errStop
+	}, opt)
+	require.Equal(t, errStop, err)
+	require.Empty(t, metrics.messages)
+	require.Len(t, metrics.errs, 2)
+	require.True(t, errors.Is(metrics.errs[0], io.ErrUnexpectedEOF))
+	require.Equal(t, errStop, metrics.errs[1])
+
+	// Including errors from the callbacks of wrappers around MessageEach, which are
+	// returned as is.
+	metrics.errs = nil
+	err = molecule.Transform(codec.NewBuffer(data), codec.NewEncoder(nil), func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+		return errStop
+	}, opt)
+	require.Equal(t, errStop, err)
+	err = molecule.SubMessageEach(codec.NewBuffer(data), 2, func(fieldNum int32, value molecule.Value) (bool, error) {
+		return false, errStop
+	}, opt)
+	require.Equal(t, errStop, err)
+	require.Empty(t, metrics.messages)
+	require.Equal(t, []error{errStop, errStop}, metrics.errs)
+
+	// Without the option the default path doesn't allocate.
+	AssertNoAllocs(t, func() {
+		if err := molecule.MessageEach(codec.NewBuffer(data), nopMessageEachFn); err != nil {
+			panic(err)
+		}
+	})
+}
+
+func TestWithCollectErrors(t *testing.T) {
+	encoder := codec.NewEncoder(nil)
+	require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(10))
+	// Outside of the allowed range.
+	reservedOffset := len(encoder.Bytes())
+	require.NoError(t, encoder.EncodeTagAndWireType(19000, codec.WireVarint))
+	require.NoError(t, encoder.EncodeVarint(1))
+	// Too large.
+	largeOffset := len(encoder.Bytes())
+	require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("0123456789")))
+	// A group, which isn't supported.
+	groupOffset := len(encoder.Bytes())
+	require.NoError(t, encoder.WriteGroup(3, func(group *codec.Encoder) error {
+		require.NoError(t, group.EncodeTagAndWireType(1, codec.WireVarint))
+		return group.EncodeVarint(1)
+	}))
+	require.NoError(t, encoder.EncodeTagAndWireType(4, codec.WireBytes))
+	require.NoError(t, encoder.EncodeRawBytes([]byte("ok")))
+	data := encoder.Bytes()
+
+	opts := []molecule.Option{molecule.WithAllowedFieldRange(1, 100), molecule.WithMaxMessageSize(5)}
+
+	// By default the decode stops at the first bad field.
+	var seen []int32
+	collect := func(fieldNum int32, value molecule.Value) (bool, error) {
+		seen = append(seen, fieldNum)
+		return true, nil
+	}
+	err := molecule.MessageEach(codec.NewBuffer(data), collect, opts...)
+	require.True(t, errors.Is(err, molecule.ErrFieldOutOfRange))
+	var fieldErrs molecule.FieldErrors
+	require.False(t, errors.As(err, &fieldErrs))
+	require.Equal(t, []int32{1}, seen)
+
+	err = molecule.MessageEach(codec.NewBuffer(data), collect, append(opts, molecule.WithStopOnError(true))...)
+	require.False(t, errors.As(err, &fieldErrs))
+
+	// Collecting errors reports every bad field and visits every good one.
+	seen = nil
+	err = molecule.MessageEach(codec.NewBuffer(data), collect, append(opts, molecule.WithCollectErrors())...)
+	require.True(t, errors.As(err, &fieldErrs))
+	require.Equal(t, []int32{1, 4}, seen)
+	require.Len(t, fieldErrs, 3)
+	require.Equal(t, int32(19000), fieldErrs[0].FieldNum)
+	require.Equal(t, reservedOffset, fieldErrs[0].Offset)
+	require.True(t, errors.Is(fieldErrs[0], molecule.ErrFieldOutOfRange))
+	require.Equal(t, int32(2), fieldErrs[1].FieldNum)
+	require.Equal(t, largeOffset, fieldErrs[1].Offset)
+	require.True(t, errors.Is(fieldErrs[1], codec.ErrFieldTooLarge))
+	require.Equal(t, int32(3), fieldErrs[2].FieldNum)
+	require.Equal(t, groupOffset, fieldErrs[2].Offset)
+	require.True(t, errors.Is(err, molecule.ErrFieldOutOfRange))
+	require.True(t, errors.Is(err, codec.ErrFieldTooLarge))
+	require.Contains(t, err.Error(), "3 invalid fields")
+
+	// Errors that can't be skipped end the decode but are reported along with the rest.
+	seen = nil
+	truncated := data[:len(data)-1]
+	err = molecule.MessageEach(codec.NewBuffer(truncated), collect, molecule.WithCollectErrors(), molecule.WithMaxMessageSize(5))
+	require.True(t, errors.As(err, &fieldErrs))
+	require.Len(t, fieldErrs, 3)
+	require.Equal(t, int32(2), fieldErrs[0].FieldNum)
+	require.Equal(t, int32(3), fieldErrs[1].FieldNum)
+	require.Equal(t, int32(4), fieldErrs[2].FieldNum)
+	require.True(t, errors.Is(fieldErrs[2], io.ErrUnexpectedEOF))
+	require.Equal(t, []int32{1, 19000}, seen)
+
+	// A clean message isn't affected.
+	seen = nil
+	err = molecule.MessageEach(codec.NewBuffer(data[:reservedOffset]), collect, molecule.WithCollectErrors())
+	require.NoError(t, err)
+	require.Equal(t, []int32{1}, seen)
+
+	// The Scanner reports the collected errors once it reaches the end.
+	scanner := molecule.NewScanner(codec.NewBuffer(data), append(opts, molecule.WithCollectErrors())...)
+	seen = nil
+	for scanner.Scan() {
+		seen = append(seen, scanner.FieldNum())
+	}
+	require.Equal(t, []int32{1, 4}, seen)
+	require.True(t, errors.As(scanner.Err(), &fieldErrs))
+	require.Len(t, fieldErrs, 3)
+}
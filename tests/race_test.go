@@ -0,0 +1,7 @@
+//go:build race
+
+package moleculetest
+
+// raceEnabled is set when the tests are built with the race detector, which makes
+// sync.Pool drop items at random.
+const raceEnabled = true
@@ -0,0 +1,235 @@
+package moleculetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingReaderAt records how many bytes are read from the wrapped io.ReaderAt.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += n
+	return n, err
+}
+
+type readerAtField struct {
+	fieldNum int32
+	value    molecule.Value
+}
+
+func TestNewBufferFromReaderAt(t *testing.T) {
+	// Build a message that is several times larger than the window, with groups at
+	// many different offsets and a field that is larger than the window on its own.
+	encoder := codec.NewBuffer(nil)
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+		require.NoError(t, encoder.EncodeVarint(uint64(i)<<20))
+		require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte{byte(i)}, i%50)))
+		require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireFixed32))
+		require.NoError(t, encoder.EncodeFixed32(uint64(i)))
+		require.NoError(t, encoder.EncodeTagAndWireType(4, codec.WireFixed64))
+		require.NoError(t, encoder.EncodeFixed64(uint64(i)))
+		if i%7 == 0 {
+			require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireStartGroup))
+			require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+			require.NoError(t, encoder.EncodeVarint(uint64(i)))
+			require.NoError(t, encoder.EncodeTagAndWireType(5, codec.WireEndGroup))
+		}
+		if i == 2500 {
+			require.NoError(t, encoder.EncodeTagAndWireType(6, codec.WireBytes))
+			require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("large"), 20000)))
+		}
+	}
+	data := encoder.Bytes()
+
+	collect := func(buffer *codec.Buffer) []readerAtField {
+		var fields []readerAtField
+		err := molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+			fields = append(fields, readerAtField{fieldNum: fieldNum, value: value.Retain()})
+			return true, nil
+		}, molecule.WithSkipUnknownWireTypes(true))
+		require.NoError(t, err)
+		return fields
+	}
+
+	t.Run("matches slice buffer", func(t *testing.T) {
+		expected := collect(codec.NewBuffer(data))
+		buffer := codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.Equal(t, len(data), buffer.Len())
+		require.Equal(t, expected, collect(buffer))
+		require.True(t, buffer.EOF())
+		require.Equal(t, 0, buffer.Len())
+	})
+
+	t.Run("lookups", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		for i := 0; i < 20000; i++ {
+			require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireVarint))
+			require.NoError(t, encoder.EncodeVarint(uint64(i)))
+		}
+		require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("large"), 20000)))
+		data := encoder.Bytes()
+
+		buffer := codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		fieldNum, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.Equal(t, int32(1), fieldNum)
+		require.NoError(t, buffer.SkipField(codec.WireVarint))
+
+		// Looking up a field scans the rest of the message without moving the buffer.
+		s, err := molecule.GetString(buffer, 2, "")
+		require.NoError(t, err)
+		require.Equal(t, 100000, len(s))
+
+		count, err := molecule.CountField(buffer, 1)
+		require.NoError(t, err)
+		require.Equal(t, 19999, count)
+		require.Equal(t, len(data)-2, buffer.Len())
+
+		// The lookups must not have disturbed the buffer's own window.
+		var fields []int32
+		err = molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+			if fieldNum == 1 && value.Number != uint64(len(fields)+1) {
+				t.Fatalf("unexpected value %d at index %d", value.Number, len(fields))
+			}
+			fields = append(fields, fieldNum)
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.Len(t, fields, 20000)
+		require.Equal(t, int32(2), fields[len(fields)-1])
+	})
+
+	t.Run("values outlive the window", func(t *testing.T) {
+		// The wanted fields come first and are followed by far more data than fits
+		// in the window, so the scan refills it after they have been found.
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes([]byte("hello-world")))
+		require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes([]byte("nested")))
+		for i := 0; i < 200; i++ {
+			require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireBytes))
+			require.NoError(t, encoder.EncodeRawBytes(bytes.Repeat([]byte("x"), 1000)))
+		}
+		data := encoder.Bytes()
+		newBuffer := func() *codec.Buffer {
+			return codec.NewBufferFromReaderAt(bytes.NewReader(data), int64(len(data)))
+		}
+
+		s, err := molecule.GetString(newBuffer(), 1, "")
+		require.NoError(t, err)
+		require.Equal(t, "hello-world", s)
+
+		values, err := molecule.CollectRepeated(newBuffer(), 1, codec.FieldType_STRING)
+		require.NoError(t, err)
+		require.Len(t, values, 1)
+		require.Equal(t, "hello-world", string(values[0].Bytes))
+
+		fieldNum, value, found, err := molecule.FindOneof(newBuffer(), []int32{1, 3})
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, int32(3), fieldNum)
+		require.Equal(t, "nested", string(value.Bytes))
+
+		fields, err := molecule.CollectAll(newBuffer())
+		require.NoError(t, err)
+		require.Equal(t, "hello-world", string(fields[1][0].Bytes))
+		require.Len(t, fields[2], 200)
+		require.Equal(t, bytes.Repeat([]byte("x"), 1000), fields[2][0].Bytes)
+
+		buffer := newBuffer()
+		err = molecule.MessageEachBatch(buffer, 100, func(batch []molecule.FieldEntry) (bool, error) {
+			if batch[0].FieldNum == 1 {
+				require.Equal(t, "hello-world", string(batch[0].Value.Bytes))
+			}
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.True(t, buffer.EOF())
+	})
+
+	t.Run("skipped fields are not read", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireBytes))
+		require.NoError(t, encoder.EncodeRawBytes(make([]byte, 1<<20)))
+		require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireVarint))
+		require.NoError(t, encoder.EncodeVarint(42))
+
+		r := &countingReaderAt{r: bytes.NewReader(encoder.Bytes())}
+		buffer := codec.NewBufferFromReaderAt(r, int64(len(encoder.Bytes())))
+		_, wireType, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.NoError(t, buffer.SkipField(wireType))
+
+		fieldNum, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.Equal(t, int32(2), fieldNum)
+		v, err := buffer.DecodeVarint()
+		require.NoError(t, err)
+		require.Equal(t, uint64(42), v)
+		require.True(t, buffer.EOF())
+		require.Less(t, r.read, 1<<16)
+	})
+
+	t.Run("group larger than window", func(t *testing.T) {
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireStartGroup))
+		for i := 0; i < 20000; i++ {
+			require.NoError(t, encoder.EncodeTagAndWireType(2, codec.WireVarint))
+			require.NoError(t, encoder.EncodeVarint(uint64(i)))
+		}
+		require.NoError(t, encoder.EncodeTagAndWireType(1, codec.WireEndGroup))
+		require.NoError(t, encoder.EncodeTagAndWireType(3, codec.WireVarint))
+		require.NoError(t, encoder.EncodeVarint(7))
+
+		buffer := codec.NewBufferFromReaderAt(bytes.NewReader(encoder.Bytes()), int64(len(encoder.Bytes())))
+		_, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		group, err := buffer.ReadGroupBuffer()
+		require.NoError(t, err)
+
+		var count int
+		err = molecule.MessageEach(group, func(fieldNum int32, value molecule.Value) (bool, error) {
+			require.Equal(t, uint64(count), value.Number)
+			count++
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 20000, count)
+
+		fieldNum, _, err := buffer.DecodeTagAndWireType()
+		require.NoError(t, err)
+		require.Equal(t, int32(3), fieldNum)
+	})
+
+	t.Run("size overflows int", func(t *testing.T) {
+		if math.MaxInt == math.MaxInt64 {
+			t.Skip("sizes can't overflow an int on 64-bit platforms")
+		}
+		buffer := codec.NewBufferFromReaderAt(bytes.NewReader(data), math.MaxInt32+1)
+		err := molecule.MessageEach(buffer, nopMessageEachFn)
+		require.True(t, errors.Is(err, codec.ErrOverflow), err)
+	})
+
+	t.Run("truncated source", func(t *testing.T) {
+		buffer := codec.NewBufferFromReaderAt(bytes.NewReader(data[:100]), int64(len(data)))
+		err := molecule.MessageEach(buffer, nopMessageEachFn, molecule.WithSkipUnknownWireTypes(true))
+		require.Error(t, err)
+	})
+}
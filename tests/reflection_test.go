@@ -0,0 +1,247 @@
+package moleculetest
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/reflection"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestToProtoreflectScalars(t *testing.T) {
+	m := &descriptorpb.FieldDescriptorProto{
+		Name:           protov2.String("my_field"),
+		Number:         protov2.Int32(-7),
+		Label:          descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+		Proto3Optional: protov2.Bool(true),
+		Options:        &descriptorpb.FieldOptions{Deprecated: protov2.Bool(true)},
+	}
+	marshaled, err := protov2.Marshal(m)
+	require.NoError(t, err)
+
+	var (
+		md      = m.ProtoReflect().Descriptor()
+		decoded = dynamicpb.NewMessage(md)
+	)
+	err = molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+		fd := md.Fields().ByNumber(protoreflect.FieldNumber(fieldNum))
+		require.NotNil(t, fd)
+
+		v, err := reflection.ToProtoreflect(value, fd)
+		require.NoError(t, err)
+		decoded.Set(fd, v)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.True(t, protov2.Equal(m, decoded))
+}
+
+func TestToProtoreflectNegativeEnum(t *testing.T) {
+	fd := (&descriptorpb.FieldDescriptorProto{}).ProtoReflect().Descriptor().Fields().ByName("type")
+	require.NotNil(t, fd)
+
+	for _, n := range []int32{-1, math.MinInt32} {
+		v, err := reflection.ToProtoreflect(molecule.Int32Value(n), fd)
+		require.NoError(t, err)
+		require.Equal(t, protoreflect.EnumNumber(n), v.Enum())
+	}
+}
+
+func TestToProtoreflectBytesAndDouble(t *testing.T) {
+	var (
+		bytesMsg  = wrapperspb.Bytes([]byte{0x00, 0xff, 0x10})
+		doubleMsg = wrapperspb.Double(3.25)
+	)
+	for _, m := range []protov2.Message{bytesMsg, doubleMsg} {
+		marshaled, err := protov2.Marshal(m)
+		require.NoError(t, err)
+
+		fd := m.ProtoReflect().Descriptor().Fields().ByNumber(1)
+		err = molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+			v, err := reflection.ToProtoreflect(value, fd)
+			require.NoError(t, err)
+			require.Equal(t, m.ProtoReflect().Get(fd).Interface(), v.Interface())
+			return true, nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestToProtoreflectWireTypeMismatch(t *testing.T) {
+	fd := wrapperspb.Bytes(nil).ProtoReflect().Descriptor().Fields().ByNumber(1)
+	_, err := reflection.ToProtoreflect(molecule.Value{WireType: codec.WireVarint, Number: 1}, fd)
+	require.Error(t, err)
+}
+
+func TestCanonicalize(t *testing.T) {
+	deterministic := protov2.MarshalOptions{Deterministic: true}
+
+	t.Run("map entry order", func(t *testing.T) {
+		m, err := structpb.NewStruct(map[string]interface{}{
+			"b": 1.5,
+			"a": "x",
+			"c": []interface{}{true, "y"},
+		})
+		require.NoError(t, err)
+		marshaled, err := deterministic.Marshal(m)
+		require.NoError(t, err)
+
+		// Re-order the entries and precede them with an entry for the same key that the
+		// later one must replace.
+		stale, err := deterministic.Marshal(&structpb.Struct{Fields: map[string]*structpb.Value{
+			"a": structpb.NewStringValue("stale"),
+		}})
+		require.NoError(t, err)
+		var spans [][]byte
+		scanner := molecule.NewScanner(codec.NewBuffer(marshaled))
+		for scanner.Scan() {
+			start, end := scanner.FieldSpan()
+			spans = append(spans, marshaled[start:end])
+		}
+		require.NoError(t, scanner.Err())
+		require.Len(t, spans, 3)
+		reordered := append(append(append(append([]byte(nil), stale...), spans[2]...), spans[0]...), spans[1]...)
+		require.NotEqual(t, marshaled, reordered)
+
+		md := m.ProtoReflect().Descriptor()
+		a, err := reflection.Canonicalize(codec.NewBuffer(marshaled), md)
+		require.NoError(t, err)
+		b, err := reflection.Canonicalize(codec.NewBuffer(reordered), md)
+		require.NoError(t, err)
+		require.Equal(t, a, b)
+		require.Equal(t, marshaled, a)
+	})
+
+	t.Run("field order and packing", func(t *testing.T) {
+		m := &descriptorpb.SourceCodeInfo_Location{
+			Path:            []int32{4, 0, 2, -1},
+			Span:            []int32{10, 2, 30},
+			LeadingComments: protov2.String(""),
+		}
+		marshaled, err := deterministic.Marshal(m)
+		require.NoError(t, err)
+
+		// Span before path, and path split between unpacked elements and a packed run in
+		// which -1 is written as a truncated 5 byte varint rather than sign-extended.
+		encoder := proto.NewBuffer(nil)
+		spanEncoder := proto.NewBuffer(nil)
+		for _, v := range m.Span {
+			require.NoError(t, spanEncoder.EncodeVarint(uint64(v)))
+		}
+		encodeBytesField(t, encoder, 2, spanEncoder.Bytes())
+		encodeBytesField(t, encoder, 3, []byte{})
+		for _, v := range m.Path[:2] {
+			encodeVarintField(t, encoder, 1, uint64(v))
+		}
+		encodeBytesField(t, encoder, 1, []byte{2, 0xff, 0xff, 0xff, 0xff, 0x0f})
+
+		md := m.ProtoReflect().Descriptor()
+		a, err := reflection.Canonicalize(codec.NewBuffer(marshaled), md)
+		require.NoError(t, err)
+		b, err := reflection.Canonicalize(codec.NewBuffer(encoder.Bytes()), md)
+		require.NoError(t, err)
+		require.Equal(t, a, b)
+		require.Equal(t, marshaled, a)
+
+		decoded := &descriptorpb.SourceCodeInfo_Location{}
+		require.NoError(t, protov2.Unmarshal(b, decoded))
+		require.True(t, protov2.Equal(m, decoded))
+	})
+
+	t.Run("max depth", func(t *testing.T) {
+		// DescriptorProto holds nested DescriptorProtos as field 3. The chain holds one
+		// more message than its depth, since the innermost payload is empty.
+		md := (&descriptorpb.DescriptorProto{}).ProtoReflect().Descriptor()
+		chain := nestedChainField(molecule.DefaultMaxDepth-1, 3)
+		canonical, err := reflection.Canonicalize(codec.NewBuffer(chain), md)
+		require.NoError(t, err)
+		require.Equal(t, chain, canonical)
+
+		_, err = reflection.Canonicalize(codec.NewBuffer(nestedChainField(molecule.DefaultMaxDepth, 3)), md)
+		require.True(t, errors.Is(err, molecule.ErrMaxDepth))
+
+		_, err = reflection.Canonicalize(codec.NewBuffer(nestedChainField(1<<20, 3)), md)
+		require.True(t, errors.Is(err, molecule.ErrMaxDepth))
+	})
+}
+
+func TestDecodePresence(t *testing.T) {
+	md := (&descriptorpb.FieldDescriptorProto{}).ProtoReflect().Descriptor()
+
+	// number is explicitly set to its default value and name is absent.
+	marshaled, err := protov2.Marshal(&descriptorpb.FieldDescriptorProto{Number: protov2.Int32(0)})
+	require.NoError(t, err)
+	require.NotEmpty(t, marshaled)
+
+	presence, err := reflection.DecodePresence(codec.NewBuffer(marshaled), md)
+	require.NoError(t, err)
+	require.Len(t, presence, md.Fields().Len())
+	require.True(t, presence[3])
+	require.False(t, presence[1])
+
+	presence, err = reflection.DecodePresence(codec.NewBuffer(nil), md)
+	require.NoError(t, err)
+	require.False(t, presence[3])
+	require.False(t, presence[1])
+}
+
+func TestDecodeEnumName(t *testing.T) {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    protov2.String("sign.proto"),
+		Package: protov2.String("moleculetest"),
+		Syntax:  protov2.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: protov2.String("Sign"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: protov2.String("SIGN_ZERO"), Number: protov2.Int32(0)},
+				{Name: protov2.String("SIGN_NEGATIVE"), Number: protov2.Int32(-1)},
+				{Name: protov2.String("SIGN_POSITIVE"), Number: protov2.Int32(1)},
+			},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	ed := fd.Enums().Get(0)
+
+	decodeName := func(t *testing.T, n int32) string {
+		// Enums are encoded like int32s, so negative values are sign-extended.
+		encoder := codec.NewBuffer(nil)
+		require.NoError(t, encoder.EncodeVarint(uint64(int64(n))))
+		number, err := encoder.DecodeVarint()
+		require.NoError(t, err)
+		value := molecule.Value{WireType: codec.WireVarint, Number: number}
+
+		name, err := reflection.DecodeEnumName(value, ed)
+		require.NoError(t, err)
+		return name
+	}
+
+	require.Equal(t, "SIGN_POSITIVE", decodeName(t, 1))
+	require.Equal(t, "SIGN_ZERO", decodeName(t, 0))
+	require.Equal(t, "SIGN_NEGATIVE", decodeName(t, -1))
+	require.Equal(t, "7", decodeName(t, 7))
+	require.Equal(t, "-7", decodeName(t, -7))
+	require.Equal(t, "-2147483648", decodeName(t, math.MinInt32))
+
+	// Generated enums work too.
+	value := molecule.Value{WireType: codec.WireVarint, Number: uint64(descriptorpb.FieldDescriptorProto_TYPE_SINT64)}
+	name, err := reflection.DecodeEnumName(value, descriptorpb.FieldDescriptorProto_TYPE_SINT64.Descriptor())
+	require.NoError(t, err)
+	require.Equal(t, "TYPE_SINT64", name)
+
+	_, err = reflection.DecodeEnumName(molecule.Value{WireType: codec.WireFixed32}, ed)
+	require.Error(t, err)
+	_, err = reflection.DecodeEnumName(molecule.Value{WireType: codec.WireVarint, Number: 1 << 40}, ed)
+	require.Error(t, err)
+}
@@ -0,0 +1,477 @@
+package moleculetest
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepack(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 14, []byte("hello"))
+	encodeVarintField(t, encoder, 16, 1)
+	encodeVarintField(t, encoder, 16, 300)
+	encodeBytesField(t, encoder, 15, []byte{0xff})
+	// An already packed occurrence should be merged in wire order.
+	encodeBytesField(t, encoder, 16, []byte{0x02, 0x03})
+	encodeVarintField(t, encoder, 16, 4)
+
+	repacked, err := molecule.Repack(codec.NewBuffer(encoder.Bytes()), 16, codec.FieldType_INT64)
+	require.NoError(t, err)
+
+	var (
+		fieldNums []int32
+		int64s    []int64
+	)
+	err = molecule.MessageEach(codec.NewBuffer(repacked), func(fieldNum int32, value molecule.Value) (bool, error) {
+		fieldNums = append(fieldNums, fieldNum)
+		if fieldNum != 16 {
+			return true, nil
+		}
+		require.Equal(t, codec.WireBytes, value.WireType)
+		return true, molecule.PackedRepeatedEach(codec.NewBuffer(value.Bytes), codec.FieldType_INT64, func(v molecule.Value) (bool, error) {
+			i, err := v.AsInt64()
+			int64s = append(int64s, i)
+			return true, err
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int32{14, 16, 15}, fieldNums)
+	require.Equal(t, []int64{1, 300, 2, 3, 4}, int64s)
+
+	// The other fields must be untouched so the result is identical to what a
+	// marshaler emitting the same fields in the same order would produce.
+	unmarshaled := &simple.Simple{}
+	require.NoError(t, proto.Unmarshal(repacked, unmarshaled))
+	require.Equal(t, "hello", unmarshaled.String_)
+	require.Equal(t, []byte{0xff}, unmarshaled.Bytes)
+	require.Equal(t, []int64{1, 300, 2, 3, 4}, unmarshaled.RepeatedInt64Packed)
+}
+
+func TestRepackAbsentAndFixed(t *testing.T) {
+	m := &simple.Test{StringField: "hello", Int64Field: 10}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	repacked, err := molecule.Repack(codec.NewBuffer(marshaled), 3, codec.FieldType_INT64)
+	require.NoError(t, err)
+	require.Equal(t, marshaled, repacked)
+
+	encoder := proto.NewBuffer(nil)
+	for _, v := range []uint64{1, 2, 3} {
+		require.NoError(t, encoder.EncodeVarint(uint64(1)<<3|uint64(codec.WireFixed64)))
+		require.NoError(t, encoder.EncodeFixed64(v))
+	}
+	repacked, err = molecule.Repack(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_FIXED64)
+	require.NoError(t, err)
+
+	var fixed []uint64
+	err = molecule.MessageEach(codec.NewBuffer(repacked), func(fieldNum int32, value molecule.Value) (bool, error) {
+		return true, molecule.PackedRepeatedEach(codec.NewBuffer(value.Bytes), codec.FieldType_FIXED64, func(v molecule.Value) (bool, error) {
+			fixed = append(fixed, v.Number)
+			return true, nil
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, fixed)
+
+	_, err = molecule.Repack(codec.NewBuffer(marshaled), 1, codec.FieldType_STRING)
+	require.Error(t, err)
+}
+
+func TestCollectSigned(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+
+	// int32 (field 1): negative values are sign-extended 10 byte varints.
+	minusOne := int64(-1)
+	encodeVarintField(t, encoder, 1, uint64(minusOne))
+	encodeVarintField(t, encoder, 1, 5)
+
+	// sint32 (field 2) and sint64 (field 3), packed.
+	sint32s := proto.NewBuffer(nil)
+	sint64s := proto.NewBuffer(nil)
+	for _, v := range []int64{-1, 1, -64, math.MinInt32} {
+		require.NoError(t, sint32s.EncodeZigzag32(uint64(v)))
+		require.NoError(t, sint64s.EncodeZigzag64(uint64(v)))
+	}
+	minInt64 := int64(math.MinInt64)
+	require.NoError(t, sint64s.EncodeZigzag64(uint64(minInt64)))
+	encodeBytesField(t, encoder, 2, sint32s.Bytes())
+	encodeBytesField(t, encoder, 3, sint64s.Bytes())
+
+	// sfixed32 (field 4) unpacked and sfixed64 (field 5) packed.
+	for _, v := range []int32{-2, 7} {
+		require.NoError(t, encoder.EncodeVarint(4<<3|uint64(codec.WireFixed32)))
+		require.NoError(t, encoder.EncodeFixed32(uint64(uint32(v))))
+	}
+	sfixed64s := proto.NewBuffer(nil)
+	for _, v := range []int64{-3, math.MaxInt64} {
+		require.NoError(t, sfixed64s.EncodeFixed64(uint64(v)))
+	}
+	encodeBytesField(t, encoder, 5, sfixed64s.Bytes())
+
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	int32s, err := molecule.CollectInt32s(buffer, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int32{-1, 5}, int32s)
+
+	collectedSint32s, err := molecule.CollectSint32s(buffer, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int32{-1, 1, -64, math.MinInt32}, collectedSint32s)
+
+	collectedSint64s, err := molecule.CollectSint64s(buffer, 3)
+	require.NoError(t, err)
+	require.Equal(t, []int64{-1, 1, -64, math.MinInt32, math.MinInt64}, collectedSint64s)
+
+	sfixed32s, err := molecule.CollectSfixed32s(buffer, 4)
+	require.NoError(t, err)
+	require.Equal(t, []int32{-2, 7}, sfixed32s)
+
+	collectedSfixed64s, err := molecule.CollectSfixed64s(buffer, 5)
+	require.NoError(t, err)
+	require.Equal(t, []int64{-3, math.MaxInt64}, collectedSfixed64s)
+
+	// Interpreting the zig-zag encoded field as a plain int64 yields different values,
+	// which is why the collectors must branch on the declared type.
+	int64s, err := molecule.CollectInt64s(buffer, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 127, math.MaxUint32}, int64s)
+
+	values, err := molecule.CollectRepeated(buffer, 4, codec.FieldType_SFIXED32)
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+
+	// Mismatched wire types are rejected.
+	_, err = molecule.CollectSfixed32s(buffer, 1)
+	require.Error(t, err)
+}
+
+func TestRepeatedEachIndexed(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 10)
+	encodeBytesField(t, encoder, 1, []byte{11, 12, 13})
+	encodeBytesField(t, encoder, 2, []byte("other"))
+	encodeVarintField(t, encoder, 1, 14)
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	var (
+		indexes []int
+		values  []uint64
+	)
+	err := molecule.RepeatedEachIndexed(buffer, 1, codec.FieldType_UINT64, func(index int, value molecule.Value) (bool, error) {
+		indexes = append(indexes, index)
+		values = append(values, value.Number)
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 4}, indexes)
+	require.Equal(t, []uint64{10, 11, 12, 13, 14}, values)
+
+	// Stopping early inside of a packed occurrence.
+	indexes = indexes[:0]
+	err = molecule.RepeatedEachIndexed(buffer, 1, codec.FieldType_UINT64, func(index int, value molecule.Value) (bool, error) {
+		indexes = append(indexes, index)
+		return index < 2, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2}, indexes)
+}
+
+func TestCollectMessages(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	for i := 0; i < 3; i++ {
+		marshaled, err := proto.Marshal(&simple.Test{Int64Field: int64(i + 1)})
+		require.NoError(t, err)
+		encodeBytesField(t, encoder, 1, marshaled)
+		encodeVarintField(t, encoder, 2, 100)
+	}
+	data := encoder.Bytes()
+	buffer := codec.NewBuffer(data)
+
+	aliased, err := molecule.CollectMessages(buffer, 1)
+	require.NoError(t, err)
+	copied, err := molecule.CollectMessages(buffer, 1, molecule.WithCopy())
+	require.NoError(t, err)
+	require.Len(t, aliased, 3)
+	require.Len(t, copied, 3)
+	require.Equal(t, len(data), buffer.Len())
+
+	for i := range aliased {
+		v, err := molecule.GetInt32(aliased[i], 2, -1)
+		require.NoError(t, err)
+		require.Equal(t, int32(i+1), v)
+		require.Equal(t, aliased[i].Bytes(), copied[i].Bytes())
+	}
+
+	// The first message starts after its 1 byte tag and 1 byte length.
+	require.True(t, &data[2] == &aliased[0].Bytes()[0])
+	require.False(t, &data[2] == &copied[0].Bytes()[0])
+
+	empty, err := molecule.CollectMessages(buffer, 3)
+	require.NoError(t, err)
+	require.Empty(t, empty)
+
+	_, err = molecule.CollectMessages(buffer, 2)
+	require.Error(t, err)
+}
+
+func TestPackedField(t *testing.T) {
+	m := &simple.Simple{
+		String_:             "before",
+		RepeatedInt64Packed: []int64{1, -2, 300},
+		Bytes:               []byte("after"),
+	}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+	buffer := codec.NewBuffer(marshaled)
+
+	var int64s []int64
+	err = molecule.PackedField(buffer, 16, codec.FieldType_INT64, func(v molecule.Value) (bool, error) {
+		i, err := v.AsInt64()
+		int64s = append(int64s, i)
+		return true, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, -2, 300}, int64s)
+	require.Equal(t, len(marshaled), buffer.Len())
+
+	// Multiple occurrences are concatenated and fn can stop early.
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte{1, 2})
+	encodeVarintField(t, encoder, 2, 99)
+	encodeBytesField(t, encoder, 1, []byte{3, 4})
+	buffer = codec.NewBuffer(encoder.Bytes())
+
+	var uint64s []uint64
+	err = molecule.PackedField(buffer, 1, codec.FieldType_UINT64, func(v molecule.Value) (bool, error) {
+		uint64s = append(uint64s, v.Number)
+		return len(uint64s) < 3, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, uint64s)
+
+	// Absent fields never call fn.
+	err = molecule.PackedField(buffer, 3, codec.FieldType_UINT64, func(v molecule.Value) (bool, error) {
+		t.Fatal("unexpected element")
+		return false, nil
+	})
+	require.NoError(t, err)
+
+	// Unpacked occurrences, unpackable types and corrupt contents are rejected.
+	require.Error(t, molecule.PackedField(buffer, 2, codec.FieldType_UINT64, nopPackedFn))
+	require.Error(t, molecule.PackedField(buffer, 1, codec.FieldType_STRING, nopPackedFn))
+	err = molecule.PackedField(buffer, 1, codec.FieldType_FIXED32, nopPackedFn)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "PackedField: field 1:")
+}
+
+func TestCollectBools(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte{1, 0, 1, 1})
+	encodeVarintField(t, encoder, 2, 7)
+
+	// The result is sized from the packed length.
+	bools, err := molecule.CollectBools(codec.NewBuffer(encoder.Bytes()), 1)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, true, true}, bools)
+	require.Equal(t, 4, cap(bools))
+
+	// Packed and unpacked occurrences are interleaved in wire order.
+	encoder = proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 1)
+	encodeBytesField(t, encoder, 1, []byte{0, 0, 1})
+	encodeVarintField(t, encoder, 2, 1)
+	encodeVarintField(t, encoder, 1, 0)
+	encodeBytesField(t, encoder, 1, []byte{1})
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	bools, err = molecule.CollectBools(buffer, 1)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, false, true, false, true}, bools)
+	require.Equal(t, len(encoder.Bytes()), buffer.Len())
+
+	bools, err = molecule.CollectBools(buffer, 3)
+	require.NoError(t, err)
+	require.Empty(t, bools)
+
+	// A truncated packed varint and the wrong wire type are rejected.
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte{1, 0x80})
+	_, err = molecule.CollectBools(codec.NewBuffer(encoder.Bytes()), 1)
+	require.Error(t, err)
+
+	encoder = proto.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(1))
+	_, err = molecule.CollectBools(codec.NewBuffer(encoder.Bytes()), 1)
+	require.Error(t, err)
+}
+
+func TestIsPacked(t *testing.T) {
+	packed, err := proto.Marshal(&simple.Simple{RepeatedInt64Packed: []int64{1, 2, 3}})
+	require.NoError(t, err)
+	isPacked, err := molecule.IsPacked(codec.NewBuffer(packed), 16, codec.FieldType_INT64)
+	require.NoError(t, err)
+	require.True(t, isPacked)
+
+	unpacked := proto.NewBuffer(nil)
+	encodeVarintField(t, unpacked, 1, 1)
+	encodeVarintField(t, unpacked, 1, 2)
+	buffer := codec.NewBuffer(unpacked.Bytes())
+	isPacked, err = molecule.IsPacked(buffer, 1, codec.FieldType_INT64)
+	require.NoError(t, err)
+	require.False(t, isPacked)
+	require.Equal(t, len(unpacked.Bytes()), buffer.Len())
+
+	// Mixed encodings report how the first occurrence is encoded.
+	mixed := proto.NewBuffer(nil)
+	encodeVarintField(t, mixed, 2, 9)
+	encodeBytesField(t, mixed, 1, []byte{1, 2})
+	encodeVarintField(t, mixed, 1, 3)
+	encodeVarintField(t, mixed, 3, 4)
+	encodeBytesField(t, mixed, 3, []byte{5, 6})
+	buffer = codec.NewBuffer(mixed.Bytes())
+
+	isPacked, err = molecule.IsPacked(buffer, 1, codec.FieldType_UINT32)
+	require.NoError(t, err)
+	require.True(t, isPacked)
+	isPacked, err = molecule.IsPacked(buffer, 3, codec.FieldType_UINT32)
+	require.NoError(t, err)
+	require.False(t, isPacked)
+
+	// Absent fields aren't packed.
+	isPacked, err = molecule.IsPacked(buffer, 4, codec.FieldType_UINT32)
+	require.NoError(t, err)
+	require.False(t, isPacked)
+
+	// Mismatched wire types and types that can't be packed are rejected.
+	_, err = molecule.IsPacked(buffer, 2, codec.FieldType_FIXED32)
+	require.Error(t, err)
+	_, err = molecule.IsPacked(buffer, 1, codec.FieldType_BYTES)
+	require.Error(t, err)
+}
+
+func TestCollectRepeatedLengthDelimited(t *testing.T) {
+	t.Run("repeated string", func(t *testing.T) {
+		// Every one of these strings is also a valid run of packed varints.
+		strs := []string{"abc", "\x01\x02", ""}
+		encoder := proto.NewBuffer(nil)
+		for _, s := range strs {
+			encodeBytesField(t, encoder, 1, []byte(s))
+		}
+		buffer := codec.NewBuffer(encoder.Bytes())
+
+		values, err := molecule.CollectRepeated(buffer, 1, codec.FieldType_STRING)
+		require.NoError(t, err)
+		require.Len(t, values, len(strs))
+		for i, v := range values {
+			s, err := v.AsStringSafe()
+			require.NoError(t, err)
+			require.Equal(t, strs[i], s)
+		}
+
+		// Collected as a scalar type, the same bytes are unpacked.
+		values, err = molecule.CollectRepeated(buffer, 1, codec.FieldType_INT64)
+		require.NoError(t, err)
+		require.Len(t, values, 5)
+	})
+
+	t.Run("repeated message", func(t *testing.T) {
+		var (
+			encoder  = proto.NewBuffer(nil)
+			expected []*simple.Test
+		)
+		for i := int64(1); i <= 3; i++ {
+			m := &simple.Test{Int64Field: i, RepeatedInt64Field: []int64{i, i}}
+			marshaled, err := proto.Marshal(m)
+			require.NoError(t, err)
+			encodeBytesField(t, encoder, 1, marshaled)
+			expected = append(expected, m)
+		}
+
+		values, err := molecule.CollectRepeated(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_MESSAGE)
+		require.NoError(t, err)
+		require.Len(t, values, len(expected))
+		for i, v := range values {
+			var m simple.Test
+			require.NoError(t, proto.Unmarshal(v.Bytes, &m))
+			require.True(t, proto.Equal(expected[i], &m))
+		}
+	})
+
+	t.Run("wrong wire type", func(t *testing.T) {
+		encoder := proto.NewBuffer(nil)
+		encodeVarintField(t, encoder, 1, 1)
+		_, err := molecule.CollectRepeated(codec.NewBuffer(encoder.Bytes()), 1, codec.FieldType_BYTES)
+		require.Error(t, err)
+	})
+}
+
+func TestCollectFixed(t *testing.T) {
+	packed := func(values ...uint64) []byte {
+		var b []byte
+		for _, v := range values {
+			b = append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+		}
+		return b
+	}
+
+	// Packed and unpacked occurrences are interleaved in wire order.
+	encoder := proto.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireFixed64)))
+	require.NoError(t, encoder.EncodeFixed64(math.MaxUint64))
+	encodeBytesField(t, encoder, 1, packed(1, 1<<40, 3))
+	encodeVarintField(t, encoder, 2, 7)
+	encodeBytesField(t, encoder, 1, nil)
+	encodeBytesField(t, encoder, 1, packed(4))
+	buffer := codec.NewBuffer(encoder.Bytes())
+
+	fixed64s, err := molecule.CollectFixed64s(buffer, 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{math.MaxUint64, 1, 1 << 40, 3, 4}, fixed64s)
+	require.Equal(t, 5, cap(fixed64s))
+	require.Equal(t, len(encoder.Bytes()), buffer.Len())
+
+	fixed64s, err = molecule.CollectFixed64s(buffer, 3)
+	require.NoError(t, err)
+	require.Empty(t, fixed64s)
+
+	// The same packed bytes hold twice as many fixed32 elements.
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, packed(1<<32|2, 3))
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(math.MaxUint32))
+	fixed32s, err := molecule.CollectFixed32s(codec.NewBuffer(encoder.Bytes()), 1)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2, 1, 3, 0, math.MaxUint32}, fixed32s)
+
+	// Packed lengths that aren't a multiple of the element size are rejected.
+	for _, n := range []int{1, 7, 9, 15} {
+		encoder = proto.NewBuffer(nil)
+		encodeBytesField(t, encoder, 1, make([]byte, n))
+		_, err = molecule.CollectFixed64s(codec.NewBuffer(encoder.Bytes()), 1)
+		require.True(t, errors.Is(err, codec.ErrBadLength), "length %d", n)
+	}
+	for _, n := range []int{1, 3, 6} {
+		encoder = proto.NewBuffer(nil)
+		encodeBytesField(t, encoder, 1, make([]byte, n))
+		_, err = molecule.CollectFixed32s(codec.NewBuffer(encoder.Bytes()), 1)
+		require.True(t, errors.Is(err, codec.ErrBadLength), "length %d", n)
+	}
+
+	// So is the wrong wire type.
+	encoder = proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 1)
+	_, err = molecule.CollectFixed64s(codec.NewBuffer(encoder.Bytes()), 1)
+	require.Error(t, err)
+	_, err = molecule.CollectFixed32s(codec.NewBuffer(encoder.Bytes()), 1)
+	require.Error(t, err)
+}
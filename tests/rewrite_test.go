@@ -0,0 +1,175 @@
+package moleculetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceFieldScalar(t *testing.T) {
+	m := &simple.Test{StringField: "secret", Int64Field: 10, RepeatedInt64Field: []int64{1, 2}}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	replacement := proto.NewBuffer(nil)
+	encodeBytesField(t, replacement, 1, []byte("xxx"))
+
+	buffer := codec.NewBuffer(marshaled)
+	replaced, err := molecule.ReplaceField(buffer, 1, replacement.Bytes())
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+
+	// Everything after the 8 byte string field is untouched.
+	require.Equal(t, replacement.Bytes(), replaced[:5])
+	require.Equal(t, marshaled[8:], replaced[5:])
+
+	unmarshaled := &simple.Test{}
+	require.NoError(t, proto.Unmarshal(replaced, unmarshaled))
+	require.Equal(t, "xxx", unmarshaled.StringField)
+	require.Equal(t, int64(10), unmarshaled.Int64Field)
+	require.Equal(t, []int64{1, 2}, unmarshaled.RepeatedInt64Field)
+}
+
+func TestReplaceFieldNested(t *testing.T) {
+	original, err := proto.Marshal(&simple.Test{StringField: "secret"})
+	require.NoError(t, err)
+	redacted, err := proto.Marshal(&simple.Test{Int64Field: 1})
+	require.NoError(t, err)
+
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 2, 5)
+	encodeBytesField(t, encoder, 1, original)
+	encodeVarintField(t, encoder, 3, 7)
+	// Only the first occurrence is replaced.
+	encodeBytesField(t, encoder, 1, original)
+	msg := encoder.Bytes()
+
+	replacement := proto.NewBuffer(nil)
+	encodeBytesField(t, replacement, 1, redacted)
+
+	replaced, err := molecule.ReplaceField(codec.NewBuffer(msg), 1, replacement.Bytes())
+	require.NoError(t, err)
+
+	expected := proto.NewBuffer(nil)
+	encodeVarintField(t, expected, 2, 5)
+	encodeBytesField(t, expected, 1, redacted)
+	encodeVarintField(t, expected, 3, 7)
+	encodeBytesField(t, expected, 1, original)
+	require.Equal(t, expected.Bytes(), replaced)
+}
+
+func TestReplaceFieldAppend(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Test{StringField: "hello"})
+	require.NoError(t, err)
+
+	replacement := proto.NewBuffer(nil)
+	encodeVarintField(t, replacement, 2, 42)
+
+	replaced, err := molecule.ReplaceField(codec.NewBuffer(marshaled), 2, replacement.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte(nil), marshaled...), replacement.Bytes()...), replaced)
+
+	replaced, err = molecule.ReplaceField(codec.NewBuffer(nil), 2, replacement.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, replacement.Bytes(), replaced)
+
+	// The replacement must be exactly one occurrence of the field.
+	_, err = molecule.ReplaceField(codec.NewBuffer(marshaled), 3, replacement.Bytes())
+	require.Error(t, err)
+	_, err = molecule.ReplaceField(codec.NewBuffer(marshaled), 2, nil)
+	require.Error(t, err)
+	_, err = molecule.ReplaceField(codec.NewBuffer(marshaled), 2, append(replacement.Bytes(), replacement.Bytes()...))
+	require.Error(t, err)
+
+	// Corrupt messages are rejected.
+	_, err = molecule.ReplaceField(codec.NewBuffer([]byte{0x0a, 0x05}), 2, replacement.Bytes())
+	require.Error(t, err)
+}
+
+func TestTransform(t *testing.T) {
+	m := &simple.Test{StringField: "secret", Int64Field: 10, RepeatedInt64Field: []int64{1, 2}}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	transform := func(t *testing.T, fn molecule.TransformFn) *simple.Test {
+		in := codec.NewBuffer(marshaled)
+		out := codec.NewEncoder(nil)
+		require.NoError(t, molecule.Transform(in, out, fn))
+		require.True(t, in.EOF())
+		var transformed simple.Test
+		require.NoError(t, proto.Unmarshal(out.Bytes(), &transformed))
+		return &transformed
+	}
+
+	t.Run("identity", func(t *testing.T) {
+		out := codec.NewEncoder(nil)
+		require.NoError(t, molecule.Transform(codec.NewBuffer(marshaled), out, func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+			return value.EncodeTo(out, fieldNum)
+		}))
+		require.Equal(t, marshaled, out.Bytes())
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		transformed := transform(t, func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+			if fieldNum == 1 {
+				return nil
+			}
+			return value.EncodeTo(out, fieldNum)
+		})
+		require.True(t, proto.Equal(&simple.Test{Int64Field: 10, RepeatedInt64Field: []int64{1, 2}}, transformed))
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		// Move the repeated field's elements into the singular int64 field, the last of
+		// which wins.
+		transformed := transform(t, func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+			switch fieldNum {
+			case 2:
+				return nil
+			case 3:
+				return molecule.PackedRepeatedEach(codec.NewBuffer(value.Bytes), codec.FieldType_INT64, func(element molecule.Value) (bool, error) {
+					return true, element.EncodeTo(out, 2)
+				})
+			}
+			return value.EncodeTo(out, fieldNum)
+		})
+		require.True(t, proto.Equal(&simple.Test{StringField: "secret", Int64Field: 2}, transformed))
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		transformed := transform(t, func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+			if err := value.EncodeTo(out, fieldNum); err != nil {
+				return err
+			}
+			if fieldNum == 3 {
+				return value.EncodeTo(out, fieldNum)
+			}
+			return nil
+		})
+		require.True(t, proto.Equal(&simple.Test{StringField: "secret", Int64Field: 10, RepeatedInt64Field: []int64{1, 2, 1, 2}}, transformed))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		errStop := errors.New("stop")
+		out := codec.NewEncoder(nil)
+		err := molecule.Transform(codec.NewBuffer(marshaled), out, func(fieldNum int32, value molecule.Value, out *codec.Encoder) error {
+			if fieldNum == 2 {
+				return errStop
+			}
+			return value.EncodeTo(out, fieldNum)
+		})
+		require.Equal(t, errStop, err)
+
+		err = molecule.Transform(codec.NewBuffer(marshaled[:len(marshaled)-1]), codec.NewEncoder(nil), func(int32, molecule.Value, *codec.Encoder) error {
+			return nil
+		})
+		require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	})
+}
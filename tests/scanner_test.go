@@ -0,0 +1,169 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanner(t *testing.T) {
+	m := &simple.Simple{Double: 1.5, Int64: 300, String_: "hello", Fixed32: 7, Bytes: []byte{1, 2}}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	var expected []int32
+	err = molecule.MessageEach(codec.NewBuffer(marshaled), func(fieldNum int32, value molecule.Value) (bool, error) {
+		expected = append(expected, fieldNum)
+		return true, nil
+	})
+	require.NoError(t, err)
+
+	var (
+		scanner = molecule.NewScanner(codec.NewBuffer(marshaled))
+		fields  []int32
+		prevEnd int
+	)
+	for scanner.Scan() {
+		fields = append(fields, scanner.FieldNum())
+
+		// Spans are contiguous and each one holds exactly the field's encoding.
+		start, end := scanner.FieldSpan()
+		require.Equal(t, prevEnd, start)
+		prevEnd = end
+
+		var count int
+		err := molecule.MessageEach(codec.NewBuffer(marshaled[start:end]), func(fieldNum int32, value molecule.Value) (bool, error) {
+			require.Equal(t, scanner.FieldNum(), fieldNum)
+			require.Equal(t, scanner.Value(), value)
+			count++
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, expected, fields)
+	require.Equal(t, len(marshaled), prevEnd)
+
+	t.Run("relative to starting position", func(t *testing.T) {
+		buffer := codec.NewBuffer(marshaled)
+		require.NoError(t, buffer.Skip(9)) // The double field.
+		data := buffer.Bytes()
+
+		scanner := molecule.NewScanner(buffer)
+		require.True(t, scanner.Scan())
+		start, end := scanner.FieldSpan()
+		require.Equal(t, 0, start)
+		require.Equal(t, []byte{4 << 3, 0xac, 0x02}, data[start:end])
+	})
+
+	t.Run("error", func(t *testing.T) {
+		scanner := molecule.NewScanner(codec.NewBuffer(marshaled[:len(marshaled)-1]))
+		for scanner.Scan() {
+		}
+		require.Error(t, scanner.Err())
+		require.False(t, scanner.Scan())
+	})
+}
+
+func TestScannerOffset(t *testing.T) {
+	m := &simple.Simple{Double: 1.5, Int64: 300, String_: "hello", Fixed32: 7, Bytes: []byte{1, 2}}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	scanner := molecule.NewScanner(codec.NewBuffer(marshaled))
+	require.Equal(t, 0, scanner.Offset())
+
+	// Checkpoint after the second field and stop, as if the process had crashed.
+	var fields []int32
+	for i := 0; i < 2; i++ {
+		require.True(t, scanner.Scan())
+		fields = append(fields, scanner.FieldNum())
+	}
+	checkpoint := scanner.Offset()
+	_, end := scanner.FieldSpan()
+	require.Equal(t, end, checkpoint)
+
+	// Resume from the checkpoint and scan to completion.
+	buffer := codec.NewBuffer(marshaled)
+	require.NoError(t, buffer.Skip(checkpoint))
+	scanner = molecule.NewScanner(buffer)
+	for scanner.Scan() {
+		fields = append(fields, scanner.FieldNum())
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, []int32{1, 4, 9, 14, 15}, fields)
+	require.Equal(t, len(marshaled)-checkpoint, scanner.Offset())
+
+	// A truncated field leaves the offset at the end of the last complete field.
+	scanner = molecule.NewScanner(codec.NewBuffer(marshaled[:len(marshaled)-1]))
+	var offsets []int
+	for scanner.Scan() {
+		offsets = append(offsets, scanner.Offset())
+	}
+	require.Error(t, scanner.Err())
+	require.Equal(t, offsets[len(offsets)-1], scanner.Offset())
+}
+
+func TestFieldSpanAtPath(t *testing.T) {
+	leaf := &simple.Test{StringField: "signed", Int64Field: 42, RepeatedInt64Field: []int64{1, 2}}
+	nested, err := proto.Marshal(&simple.Nested{NestedMessage: leaf})
+	require.NoError(t, err)
+
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 1, 7)
+	encodeBytesField(t, encoder, 2, []byte("stale"))
+	encodeBytesField(t, encoder, 2, nested)
+	encodeVarintField(t, encoder, 3, 8)
+	data := encoder.Bytes()
+
+	// Leading bytes that have already been read aren't part of the offsets.
+	buffer := codec.NewBuffer(append([]byte{0x08, 0x01}, data...))
+	require.NoError(t, buffer.Skip(2))
+
+	spanAt := func(path ...int32) []byte {
+		start, end, found, err := molecule.FieldSpanAtPath(buffer, path)
+		require.NoError(t, err)
+		require.True(t, found, "path %v", path)
+		return data[start:end]
+	}
+
+	// A nested message's span covers its tag, length and contents, and parses on its own.
+	span := spanAt(2, 1)
+	var parsed simple.Nested
+	require.NoError(t, proto.Unmarshal(span, &parsed))
+	require.True(t, proto.Equal(leaf, parsed.NestedMessage))
+	marshaledLeaf, err := proto.Marshal(leaf)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{0x0a, byte(len(marshaledLeaf))}, marshaledLeaf...), span)
+
+	// The last occurrence of a field is followed.
+	require.Equal(t, append([]byte{0x12, byte(len(nested))}, nested...), spanAt(2))
+
+	// Scalar leaves work too.
+	span = spanAt(2, 1, 2)
+	require.Equal(t, []byte{0x10, 42}, span)
+	require.Equal(t, []byte{0x18, 8}, spanAt(3))
+	require.Equal(t, len(data), buffer.Len())
+
+	for _, path := range [][]int32{{4}, {2, 5}, {2, 1, 7}} {
+		_, _, found, err := molecule.FieldSpanAtPath(buffer, path)
+		require.NoError(t, err)
+		require.False(t, found, "path %v", path)
+	}
+
+	// Paths can only go through length-delimited fields.
+	_, _, _, err = molecule.FieldSpanAtPath(buffer, []int32{1, 1})
+	require.EqualError(t, err, "FieldSpanAtPath: path [1]: expected wiretype 2, got: 0")
+	_, _, _, err = molecule.FieldSpanAtPath(buffer, nil)
+	require.Error(t, err)
+
+	// Malformed messages are reported.
+	_, _, _, err = molecule.FieldSpanAtPath(codec.NewBuffer(data[:len(data)-1]), []int32{2})
+	require.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package moleculetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSchema(t *testing.T) {
+	testSchema := molecule.Schema{
+		1: {Type: codec.FieldType_STRING},
+		2: {Type: codec.FieldType_INT64},
+		3: {Type: codec.FieldType_INT64, Repeated: true},
+	}
+	schema := molecule.Schema{
+		1: {Type: codec.FieldType_STRING},
+		2: {Type: codec.FieldType_MESSAGE, Repeated: true, Nested: testSchema},
+		3: {Type: codec.FieldType_MESSAGE, Nested: molecule.Schema{
+			1: {Type: codec.FieldType_MESSAGE, Nested: testSchema},
+		}},
+		// Without a nested schema the message is left encoded.
+		4: {Type: codec.FieldType_MESSAGE},
+	}
+
+	first, err := proto.Marshal(&simple.Test{StringField: "a", Int64Field: 1, RepeatedInt64Field: []int64{1, 2}})
+	require.NoError(t, err)
+	second, err := proto.Marshal(&simple.Test{StringField: "b"})
+	require.NoError(t, err)
+	nested, err := proto.Marshal(&simple.Nested{NestedMessage: &simple.Test{Int64Field: 3, RepeatedInt64Field: []int64{4}}})
+	require.NoError(t, err)
+
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte("outer"))
+	encodeBytesField(t, encoder, 2, first)
+	encodeBytesField(t, encoder, 3, nested)
+	encodeBytesField(t, encoder, 2, second)
+	encodeBytesField(t, encoder, 4, second)
+	// Fields that aren't in the schema are ignored.
+	encodeVarintField(t, encoder, 5, 1)
+
+	buffer := codec.NewBuffer(encoder.Bytes())
+	decoded, err := molecule.DecodeSchema(buffer, schema)
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+	require.Equal(t, map[int32]interface{}{
+		1: "outer",
+		2: []interface{}{
+			map[int32]interface{}{1: "a", 2: int64(1), 3: []interface{}{int64(1), int64(2)}},
+			map[int32]interface{}{1: "b"},
+		},
+		3: map[int32]interface{}{
+			1: map[int32]interface{}{2: int64(3), 3: []interface{}{int64(4)}},
+		},
+		4: second,
+	}, decoded)
+
+	// The last occurrence of a singular field wins, and unpacked repeated elements are
+	// collected just like packed ones.
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte("x"))
+	encodeBytesField(t, encoder, 1, []byte("y"))
+	encodeVarintField(t, encoder, 3, 5)
+	encodeBytesField(t, encoder, 3, []byte{6, 7})
+	decoded, err = molecule.DecodeSchema(codec.NewBuffer(encoder.Bytes()), testSchema)
+	require.NoError(t, err)
+	require.Equal(t, map[int32]interface{}{
+		1: "y",
+		3: []interface{}{int64(5), int64(6), int64(7)},
+	}, decoded)
+
+	// Errors in nested messages name the path to the bad field.
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 2, first[:len(first)-1])
+	_, err = molecule.DecodeSchema(codec.NewBuffer(encoder.Bytes()), schema)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	require.Contains(t, err.Error(), "field 2: ")
+
+	encoder = proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 3, 1)
+	_, err = molecule.DecodeSchema(codec.NewBuffer(encoder.Bytes()), schema)
+	require.EqualError(t, err, "DecodeSchema: field 3: expected wiretype 2, got: 0")
+
+	_, err = molecule.DecodeSchema(codec.NewBuffer(encoder.Bytes()), molecule.Schema{3: {Type: codec.FieldType_GROUP}})
+	require.Error(t, err)
+}
+
+func TestDecodeSchemaMaxDepth(t *testing.T) {
+	// A recursive schema follows the message down until DefaultMaxDepth. The chain
+	// holds one more message than its depth, since the innermost payload is empty.
+	schema := molecule.Schema{}
+	schema[1] = molecule.FieldSpec{Type: codec.FieldType_MESSAGE, Nested: schema}
+
+	_, err := molecule.DecodeSchema(codec.NewBuffer(nestedChain(molecule.DefaultMaxDepth-1)), schema)
+	require.NoError(t, err)
+
+	_, err = molecule.DecodeSchema(codec.NewBuffer(nestedChain(molecule.DefaultMaxDepth)), schema)
+	require.True(t, errors.Is(err, molecule.ErrMaxDepth))
+
+	_, err = molecule.DecodeSchema(codec.NewBuffer(nestedChain(1<<20)), schema)
+	require.True(t, errors.Is(err, molecule.ErrMaxDepth))
+}
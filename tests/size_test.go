@@ -0,0 +1,94 @@
+package moleculetest
+
+import (
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// nestedChain returns a message made of depth messages nested inside each other, each of
+// which holds the next one as field 1. It is built without recursion or quadratic copying
+// so that it can be used to check how hostile, deeply nested input is handled.
+func nestedChain(depth int) []byte {
+	return nestedChainField(depth, 1)
+}
+
+// nestedChainField is like nestedChain but nests the messages in the given field, which
+// must be below 16 so that its tag fits in a single byte.
+func nestedChainField(depth int, fieldNum int32) []byte {
+	// lengths[i] is the length of the contents of the field at depth i+1.
+	lengths := make([]int, depth)
+	for i := depth - 2; i >= 0; i-- {
+		lengths[i] = 1 + codec.ComputeVarintSize(uint64(lengths[i+1])) + lengths[i+1]
+	}
+	b := make([]byte, 0, 1+codec.ComputeVarintSize(uint64(lengths[0]))+lengths[0])
+	for _, l := range lengths {
+		b = append(b, byte(fieldNum)<<3|byte(codec.WireBytes))
+		for v := uint64(l); ; v >>= 7 {
+			if v < 0x80 {
+				b = append(b, byte(v))
+				break
+			}
+			b = append(b, byte(v)|0x80)
+		}
+	}
+	return b
+}
+
+func TestMessageSize(t *testing.T) {
+	inner := &simple.Test{StringField: "hello", Int64Field: 5, RepeatedInt64Field: []int64{1, 2, 3}}
+	m := &simple.Nested{NestedMessage: inner}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	// The nested message field plus its string, int64 and packed repeated fields. Neither
+	// "hello" nor the packed bytes parse as messages.
+	buffer := codec.NewBuffer(marshaled)
+	fields, bytes, err := molecule.MessageSize(buffer)
+	require.NoError(t, err)
+	require.Equal(t, 4, fields)
+	require.Equal(t, len(marshaled), bytes)
+	require.Equal(t, 0, buffer.Len())
+
+	// Two levels of nesting.
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, marshaled)
+	encodeVarintField(t, encoder, 2, 7)
+	fields, bytes, err = molecule.MessageSize(codec.NewBuffer(encoder.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 6, fields)
+	require.Equal(t, len(encoder.Bytes()), bytes)
+
+	// Bytes whose tags have field number 0 aren't a message.
+	encoder = proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte{0x00, 0x00})
+	fields, _, err = molecule.MessageSize(codec.NewBuffer(encoder.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 1, fields)
+
+	// Messages nested deeper than the limit are counted as opaque bytes, which keeps
+	// hostile input from exhausting the stack.
+	fields, _, err = molecule.MessageSize(codec.NewBuffer(nestedChain(molecule.DefaultMaxDepth)))
+	require.NoError(t, err)
+	require.Equal(t, molecule.DefaultMaxDepth, fields)
+	deep := nestedChain(1 << 20)
+	fields, bytes, err = molecule.MessageSize(codec.NewBuffer(deep))
+	require.NoError(t, err)
+	require.Equal(t, molecule.DefaultMaxDepth, fields)
+	require.Equal(t, len(deep), bytes)
+
+	AssertNoAllocs(t, func() {
+		buffer.Reset(marshaled)
+		if _, _, err := molecule.MessageSize(buffer); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	_, _, err = molecule.MessageSize(codec.NewBuffer(marshaled[:len(marshaled)-1]))
+	require.Error(t, err)
+}
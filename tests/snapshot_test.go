@@ -0,0 +1,135 @@
+package moleculetest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIndependentOfBuffer(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte("hello"))
+	encodeVarintField(t, encoder, 2, 10)
+	encodeVarintField(t, encoder, 3, 1)
+	encodeVarintField(t, encoder, 3, 2)
+	marshaled := encoder.Bytes()
+
+	buffer := codec.NewBuffer(marshaled)
+	snapshot, err := molecule.NewSnapshot(buffer)
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+
+	// Clobber the source bytes, the snapshot must be unaffected.
+	for i := range marshaled {
+		marshaled[i] = 0
+	}
+
+	require.Equal(t, []int32{1, 2, 3}, snapshot.Fields())
+
+	v, ok := snapshot.Get(1)
+	require.True(t, ok)
+	str, err := v.AsStringUnsafe()
+	require.NoError(t, err)
+	require.Equal(t, "hello", str)
+
+	v, ok = snapshot.Get(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), v.Number)
+
+	all := snapshot.All(3)
+	require.Len(t, all, 2)
+	require.Equal(t, uint64(1), all[0].Number)
+	require.Equal(t, uint64(2), all[1].Number)
+
+	_, ok = snapshot.Get(4)
+	require.False(t, ok)
+	require.Empty(t, snapshot.All(4))
+}
+
+func TestSnapshotConcurrentReads(t *testing.T) {
+	m := &simple.Test{StringField: "hello world!", Int64Field: 10, RepeatedInt64Field: []int64{1, 2, 3}}
+	marshaled, err := proto.Marshal(m)
+	require.NoError(t, err)
+
+	snapshot, err := molecule.NewSnapshot(codec.NewBuffer(marshaled))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				v, ok := snapshot.Get(1)
+				assert.True(t, ok)
+				str, _ := v.AsStringUnsafe()
+				assert.Equal(t, m.StringField, str)
+
+				v, ok = snapshot.Get(2)
+				assert.True(t, ok)
+				assert.Equal(t, uint64(m.Int64Field), v.Number)
+
+				assert.Len(t, snapshot.All(3), 1)
+				assert.Len(t, snapshot.Fields(), 3)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestParseOwned(t *testing.T) {
+	nested, err := proto.Marshal(&simple.Test{StringField: "inner", Int64Field: 7})
+	require.NoError(t, err)
+	encoder := proto.NewBuffer(nil)
+	encodeBytesField(t, encoder, 1, []byte("hello"))
+	encodeVarintField(t, encoder, 2, 10)
+	encodeBytesField(t, encoder, 3, nested)
+	encodeBytesField(t, encoder, 1, []byte("world"))
+	encodeBytesField(t, encoder, 4, nil)
+	data := encoder.Bytes()
+
+	snapshot, err := molecule.ParseOwned(data)
+	require.NoError(t, err)
+
+	// Clobber the input, the snapshot must be unaffected.
+	for i := range data {
+		data[i] = 0xff
+	}
+
+	require.Equal(t, []int32{1, 2, 3, 4}, snapshot.Fields())
+	all := snapshot.All(1)
+	require.Len(t, all, 2)
+	require.Equal(t, []byte("hello"), all[0].Bytes)
+	require.Equal(t, []byte("world"), all[1].Bytes)
+
+	v, ok := snapshot.Get(2)
+	require.True(t, ok)
+	require.Equal(t, uint64(10), v.Number)
+
+	// Nested messages can be decoded from the owned bytes.
+	v, ok = snapshot.Get(3)
+	require.True(t, ok)
+	var decoded simple.Test
+	require.NoError(t, proto.Unmarshal(v.Bytes, &decoded))
+	require.Equal(t, "inner", decoded.StringField)
+	require.Equal(t, int64(7), decoded.Int64Field)
+
+	v, ok = snapshot.Get(4)
+	require.True(t, ok)
+	require.Empty(t, v.Bytes)
+
+	// Appending to one value doesn't clobber the next.
+	hello := append(all[0].Bytes, '!')
+	require.Equal(t, []byte("hello!"), hello)
+	require.Equal(t, []byte("world"), all[1].Bytes)
+
+	_, err = molecule.ParseOwned([]byte{0x0a, 0x05, 'a'})
+	require.Error(t, err)
+}
@@ -0,0 +1,177 @@
+package moleculetest
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeTyped(t *testing.T) {
+	nested, err := proto.Marshal(&simple.Test{StringField: "inner", Int64Field: 2})
+	require.NoError(t, err)
+
+	encoder := proto.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeZigzag64(^uint64(0))) // -1
+	require.NoError(t, encoder.EncodeVarint(2<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(uint64(uint32(0xfffffffe)))) // -2
+	require.NoError(t, encoder.EncodeVarint(3<<3|uint64(codec.WireFixed64)))
+	require.NoError(t, encoder.EncodeFixed64(1<<40))
+	encodeBytesField(t, encoder, 4, nested)
+	encodeBytesField(t, encoder, 5, []byte("hello"))
+	encodeBytesField(t, encoder, 6, []byte{1, 2, 3})
+	// sint32 field 7 occurs unpacked, twice.
+	require.NoError(t, encoder.EncodeVarint(7<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeZigzag32(uint64(3)))
+	require.NoError(t, encoder.EncodeVarint(7<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeZigzag32(^uint64(0)))
+	// A packed field with a single element is still a slice.
+	encodeBytesField(t, encoder, 8, []byte{1})
+	// Fields that aren't in the schema are ignored.
+	encodeVarintField(t, encoder, 9, 1)
+
+	schema := map[int32]codec.FieldType{
+		1:  codec.FieldType_SINT64,
+		2:  codec.FieldType_SFIXED32,
+		3:  codec.FieldType_FIXED64,
+		4:  codec.FieldType_MESSAGE,
+		5:  codec.FieldType_STRING,
+		6:  codec.FieldType_UINT64,
+		7:  codec.FieldType_SINT32,
+		8:  codec.FieldType_BOOL,
+		10: codec.FieldType_DOUBLE,
+	}
+	buffer := codec.NewBuffer(encoder.Bytes())
+	decoded, err := molecule.DecodeTyped(buffer, schema)
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+	require.Equal(t, map[int32]interface{}{
+		1: int64(-1),
+		2: int32(-2),
+		3: uint64(1 << 40),
+		4: nested,
+		5: "hello",
+		6: []interface{}{uint64(1), uint64(2), uint64(3)},
+		7: []interface{}{int32(3), int32(-1)},
+		8: []interface{}{true},
+	}, decoded)
+
+	// Nested messages can be decoded with their own schema.
+	inner, err := molecule.DecodeTyped(codec.NewBuffer(decoded[4].([]byte)), map[int32]codec.FieldType{
+		1: codec.FieldType_STRING,
+		2: codec.FieldType_INT64,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[int32]interface{}{1: "inner", 2: int64(2)}, inner)
+
+	// The same bytes decode differently without the zig-zag and signed types.
+	decoded, err = molecule.DecodeTyped(codec.NewBuffer(encoder.Bytes()), map[int32]codec.FieldType{
+		1: codec.FieldType_UINT64,
+		2: codec.FieldType_FIXED32,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[int32]interface{}{1: uint64(1), 2: uint32(0xfffffffe)}, decoded)
+
+	// Mismatched wire types and unsupported field types are rejected.
+	_, err = molecule.DecodeTyped(codec.NewBuffer(encoder.Bytes()), map[int32]codec.FieldType{1: codec.FieldType_FIXED32})
+	require.Error(t, err)
+	_, err = molecule.DecodeTyped(codec.NewBuffer(encoder.Bytes()), map[int32]codec.FieldType{3: codec.FieldType_STRING})
+	require.Error(t, err)
+	_, err = molecule.DecodeTyped(codec.NewBuffer(encoder.Bytes()), map[int32]codec.FieldType{4: codec.FieldType_GROUP})
+	require.Error(t, err)
+}
+
+func TestCollectAll(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	encodeVarintField(t, encoder, 2, 1)
+	encodeBytesField(t, encoder, 1, []byte("a"))
+	encodeVarintField(t, encoder, 2, 2)
+	require.NoError(t, encoder.EncodeVarint(3<<3|uint64(codec.WireFixed64)))
+	require.NoError(t, encoder.EncodeFixed64(7))
+	encodeBytesField(t, encoder, 1, []byte("b"))
+	encodeVarintField(t, encoder, 2, 3)
+
+	buffer := codec.NewBuffer(encoder.Bytes())
+	fields, err := molecule.CollectAll(buffer)
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+	require.Equal(t, map[int32][]molecule.Value{
+		1: {molecule.BytesValue([]byte("a")), molecule.BytesValue([]byte("b"))},
+		2: {molecule.Uint64Value(1), molecule.Uint64Value(2), molecule.Uint64Value(3)},
+		3: {molecule.Fixed64Value(7)},
+	}, fields)
+
+	fields, err = molecule.CollectAll(codec.NewBuffer(nil))
+	require.NoError(t, err)
+	require.Empty(t, fields)
+
+	_, err = molecule.CollectAll(codec.NewBuffer(encoder.Bytes()[:len(encoder.Bytes())-1]))
+	require.Error(t, err)
+}
+
+func TestMessageEachWithSchema(t *testing.T) {
+	encoder := proto.NewBuffer(nil)
+	// The same bits in fields of the same wire type but different declared types.
+	for _, fieldNum := range []uint64{1, 2, 3} {
+		require.NoError(t, encoder.EncodeVarint(fieldNum<<3|uint64(codec.WireFixed64)))
+		require.NoError(t, encoder.EncodeFixed64(math.MaxUint64))
+	}
+	for _, fieldNum := range []uint64{4, 5} {
+		require.NoError(t, encoder.EncodeVarint(fieldNum<<3|uint64(codec.WireFixed32)))
+		require.NoError(t, encoder.EncodeFixed32(uint64(uint32(0xfffffffe))))
+	}
+	// A packed sfixed32 field and a field that isn't in the schema.
+	encodeBytesField(t, encoder, 6, []byte{0xff, 0xff, 0xff, 0xff, 2, 0, 0, 0})
+	encodeBytesField(t, encoder, 7, []byte("hello"))
+
+	schema := map[int32]codec.FieldType{
+		1: codec.FieldType_FIXED64,
+		2: codec.FieldType_SFIXED64,
+		3: codec.FieldType_DOUBLE,
+		4: codec.FieldType_FIXED32,
+		5: codec.FieldType_SFIXED32,
+		6: codec.FieldType_SFIXED32,
+	}
+	decoded := map[int32]interface{}{}
+	buffer := codec.NewBuffer(encoder.Bytes())
+	err := molecule.MessageEachWithSchema(buffer, schema, func(fieldNum int32, value molecule.Value) (bool, error) {
+		require.Equal(t, schema[fieldNum], value.FieldType)
+		if fieldNum == 7 {
+			_, err := value.Typed()
+			require.Error(t, err)
+			return true, nil
+		}
+		v, err := value.Typed()
+		decoded[fieldNum] = v
+		return true, err
+	})
+	require.NoError(t, err)
+	require.True(t, buffer.EOF())
+
+	require.Equal(t, uint64(math.MaxUint64), decoded[1])
+	require.Equal(t, int64(-1), decoded[2])
+	require.True(t, math.IsNaN(decoded[3].(float64)))
+	require.Equal(t, uint32(0xfffffffe), decoded[4])
+	require.Equal(t, int32(-2), decoded[5])
+	require.Equal(t, []interface{}{int32(-1), int32(2)}, decoded[6])
+
+	// Fields must be encoded with the wire type of their declared type.
+	err = molecule.MessageEachWithSchema(codec.NewBuffer(encoder.Bytes()), map[int32]codec.FieldType{
+		1: codec.FieldType_SFIXED32,
+	}, func(int32, molecule.Value) (bool, error) { return true, nil })
+	require.EqualError(t, err, "MessageEachWithSchema: field 1: expected wiretype 5, got: 1")
+
+	// Errors returned by fn are returned as is.
+	errStop := errors.New("stop")
+	err = molecule.MessageEachWithSchema(codec.NewBuffer(encoder.Bytes()), schema, func(int32, molecule.Value) (bool, error) {
+		return false, errStop
+	})
+	require.Equal(t, errStop, err)
+}
@@ -0,0 +1,122 @@
+package moleculetest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateWellFormed(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Simple{
+		Double:              1.5,
+		Fixed32:             7,
+		Sint64:              -3,
+		String_:             "hello",
+		RepeatedInt64Packed: []int64{1, 2, 3},
+	})
+	require.NoError(t, err)
+
+	group := func(fieldNum int32, contents ...func(*codec.Buffer)) func(*codec.Buffer) {
+		return func(encoder *codec.Buffer) {
+			require.NoError(t, encoder.EncodeTagAndWireType(fieldNum, codec.WireStartGroup))
+			for _, c := range contents {
+				c(encoder)
+			}
+			require.NoError(t, encoder.EncodeTagAndWireType(fieldNum, codec.WireEndGroup))
+		}
+	}
+	varint := func(fieldNum int32, v uint64) func(*codec.Buffer) {
+		return func(encoder *codec.Buffer) {
+			require.NoError(t, encoder.EncodeTagAndWireType(fieldNum, codec.WireVarint))
+			require.NoError(t, encoder.EncodeVarint(v))
+		}
+	}
+	encode := func(fields ...func(*codec.Buffer)) []byte {
+		encoder := codec.NewBuffer(nil)
+		for _, f := range fields {
+			f(encoder)
+		}
+		return encoder.Bytes()
+	}
+
+	t.Run("well-formed", func(t *testing.T) {
+		buffer := codec.NewBuffer(marshaled)
+		require.NoError(t, molecule.ValidateWellFormed(buffer))
+		require.Equal(t, len(marshaled), buffer.Len())
+
+		require.NoError(t, molecule.ValidateWellFormed(codec.NewBuffer(nil)))
+		nested := encode(varint(1, 1), group(2, varint(3, 4), group(5, group(6))), varint(7, 8))
+		require.NoError(t, molecule.ValidateWellFormed(codec.NewBuffer(nested)))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		for n := 1; n < len(marshaled); n++ {
+			err := molecule.ValidateWellFormed(codec.NewBuffer(marshaled[:n]))
+			if err == nil {
+				// Cutting the message between fields leaves a valid message.
+				continue
+			}
+			require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "length %d: %v", n, err)
+		}
+		// The length of the string field claims more bytes than remain.
+		err := molecule.ValidateWellFormed(codec.NewBuffer([]byte{0x72, 0x05, 'a'}))
+		require.EqualError(t, err, "ValidateWellFormed: offset 0: field 14: unexpected EOF")
+	})
+
+	t.Run("bad wire type", func(t *testing.T) {
+		err := molecule.ValidateWellFormed(codec.NewBuffer(append(encode(varint(1, 1)), 0x0e)))
+		require.True(t, errors.Is(err, codec.ErrBadWireType))
+		require.Contains(t, err.Error(), "offset 2")
+	})
+
+	t.Run("unbalanced groups", func(t *testing.T) {
+		start := func(fieldNum int32) func(*codec.Buffer) {
+			return func(encoder *codec.Buffer) {
+				require.NoError(t, encoder.EncodeTagAndWireType(fieldNum, codec.WireStartGroup))
+			}
+		}
+		end := func(fieldNum int32) func(*codec.Buffer) {
+			return func(encoder *codec.Buffer) {
+				require.NoError(t, encoder.EncodeTagAndWireType(fieldNum, codec.WireEndGroup))
+			}
+		}
+		for name, fields := range map[string][]func(*codec.Buffer){
+			"unterminated":   {group(1), start(2), varint(3, 4)},
+			"unopened":       {varint(1, 1), end(2)},
+			"mismatched":     {group(1, end(2))},
+			"outer too soon": {group(1, func(encoder *codec.Buffer) { end(1)(encoder); end(2)(encoder) })},
+		} {
+			err := molecule.ValidateWellFormed(codec.NewBuffer(encode(fields...)))
+			require.True(t, errors.Is(err, molecule.ErrUnbalancedGroup), "%s: %v", name, err)
+		}
+
+		// Groups can't be nested arbitrarily deep.
+		deep := group(1)
+		for i := 0; i < 100; i++ {
+			deep = group(1, deep)
+		}
+		require.Error(t, molecule.ValidateWellFormed(codec.NewBuffer(encode(deep))))
+	})
+
+	t.Run("options", func(t *testing.T) {
+		require.True(t, errors.Is(
+			molecule.ValidateWellFormed(codec.NewBuffer(marshaled), molecule.WithMaxMessageSize(4)),
+			codec.ErrFieldTooLarge))
+		require.True(t, errors.Is(
+			molecule.ValidateWellFormed(codec.NewBuffer(marshaled), molecule.WithMaxTotalBytes(10)),
+			molecule.ErrMaxTotalBytes))
+		require.True(t, errors.Is(
+			molecule.ValidateWellFormed(codec.NewBuffer(marshaled), molecule.WithAllowedFieldRange(1, 10)),
+			molecule.ErrFieldOutOfRange))
+		require.True(t, errors.Is(
+			molecule.ValidateWellFormed(codec.NewBuffer(nil), molecule.WithRejectEmpty()),
+			molecule.ErrEmptyMessage))
+	})
+}
@@ -0,0 +1,317 @@
+package moleculetest
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+	"github.com/richardartoul/molecule/src/proto"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueConstructors(t *testing.T) {
+	var value molecule.Value
+	for _, v := range []float64{0, -1.5, math.MaxFloat64, math.Inf(-1)} {
+		value = molecule.DoubleValue(v)
+		d, err := value.AsDouble()
+		require.NoError(t, err)
+		require.Equal(t, v, d)
+	}
+	for _, v := range []float32{0, -1.5, math.MaxFloat32} {
+		value = molecule.FloatValue(v)
+		f, err := value.AsFloat()
+		require.NoError(t, err)
+		require.Equal(t, v, f)
+	}
+	for _, v := range []int32{0, -1, math.MinInt32, math.MaxInt32} {
+		value = molecule.Int32Value(v)
+		i, err := value.AsInt32()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+
+		value = molecule.Sint32Value(v)
+		i, err = value.AsSint32()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+
+		value = molecule.SFixed32Value(v)
+		i, err = value.AsSFixed32()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+	}
+	for _, v := range []int64{0, -1, math.MinInt64, math.MaxInt64} {
+		value = molecule.Int64Value(v)
+		i, err := value.AsInt64()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+
+		value = molecule.Sint64Value(v)
+		i, err = value.AsSint64()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+
+		value = molecule.SFixed64Value(v)
+		i, err = value.AsSFixed64()
+		require.NoError(t, err)
+		require.Equal(t, v, i)
+	}
+	for _, v := range []uint32{0, 1, math.MaxUint32} {
+		value = molecule.Uint32Value(v)
+		u, err := value.AsUint32()
+		require.NoError(t, err)
+		require.Equal(t, v, u)
+
+		value = molecule.Fixed32Value(v)
+		u, err = value.AsFixed32()
+		require.NoError(t, err)
+		require.Equal(t, v, u)
+	}
+	for _, v := range []uint64{0, 1, math.MaxUint64} {
+		value = molecule.Uint64Value(v)
+		u, err := value.AsUint64()
+		require.NoError(t, err)
+		require.Equal(t, v, u)
+
+		value = molecule.Fixed64Value(v)
+		u, err = value.AsFixed64()
+		require.NoError(t, err)
+		require.Equal(t, v, u)
+	}
+	for _, v := range []bool{true, false} {
+		value = molecule.BoolValue(v)
+		b, err := value.AsBool()
+		require.NoError(t, err)
+		require.Equal(t, v, b)
+	}
+
+	str := molecule.StringValue("hello")
+	require.Equal(t, codec.WireBytes, str.WireType)
+	s, err := str.AsStringSafe()
+	require.NoError(t, err)
+	require.Equal(t, "hello", s)
+
+	value = molecule.BytesValue([]byte{1, 2})
+	b, err := value.AsBytesSafe()
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, b)
+
+	// The wire types must match what the protobuf encoding uses for each type.
+	require.Equal(t, codec.WireVarint, molecule.Sint64Value(-1).WireType)
+	require.Equal(t, codec.WireFixed32, molecule.FloatValue(1).WireType)
+	require.Equal(t, codec.WireFixed64, molecule.DoubleValue(1).WireType)
+	require.Equal(t, uint64(math.MaxUint64), molecule.Int32Value(-1).Number)
+}
+
+func TestValueRetain(t *testing.T) {
+	data := []byte{0x0a, 0x02, 'h', 'i', 0x10, 0x01}
+	buffer := codec.NewBuffer(data)
+
+	var retained, aliased []molecule.Value
+	err := molecule.MessageEach(buffer, func(fieldNum int32, value molecule.Value) (bool, error) {
+		retained = append(retained, value.Retain())
+		aliased = append(aliased, value)
+		return true, nil
+	})
+	require.NoError(t, err)
+
+	// Reuse the underlying slice for a different message.
+	copy(data, []byte{0x0a, 0x02, 'n', 'o', 0x10, 0x02})
+	buffer.Reset(data)
+
+	require.Equal(t, []byte("no"), aliased[0].Bytes)
+	require.Equal(t, []byte("hi"), retained[0].Bytes)
+	require.Equal(t, codec.WireBytes, retained[0].WireType)
+	require.Equal(t, uint64(1), retained[1].Number)
+	require.Nil(t, retained[1].Bytes)
+}
+
+func TestAsInt32SignExtension(t *testing.T) {
+	testCases := []struct {
+		name     string
+		number   int64
+		expected int32
+		err      bool
+	}{
+		{name: "minus one", number: -1, expected: -1},
+		{name: "min int32", number: math.MinInt32, expected: math.MinInt32},
+		{name: "max int32", number: math.MaxInt32, expected: math.MaxInt32},
+		{name: "zero", number: 0, expected: 0},
+		{name: "above int32", number: math.MaxInt32 + 1, err: true},
+		{name: "below int32", number: math.MinInt32 - 1, err: true},
+		{name: "valid int64", number: 1 << 40, err: true},
+		// -1 truncated to 32 bits rather than sign-extended.
+		{name: "not sign-extended", number: math.MaxUint32, err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Encode the value the way protobuf encodes an int32 (or an int64).
+			encoder := codec.NewBuffer(nil)
+			require.NoError(t, encoder.EncodeVarint(uint64(tc.number)))
+			if tc.number == -1 {
+				require.Equal(t, 10, encoder.Len())
+			}
+			number, err := encoder.DecodeVarint()
+			require.NoError(t, err)
+
+			value := molecule.Value{WireType: codec.WireVarint, Number: number}
+			i, err := value.AsInt32()
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, i)
+		})
+	}
+}
+
+func TestValueEncodedSize(t *testing.T) {
+	encode := func(t *testing.T, fieldNum int32, v molecule.Value) []byte {
+		buffer := codec.NewBuffer(nil)
+		if v.WireType == codec.WireStartGroup {
+			require.NoError(t, buffer.WriteDelimitedMessage(fieldNum, v.Bytes))
+			return buffer.Bytes()
+		}
+		require.NoError(t, buffer.EncodeTagAndWireType(fieldNum, v.WireType))
+		switch v.WireType {
+		case codec.WireVarint:
+			require.NoError(t, buffer.EncodeVarint(v.Number))
+		case codec.WireFixed32:
+			require.NoError(t, buffer.EncodeFixed32(v.Number))
+		case codec.WireFixed64:
+			require.NoError(t, buffer.EncodeFixed64(v.Number))
+		case codec.WireBytes:
+			require.NoError(t, buffer.EncodeRawBytes(v.Bytes))
+		}
+		return buffer.Bytes()
+	}
+
+	values := []molecule.Value{
+		molecule.BoolValue(false),
+		molecule.Uint64Value(127),
+		molecule.Uint64Value(128),
+		molecule.Int32Value(-1),
+		molecule.Uint64Value(math.MaxUint64),
+		molecule.Sint64Value(-1),
+		molecule.FloatValue(1.5),
+		molecule.SFixed64Value(-1),
+		molecule.BytesValue(nil),
+		molecule.StringValue("hello"),
+		molecule.BytesValue(make([]byte, 200)),
+		{WireType: codec.WireStartGroup},
+		{WireType: codec.WireStartGroup, Bytes: []byte{0x08, 0x01}},
+	}
+	for _, fieldNum := range []int32{1, 15, 16, 2047, 2048, math.MaxInt32} {
+		for _, v := range values {
+			encoded := encode(t, fieldNum, v)
+			require.Equal(t, len(encoded), v.EncodedSize(fieldNum), "field %d, value %v", fieldNum, v)
+
+			// EncodedSize is exactly what EncodeTo writes.
+			encoder := codec.NewEncoder(nil)
+			require.NoError(t, v.EncodeTo(encoder, fieldNum))
+			require.Equal(t, encoded, encoder.Bytes(), "field %d, value %v", fieldNum, v)
+
+			// The encoding decodes back to the same value.
+			err := molecule.MessageEach(codec.NewBuffer(encoded), func(num int32, decoded molecule.Value) (bool, error) {
+				require.Equal(t, fieldNum, num)
+				require.Equal(t, v.EncodedSize(fieldNum), decoded.EncodedSize(num))
+				return true, nil
+			}, molecule.WithDelimitedMessages())
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestValueEncodeTo(t *testing.T) {
+	for _, v := range []molecule.Value{
+		molecule.Int32Value(-1),
+		molecule.Uint64Value(math.MaxUint64),
+		molecule.FloatValue(1.5),
+		molecule.DoubleValue(-2.5),
+		molecule.StringValue("hello"),
+	} {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, v.EncodeTo(encoder, 2048))
+		require.Equal(t, v.EncodedSize(2048), encoder.Len())
+
+		err := molecule.MessageEach(codec.NewBuffer(encoder.Bytes()), func(fieldNum int32, decoded molecule.Value) (bool, error) {
+			require.Equal(t, int32(2048), fieldNum)
+			require.Equal(t, v, decoded)
+			return true, nil
+		})
+		require.NoError(t, err)
+	}
+
+	// Delimited messages stay delimited.
+	delimited := molecule.Value{WireType: codec.WireStartGroup, Bytes: []byte{0x08, 0x01}}
+	encoder := codec.NewEncoder(nil)
+	require.NoError(t, delimited.EncodeTo(encoder, 3))
+	require.Equal(t, []byte{0x1b, 0x08, 0x01, 0x1c}, encoder.Bytes())
+
+	// Nothing is written for values that can't be encoded.
+	invalid := molecule.Value{WireType: codec.WireEndGroup}
+	encoder.Reset()
+	require.True(t, errors.Is(invalid.EncodeTo(encoder, 1), codec.ErrBadWireType))
+	require.Empty(t, encoder.Bytes())
+}
+
+func TestValueIsMessage(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Nested{NestedMessage: &simple.Test{StringField: "hello", Int64Field: 10}})
+	require.NoError(t, err)
+
+	// Groups nested deeply enough to blow the stack if they were scanned recursively.
+	deepGroups := bytes.Repeat([]byte{1<<3 | byte(codec.WireStartGroup)}, 1<<20)
+
+	cases := []struct {
+		name     string
+		value    molecule.Value
+		expected bool
+	}{
+		{"sub-message", molecule.BytesValue(marshaled), true},
+		{"empty", molecule.BytesValue(nil), true},
+		// "hi" is a valid message consisting of field 13 with the varint value 105.
+		{"string that parses", molecule.StringValue("hi"), true},
+		{"string", molecule.StringValue("hello, world"), false},
+		{"random bytes", molecule.BytesValue([]byte{0xff, 0xfe, 0xfd, 0x07}), false},
+		{"field number zero", molecule.BytesValue([]byte{0x00, 0x01}), false},
+		{"truncated", molecule.BytesValue(marshaled[:len(marshaled)-1]), false},
+		{"huge length", molecule.BytesValue([]byte{1<<3 | 2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}), false},
+		{"group", molecule.BytesValue([]byte{1<<3 | 3, 1<<3 | 4}), false},
+		{"deep groups", molecule.BytesValue(deepGroups), false},
+		{"not length-delimited", molecule.Uint64Value(1), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := c.value
+			require.Equal(t, c.expected, v.IsMessage())
+			AssertNoAllocs(t, func() { v.IsMessage() })
+		})
+	}
+}
+
+func TestValueAsMessage(t *testing.T) {
+	marshaled, err := proto.Marshal(&simple.Test{StringField: "hello", Int64Field: 10})
+	require.NoError(t, err)
+	data := append(append([]byte(nil), marshaled...), 0xff)
+
+	value := molecule.BytesValue(data[:len(marshaled)])
+	sub, err := value.AsMessage()
+	require.NoError(t, err)
+	str, err := molecule.GetString(sub, 1, "")
+	require.NoError(t, err)
+	require.Equal(t, "hello", str)
+
+	// The Buffer aliases the value's bytes but can't overwrite what follows them.
+	require.True(t, &data[0] == &sub.Bytes()[0])
+	require.NoError(t, sub.EncodeVarint(1))
+	require.Equal(t, byte(0xff), data[len(marshaled)])
+
+	intValue := molecule.Int64Value(1)
+	_, err = intValue.AsMessage()
+	require.True(t, errors.Is(err, molecule.ErrNotMessage))
+}
@@ -0,0 +1,227 @@
+package moleculetest
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/molecule"
+	"github.com/richardartoul/molecule/src/codec"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	protov2 "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestDecodeFieldMask(t *testing.T) {
+	expected := []string{"user.name", "user.address.city", "etag"}
+
+	encoder := proto.NewBuffer(nil)
+	for _, path := range expected {
+		require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireBytes)))
+		require.NoError(t, encoder.EncodeStringBytes(path))
+	}
+
+	paths, err := molecule.DecodeFieldMask(codec.NewBuffer(encoder.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, expected, paths)
+}
+
+func TestDecodeFieldMaskEmpty(t *testing.T) {
+	paths, err := molecule.DecodeFieldMask(codec.NewBuffer(nil))
+	require.NoError(t, err)
+	require.Empty(t, paths)
+}
+
+func TestUnwrapScalarWrapper(t *testing.T) {
+	unwrap := func(t *testing.T, m protov2.Message, innerType codec.FieldType) (molecule.Value, bool) {
+		marshaled, err := protov2.Marshal(m)
+		require.NoError(t, err)
+		value, found, err := molecule.UnwrapScalarWrapper(codec.NewBuffer(marshaled), innerType)
+		require.NoError(t, err)
+		return value, found
+	}
+
+	value, found := unwrap(t, wrapperspb.Double(-1.5), codec.FieldType_DOUBLE)
+	require.True(t, found)
+	d, err := value.AsDouble()
+	require.NoError(t, err)
+	require.Equal(t, -1.5, d)
+
+	value, found = unwrap(t, wrapperspb.Float(2.5), codec.FieldType_FLOAT)
+	require.True(t, found)
+	f, err := value.AsFloat()
+	require.NoError(t, err)
+	require.Equal(t, float32(2.5), f)
+
+	value, found = unwrap(t, wrapperspb.Int64(math.MinInt64), codec.FieldType_INT64)
+	require.True(t, found)
+	i64, err := value.AsInt64()
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MinInt64), i64)
+
+	value, found = unwrap(t, wrapperspb.UInt64(math.MaxUint64), codec.FieldType_UINT64)
+	require.True(t, found)
+	u64, err := value.AsUint64()
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), u64)
+
+	value, found = unwrap(t, wrapperspb.Int32(-7), codec.FieldType_INT32)
+	require.True(t, found)
+	i32, err := value.AsInt32()
+	require.NoError(t, err)
+	require.Equal(t, int32(-7), i32)
+
+	value, found = unwrap(t, wrapperspb.UInt32(math.MaxUint32), codec.FieldType_UINT32)
+	require.True(t, found)
+	u32, err := value.AsUint32()
+	require.NoError(t, err)
+	require.Equal(t, uint32(math.MaxUint32), u32)
+
+	value, found = unwrap(t, wrapperspb.Bool(true), codec.FieldType_BOOL)
+	require.True(t, found)
+	b, err := value.AsBool()
+	require.NoError(t, err)
+	require.True(t, b)
+
+	value, found = unwrap(t, wrapperspb.String("hello"), codec.FieldType_STRING)
+	require.True(t, found)
+	s, err := value.AsStringSafe()
+	require.NoError(t, err)
+	require.Equal(t, "hello", s)
+
+	value, found = unwrap(t, wrapperspb.Bytes([]byte{1, 2}), codec.FieldType_BYTES)
+	require.True(t, found)
+	require.Equal(t, []byte{1, 2}, value.Bytes)
+
+	// Types without a well-known wrapper, as used by custom nullable types.
+	encoder := proto.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireVarint)))
+	require.NoError(t, encoder.EncodeZigzag64(uint64(math.MaxUint64)))
+	value, found, err = molecule.UnwrapScalarWrapper(codec.NewBuffer(encoder.Bytes()), codec.FieldType_SINT64)
+	require.NoError(t, err)
+	require.True(t, found)
+	i64, err = value.AsSint64()
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), i64)
+
+	encoder = proto.NewBuffer(nil)
+	require.NoError(t, encoder.EncodeVarint(1<<3|uint64(codec.WireFixed32)))
+	require.NoError(t, encoder.EncodeFixed32(uint64(math.MaxUint32)))
+	value, found, err = molecule.UnwrapScalarWrapper(codec.NewBuffer(encoder.Bytes()), codec.FieldType_SFIXED32)
+	require.NoError(t, err)
+	require.True(t, found)
+	i32, err = value.AsSFixed32()
+	require.NoError(t, err)
+	require.Equal(t, int32(-1), i32)
+
+	// Wrappers holding the default value encode nothing, so field 1 is absent.
+	for _, innerType := range []codec.FieldType{
+		codec.FieldType_DOUBLE, codec.FieldType_FLOAT, codec.FieldType_INT64, codec.FieldType_UINT64,
+		codec.FieldType_INT32, codec.FieldType_FIXED64, codec.FieldType_FIXED32, codec.FieldType_BOOL,
+		codec.FieldType_STRING, codec.FieldType_BYTES, codec.FieldType_UINT32, codec.FieldType_ENUM,
+		codec.FieldType_SFIXED32, codec.FieldType_SFIXED64, codec.FieldType_SINT32, codec.FieldType_SINT64,
+	} {
+		value, found, err = molecule.UnwrapScalarWrapper(codec.NewBuffer(nil), innerType)
+		require.NoError(t, err, innerType)
+		require.False(t, found, innerType)
+		require.Equal(t, molecule.Value{}, value, innerType)
+	}
+	_, found = unwrap(t, wrapperspb.Int64(0), codec.FieldType_INT64)
+	require.False(t, found)
+
+	// Mismatched wire types and non-scalar types are rejected.
+	marshaled, err := protov2.Marshal(wrapperspb.String("hello"))
+	require.NoError(t, err)
+	_, _, err = molecule.UnwrapScalarWrapper(codec.NewBuffer(marshaled), codec.FieldType_INT64)
+	require.Error(t, err)
+	_, _, err = molecule.UnwrapScalarWrapper(codec.NewBuffer(marshaled), codec.FieldType_MESSAGE)
+	require.Error(t, err)
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	for _, ts := range []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1700000000, 123456789),
+		// Before the epoch the seconds are negative but the nanos never are.
+		time.Unix(-1, 500000000),
+		time.Unix(-1700000000, 1),
+		time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.FixedZone("", 3600)),
+	} {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, molecule.EncodeTimestamp(encoder, 3, ts))
+
+		// The field holds the same message as the protobuf library encodes.
+		expected, err := protov2.Marshal(timestamppb.New(ts))
+		require.NoError(t, err)
+		_, value, found, err := molecule.FindOneof(codec.NewBuffer(encoder.Bytes()), []int32{3})
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, expected, value.Bytes, "%v", ts)
+
+		decoded, err := molecule.DecodeTimestamp(codec.NewBuffer(value.Bytes))
+		require.NoError(t, err)
+		require.True(t, ts.Equal(decoded), "%v != %v", ts, decoded)
+		require.Equal(t, time.UTC, decoded.Location())
+	}
+
+	require.Error(t, molecule.EncodeTimestamp(codec.NewEncoder(nil), 1, time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.Error(t, molecule.EncodeTimestamp(codec.NewEncoder(nil), 1, time.Date(0, 12, 31, 0, 0, 0, 0, time.UTC)))
+
+	for _, invalid := range []*timestamppb.Timestamp{
+		{Seconds: 0, Nanos: -1},
+		{Seconds: 0, Nanos: 1e9},
+		{Seconds: 253402300800},
+	} {
+		marshaled, err := protov2.Marshal(invalid)
+		require.NoError(t, err)
+		_, err = molecule.DecodeTimestamp(codec.NewBuffer(marshaled))
+		require.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	for _, d := range []time.Duration{
+		0,
+		time.Second,
+		1500 * time.Millisecond,
+		// Negative durations have negative seconds and nanos.
+		-1500 * time.Millisecond,
+		-time.Nanosecond,
+		-3 * time.Second,
+		math.MaxInt64,
+		math.MinInt64,
+	} {
+		encoder := codec.NewEncoder(nil)
+		require.NoError(t, molecule.EncodeDuration(encoder, 3, d))
+
+		expected, err := protov2.Marshal(durationpb.New(d))
+		require.NoError(t, err)
+		_, value, found, err := molecule.FindOneof(codec.NewBuffer(encoder.Bytes()), []int32{3})
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, expected, value.Bytes, "%v", d)
+
+		decoded, err := molecule.DecodeDuration(codec.NewBuffer(value.Bytes))
+		require.NoError(t, err)
+		require.Equal(t, d, decoded)
+	}
+
+	for _, invalid := range []*durationpb.Duration{
+		{Seconds: 1, Nanos: -1},
+		{Seconds: -1, Nanos: 1},
+		{Nanos: 1e9},
+		{Seconds: 9223372037},
+		{Seconds: 9223372036, Nanos: 854775808},
+		{Seconds: -9223372036, Nanos: -854775809},
+	} {
+		marshaled, err := protov2.Marshal(invalid)
+		require.NoError(t, err)
+		_, err = molecule.DecodeDuration(codec.NewBuffer(marshaled))
+		require.Error(t, err, "%v", invalid)
+	}
+}
@@ -0,0 +1,253 @@
+package molecule
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// DecodeTyped decodes the message stored in buffer using schema, which maps the number of
+// each field of interest to its declared type. Knowing the declared type resolves the
+// ambiguities of the wire format, such as whether a varint holds an int64 or a zig-zag
+// encoded sint64, so each field is returned as the Go type that protobuf uses for it:
+//
+//	double                      float64
+//	float                       float32
+//	int32, sint32, sfixed32     int32
+//	int64, sint64, sfixed64     int64
+//	uint32, fixed32             uint32
+//	uint64, fixed64             uint64
+//	bool                        bool
+//	enum                        int32
+//	string                      string
+//	bytes, message              []byte
+//
+// Nested messages are returned as their encoded bytes, which can in turn be decoded with
+// their own schema. Fields that occur more than once, or whose elements are packed, are
+// returned as a []interface{} of elements in wire order. Fields that aren't in the schema
+// are ignored. Every returned value is a copy that doesn't alias the buffer.
+//
+// The buffer is consumed.
+func DecodeTyped(buffer *codec.Buffer, schema map[int32]codec.FieldType) (map[int32]interface{}, error) {
+	var (
+		elements = make(map[int32][]interface{}, len(schema))
+		packed   map[int32]bool
+	)
+	err := MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		fieldType, ok := schema[fieldNum]
+		if !ok {
+			return true, nil
+		}
+		wireType, err := wireTypeForFieldType(fieldType)
+		if err != nil || fieldType == codec.FieldType_GROUP {
+			return false, fmt.Errorf("DecodeTyped: field %d: unsupported field type %v", fieldNum, fieldType)
+		}
+
+		if wireType != codec.WireBytes && value.WireType == codec.WireBytes {
+			if packed == nil {
+				packed = map[int32]bool{}
+			}
+			packed[fieldNum] = true
+			err := PackedRepeatedEach(buffer.Nested(value.Bytes), fieldType, func(element Value) (bool, error) {
+				v, err := decodeTypedValue(fieldType, element)
+				if err != nil {
+					return false, err
+				}
+				elements[fieldNum] = append(elements[fieldNum], v)
+				return true, nil
+			})
+			if err != nil {
+				return false, fmt.Errorf("DecodeTyped: field %d: %w", fieldNum, err)
+			}
+			return true, nil
+		}
+		if value.WireType != wireType {
+			return false, fmt.Errorf(
+				"DecodeTyped: field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+		}
+		v, err := decodeTypedValue(fieldType, value)
+		if err != nil {
+			return false, fmt.Errorf("DecodeTyped: field %d: %w", fieldNum, err)
+		}
+		elements[fieldNum] = append(elements[fieldNum], v)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int32]interface{}, len(elements))
+	for fieldNum, values := range elements {
+		if len(values) == 1 && !packed[fieldNum] {
+			result[fieldNum] = values[0]
+		} else {
+			result[fieldNum] = values
+		}
+	}
+	return result, nil
+}
+
+// MessageEachWithSchema is like MessageEach except that the FieldType of the Value of
+// every field in schema, which maps field numbers to their declared types, is set so that
+// the Value can be interpreted with Typed. This resolves the ambiguities of the wire
+// format, such as whether a fixed64 holds a fixed64, an sfixed64 or a double, once rather
+// than at every use. Values of fields that aren't in the schema are passed to fn
+// unchanged.
+//
+// Packed occurrences of scalar fields are accepted, otherwise every field in the schema
+// must have been encoded with the wire type of its declared type. Since Typed doesn't know
+// the buffer that a value came from, packed fixed-width fields read from a buffer created
+// with codec.WithByteOrder are passed to fn as a little-endian copy. The buffer is
+// consumed.
+func MessageEachWithSchema(buffer *codec.Buffer, schema map[int32]codec.FieldType, fn MessageEachFn, opts ...Option) error {
+	var fnErr error
+	err := MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		fieldType, ok := schema[fieldNum]
+		if ok {
+			wireType, err := wireTypeForFieldType(fieldType)
+			if err != nil || fieldType == codec.FieldType_GROUP {
+				return false, fmt.Errorf("field %d: unsupported field type %v", fieldNum, fieldType)
+			}
+			packed := wireType != codec.WireBytes && value.WireType == codec.WireBytes
+			if value.WireType != wireType && !packed {
+				return false, fmt.Errorf("field %d: expected wiretype %d, got: %d", fieldNum, wireType, value.WireType)
+			}
+			value.FieldType = fieldType
+			if packed && wireType != codec.WireVarint && buffer.ByteOrder() != binary.LittleEndian {
+				value.Bytes = toLittleEndian(buffer.ByteOrder(), value.Bytes, wireType)
+			}
+		}
+
+		var shouldContinue bool
+		shouldContinue, fnErr = fn(fieldNum, value)
+		return shouldContinue, fnErr
+	}, opts...)
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("MessageEachWithSchema: %w", err)
+	}
+	return nil
+}
+
+// Typed interprets a value decoded with MessageEachWithSchema as its declared FieldType,
+// returning the same Go type as DecodeTyped does, for example an int64 for an sfixed64
+// and a uint64 for a fixed64. Packed occurrences of repeated fields are returned as a
+// []interface{} of their elements. Strings and bytes are safe copies that don't alias the
+// buffer.
+//
+// An error is returned for values whose FieldType isn't set.
+func (v *Value) Typed() (interface{}, error) {
+	if v.FieldType == 0 {
+		return nil, errors.New("Typed: value has no field type, decode it with MessageEachWithSchema")
+	}
+	wireType, err := wireTypeForFieldType(v.FieldType)
+	if err != nil {
+		return nil, fmt.Errorf("Typed: %w", err)
+	}
+	if wireType == v.WireType {
+		return decodeTypedValue(v.FieldType, *v)
+	}
+	if wireType == codec.WireBytes || v.WireType != codec.WireBytes {
+		return nil, fmt.Errorf("Typed: %v expects wiretype %d, got: %d", v.FieldType, wireType, v.WireType)
+	}
+
+	var elements []interface{}
+	err = PackedRepeatedEach(codec.NewBuffer(v.Bytes), v.FieldType, func(element Value) (bool, error) {
+		e, err := decodeTypedValue(v.FieldType, element)
+		if err != nil {
+			return false, err
+		}
+		elements = append(elements, e)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Typed: %w", err)
+	}
+	return elements, nil
+}
+
+// decodeTypedValue interprets value, whose wire type has already been checked, as
+// fieldType.
+func decodeTypedValue(fieldType codec.FieldType, value Value) (interface{}, error) {
+	switch fieldType {
+	case codec.FieldType_DOUBLE:
+		return value.AsDouble()
+	case codec.FieldType_FLOAT:
+		return value.AsFloat()
+	case codec.FieldType_INT32, codec.FieldType_ENUM:
+		return value.AsInt32()
+	case codec.FieldType_INT64:
+		return value.AsInt64()
+	case codec.FieldType_UINT32:
+		return value.AsUint32()
+	case codec.FieldType_UINT64:
+		return value.AsUint64()
+	case codec.FieldType_SINT32:
+		return value.AsSint32()
+	case codec.FieldType_SINT64:
+		return value.AsSint64()
+	case codec.FieldType_FIXED32:
+		return value.AsFixed32()
+	case codec.FieldType_FIXED64:
+		return value.AsFixed64()
+	case codec.FieldType_SFIXED32:
+		return value.AsSFixed32()
+	case codec.FieldType_SFIXED64:
+		return value.AsSFixed64()
+	case codec.FieldType_BOOL:
+		return value.AsBool()
+	case codec.FieldType_STRING:
+		return value.AsStringSafe()
+	case codec.FieldType_BYTES, codec.FieldType_MESSAGE:
+		return value.AsBytesSafe()
+	default:
+		return nil, fmt.Errorf("unsupported field type %v", fieldType)
+	}
+}
+
+// CollectAll decodes the message stored in buffer in a single pass and groups the values
+// of its top-level fields by field number. The values of each field are in wire order, so
+// the last element of a singular field's slice is the one that protobuf would use, and
+// packed fields are left as a single length-delimited Value per occurrence since the
+// wire format alone doesn't say whether they are packed.
+//
+// CollectAll is meant for tools that want to inspect every field of a message and
+// allocates a map and a slice per field to do so. Prefer MessageEach, or one of the
+// lookup helpers such as FindOneof or CollectRepeated, when allocations matter. The
+// Bytes of each returned Value are an unsafe view over the buffer, call Retain on any
+// value that needs to outlive it.
+//
+// The buffer is consumed.
+func CollectAll(buffer *codec.Buffer) (map[int32][]Value, error) {
+	fields := map[int32][]Value{}
+	err := retainingEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		fields[fieldNum] = append(fields[fieldNum], value)
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CollectAll: %w", err)
+	}
+	return fields, nil
+}
+
+// toLittleEndian returns a copy of the packed fixed-width elements b, which are encoded
+// with wireType in the given byte order, with every element in little-endian order. A
+// trailing partial element is copied as is.
+func toLittleEndian(order binary.ByteOrder, b []byte, wireType codec.WireType) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	if wireType == codec.WireFixed32 {
+		for i := 0; i+4 <= len(b); i += 4 {
+			binary.LittleEndian.PutUint32(out[i:], order.Uint32(b[i:]))
+		}
+		return out
+	}
+	for i := 0; i+8 <= len(b); i += 8 {
+		binary.LittleEndian.PutUint64(out[i:], order.Uint64(b[i:]))
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package molecule
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// ErrUnbalancedGroup is returned by ValidateWellFormed when an end group tag doesn't
+// match the start group tag of the innermost open group, or when the message ends before
+// every group has been terminated.
+var ErrUnbalancedGroup = errors.New("molecule: unbalanced group")
+
+// maxGroupDepth is the deepest nesting of groups that ValidateWellFormed accepts, which
+// matches the default recursion limit of the protobuf libraries.
+const maxGroupDepth = 100
+
+// ValidateWellFormed verifies that the message stored in buffer is structurally valid
+// protobuf without decoding any values or needing a schema: every tag decodes to a valid
+// field number and wire type, every length-delimited field and fixed-width value is
+// within the bounds of the message, and every group is terminated by the end group tag
+// of the same field, with groups nested no more than 100 deep. This makes it a cheap
+// filter for untrusted input ahead of more expensive processing. The contents of
+// length-delimited fields aren't validated since, without a schema, there is no telling
+// which of them are nested messages.
+//
+// WithMaxMessageSize, WithMaxTotalBytes, WithAllowedFieldRange and WithRejectEmpty are
+// enforced as they would be by MessageEach. Errors include the offset of the field that
+// failed, relative to the start of the message.
+//
+// The buffer is not advanced.
+func ValidateWellFormed(buffer *codec.Buffer, opts ...Option) error {
+	state := newDecodeState(opts)
+	if state.opts.rejectEmpty && buffer.EOF() {
+		return fmt.Errorf("ValidateWellFormed: %w", ErrEmptyMessage)
+	}
+
+	b := buffer.Clone()
+	if state.opts.maxMessageSize > 0 {
+		b.SetMaxFieldLength(state.opts.maxMessageSize)
+	}
+	var (
+		origin = b.Len()
+		// groups holds the field numbers of the open groups, innermost last.
+		groupsArr [maxGroupDepth]int32
+		groups    = groupsArr[:0]
+	)
+	for !b.EOF() {
+		fieldStart := b.Len()
+		fieldNum, wireType, err := b.DecodeTagAndWireType()
+		if err != nil {
+			return fmt.Errorf("ValidateWellFormed: offset %d: error decoding tag: %w", origin-fieldStart, err)
+		}
+		if err := state.checkFieldNum(fieldNum); err != nil {
+			return fmt.Errorf("ValidateWellFormed: offset %d: %w", origin-fieldStart, err)
+		}
+
+		switch wireType {
+		case codec.WireStartGroup:
+			if len(groups) == maxGroupDepth {
+				return fmt.Errorf(
+					"ValidateWellFormed: offset %d: groups nested more than %d deep", origin-fieldStart, maxGroupDepth)
+			}
+			groups = append(groups, fieldNum)
+		case codec.WireEndGroup:
+			if len(groups) == 0 || groups[len(groups)-1] != fieldNum {
+				return fmt.Errorf(
+					"ValidateWellFormed: offset %d: %w: end group tag for field %d", origin-fieldStart, ErrUnbalancedGroup, fieldNum)
+			}
+			groups = groups[:len(groups)-1]
+		default:
+			if err := b.SkipField(wireType); err != nil {
+				return fmt.Errorf("ValidateWellFormed: offset %d: field %d: %w", origin-fieldStart, fieldNum, err)
+			}
+		}
+		if err := state.consume(fieldStart - b.Len()); err != nil {
+			return fmt.Errorf("ValidateWellFormed: %w", err)
+		}
+	}
+	if len(groups) > 0 {
+		return fmt.Errorf(
+			"ValidateWellFormed: %w: group for field %d is not terminated", ErrUnbalancedGroup, groups[len(groups)-1])
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package molecule
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"reflect"
@@ -15,6 +16,10 @@ import (
 type Value struct {
 	// WireType is the protobuf wire type that was used to encode the field.
 	WireType codec.WireType
+	// FieldType is the declared type of the field for values decoded with
+	// MessageEachWithSchema, which allows Typed to interpret the value without being told
+	// its type again. It is zero, which is not a valid field type, otherwise.
+	FieldType codec.FieldType
 	// Number will contain the value for any fields encoded with the
 	// following wire types:
 	//
@@ -26,12 +31,96 @@ type Value struct {
 	// following wire types:
 	//
 	// 1. bytes
+	// 2. start group, for delimited messages decoded with WithDelimitedMessages
 	//
-	// Bytes is an unsafe view over the bytes in the buffer. To obtain a "safe" copy
-	// call value.AsSafeBytes() or copy Bytes directly.
+	// Bytes is an unsafe view over the bytes in the buffer. It is only valid for as
+	// long as the buffer's underlying slice is neither modified nor reused, which for
+	// a Value passed to a callback usually means only until the callback returns. To
+	// obtain a "safe" copy call value.AsBytesSafe(), or call value.Retain() to copy
+	// the entire Value. Values decoded from a buffer created with
+	// codec.WithDefaultCopyBytes(true) hold their own copy instead.
 	Bytes []byte
 }
 
+// DoubleValue returns a Value holding a double, encoded as a fixed64.
+func DoubleValue(v float64) Value {
+	return Value{WireType: codec.WireFixed64, Number: math.Float64bits(v)}
+}
+
+// FloatValue returns a Value holding a float, encoded as a fixed32.
+func FloatValue(v float32) Value {
+	return Value{WireType: codec.WireFixed32, Number: uint64(math.Float32bits(v))}
+}
+
+// Int32Value returns a Value holding an int32, encoded as a varint. Negative values are
+// sign-extended to 64 bits, just like they are on the wire.
+func Int32Value(v int32) Value {
+	return Value{WireType: codec.WireVarint, Number: uint64(int64(v))}
+}
+
+// Int64Value returns a Value holding an int64, encoded as a varint.
+func Int64Value(v int64) Value {
+	return Value{WireType: codec.WireVarint, Number: uint64(v)}
+}
+
+// Uint32Value returns a Value holding a uint32, encoded as a varint.
+func Uint32Value(v uint32) Value {
+	return Value{WireType: codec.WireVarint, Number: uint64(v)}
+}
+
+// Uint64Value returns a Value holding a uint64, encoded as a varint.
+func Uint64Value(v uint64) Value {
+	return Value{WireType: codec.WireVarint, Number: v}
+}
+
+// Sint32Value returns a Value holding a sint32, zig-zag encoded as a varint.
+func Sint32Value(v int32) Value {
+	return Value{WireType: codec.WireVarint, Number: codec.EncodeZigZag32(v)}
+}
+
+// Sint64Value returns a Value holding a sint64, zig-zag encoded as a varint.
+func Sint64Value(v int64) Value {
+	return Value{WireType: codec.WireVarint, Number: codec.EncodeZigZag64(v)}
+}
+
+// Fixed32Value returns a Value holding a fixed32.
+func Fixed32Value(v uint32) Value {
+	return Value{WireType: codec.WireFixed32, Number: uint64(v)}
+}
+
+// Fixed64Value returns a Value holding a fixed64.
+func Fixed64Value(v uint64) Value {
+	return Value{WireType: codec.WireFixed64, Number: v}
+}
+
+// SFixed32Value returns a Value holding a sfixed32.
+func SFixed32Value(v int32) Value {
+	return Value{WireType: codec.WireFixed32, Number: uint64(uint32(v))}
+}
+
+// SFixed64Value returns a Value holding a sfixed64.
+func SFixed64Value(v int64) Value {
+	return Value{WireType: codec.WireFixed64, Number: uint64(v)}
+}
+
+// BoolValue returns a Value holding a bool, encoded as a varint.
+func BoolValue(v bool) Value {
+	if v {
+		return Value{WireType: codec.WireVarint, Number: 1}
+	}
+	return Value{WireType: codec.WireVarint}
+}
+
+// StringValue returns a Value holding a copy of the bytes of v.
+func StringValue(v string) Value {
+	return Value{WireType: codec.WireBytes, Bytes: []byte(v)}
+}
+
+// BytesValue returns a Value holding v. v is not copied.
+func BytesValue(v []byte) Value {
+	return Value{WireType: codec.WireBytes, Bytes: v}
+}
+
 // AsDouble interprets the value as a double.
 func (v *Value) AsDouble() (float64, error) {
 	return math.Float64frombits(v.Number), nil
@@ -46,6 +135,12 @@ func (v *Value) AsFloat() (float32, error) {
 }
 
 // AsInt32 interprets the value as an int32.
+//
+// Protobuf encodes negative int32 values as 10 byte varints that are sign-extended to 64
+// bits, so -1 is stored in Number as 0xFFFFFFFFFFFFFFFF. Interpreting Number as an int64
+// recovers the original value for every valid int32, whereas values outside of the int32
+// range, such as an int64 field decoded as an int32 by mistake, are rejected with an
+// error rather than silently truncated.
 func (v *Value) AsInt32() (int32, error) {
 	s := int64(v.Number)
 	if s > math.MaxInt32 {
@@ -143,6 +238,104 @@ func (v *Value) AsBytesSafe() ([]byte, error) {
 	return append([]byte(nil), v.Bytes...), nil
 }
 
+// Retain returns a deep copy of the value that does not alias the buffer it was read from
+// and is therefore safe to store after the callback that received it has returned, or
+// after the buffer has been reused.
+func (v *Value) Retain() Value {
+	retained := *v
+	if v.Bytes != nil {
+		retained.Bytes = make([]byte, len(v.Bytes))
+		copy(retained.Bytes, v.Bytes)
+	}
+	return retained
+}
+
+// ErrNotMessage is returned by AsMessage when the value isn't length-delimited.
+var ErrNotMessage = errors.New("molecule: value is not length-delimited")
+
+// AsMessage interprets the value as a nested message and returns a Buffer over its
+// contents that can be passed to MessageEach and its variants. The Buffer aliases the
+// same bytes as the value rather than copying them and is capped so that encoding to it
+// can't overwrite the data that follows the message. ErrNotMessage is returned if the
+// value isn't length-delimited.
+//
+// AsMessage is small enough to be inlined, so when the returned Buffer doesn't outlive the
+// caller it is allocated on the stack and recursively decoding a tree of nested messages
+// with AsMessage and MessageEach doesn't allocate.
+func (v *Value) AsMessage() (*codec.Buffer, error) {
+	if v.WireType != codec.WireBytes {
+		// A sentinel, rather than a formatted error, keeps AsMessage within the inlining
+		// budget.
+		return nil, ErrNotMessage
+	}
+	b := v.Bytes
+	return codec.NewBuffer(b[:len(b):len(b)]), nil
+}
+
+// IsMessage reports whether the value is a length-delimited field whose contents parse
+// cleanly, up to their very end, as the top-level fields of a message. Empty contents are
+// a valid, empty message. Nested messages aren't descended into and groups are rejected,
+// as they are by MessageEach, so IsMessage runs in time linear in the length of the
+// value, with a fixed stack depth, and never allocates, even for hostile input.
+//
+// Like GuessKind this is only a heuristic: short strings and binary data are often valid
+// messages too, for example "hi" parses as field 13 with the varint value 105.
+func (v *Value) IsMessage() bool {
+	return v.WireType == codec.WireBytes && isMessage(v.Bytes)
+}
+
+// EncodedSize returns the number of bytes that the value would occupy if it was encoded
+// as field fieldNum, including the field's tag, which is the number of bytes written by
+// EncodeTo. Varints are assumed to be encoded minimally, so the result may be smaller
+// than the span the value was originally decoded from if the encoder that produced it
+// padded its varints.
+func (v *Value) EncodedSize(fieldNum int32) int {
+	size := codec.ComputeVarintSize(uint64(fieldNum)<<3 | uint64(v.WireType))
+	switch v.WireType {
+	case codec.WireVarint:
+		size += codec.ComputeVarintSize(v.Number)
+	case codec.WireFixed32:
+		size += 4
+	case codec.WireFixed64:
+		size += 8
+	case codec.WireBytes:
+		size += codec.ComputeVarintSize(uint64(len(v.Bytes))) + len(v.Bytes)
+	case codec.WireStartGroup:
+		// Delimited messages are followed by an end group tag, which is the same
+		// size as the start group tag.
+		size += len(v.Bytes) + codec.ComputeVarintSize(uint64(fieldNum)<<3|uint64(codec.WireEndGroup))
+	}
+	return size
+}
+
+// EncodeTo encodes the value into enc as field fieldNum, including the field's tag, so
+// a decoded value can be copied into another message, possibly under a different field
+// number. Delimited messages decoded with WithDelimitedMessages are encoded as delimited
+// messages again.
+func (v *Value) EncodeTo(enc *codec.Encoder, fieldNum int32) error {
+	switch v.WireType {
+	case codec.WireVarint, codec.WireFixed32, codec.WireFixed64, codec.WireBytes:
+	case codec.WireStartGroup:
+		return enc.WriteDelimitedMessage(fieldNum, v.Bytes)
+	default:
+		return fmt.Errorf("%w: can't encode wiretype %d", codec.ErrBadWireType, v.WireType)
+	}
+
+	if err := enc.EncodeTagAndWireType(fieldNum, v.WireType); err != nil {
+		return err
+	}
+	switch v.WireType {
+	case codec.WireVarint:
+		return enc.EncodeVarint(v.Number)
+	case codec.WireFixed32:
+		return enc.EncodeFixed32(v.Number)
+	case codec.WireFixed64:
+		return enc.EncodeFixed64(v.Number)
+	default:
+		return enc.EncodeRawBytes(v.Bytes)
+	}
+}
+
 func unsafeBytesToString(b []byte) string {
 	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
 	sh := reflect.StringHeader{Data: bh.Data, Len: bh.Len}
@@ -0,0 +1,208 @@
+package molecule
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/richardartoul/molecule/src/codec"
+)
+
+// DecodeFieldMask decodes the google.protobuf.FieldMask message stored in buffer and
+// returns its paths in the order they were encoded.
+//
+//	message FieldMask {
+//	  repeated string paths = 1;
+//	}
+//
+// The returned strings are safe copies and do not alias the buffer.
+func DecodeFieldMask(buffer *codec.Buffer) ([]string, error) {
+	var paths []string
+	err := MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		if fieldNum != 1 {
+			return true, nil
+		}
+		if value.WireType != codec.WireBytes {
+			return false, fmt.Errorf(
+				"DecodeFieldMask: expected paths to have wiretype bytes, got: %d", value.WireType)
+		}
+		path, err := value.AsStringSafe()
+		if err != nil {
+			return false, err
+		}
+		paths = append(paths, path)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// UnwrapScalarWrapper decodes the message stored in buffer as a wrapper around a single
+// scalar of type innerType stored in field 1, the layout shared by the well-known
+// wrappers such as google.protobuf.Int64Value and by gogoproto's nullable custom types:
+//
+//	message Int64Value {
+//	  int64 value = 1;
+//	}
+//
+// The returned bool reports whether field 1 was present. A wrapper whose field 1 is
+// absent holds the zero value of innerType, since proto3 omits fields set to their
+// default. If field 1 occurs more than once the last occurrence wins.
+//
+// The Bytes of the returned Value, for string and bytes wrappers, are an unsafe view over
+// the buffer. The buffer is not advanced.
+func UnwrapScalarWrapper(buffer *codec.Buffer, innerType codec.FieldType) (Value, bool, error) {
+	if innerType == codec.FieldType_MESSAGE || innerType == codec.FieldType_GROUP {
+		return Value{}, false, fmt.Errorf("UnwrapScalarWrapper: field type %v is not a scalar", innerType)
+	}
+	wireType, err := wireTypeForFieldType(innerType)
+	if err != nil {
+		return Value{}, false, fmt.Errorf("UnwrapScalarWrapper: %w", err)
+	}
+	return findLast("UnwrapScalarWrapper", buffer, 1, wireType)
+}
+
+// The range of google.protobuf.Timestamp, 0001-01-01T00:00:00Z to 9999-12-31T23:59:59Z.
+const (
+	minTimestampSeconds = -62135596800
+	maxTimestampSeconds = 253402300799
+)
+
+// DecodeTimestamp decodes the google.protobuf.Timestamp message stored in buffer and
+// returns it as a time.Time in UTC.
+//
+//	message Timestamp {
+//	  int64 seconds = 1;
+//	  int32 nanos = 2;
+//	}
+//
+// Timestamps outside of the range supported by the message, or with nanos outside of
+// [0, 999999999], are rejected. The buffer is consumed.
+func DecodeTimestamp(buffer *codec.Buffer) (time.Time, error) {
+	seconds, nanos, err := decodeSecondsNanos("DecodeTimestamp", buffer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if seconds < minTimestampSeconds || seconds > maxTimestampSeconds {
+		return time.Time{}, fmt.Errorf("DecodeTimestamp: seconds %d out of range", seconds)
+	}
+	if nanos < 0 || nanos >= int32(time.Second) {
+		return time.Time{}, fmt.Errorf("DecodeTimestamp: nanos %d out of range", nanos)
+	}
+	return time.Unix(seconds, int64(nanos)).UTC(), nil
+}
+
+// DecodeDuration decodes the google.protobuf.Duration message stored in buffer.
+//
+//	message Duration {
+//	  int64 seconds = 1;
+//	  int32 nanos = 2;
+//	}
+//
+// Durations whose seconds and nanos have different signs, whose nanos are outside of
+// [-999999999, 999999999], or that don't fit in a time.Duration, which is limited to
+// roughly 292 years, are rejected. The buffer is consumed.
+func DecodeDuration(buffer *codec.Buffer) (time.Duration, error) {
+	seconds, nanos, err := decodeSecondsNanos("DecodeDuration", buffer)
+	if err != nil {
+		return 0, err
+	}
+	if nanos <= -int32(time.Second) || nanos >= int32(time.Second) {
+		return 0, fmt.Errorf("DecodeDuration: nanos %d out of range", nanos)
+	}
+	if (seconds < 0 && nanos > 0) || (seconds > 0 && nanos < 0) {
+		return 0, fmt.Errorf("DecodeDuration: seconds %d and nanos %d have different signs", seconds, nanos)
+	}
+	if seconds > math.MaxInt64/int64(time.Second) || seconds < math.MinInt64/int64(time.Second) {
+		return 0, fmt.Errorf("DecodeDuration: seconds %d overflow time.Duration", seconds)
+	}
+	d := time.Duration(seconds) * time.Second
+	if (nanos > 0 && d > math.MaxInt64-time.Duration(nanos)) || (nanos < 0 && d < math.MinInt64-time.Duration(nanos)) {
+		return 0, fmt.Errorf("DecodeDuration: %ds %dns overflows time.Duration", seconds, nanos)
+	}
+	return d + time.Duration(nanos), nil
+}
+
+// decodeSecondsNanos decodes the seconds and nanos fields shared by Timestamp and
+// Duration. If a field occurs more than once the last occurrence wins.
+func decodeSecondsNanos(funcName string, buffer *codec.Buffer) (seconds int64, nanos int32, err error) {
+	err = MessageEach(buffer, func(fieldNum int32, value Value) (bool, error) {
+		if fieldNum != 1 && fieldNum != 2 {
+			return true, nil
+		}
+		if value.WireType != codec.WireVarint {
+			return false, fmt.Errorf(
+				"%s: field %d: expected wiretype %d, got: %d", funcName, fieldNum, codec.WireVarint, value.WireType)
+		}
+		if fieldNum == 1 {
+			seconds = int64(value.Number)
+			return true, nil
+		}
+		var err error
+		nanos, err = value.AsInt32()
+		if err != nil {
+			return false, fmt.Errorf("%s: field %d: %w", funcName, fieldNum, err)
+		}
+		return true, nil
+	})
+	return seconds, nanos, err
+}
+
+// EncodeTimestamp encodes t as the google.protobuf.Timestamp message field fieldNum. Like
+// the protobuf libraries it rejects times outside of the range supported by the message,
+// 0001-01-01T00:00:00Z to 9999-12-31T23:59:59.999999999Z. The location of t is ignored.
+func EncodeTimestamp(enc *codec.Encoder, fieldNum int32, t time.Time) error {
+	seconds := t.Unix()
+	if seconds < minTimestampSeconds || seconds > maxTimestampSeconds {
+		return fmt.Errorf("EncodeTimestamp: %v out of range", t)
+	}
+	// Nanosecond is always in [0, 999999999], as the message requires.
+	return encodeSecondsNanos(enc, fieldNum, seconds, int32(t.Nanosecond()))
+}
+
+// EncodeDuration encodes d as the google.protobuf.Duration message field fieldNum. The
+// message requires the seconds and nanos of a negative duration to both be negative,
+// for example -1.5s is encoded as -1 seconds and -500000000 nanos, which is what dividing
+// d by a second gives.
+func EncodeDuration(enc *codec.Encoder, fieldNum int32, d time.Duration) error {
+	return encodeSecondsNanos(enc, fieldNum, int64(d/time.Second), int32(d%time.Second))
+}
+
+// encodeSecondsNanos encodes the message field fieldNum holding the seconds and nanos
+// fields shared by Timestamp and Duration. As in proto3, fields that are zero are omitted.
+func encodeSecondsNanos(enc *codec.Encoder, fieldNum int32, seconds int64, nanos int32) error {
+	var size int
+	if seconds != 0 {
+		size += 1 + codec.ComputeVarintSize(uint64(seconds))
+	}
+	if nanos != 0 {
+		// Negative int32s are sign extended to 64 bits.
+		size += 1 + codec.ComputeVarintSize(uint64(int64(nanos)))
+	}
+
+	if err := enc.EncodeTagAndWireType(fieldNum, codec.WireBytes); err != nil {
+		return err
+	}
+	if err := enc.EncodeVarint(uint64(size)); err != nil {
+		return err
+	}
+	if seconds != 0 {
+		if err := enc.EncodeTagAndWireType(1, codec.WireVarint); err != nil {
+			return err
+		}
+		if err := enc.EncodeVarint(uint64(seconds)); err != nil {
+			return err
+		}
+	}
+	if nanos != 0 {
+		if err := enc.EncodeTagAndWireType(2, codec.WireVarint); err != nil {
+			return err
+		}
+		if err := enc.EncodeVarint(uint64(int64(nanos))); err != nil {
+			return err
+		}
+	}
+	return nil
+}